@@ -0,0 +1,160 @@
+package hotswap
+
+import (
+	"log"
+	"time"
+)
+
+// 自动伸缩
+// Config.Autoscale 不为nil时，Start 启动自动伸缩：每个采样间隔读取队列长度、任务的平均排队时间、
+// 被拒绝的提交数（TrySubmit 失败、SubmitWithTimeout 超时）与 worker 利用率，
+// 连续 UpSamples 次有压力时扩容，连续 DownSamples 次空闲时缩容，两次调整之间至少间隔冷却时间。
+// 扩容直接启动新 worker；缩容向空闲的 worker 发出停止信号，队列中的任务不受影响。
+
+// AutoscaleConfig 自动伸缩设置，零值字段使用默认值
+type AutoscaleConfig struct {
+	Interval time.Duration // 采样间隔，默认1秒
+
+	// 满足任一条件视为有压力：平均每个 worker 的排队任务数超过 UpQueuePerWorker（默认1），
+	// 平均排队时间超过 UpWait（默认100毫秒），或有被拒绝的提交
+	UpQueuePerWorker float64
+	UpWait           time.Duration
+	// 队列为空、没有被拒绝的提交且 worker 利用率低于 DownUtilization（默认0.5）时视为空闲
+	DownUtilization float64
+
+	UpSamples    int           // 扩容需要连续有压力的采样次数，默认2
+	DownSamples  int           // 缩容需要连续空闲的采样次数，默认5
+	UpCooldown   time.Duration // 调整后再次扩容的最短间隔，默认2个采样间隔
+	DownCooldown time.Duration // 调整后再次缩容的最短间隔，默认30秒
+}
+
+func (c AutoscaleConfig) withDefaults() AutoscaleConfig {
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.UpQueuePerWorker <= 0 {
+		c.UpQueuePerWorker = 1
+	}
+	if c.UpWait <= 0 {
+		c.UpWait = 100 * time.Millisecond
+	}
+	if c.DownUtilization <= 0 {
+		c.DownUtilization = 0.5
+	}
+	if c.UpSamples <= 0 {
+		c.UpSamples = 2
+	}
+	if c.DownSamples <= 0 {
+		c.DownSamples = 5
+	}
+	if c.UpCooldown <= 0 {
+		c.UpCooldown = 2 * c.Interval
+	}
+	if c.DownCooldown <= 0 {
+		c.DownCooldown = 30 * time.Second
+	}
+	return c
+}
+
+// autoscaleSample 一个采样间隔内的指标
+type autoscaleSample struct {
+	queue    int           // 采样时的队列长度
+	wait     time.Duration // 间隔内开始执行的任务的平均排队时间
+	rejected int64         // 间隔内被拒绝的提交数
+	util     float64       // 间隔内 worker 的利用率，0-1
+}
+
+// autoscaler 伸缩决策，只在 autoscaleLoop 中使用
+type autoscaler struct {
+	cfg        AutoscaleConfig
+	upStreak   int
+	downStreak int
+	lastChange time.Time
+}
+
+// decide 根据采样返回目标 worker 数与原因，不需要调整时返回 workers
+// 扩容每次增加四分之一（至少1个），缩容每次减少1个
+func (a *autoscaler) decide(s autoscaleSample, workers, minWorkers, maxWorkers int, now time.Time) (int, string) {
+	pressure := s.rejected > 0 || s.wait > a.cfg.UpWait ||
+		float64(s.queue) > a.cfg.UpQueuePerWorker*float64(workers)
+	idle := s.queue == 0 && s.rejected == 0 && s.util < a.cfg.DownUtilization
+
+	switch {
+	case pressure:
+		a.upStreak++
+		a.downStreak = 0
+	case idle:
+		a.downStreak++
+		a.upStreak = 0
+	default:
+		a.upStreak, a.downStreak = 0, 0
+	}
+
+	since := now.Sub(a.lastChange)
+	if a.upStreak >= a.cfg.UpSamples && workers < maxWorkers && since >= a.cfg.UpCooldown {
+		a.upStreak = 0
+		a.lastChange = now
+		return min(workers+max(1, workers/4), maxWorkers), "pressure"
+	}
+	if a.downStreak >= a.cfg.DownSamples && workers > minWorkers && since >= a.cfg.DownCooldown {
+		a.downStreak = 0
+		a.lastChange = now
+		return workers - 1, "idle"
+	}
+	return workers, ""
+}
+
+// autoscaleLoop 定期采样并调整 worker 数量，直到工作池停止
+func (wp *WorkerPool) autoscaleLoop(cfg AutoscaleConfig) {
+	a := &autoscaler{cfg: cfg, lastChange: time.Now()}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	last := wp.readCounters()
+	lastTime := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wp.ctx.Done():
+			return
+		}
+		now := time.Now()
+		cur := wp.readCounters()
+		workers := wp.Workers()
+		s := autoscaleSample{queue: wp.queue.len(), rejected: cur.rejected - last.rejected}
+		if n := cur.started - last.started; n > 0 {
+			s.wait = time.Duration((cur.waitNanos - last.waitNanos) / n)
+		}
+		// 长时间执行的任务在结束前不计入 busyNanos，用执行中的任务数补充
+		busy := float64(cur.busyNanos-last.busyNanos) / float64(now.Sub(lastTime)*time.Duration(workers))
+		s.util = max(busy, float64(wp.stats.inFlight.Load())/float64(workers))
+		last, lastTime = cur, now
+
+		target, reason := a.decide(s, workers, wp.minWorkers, wp.maxWorkers, now)
+		if target == workers {
+			continue
+		}
+		if err := wp.scaleWorkers(target); err != nil {
+			return
+		}
+		log.Printf("WorkerPool autoscale: %d -> %d workers (%s, queue %d, wait %v, rejected %d, util %.2f)",
+			workers, target, reason, s.queue, s.wait, s.rejected, s.util)
+	}
+}
+
+// poolCounters 累计的执行指标
+type poolCounters struct {
+	started   int64
+	waitNanos int64
+	busyNanos int64
+	rejected  int64
+}
+
+func (wp *WorkerPool) readCounters() poolCounters {
+	return poolCounters{
+		started:   wp.stats.wait.count.Load(),
+		waitNanos: wp.stats.wait.sum.Load(),
+		busyNanos: wp.stats.exec.sum.Load(),
+		rejected:  wp.stats.rejected.Load(),
+	}
+}
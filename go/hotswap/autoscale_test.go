@@ -0,0 +1,104 @@
+package hotswap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAutoscalerHysteresis(t *testing.T) {
+	a := &autoscaler{cfg: AutoscaleConfig{Interval: time.Second}.withDefaults()}
+	now := time.Now()
+	a.lastChange = now
+	busy := autoscaleSample{queue: 100, util: 1}
+	idle := autoscaleSample{util: 0.1}
+	step := func(s autoscaleSample, workers int) int {
+		now = now.Add(time.Second)
+		n, _ := a.decide(s, workers, 4, 10, now)
+		return n
+	}
+
+	// 一次压力不扩容，连续两次才扩容
+	if n := step(busy, 4); n != 4 {
+		t.Fatalf("scaled to %d after one sample", n)
+	}
+	if n := step(busy, 4); n != 5 {
+		t.Fatalf("scaled to %d after two samples, want 5", n)
+	}
+	// 压力与空闲交替时不调整
+	for i := 0; i < 10; i++ {
+		s := busy
+		if i%2 == 0 {
+			s = idle
+		}
+		if n := step(s, 5); n != 5 {
+			t.Fatalf("flapping samples scaled to %d", n)
+		}
+	}
+	// 缩容需要连续5次空闲，且距上次调整超过冷却时间（默认30秒）
+	for i := 0; i < 4; i++ {
+		if n := step(idle, 5); n != 5 {
+			t.Fatalf("scaled down after %d idle samples", i+1)
+		}
+	}
+	if n := step(idle, 5); n != 5 {
+		t.Fatal("scaled down within the cooldown")
+	}
+	now = now.Add(15 * time.Second)
+	if n := step(idle, 5); n != 4 {
+		t.Fatalf("scaled to %d after the cooldown, want 4", n)
+	}
+	// 不超出上下限
+	a.downStreak = 10
+	if n := step(idle, 4); n != 4 {
+		t.Fatalf("scaled below MinWorkers to %d", n)
+	}
+	a.upStreak, a.lastChange = 10, time.Time{}
+	if n := step(autoscaleSample{rejected: 1}, 9); n != 10 {
+		t.Fatalf("scaled to %d, want MaxWorkers 10", n)
+	}
+}
+
+func TestAutoscaleGrowsAndShrinks(t *testing.T) {
+	wp := NewWorkerPool(Config{
+		MinWorkers: 1,
+		MaxWorkers: 8,
+		QueueSize:  1000,
+		Autoscale: &AutoscaleConfig{
+			Interval:     10 * time.Millisecond,
+			UpWait:       20 * time.Millisecond,
+			DownSamples:  3,
+			DownCooldown: 20 * time.Millisecond,
+		},
+	})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	for i := 0; i < 400; i++ {
+		wp.Submit(TaskFunc(func() { time.Sleep(2 * time.Millisecond) }))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for wp.Workers() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d workers with %d queued tasks", wp.Workers(), wp.QueueSize())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	peak := wp.Workers()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for wp.Workers() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("still %d workers long after the queue drained (peak %d)", wp.Workers(), peak)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 缩容后仍能执行任务
+	done := make(chan struct{})
+	wp.Submit(TaskFunc(func() { close(done) }))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task not executed after scaling down")
+	}
+}
@@ -0,0 +1,181 @@
+package hotswap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 周期任务的时间表
+type Schedule interface {
+	// Next 返回 t 之后（不含 t）的下一次执行时间，没有时返回零值
+	Next(t time.Time) time.Time
+}
+
+// CronSchedule 解析后的 cron 表达式
+// 格式为 "分 时 日 月 周"，每个字段支持 *、?、数字、a-b 范围、/n 步长与逗号分隔的列表，
+// 月份与星期可以用英文缩写（JAN-DEC、SUN-SAT），星期的0与7都表示周日。
+// 日与周都有限制时满足任意一个即可（与 Vixie cron 相同）。
+// 也支持 @yearly（@annually）、@monthly、@weekly、@daily（@midnight）、@hourly。
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // 每个字段允许的值，第 i 位表示值 i
+	domStar, dowStar              bool   // 日、周字段为 * 或 ?
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField 一个字段的取值范围与名称
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // 名称对应 min 开始的值
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12,
+		names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}}
+	// 星期允许7（周日），解析后并入0
+	cronDow = cronField{name: "day of week", min: 0, max: 7,
+		names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}}
+)
+
+// ParseCron 解析 cron 表达式
+func ParseCron(expr string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "@") {
+		d, ok := cronDescriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, fmt.Errorf("cron %q: unknown descriptor", expr)
+		}
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	c := &CronSchedule{}
+	var err error
+	for i, f := range []struct {
+		def  cronField
+		bits *uint64
+	}{{cronMinute, &c.minute}, {cronHour, &c.hour}, {cronDom, &c.dom}, {cronMonth, &c.month}, {cronDow, &c.dow}} {
+		if *f.bits, err = f.def.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	c.domStar = fields[2] == "*" || fields[2] == "?"
+	c.dowStar = fields[4] == "*" || fields[4] == "?"
+	return c, nil
+}
+
+// parse 解析一个字段，返回允许的值的位集合
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s: invalid step %q", f.name, stepStr)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*" || rng == "?":
+			if f.max == 7 {
+				hi = 6 // 星期的 * 不重复包含7
+			}
+		default:
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(a); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max // a/n 表示从 a 到最大值
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s: invalid range %q", f.name, rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value 解析数字或名称
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("%s: invalid value %q", f.name, s)
+	}
+	return n, nil
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next 返回 t 之后的下一次执行时间，按 t 的时区计算；5年内没有匹配的时间（如 2月30日）时返回零值
+// 夏令时跳过的时刻当天不执行
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// everySchedule 固定间隔的时间表，从上一次的计划时间开始计算
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
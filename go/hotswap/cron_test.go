@@ -0,0 +1,69 @@
+package hotswap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 10, 19, 10, 7, 30, 0, time.UTC) // 周一
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"* * * * *", "2026-10-19 10:08"},
+		{"*/15 * * * *", "2026-10-19 10:15"},
+		{"0 2 * * *", "2026-10-20 02:00"},
+		{"@daily", "2026-10-20 00:00"},
+		{"@hourly", "2026-10-19 11:00"},
+		{"30 9 * * sat,SUN", "2026-10-24 09:30"},
+		{"0 9 * * MON-FRI", "2026-10-20 09:00"},
+		{"0 0 1,15 * *", "2026-11-01 00:00"},
+		{"0 0 1 jan *", "2027-01-01 00:00"},
+		{"5/20 10-12 * * *", "2026-10-19 10:25"},
+		{"0 0 * * 7", "2026-10-25 00:00"},
+		// 日与周都有限制时满足任意一个
+		{"0 0 13 * 5", "2026-10-23 00:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+		if got := c.Next(from).Format("2006-01-02 15:04"); got != tt.want {
+			t.Errorf("%q: Next = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+
+	c, _ := ParseCron("0 0 30 2 *")
+	if next := c.Next(from); !next.IsZero() {
+		t.Errorf("Feb 30 scheduled at %v", next)
+	}
+
+	// 按 t 的时区计算
+	shanghai := time.FixedZone("CST", 8*3600)
+	c, _ = ParseCron("0 2 * * *")
+	if got := c.Next(from.In(shanghai)); !got.Equal(time.Date(2026, 10, 20, 2, 0, 0, 0, shanghai)) {
+		t.Errorf("Next in +08:00 = %v", got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"@reboot",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
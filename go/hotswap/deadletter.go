@@ -0,0 +1,327 @@
+package hotswap
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 死信
+// 设置 Config.DeadLetter 后，没有 Future 的可序列化任务（实现 SerializableTask）在以下情况写入死信存储：
+// 被拒绝（队列已满、SubmitWithTimeout 超时）、没有执行就被丢弃（排队期间取消、工作池停止）、执行失败或 panic。
+// 死信记录任务类型、JSON 序列化的任务、优先级、原因与时间；ReplayDeadLetters 按 RegisterTaskType 注册的类型
+// 还原任务并重新提交，提交成功的死信从存储中删除。
+
+// SerializableTask 可以写入死信存储的任务
+// 实现者还需实现 Task 或 ContextTask，并且可以用 encoding/json 序列化与还原
+type SerializableTask interface {
+	TaskType() string // 任务类型名，重放时按此查找 RegisterTaskType 注册的构造函数
+}
+
+// DeadLetter 一条死信
+type DeadLetter struct {
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+	Priority Priority        `json:"priority"`
+	Reason   string          `json:"reason"`
+	Time     time.Time       `json:"time"`
+}
+
+// DeadLetterSink 死信存储
+type DeadLetterSink interface {
+	// Put 保存一条死信
+	Put(letter DeadLetter) error
+	// Replay 依次把已保存的死信交给 fn，fn 返回nil的死信从存储中删除；fn 中可以调用 Put
+	// 并发调用 Replay 时每条死信只能交给 fn 一次
+	Replay(fn func(letter DeadLetter) error) error
+}
+
+var (
+	taskTypesMu sync.RWMutex
+	taskTypes   = make(map[string]func() SerializableTask)
+)
+
+// RegisterTaskType 注册可重放的任务类型，newTask 返回用于 json.Unmarshal 的空任务（通常为指针）
+func RegisterTaskType(name string, newTask func() SerializableTask) {
+	taskTypesMu.Lock()
+	defer taskTypesMu.Unlock()
+	taskTypes[name] = newTask
+}
+
+// decodeDeadLetter 按注册的类型还原死信中的任务
+func decodeDeadLetter(letter DeadLetter) (ContextTask, error) {
+	taskTypesMu.RLock()
+	newTask := taskTypes[letter.Type]
+	taskTypesMu.RUnlock()
+	if newTask == nil {
+		return nil, fmt.Errorf("unregistered task type %q", letter.Type)
+	}
+	st := newTask()
+	if err := json.Unmarshal(letter.Payload, st); err != nil {
+		return nil, fmt.Errorf("decode task %q: %w", letter.Type, err)
+	}
+	switch t := st.(type) {
+	case ContextTask:
+		return t, nil
+	case Task:
+		return taskAdapter{t}, nil
+	}
+	return nil, fmt.Errorf("task type %q implements neither Task nor ContextTask", letter.Type)
+}
+
+// serializableTask 返回任务的可序列化形式，Task 经过 taskAdapter 包装时取原任务
+func serializableTask(t ContextTask) (SerializableTask, bool) {
+	if a, ok := t.(taskAdapter); ok {
+		st, ok := a.task.(SerializableTask)
+		return st, ok
+	}
+	st, ok := t.(SerializableTask)
+	return st, ok
+}
+
+// saveDeadLetter 把没有 Future 的可序列化任务写入死信存储，失败只记录日志
+func (wp *WorkerPool) saveDeadLetter(j *job, reason error) {
+	if wp.deadLetter == nil || j.done != nil {
+		return
+	}
+	st, ok := serializableTask(j.task)
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(st)
+	if err == nil {
+		err = wp.deadLetter.Put(DeadLetter{
+			Type:     st.TaskType(),
+			Payload:  payload,
+			Priority: j.priority,
+			Reason:   reason.Error(),
+			Time:     time.Now(),
+		})
+	}
+	if err != nil {
+		log.Printf("Task dead letter not saved: %v (reason: %v)", err, reason)
+	}
+}
+
+// ReplayDeadLetters 把死信存储中的任务按原优先级重新提交（阻塞，规则同 SubmitContext），返回提交成功的数量
+// 无法还原或提交失败的死信保留在存储中，返回遇到的第一个错误；ctx 取消后其余死信保留
+func (wp *WorkerPool) ReplayDeadLetters(ctx context.Context) (int, error) {
+	if wp.deadLetter == nil {
+		return 0, errors.New("dead letter sink not configured")
+	}
+	n := 0
+	var first error
+	err := wp.deadLetter.Replay(func(letter DeadLetter) error {
+		err := ctx.Err()
+		if err == nil {
+			var task ContextTask
+			if task, err = decodeDeadLetter(letter); err == nil {
+				err = wp.SubmitContext(ctx, task, WithPriority(letter.Priority))
+			}
+		}
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, first
+}
+
+// FileDeadLetterSink 把死信按行保存为 JSON（JSONL）的文件存储
+type FileDeadLetterSink struct {
+	mu       sync.Mutex // 保护文件的写入与改名
+	replayMu sync.Mutex // 串行执行 Replay，避免两次重放处理同一个 .replay 文件
+	path     string
+}
+
+// NewFileDeadLetterSink 创建文件死信存储，文件不存在时在写入第一条死信时创建
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{path: path}
+}
+
+// Put 追加一行死信
+func (s *FileDeadLetterSink) Put(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Replay 先把文件改名为 .replay 文件再逐行处理，处理期间新的死信写入新文件，失败的死信重新追加
+// 上次重放中断留下的 .replay 文件会先被处理；无法解析的行原样保留在 .replay 文件中。
+// 同一个 FileDeadLetterSink 的 Replay 串行执行，多个进程不能同时重放同一个文件
+func (s *FileDeadLetterSink) Replay(fn func(letter DeadLetter) error) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	replayPath := s.path + ".replay"
+	s.mu.Lock()
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		if err := os.Rename(s.path, replayPath); err != nil {
+			s.mu.Unlock()
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	s.mu.Unlock()
+
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(line), &letter); err != nil {
+			bad = append(bad, line)
+			continue
+		}
+		if fn(letter) != nil {
+			if err := s.Put(letter); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	f.Close()
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		return os.WriteFile(replayPath, []byte(strings.Join(bad, "\n")+"\n"), 0644)
+	}
+	return os.Remove(replayPath)
+}
+
+// SQLExecer SQL 死信存储使用的数据库接口，*easydb.EasyDb 与 *sql.DB 都满足
+type SQLExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// SQLDeadLetterSink 把死信保存到数据库表的存储
+// dialect 为 postgres、mysql 或 sqlite3，决定占位符与建表语句
+type SQLDeadLetterSink struct {
+	db       SQLExecer
+	dialect  string
+	table    string
+	replayMu sync.Mutex // 串行执行 Replay，避免读出同一批死信重复处理
+}
+
+// NewSQLDeadLetterSink 创建 SQL 死信存储，table 为空时使用 hotswap_dead_letters
+func NewSQLDeadLetterSink(db SQLExecer, dialect, table string) *SQLDeadLetterSink {
+	if table == "" {
+		table = "hotswap_dead_letters"
+	}
+	return &SQLDeadLetterSink{db: db, dialect: dialect, table: table}
+}
+
+func (s *SQLDeadLetterSink) placeholder(i int) string {
+	if s.dialect == "postgres" {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// CreateTable 创建死信表（已存在时不做修改）
+func (s *SQLDeadLetterSink) CreateTable() error {
+	id := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	switch s.dialect {
+	case "postgres":
+		id = "BIGSERIAL PRIMARY KEY"
+	case "mysql":
+		id = "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	}
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id %s,
+	task_type VARCHAR(255) NOT NULL,
+	payload TEXT NOT NULL,
+	priority INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+)`, s.table, id))
+	return err
+}
+
+// Put 插入一条死信
+func (s *SQLDeadLetterSink) Put(letter DeadLetter) error {
+	_, err := s.db.Exec(fmt.Sprintf("INSERT INTO %s (task_type, payload, priority, reason, created_at) VALUES (%s, %s, %s, %s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5)),
+		letter.Type, string(letter.Payload), int(letter.Priority), letter.Reason, letter.Time)
+	return err
+}
+
+// Replay 按写入顺序读出全部死信，fn 返回nil的按 id 删除
+// 同一个 SQLDeadLetterSink 的 Replay 串行执行，多个进程不能同时重放同一张表
+func (s *SQLDeadLetterSink) Replay(fn func(letter DeadLetter) error) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	rows, err := s.db.Query(fmt.Sprintf("SELECT id, task_type, payload, priority, reason, created_at FROM %s ORDER BY id", s.table))
+	if err != nil {
+		return err
+	}
+	type row struct {
+		id     int64
+		letter DeadLetter
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		var payload string
+		var priority int
+		if err := rows.Scan(&r.id, &r.letter.Type, &payload, &priority, &r.letter.Reason, &r.letter.Time); err != nil {
+			rows.Close()
+			return err
+		}
+		r.letter.Payload = json.RawMessage(payload)
+		r.letter.Priority = Priority(priority)
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// 读完后再处理，fn 中的 Put 不会与查询争用连接
+	for _, r := range all {
+		if fn(r.letter) != nil {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = %s", s.table, s.placeholder(1)), r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
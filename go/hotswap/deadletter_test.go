@@ -0,0 +1,390 @@
+package hotswap
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replayTask 测试用的可序列化任务，执行时记录 ID，Fail 为 true 时 panic
+type replayTask struct {
+	ID   int  `json:"id"`
+	Fail bool `json:"fail"`
+}
+
+var (
+	replayMu  sync.Mutex
+	replayRan []int
+)
+
+func (t *replayTask) TaskType() string { return "test.replay" }
+
+func (t *replayTask) Execute() {
+	replayMu.Lock()
+	replayRan = append(replayRan, t.ID)
+	replayMu.Unlock()
+	if t.Fail {
+		panic("replay task failed")
+	}
+}
+
+// unregisteredTask 没有注册类型的可序列化 ContextTask，执行时返回错误
+type unregisteredTask struct{}
+
+func (unregisteredTask) TaskType() string { return "test.unregistered" }
+func (unregisteredTask) Execute(context.Context) error {
+	return errors.New("unregistered task failed")
+}
+
+func init() {
+	RegisterTaskType("test.replay", func() SerializableTask { return &replayTask{} })
+}
+
+func readLetters(t *testing.T, sink DeadLetterSink) []DeadLetter {
+	t.Helper()
+	var letters []DeadLetter
+	// 全部返回错误，死信保留在存储中
+	if err := sink.Replay(func(l DeadLetter) error {
+		letters = append(letters, l)
+		return errors.New("keep")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return letters
+}
+
+func TestDeadLetterFileSink(t *testing.T) {
+	replayMu.Lock()
+	replayRan = nil
+	replayMu.Unlock()
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead.jsonl"))
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 1, DeadLetter: sink, OnError: func(error) {}})
+	wp.Start()
+
+	release := blockWorkers(t, wp, 1)
+	if !wp.TrySubmit(&replayTask{ID: 1}) {
+		t.Fatal("queue should have room")
+	}
+	// 队列已满：被拒绝
+	if wp.TrySubmitPriority(&replayTask{ID: 2}, PriorityNormal) {
+		t.Fatal("TrySubmit accepted a task on a full queue")
+	}
+	// 不可序列化的任务不写入
+	wp.TrySubmit(TaskFunc(func() {}))
+	close(release)
+
+	// 执行失败；没有注册类型的任务同样写入
+	wp.SubmitPriority(&replayTask{ID: 3, Fail: true}, PriorityHigh)
+	wp.SubmitContext(context.Background(), unregisteredTask{})
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	letters := readLetters(t, sink)
+	if len(letters) != 3 {
+		t.Fatalf("%d dead letters, want 3: %+v", len(letters), letters)
+	}
+	if letters[0].Type != "test.replay" || letters[0].Reason != ErrQueueFull.Error() {
+		t.Fatalf("rejected letter = %+v", letters[0])
+	}
+	if letters[1].Priority != PriorityHigh || !strings.HasPrefix(letters[1].Reason, "task panicked: replay task failed") {
+		t.Fatalf("failed letter = %+v", letters[1])
+	}
+	if letters[2].Type != "test.unregistered" || letters[2].Reason != "unregistered task failed" {
+		t.Fatalf("unregistered letter = %+v", letters[2])
+	}
+
+	// 重放：注册的类型重新提交后删除，没有注册的保留
+	replayMu.Lock()
+	replayRan = nil
+	replayMu.Unlock()
+	wp = NewWorkerPool(Config{MinWorkers: 1, QueueSize: 10, DeadLetter: sink, OnError: func(error) {}})
+	wp.Start()
+	n, err := wp.ReplayDeadLetters(context.Background())
+	if n != 2 || err == nil {
+		t.Fatalf("ReplayDeadLetters = %d, %v; want 2 and an unregistered type error", n, err)
+	}
+	wp.Stop(context.Background())
+	replayMu.Lock()
+	ran := append([]int(nil), replayRan...)
+	replayMu.Unlock()
+	slices.Sort(ran)
+	if !slices.Equal(ran, []int{2, 3}) {
+		t.Fatalf("replayed tasks %v, want [2 3]", ran)
+	}
+	// 没有注册的保留，ID 3 再次失败又写入一条
+	types := map[string]int{}
+	for _, l := range readLetters(t, sink) {
+		types[l.Type]++
+	}
+	if len(types) != 2 || types["test.unregistered"] != 1 || types["test.replay"] != 1 {
+		t.Fatalf("letters after replay = %v", types)
+	}
+}
+
+func TestDeadLetterDropped(t *testing.T) {
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead.jsonl"))
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 10, DeadLetter: sink, OnError: func(error) {}})
+	wp.Start()
+	started := make(chan struct{})
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}))
+	<-started
+	wp.SubmitPriority(&replayTask{ID: 1}, PriorityLow)
+
+	// Stop 超时，队列中的任务被丢弃
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wp.Stop(ctx)
+
+	letters := readLetters(t, sink)
+	if len(letters) != 1 || letters[0].Priority != PriorityLow {
+		t.Fatalf("letters = %+v", letters)
+	}
+	// Future 的结果交给调用方，不写入
+	wp = NewWorkerPool(Config{MinWorkers: 1, DeadLetter: sink})
+	wp.Start()
+	f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		return 0, errors.New("future failed")
+	})
+	f.Wait(context.Background())
+	wp.Stop(context.Background())
+	if letters = readLetters(t, sink); len(letters) != 1 {
+		t.Fatalf("%d letters after a failed future, want 1", len(letters))
+	}
+}
+
+func TestFileDeadLetterSinkKeepsBadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	if err := os.WriteFile(path, []byte("not json\n{\"type\":\"x\",\"payload\":{}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sink := NewFileDeadLetterSink(path)
+	var got []string
+	if err := sink.Replay(func(l DeadLetter) error {
+		got = append(got, l.Type)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "x" {
+		t.Fatalf("replayed %v", got)
+	}
+	b, err := os.ReadFile(path + ".replay")
+	if err != nil || string(b) != "not json\n" {
+		t.Fatalf("kept %q, %v", b, err)
+	}
+	// 下次重放先处理 .replay 文件
+	if err := sink.Replay(func(DeadLetter) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memSQL 测试用的内存 database/sql 驱动，只支持 SQLDeadLetterSink 使用的语句
+type memSQL struct {
+	mu      sync.Mutex
+	nextID  int64
+	rows    [][]driver.Value // id, task_type, payload, priority, reason, created_at
+	queries []string
+}
+
+var (
+	memSQLMu  sync.Mutex
+	memSQLDBs = map[string]*memSQL{}
+)
+
+func init() {
+	sql.Register("hotswap-memsql", memSQLDriver{})
+}
+
+// openMemSQL 打开一个新的内存数据库
+func openMemSQL(t *testing.T) (*sql.DB, *memSQL) {
+	t.Helper()
+	m := &memSQL{}
+	memSQLMu.Lock()
+	memSQLDBs[t.Name()] = m
+	memSQLMu.Unlock()
+	db, err := sql.Open("hotswap-memsql", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, m
+}
+
+type memSQLDriver struct{}
+
+func (memSQLDriver) Open(name string) (driver.Conn, error) {
+	memSQLMu.Lock()
+	defer memSQLMu.Unlock()
+	return memSQLConn{memSQLDBs[name]}, nil
+}
+
+type memSQLConn struct{ db *memSQL }
+
+func (c memSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return memSQLStmt{c.db, query}, nil
+}
+func (memSQLConn) Close() error              { return nil }
+func (memSQLConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions not supported") }
+
+type memSQLStmt struct {
+	db    *memSQL
+	query string
+}
+
+func (memSQLStmt) Close() error  { return nil }
+func (memSQLStmt) NumInput() int { return -1 }
+
+func (s memSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries = append(s.db.queries, s.query)
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+	case strings.HasPrefix(s.query, "INSERT INTO"):
+		s.db.nextID++
+		s.db.rows = append(s.db.rows, append([]driver.Value{s.db.nextID}, args...))
+	case strings.HasPrefix(s.query, "DELETE FROM"):
+		n := len(s.db.rows)
+		s.db.rows = slices.DeleteFunc(s.db.rows, func(r []driver.Value) bool { return r[0] == args[0] })
+		return driver.RowsAffected(n - len(s.db.rows)), nil
+	default:
+		return nil, fmt.Errorf("unsupported statement %q", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s memSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries = append(s.db.queries, s.query)
+	if !strings.HasPrefix(s.query, "SELECT") {
+		return nil, fmt.Errorf("unsupported query %q", s.query)
+	}
+	return &memSQLRows{rows: slices.Clone(s.db.rows)}, nil
+}
+
+type memSQLRows struct{ rows [][]driver.Value }
+
+func (*memSQLRows) Columns() []string {
+	return []string{"id", "task_type", "payload", "priority", "reason", "created_at"}
+}
+func (*memSQLRows) Close() error { return nil }
+func (r *memSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestSQLDeadLetterSink(t *testing.T) {
+	db, mem := openMemSQL(t)
+	sink := NewSQLDeadLetterSink(db, "postgres", "")
+	if err := sink.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for i := 1; i <= 3; i++ {
+		if err := sink.Put(DeadLetter{Type: "test.replay", Payload: json.RawMessage(fmt.Sprintf(`{"id":%d}`, i)),
+			Priority: PriorityHigh, Reason: "failed", Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := mem.queries[1]; !strings.Contains(q, "INTO hotswap_dead_letters") || !strings.Contains(q, "$5") {
+		t.Fatalf("insert statement %q", q)
+	}
+
+	// 按写入顺序交给 fn，成功的删除，失败的保留
+	var ids []string
+	if err := sink.Replay(func(l DeadLetter) error {
+		ids = append(ids, string(l.Payload))
+		if l.Priority != PriorityHigh || l.Reason != "failed" || !l.Time.Equal(now) {
+			t.Errorf("letter %+v", l)
+		}
+		if string(l.Payload) == `{"id":2}` {
+			return errors.New("keep")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != `[{"id":1} {"id":2} {"id":3}]` {
+		t.Fatalf("replayed %v", ids)
+	}
+	if letters := readLetters(t, sink); len(letters) != 1 || string(letters[0].Payload) != `{"id":2}` {
+		t.Fatalf("letters after replay = %+v", letters)
+	}
+
+	// mysql 与 sqlite3 使用 ? 占位符
+	mysql := NewSQLDeadLetterSink(db, "mysql", "dl")
+	mysql.Put(DeadLetter{Type: "x", Payload: json.RawMessage(`{}`)})
+	if q := mem.queries[len(mem.queries)-1]; !strings.Contains(q, "INTO dl") || strings.Contains(q, "$") {
+		t.Fatalf("mysql insert statement %q", q)
+	}
+}
+
+func TestDeadLetterConcurrentReplay(t *testing.T) {
+	db, _ := openMemSQL(t)
+	sinks := map[string]DeadLetterSink{
+		"file": NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead.jsonl")),
+		"sql":  NewSQLDeadLetterSink(db, "sqlite3", ""),
+	}
+	for name, sink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			const letters = 20
+			for i := 0; i < letters; i++ {
+				sink.Put(DeadLetter{Type: "test.replay", Payload: json.RawMessage(fmt.Sprintf(`{"id":%d}`, i))})
+			}
+
+			// 同时重放时每条死信只交给 fn 一次
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			seen := map[string]int{}
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := sink.Replay(func(l DeadLetter) error {
+						time.Sleep(time.Millisecond)
+						mu.Lock()
+						seen[string(l.Payload)]++
+						mu.Unlock()
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if len(seen) != letters {
+				t.Fatalf("%d of %d letters replayed", len(seen), letters)
+			}
+			for payload, n := range seen {
+				if n != 1 {
+					t.Fatalf("letter %s replayed %d times", payload, n)
+				}
+			}
+			if left := readLetters(t, sink); len(left) != 0 {
+				t.Fatalf("%d letters left", len(left))
+			}
+		})
+	}
+}
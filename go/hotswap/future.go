@@ -0,0 +1,85 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrTaskDropped 任务没有执行就被丢弃，错误链中带有丢弃的原因（如 ctx 取消、ErrPoolStopped）
+var ErrTaskDropped = errors.New("task dropped")
+
+// droppedError 带原因的 ErrTaskDropped
+func droppedError(reason error) error {
+	return fmt.Errorf("%w: %w", ErrTaskDropped, reason)
+}
+
+// PanicError 任务执行时 panic，由 worker 恢复后转换的错误
+type PanicError struct {
+	Value any    // recover() 的返回值
+	Stack []byte // panic 时的调用栈
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// Unwrap panic 的值是 error 时返回该 error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// execute 执行任务，把 panic 转换为 *PanicError
+func execute(ctx context.Context, task ContextTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return task.Execute(ctx)
+}
+
+// Future 异步任务的结果
+type Future[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// Done 任务完成（包括失败、panic 与被丢弃）时关闭
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 等待任务完成，返回任务的结果与错误；ctx 先取消时返回 ctx.Err()，不影响任务本身
+// 任务 panic 时错误为 *PanicError，没有执行就被丢弃时错误为 ErrTaskDropped
+func (f *Future[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// SubmitFuture 提交有返回值的任务（阻塞），提交规则同 SubmitContext
+// 任务的错误、panic 与丢弃只通过 Future 返回，不调用 Config.OnError
+func SubmitFuture[T any](wp *WorkerPool, ctx context.Context, fn func(ctx context.Context) (T, error), opts ...TaskOption) (*Future[T], error) {
+	f := &Future[T]{done: make(chan struct{})}
+	j := newJob(ctx, ContextTaskFunc(func(ctx context.Context) error {
+		var err error
+		f.val, err = fn(ctx)
+		return err
+	}), opts)
+	j.done = func(err error) {
+		f.err = err
+		close(f.done)
+	}
+	if err := wp.enqueue(ctx, j, true); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
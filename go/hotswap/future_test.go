@@ -0,0 +1,100 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmitFuture(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 2})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	f, err := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) { return 42, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f.Wait(context.Background()); v != 42 || err != nil {
+		t.Fatalf("Wait = %d, %v", v, err)
+	}
+
+	errBoom := errors.New("boom")
+	f, _ = SubmitFuture(wp, context.Background(), func(context.Context) (int, error) { return 0, errBoom })
+	if _, err := f.Wait(context.Background()); !errors.Is(err, errBoom) {
+		t.Fatalf("Wait err = %v", err)
+	}
+
+	// Wait 的 ctx 取消不影响任务
+	release := make(chan struct{})
+	fs, _ := SubmitFuture(wp, context.Background(), func(context.Context) (string, error) {
+		<-release
+		return "late", nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := fs.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with expired ctx = %v", err)
+	}
+	close(release)
+	if v, err := fs.Wait(context.Background()); v != "late" || err != nil {
+		t.Fatalf("Wait = %q, %v", v, err)
+	}
+}
+
+func TestPanicRecovered(t *testing.T) {
+	errs := make(chan error, 1)
+	wp := NewWorkerPool(Config{MinWorkers: 1, OnError: func(err error) { errs <- err }})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		var m map[string]int
+		m["x"] = 1
+		return 0, nil
+	})
+	_, err := f.Wait(context.Background())
+	var pe *PanicError
+	if !errors.As(err, &pe) || !strings.Contains(string(pe.Stack), "TestPanicRecovered") {
+		t.Fatalf("future err = %v", err)
+	}
+
+	// 没有 Future 的任务 panic 交给 OnError，worker 继续工作
+	wp.Submit(TaskFunc(func() { panic("fire and forget") }))
+	if err := <-errs; !errors.As(err, &pe) || pe.Value != "fire and forget" {
+		t.Fatalf("OnError got %v", err)
+	}
+	errBoom := errors.New("boom")
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error { return errBoom }))
+	if err := <-errs; !errors.Is(err, errBoom) {
+		t.Fatalf("OnError got %v", err)
+	}
+}
+
+func TestFutureDroppedOnStop(t *testing.T) {
+	errs := make(chan error, 10)
+	wp := NewWorkerPool(Config{MinWorkers: 1, OnError: func(err error) { errs <- err }})
+	wp.Start()
+	started := make(chan struct{})
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}))
+	<-started
+
+	f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) { return 1, nil })
+	wp.Submit(TaskFunc(func() {}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go wp.Stop(ctx)
+
+	if _, err := f.Wait(context.Background()); !errors.Is(err, ErrTaskDropped) || !errors.Is(err, ErrPoolStopped) {
+		t.Fatalf("future of a dropped task: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrTaskDropped) {
+		t.Fatalf("OnError got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package hotswap
+
+import "context"
+
+// key 任务
+// 设置了 key 的任务（SubmitKeyed 或 WithKey）按 key 限制并发：同一 key 同时放入队列或执行的任务不超过其并发上限
+// （默认1，即同一 key 的任务按提交顺序逐个执行、不重叠），超出的任务按提交顺序在该 key 的等待列表中，
+// 不占用 worker，但与队列中的任务一样计入所在优先级的队列容量：队列已满时 SubmitKeyed 等待空位，
+// 非阻塞的提交返回 ErrQueueFull。前一个任务结束（完成、失败、被丢弃，等待重试期间不算结束）后下一个任务放入队列。
+// 不同 key 的任务互不影响，仍由共享的 worker 并行执行。
+
+// keyState 一个 key 的执行状态，没有任务时删除
+// running: 占用名额（已放入队列、执行中或等待重试）的任务数；pending: 等待名额的任务，按提交顺序
+type keyState struct {
+	running int
+	pending []*job
+}
+
+// WithKey 设置任务的 key，同一 key 的任务按提交顺序执行，同时执行的数量不超过 SetKeyConcurrency 设置的上限
+func WithKey(key string) TaskOption {
+	return func(j *job) { j.key = key }
+}
+
+// SubmitKeyed 提交 key 任务（阻塞），同一 key 的任务按提交顺序执行且不重叠（可用 SetKeyConcurrency 放宽）
+// 队列已满（包括等待该 key 的任务）时等待空位，同 Submit；key 有任务在执行时任务等轮到时再放入队列。工作池已停止时丢弃任务。
+func (wp *WorkerPool) SubmitKeyed(key string, task Task) {
+	j := newJob(nil, taskAdapter{task}, []TaskOption{WithKey(key)})
+	if err := wp.enqueue(context.Background(), j, true); err != nil {
+		wp.dropJob(j, err)
+	}
+}
+
+// SetKeyConcurrency 设置 key 的并发上限，覆盖 Config.KeyConcurrency；n 小于等于0时恢复默认值
+// 提高上限后等待中的任务立即放入队列，降低上限不影响已放入队列的任务
+func (wp *WorkerPool) SetKeyConcurrency(key string, n int) {
+	wp.keyMu.Lock()
+	if n > 0 {
+		wp.keyLimits[key] = n
+	} else {
+		delete(wp.keyLimits, key)
+	}
+	var next []*job
+	if ks := wp.keys[key]; ks != nil {
+		next = wp.admitPendingLocked(key, ks)
+	}
+	wp.keyMu.Unlock()
+	wp.pushReleased(next)
+}
+
+// keyLimitLocked key 的并发上限，需持有 keyMu
+func (wp *WorkerPool) keyLimitLocked(key string) int {
+	if n, ok := wp.keyLimits[key]; ok {
+		return n
+	}
+	return wp.keyConcurrency
+}
+
+// acquireKey 为 key 任务占用一个名额；名额已满时加入等待列表并返回 false
+func (wp *WorkerPool) acquireKey(j *job) bool {
+	wp.keyMu.Lock()
+	defer wp.keyMu.Unlock()
+	ks := wp.keys[j.key]
+	if ks == nil {
+		ks = &keyState{}
+		wp.keys[j.key] = ks
+	}
+	if ks.running < wp.keyLimitLocked(j.key) && len(ks.pending) == 0 {
+		ks.running++
+		j.keyHeld = true
+		return true
+	}
+	ks.pending = append(ks.pending, j)
+	wp.stats.keyPending.Add(1)
+	return false
+}
+
+// releaseKey 任务结束后归还名额，并把同一 key 等待中的任务放入队列；没有占用名额时不做处理
+func (wp *WorkerPool) releaseKey(j *job) {
+	if !j.keyHeld {
+		return
+	}
+	j.keyHeld = false
+	wp.keyMu.Lock()
+	ks := wp.keys[j.key]
+	ks.running--
+	next := wp.admitPendingLocked(j.key, ks)
+	wp.keyMu.Unlock()
+	wp.pushReleased(next)
+}
+
+// admitPendingLocked 在名额内按提交顺序取出等待中的任务，key 没有任务时删除其状态，需持有 keyMu
+func (wp *WorkerPool) admitPendingLocked(key string, ks *keyState) []*job {
+	var next []*job
+	for limit := wp.keyLimitLocked(key); ks.running < limit && len(ks.pending) > 0; {
+		j := ks.pending[0]
+		ks.pending[0] = nil
+		ks.pending = ks.pending[1:]
+		j.keyHeld = true
+		ks.running++
+		next = append(next, j)
+	}
+	wp.stats.keyPending.Add(-int64(len(next)))
+	if ks.running == 0 && len(ks.pending) == 0 {
+		delete(wp.keys, key)
+	}
+	return next
+}
+
+// pushReleased 把轮到的任务放入提交时预留的容量，不等待，因此可以在 worker 中调用；工作池已停止时丢弃
+func (wp *WorkerPool) pushReleased(jobs []*job) {
+	for _, j := range jobs {
+		if !wp.queue.pushReleased(j) {
+			wp.dropJob(j, ErrPoolStopped)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitKeyedOrder(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 8, QueueSize: 16})
+	wp.Start()
+
+	const keys, perKey = 5, 100
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	var running [keys]atomic.Int32
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("user-%d", k)
+			wp.SubmitKeyed(key, TaskFunc(func() {
+				if running[k].Add(1) > 1 {
+					t.Errorf("tasks of %s overlapped", key)
+				}
+				time.Sleep(10 * time.Microsecond)
+				mu.Lock()
+				seen[key] = append(seen[key], i)
+				mu.Unlock()
+				running[k].Add(-1)
+			}))
+		}
+	}
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for key, order := range seen {
+		if len(order) != perKey {
+			t.Fatalf("%s: %d of %d tasks executed", key, len(order), perKey)
+		}
+		for i, v := range order {
+			if v != i {
+				t.Fatalf("%s executed out of order: %v", key, order[:i+1])
+			}
+		}
+	}
+	if s := wp.Stats(); s.Submitted != keys*perKey || s.Completed != keys*perKey || s.KeyWait != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+	if len(wp.keys) != 0 {
+		t.Fatalf("%d keys left after all tasks finished", len(wp.keys))
+	}
+}
+
+func TestSubmitKeyedUnrelatedKeysRunConcurrently(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 4})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	// 4个 key 的任务互相等待，被串行执行时会超时
+	var barrier sync.WaitGroup
+	barrier.Add(4)
+	done := make(chan struct{}, 4)
+	for k := 0; k < 4; k++ {
+		wp.SubmitKeyed(fmt.Sprint(k), TaskFunc(func() {
+			barrier.Done()
+			barrier.Wait()
+			done <- struct{}{}
+		}))
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("tasks with different keys did not run concurrently")
+		}
+	}
+}
+
+func TestKeyConcurrency(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 8})
+	wp.Start()
+	defer wp.Stop(context.Background())
+	wp.SetKeyConcurrency("wide", 3)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error {
+			defer wg.Done()
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			<-release
+			running.Add(-1)
+			return nil
+		}), WithKey("wide"))
+	}
+	for running.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if s := wp.Stats(); s.KeyWait != 3 {
+		t.Fatalf("KeyWait = %d, want 3", s.KeyWait)
+	}
+	// 提高上限后等待中的任务立即执行
+	wp.SetKeyConcurrency("wide", 6)
+	for running.Load() < 6 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if peak.Load() != 6 {
+		t.Fatalf("peak concurrency %d, want 6", peak.Load())
+	}
+}
+
+func TestKeyedRetryKeepsOrder(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 4})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+	var failed atomic.Bool
+	first, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		if !failed.Swap(true) {
+			record("first failed")
+			return 0, errors.New("transient")
+		}
+		record("first")
+		return 0, nil
+	}, WithKey("k"), WithRetry(RetryPolicy{Backoff: 30 * time.Millisecond}))
+	second, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		record("second")
+		return 0, nil
+	}, WithKey("k"))
+	first.Wait(context.Background())
+	second.Wait(context.Background())
+
+	// 等待重试期间仍占用 key，后提交的任务在重试成功之后执行
+	if fmt.Sprint(order) != "[first failed first second]" {
+		t.Fatalf("order = %v", order)
+	}
+}
+
+func TestStopKeyedTasks(t *testing.T) {
+	// 正常停止时等待中的 key 任务也会执行
+	wp := NewWorkerPool(Config{MinWorkers: 2})
+	wp.Start()
+	var n atomic.Int32
+	for i := 0; i < 20; i++ {
+		wp.SubmitKeyed("k", TaskFunc(func() {
+			time.Sleep(time.Millisecond)
+			n.Add(1)
+		}))
+	}
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n.Load() != 20 {
+		t.Fatalf("%d of 20 keyed tasks executed before Stop returned", n.Load())
+	}
+	if err := wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error { return nil }), WithKey("k")); !errors.Is(err, ErrPoolStopped) {
+		t.Fatalf("keyed submit after stop: %v", err)
+	}
+
+	// Stop 超时时等待中的 key 任务被丢弃
+	wp = NewWorkerPool(Config{MinWorkers: 1})
+	wp.Start()
+	started := make(chan struct{})
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}), WithKey("k"))
+	<-started
+	var futures []*Future[int]
+	for i := 0; i < 3; i++ {
+		f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) { return 0, nil }, WithKey("k"))
+		futures = append(futures, f)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	wp.Stop(ctx)
+	for _, f := range futures {
+		if _, err := f.Wait(context.Background()); !errors.Is(err, ErrTaskDropped) {
+			t.Fatalf("waiting keyed task ended with %v", err)
+		}
+	}
+}
+
+func TestSubmitKeyedBackpressure(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 2})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	wp.SubmitKeyed("k", TaskFunc(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	// 等待 key 的任务计入队列容量
+	var ran atomic.Int32
+	task := TaskFunc(func() { ran.Add(1) })
+	wp.SubmitKeyed("k", task)
+	wp.SubmitKeyed("k", task)
+	if s := wp.Stats(); s.KeyWait != 2 {
+		t.Fatalf("KeyWait = %d, want 2", s.KeyWait)
+	}
+	keyed := func() *job { return newJob(nil, taskAdapter{task}, []TaskOption{WithKey("k")}) }
+	if err := wp.enqueue(context.Background(), keyed(), false); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("non-blocking keyed submit on a full queue: %v", err)
+	}
+	if wp.TrySubmit(task) {
+		t.Fatal("TrySubmit accepted a task while waiting keyed tasks fill the queue")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := wp.SubmitContext(ctx, ContextTaskFunc(func(context.Context) error { return nil }), WithKey("other")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("keyed SubmitContext on a full queue: %v", err)
+	}
+
+	// SubmitKeyed 等待空位
+	submitted := make(chan struct{})
+	go func() {
+		wp.SubmitKeyed("k", task)
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("SubmitKeyed returned while the queue was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-submitted
+	for ran.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if s := wp.Stats(); s.Rejected != 3 || s.KeyWait != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestKeyedRetryWithFullQueue(t *testing.T) {
+	// 同一 key 等待中的任务占满容量时，重试不等待空位，不会互相等待
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 1})
+	wp.Start()
+	defer wp.Stop(context.Background())
+	var failed atomic.Bool
+	first, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		if !failed.Swap(true) {
+			return 0, errors.New("transient")
+		}
+		return 1, nil
+	}, WithKey("k"), WithRetry(RetryPolicy{Backoff: 10 * time.Millisecond}))
+	second, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) { return 2, nil }, WithKey("k"))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if v, err := first.Wait(ctx); v != 1 || err != nil {
+		t.Fatalf("first = %d, %v", v, err)
+	}
+	if v, err := second.Wait(ctx); v != 2 || err != nil {
+		t.Fatalf("second = %d, %v", v, err)
+	}
+}
+
+// BenchmarkSubmitKeyed 每个任务执行约50微秒，比较不设 key、全部同一 key 与不同 key 的吞吐量：
+// 不同 key 与不设 key 接近，只有同一 key 的任务被串行执行
+func BenchmarkSubmitKeyed(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		keys int
+	}{
+		{"unkeyed", 0},
+		{"keys=1", 1},
+		{"keys=8", 8},
+		{"keys=1024", 1024},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			wp := NewWorkerPool(Config{MinWorkers: 8, QueueSize: 1024})
+			wp.Start()
+			var wg sync.WaitGroup
+			task := TaskFunc(func() {
+				time.Sleep(50 * time.Microsecond)
+				wg.Done()
+			})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wg.Add(1)
+				if bc.keys == 0 {
+					wp.Submit(task)
+				} else {
+					wp.SubmitKeyed(fmt.Sprint(i%bc.keys), task)
+				}
+			}
+			wg.Wait()
+			b.StopTimer()
+			wp.Stop(context.Background())
+		})
+	}
+}
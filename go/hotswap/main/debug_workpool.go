@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"hotswap"
+	"sync"
 	"time"
 )
 
@@ -23,18 +25,27 @@ func debug_workerpool() {
 	// 4. 任务处理延迟
 	// 如内存使用率飙升，适当降低QueueSize或MinWorkers。
 	// 内存占用较低，但队列经常爆满，则适当增加QueueSize或MinWorkers
+	// 其中 2-4 已由 Config.Autoscale 自动伸缩实现：根据队列长度、排队时间与提交失败数在 MinWorkers 与 MaxWorkers 之间调整 worker 数量
+	// 监控数据可通过 pool.Stats() 获取（提交、完成、失败、拒绝、丢弃数，排队与执行时间的分位数），
+	// 或挂载 http.Handle("/metrics", pool.PrometheusHandler("api")) 供 Prometheus 采集
 
 	// 创建配置
 	// 8核服务器：workers = 24, QueueSize = workers * 10 = 240
 	config := hotswap.Config{
 		MinWorkers: 24,  // 根据文章推荐的8核服务器配置
 		QueueSize:  240, // workers * 10
+		// 负载高时最多扩容到 48 个 worker，空闲后逐步缩回 24 个
+		MaxWorkers: 48,
+		Autoscale:  &hotswap.AutoscaleConfig{},
+		// 任务返回错误或 panic 时调用
+		OnError: func(err error) {
+			fmt.Println("ERROR:", err)
+		},
 	}
 
 	// 创建工作池
 	pool := hotswap.NewWorkerPool(config)
 	pool.Start()
-	defer pool.Stop()
 
 	// 提交任务
 	task := hotswap.TaskFunc(func() {
@@ -44,8 +55,11 @@ func debug_workerpool() {
 	})
 
 	// 非阻塞提交
+	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
+		wg.Add(1)
 		go func(ii int) {
+			defer wg.Done()
 			// 非阻塞提交
 			if !pool.TrySubmit(task) {
 				// 处理队列满的情况
@@ -54,12 +68,68 @@ func debug_workerpool() {
 		}(i)
 	}
 
+	// 提交结束后停止工作池：Stop 等队列中的任务执行完才返回，最多等待5秒，超时则取消执行中的任务
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Stop(ctx); err != nil {
+		fmt.Println("ERROR: 停止工作池:", err)
+	}
+	// 所有任务都已结束，统计是最终结果
+	st := pool.Stats()
+	fmt.Printf("提交 %d 完成 %d 失败 %d 拒绝 %d，排队时间 P99 %v，执行时间 P99 %v\n",
+		st.Submitted, st.Completed, st.Failed, st.Rejected, st.QueueWait.P99, st.Exec.P99)
+
 	// // 阻塞提交
 	// pool.Submit(task)
 
+	// // 交互请求以高优先级提交，不会被积压的后台任务阻塞
+	// pool.TrySubmitPriority(task, hotswap.PriorityHigh)
+
 	// // 带超时提交
 	// // 0.2秒超时
 	// if !pool.SubmitWithTimeout(task, 200*time.Millisecond) {
 	// 	// 处理超时
 	// }
+
+	// // 重试：I/O 等偶发失败的任务最多执行3次，失败后等待 200ms、400ms 再重试，等待期间不占用 worker
+	// err := pool.SubmitContext(ctx, task, hotswap.WithRetry(hotswap.RetryPolicy{
+	// 	MaxAttempts: 3,
+	// 	Backoff:     200 * time.Millisecond,
+	// 	Retryable:   func(err error) bool { return !errors.Is(err, errNotFound) },
+	// }))
+
+	// // 同一用户的任务按提交顺序逐个执行，不同用户的任务并行执行
+	// pool.SubmitKeyed("user:42", task)
+	// // 同一文件最多同时处理2个任务
+	// pool.SetKeyConcurrency("file:/data/a.png", 2)
+
+	// // 定时任务：5分钟后执行一次；每天凌晨2点执行，错过（如进程暂停）时合并补执行一次
+	// sched := hotswap.NewScheduler(pool, hotswap.SchedulerConfig{})
+	// sched.Start()
+	// defer sched.Stop()
+	// sched.After(5*time.Minute, ctxTask)
+	// id, err := sched.Cron("0 2 * * *", ctxTask, hotswap.WithScheduleName("nightly"), hotswap.WithMissedRun(hotswap.MissedRunOnce))
+	// for _, t := range sched.List() {
+	// 	fmt.Println(t.ID, t.Name, t.Spec, t.Next)
+	// }
+	// sched.Cancel(id)
+
+	// // 死信：设置 Config.DeadLetter 后，实现 SerializableTask 的任务被拒绝、丢弃或失败时写入死信存储，
+	// // 修复问题后重新提交。任务类型需先注册：
+	// // hotswap.RegisterTaskType("send_mail", func() hotswap.SerializableTask { return &SendMailTask{} })
+	// // config.DeadLetter = hotswap.NewFileDeadLetterSink("runtime/dead_letters.jsonl")
+	// // 或保存到数据库：hotswap.NewSQLDeadLetterSink(easydb实例, "postgres", "")，首次使用前调用 CreateTable
+	// n, err := pool.ReplayDeadLetters(context.Background())
+
+	// // 支持取消的任务：ctx 取消、工作池停止或执行超过1秒时任务收到取消
+	// err := pool.SubmitContext(ctx, hotswap.ContextTaskFunc(func(ctx context.Context) error {
+	// 	return callAPI(ctx)
+	// }), hotswap.WithTaskTimeout(time.Second))
+
+	// // 等待任务结果
+	// f, err := hotswap.SubmitFuture(pool, ctx, func(ctx context.Context) (string, error) {
+	// 	return fetch(ctx)
+	// })
+	// body, err := f.Wait(ctx)
 }
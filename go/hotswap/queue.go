@@ -0,0 +1,273 @@
+package hotswap
+
+import (
+	"sync"
+	"time"
+)
+
+// Priority 任务优先级，数值越大越优先执行
+type Priority int
+
+const (
+	PriorityLow    Priority = iota // 后台批量任务
+	PriorityNormal                 // 默认优先级
+	PriorityHigh                   // 交互请求等对延迟敏感的任务
+	numPriorities
+)
+
+// defaultAging 默认的老化间隔
+const defaultAging = time.Second
+
+// valid 超出范围的优先级按最近的有效值处理
+func (p Priority) valid() Priority {
+	if p < PriorityLow {
+		return PriorityLow
+	}
+	if p >= numPriorities {
+		return PriorityHigh
+	}
+	return p
+}
+
+// jobFIFO 一个优先级的先进先出队列
+type jobFIFO struct {
+	items []*job
+	head  int
+}
+
+func (f *jobFIFO) len() int { return len(f.items) - f.head }
+
+func (f *jobFIFO) peek() *job {
+	if f.len() == 0 {
+		return nil
+	}
+	return f.items[f.head]
+}
+
+func (f *jobFIFO) push(j *job) { f.items = append(f.items, j) }
+
+func (f *jobFIFO) pop() *job {
+	j := f.items[f.head]
+	f.items[f.head] = nil
+	f.head++
+	// 已出队的部分超过一半时整理，避免切片无限增长
+	if f.head > len(f.items)/2 {
+		n := copy(f.items, f.items[f.head:])
+		clear(f.items[n:])
+		f.items = f.items[:n]
+		f.head = 0
+	}
+	return j
+}
+
+// taskQueue 按优先级分级的任务队列，每个优先级有独立的容量
+// 出队时比较各级队首任务的有效优先级：优先级加上已等待的老化间隔数，最高为 PriorityHigh，相同时先入队的优先；
+// 低优先级的任务每等待 aging 提升一级，提升到最高级后与之后入队的高优先级任务按先后执行，不会饿死。
+// 等待任务的 worker 阻塞在 cond 上；等待空位的提交方阻塞在 space 上，有任务出队时关闭并替换。
+type taskQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	levels  [numPriorities]jobFIFO
+	caps    [numPriorities]int
+	size    int
+	rsv     [numPriorities]int // 预留的容量：等待 key 名额的任务，计入容量
+	aging   time.Duration      // 小于等于0时不老化
+	space   chan struct{}
+	waiters int  // 等待 space 的提交方数量
+	closed  bool // 已关闭，不再接受任务，worker 取完剩余任务后退出
+	drained bool // 关闭后已取空，pushReleased 也不再接受任务
+}
+
+func newTaskQueue(caps [numPriorities]int, aging time.Duration) *taskQueue {
+	q := &taskQueue{caps: caps, aging: aging, space: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// tryPush 任务入队；该优先级的队列已满时返回 ErrQueueFull 与出队时关闭的 channel，已关闭时返回 ErrPoolStopped
+func (q *taskQueue) tryPush(j *job) (<-chan struct{}, error) {
+	return q.tryAdd(j, false)
+}
+
+// tryReserve 为 key 任务预留容量，之后由 pushReleased 放入队列；失败时同 tryPush
+func (q *taskQueue) tryReserve(j *job) (<-chan struct{}, error) {
+	return q.tryAdd(j, true)
+}
+
+func (q *taskQueue) tryAdd(j *job, reserve bool) (<-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrPoolStopped
+	}
+	p := j.priority.valid()
+	if q.levels[p].len()+q.rsv[p] >= q.caps[p] {
+		q.waiters++
+		return q.space, ErrQueueFull
+	}
+	if reserve {
+		q.rsv[p]++
+		j.reserved = true
+		return nil, nil
+	}
+	q.pushLocked(j)
+	return nil, nil
+}
+
+// pushReleased 把预留了容量的 key 任务放入队列，关闭后在取空之前仍然接受；已取空时归还预留并返回 false
+func (q *taskQueue) pushReleased(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.reserved {
+		j.reserved = false
+		q.rsv[j.priority.valid()]--
+	}
+	if q.drained {
+		return false
+	}
+	q.pushLocked(j)
+	return true
+}
+
+// pushRetry 放回占用 key 名额的重试任务，不受容量限制：同一 key 等待中的任务预留了容量并等待它结束，
+// 等待空位会互相等待。超出容量的部分最多为同时重试的 key 任务数；已关闭时返回 false
+func (q *taskQueue) pushRetry(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.pushLocked(j)
+	return true
+}
+
+func (q *taskQueue) pushLocked(j *job) {
+	j.enqueued = time.Now()
+	q.levels[j.priority.valid()].push(j)
+	q.size++
+	q.cond.Signal()
+}
+
+// cancelWait 等待 space 的提交方放弃等待；space 已经关闭替换时计数已清零
+func (q *taskQueue) cancelWait(space <-chan struct{}) {
+	q.mu.Lock()
+	if space == q.space && q.waiters > 0 {
+		q.waiters--
+	}
+	q.mu.Unlock()
+}
+
+// pop 为 worker w 取出下一个任务，队列为空时等待；队列已关闭且为空或 w 已停止时返回nil
+func (q *taskQueue) pop(w *worker) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if w.stopped {
+			return nil
+		}
+		if j := q.takeLocked(); j != nil {
+			return j
+		}
+		if q.closed {
+			return nil
+		}
+		q.cond.Wait()
+	}
+}
+
+// takeLocked 取出有效优先级最高的队首任务，队列为空时返回nil，需持有 q.mu
+func (q *taskQueue) takeLocked() *job {
+	if q.size == 0 {
+		return nil
+	}
+	now := time.Now()
+	best := Priority(-1)
+	var bestScore int64
+	var bestHead *job
+	for p := numPriorities - 1; p >= PriorityLow; p-- {
+		head := q.levels[p].peek()
+		if head == nil {
+			continue
+		}
+		score := int64(p)
+		if q.aging > 0 {
+			score = min(score+int64(now.Sub(head.enqueued)/q.aging), int64(PriorityHigh))
+		}
+		if best < 0 || score > bestScore || (score == bestScore && head.enqueued.Before(bestHead.enqueued)) {
+			best, bestScore, bestHead = p, score, head
+		}
+	}
+	j := q.levels[best].pop()
+	q.size--
+	if q.waiters > 0 {
+		close(q.space)
+		q.space = make(chan struct{})
+		q.waiters = 0
+	}
+	return j
+}
+
+// len 队列中的任务数
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// lens 各优先级队列中的任务数
+func (q *taskQueue) lens() [numPriorities]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n [numPriorities]int
+	for p := range q.levels {
+		n[p] = q.levels[p].len()
+	}
+	return n
+}
+
+// setCap 修改优先级 p 的容量；缩小时已在队列中的任务保留，直到低于新容量才接受新任务
+func (q *taskQueue) setCap(p Priority, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.caps[p] = n
+	if q.waiters > 0 {
+		close(q.space)
+		q.space = make(chan struct{})
+		q.waiters = 0
+	}
+}
+
+// stop 停止 worker w：空闲时立即退出，正在执行任务时执行完后退出
+func (q *taskQueue) stop(w *worker) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.stopped = true
+	q.cond.Broadcast()
+}
+
+// close 不再接受任务，唤醒所有等待的 worker 与提交方
+func (q *taskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	close(q.space)
+	q.waiters = 0
+}
+
+// drain 取出队列中剩余的全部任务；队列已关闭且没有剩余任务时标记为已取空
+func (q *taskQueue) drain() []*job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var jobs []*job
+	for j := q.takeLocked(); j != nil; j = q.takeLocked() {
+		jobs = append(jobs, j)
+	}
+	if len(jobs) == 0 && q.closed {
+		q.drained = true
+	}
+	return jobs
+}
@@ -0,0 +1,124 @@
+package hotswap
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPriorityLatencyUnderSaturation 低优先级任务积压时，高优先级任务的排队时间不超过一个任务的执行时间
+func TestPriorityLatencyUnderSaturation(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 4, QueueSize: 5000, Aging: -1, OnError: func(error) {}})
+	wp.Start()
+	defer func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		wp.Stop(ctx)
+	}()
+
+	// 约 2.5 秒的积压
+	for i := 0; i < 5000; i++ {
+		if !wp.TrySubmitPriority(TaskFunc(func() { time.Sleep(2 * time.Millisecond) }), PriorityLow) {
+			t.Fatal("low priority queue full")
+		}
+	}
+
+	measure := func(p Priority, n int) []time.Duration {
+		waits := make([]time.Duration, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			submitted := time.Now()
+			wp.SubmitPriority(TaskFunc(func() {
+				waits[i] = time.Since(submitted)
+				wg.Done()
+			}), p)
+			time.Sleep(5 * time.Millisecond)
+		}
+		wg.Wait()
+		sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+		return waits
+	}
+	high := measure(PriorityHigh, 20)
+	if p99 := high[len(high)*99/100]; p99 > 50*time.Millisecond {
+		t.Fatalf("high priority queue wait p99 %v under saturation (%v)", p99, high)
+	}
+	if wp.QueueSize() < 4000 {
+		t.Fatalf("backlog drained to %d while measuring, saturation too short", wp.QueueSize())
+	}
+	t.Logf("high priority wait p50 %v p99 %v, backlog %d", high[len(high)/2], high[len(high)*99/100], wp.QueueSize())
+}
+
+// TestPriorityAging 高优先级任务持续积压时，等待足够久的低优先级任务仍能执行
+func TestPriorityAging(t *testing.T) {
+	for _, tc := range []struct {
+		aging   time.Duration
+		maxRank int
+	}{
+		{aging: 20 * time.Millisecond, maxRank: 25},
+		{aging: -1, maxRank: 50},
+	} {
+		wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 100, Aging: tc.aging})
+		wp.Start()
+		release := blockWorkers(t, wp, 1)
+
+		var order atomic.Int32
+		var lowRank int32
+		wp.SubmitPriority(TaskFunc(func() { lowRank = order.Add(1) }), PriorityLow)
+		for i := 0; i < 50; i++ {
+			wp.SubmitPriority(TaskFunc(func() {
+				order.Add(1)
+				time.Sleep(5 * time.Millisecond)
+			}), PriorityHigh)
+		}
+		close(release)
+		wp.Stop(context.Background())
+
+		if tc.aging > 0 && lowRank > int32(tc.maxRank) {
+			t.Fatalf("aging %v: low priority task ran %dth of 51", tc.aging, lowRank)
+		}
+		if tc.aging < 0 && lowRank != 51 {
+			t.Fatalf("without aging the low priority task ran %dth of 51", lowRank)
+		}
+	}
+}
+
+func TestPriorityCapacity(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 2, PriorityQueues: map[Priority]int{PriorityHigh: 1}})
+	wp.Start()
+	release := blockWorkers(t, wp, 1)
+
+	var ran atomic.Int32
+	task := TaskFunc(func() { ran.Add(1) })
+	for i, want := range []bool{true, true, false} {
+		if got := wp.TrySubmitPriority(task, PriorityLow); got != want {
+			t.Fatalf("low #%d accepted=%v", i, got)
+		}
+	}
+	// 低优先级队列已满不影响其他优先级
+	if !wp.TrySubmitPriority(task, PriorityHigh) || wp.TrySubmitPriority(task, PriorityHigh) {
+		t.Fatal("high priority capacity is not 1")
+	}
+	if !wp.TrySubmit(task) {
+		t.Fatal("normal priority rejected")
+	}
+	if wp.SubmitWithTimeoutPriority(task, PriorityLow, 10*time.Millisecond) {
+		t.Fatal("SubmitWithTimeoutPriority accepted a task into a full queue")
+	}
+
+	// 缩小队列不丢弃已入队的任务
+	if err := wp.UpdateQueueSize(1); err != nil {
+		t.Fatal(err)
+	}
+	if wp.QueueSize() != 4 {
+		t.Fatalf("queue size %d after shrinking, want 4", wp.QueueSize())
+	}
+	close(release)
+	wp.Stop(context.Background())
+	if ran.Load() != 4 {
+		t.Fatalf("%d of 4 queued tasks ran", ran.Load())
+	}
+}
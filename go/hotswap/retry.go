@@ -0,0 +1,255 @@
+package hotswap
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// 重试
+// 任务失败后按 RetryPolicy 等待一段时间再放回队列：等待中的任务放在延迟队列（按到期时间排列的堆）中，
+// 由一个协程在到期时放回原优先级的队列，不占用 worker。只有最后一次失败交给 Future、OnError 与死信存储，
+// 每次执行前后都会调用 BeforeTask/AfterTask（TaskInfo.Attempt 为第几次执行）。
+// 提交时的 ctx 或工作池的 ctx 取消后不再重试；Stop 时等待中的重试不再执行，以最后一次的错误结束。
+
+// RetryPolicy 重试策略，零值字段使用默认值
+// 第 n 次重试前等待 Backoff*Multiplier^(n-1)，最多 MaxBackoff，再随机减少最多 Jitter 的比例，避免同时失败的任务同时重试
+type RetryPolicy struct {
+	MaxAttempts int           // 最多执行次数（包括第一次），默认3，1表示不重试
+	Backoff     time.Duration // 第一次重试前的等待时间，默认100毫秒
+	MaxBackoff  time.Duration // 等待时间的上限，默认30秒
+	Multiplier  float64       // 每次重试等待时间的倍数，默认2
+	Jitter      float64       // 随机减少等待时间的最大比例（0-1），0表示默认0.2，小于0表示不抖动
+
+	// Retryable 判断错误是否可以重试，为nil时除 panic（*PanicError）外的错误都重试
+	Retryable func(err error) bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = 2
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.2
+	}
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	return p
+}
+
+// retryable 错误是否可以重试
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	var pe *PanicError
+	return !errors.As(err, &pe)
+}
+
+// delay 第 attempt 次执行失败后的等待时间
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.Backoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	d = min(d, float64(p.MaxBackoff))
+	d -= d * p.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// WithRetry 设置任务的重试策略，覆盖 Config.Retry；WithRetry(RetryPolicy{MaxAttempts: 1}) 表示不重试
+func WithRetry(p RetryPolicy) TaskOption {
+	p = p.withDefaults()
+	return func(j *job) { j.retry = &p }
+}
+
+// delayHeap 按到期时间排列的任务
+type delayHeap []*job
+
+func (h delayHeap) Len() int           { return len(h) }
+func (h delayHeap) Less(i, k int) bool { return h[i].due.Before(h[k].due) }
+func (h delayHeap) Swap(i, k int)      { h[i], h[k] = h[k], h[i] }
+func (h *delayHeap) Push(x any)        { *h = append(*h, x.(*job)) }
+func (h *delayHeap) Pop() any {
+	old := *h
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return j
+}
+
+// delayQueue 等待重试的任务，到期后由 retryLoop 放回队列
+// wake: 加入比当前最早的更早到期的任务或关闭时通知 retryLoop
+type delayQueue struct {
+	mu     sync.Mutex
+	jobs   delayHeap
+	wake   chan struct{}
+	closed bool
+}
+
+func newDelayQueue() *delayQueue {
+	return &delayQueue{wake: make(chan struct{}, 1)}
+}
+
+// push 加入在 due 到期的任务，已关闭时返回 false
+func (d *delayQueue) push(j *job, due time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	j.due = due
+	heap.Push(&d.jobs, j)
+	if d.jobs[0] == j {
+		d.notify()
+	}
+	return true
+}
+
+func (d *delayQueue) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// popDue 取出 now 之前到期的任务，并返回下一个任务的到期时间（没有时为零值）；已关闭时 ok 为 false
+func (d *delayQueue) popDue(now time.Time) (due []*job, next time.Time, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, time.Time{}, false
+	}
+	for len(d.jobs) > 0 && !d.jobs[0].due.After(now) {
+		due = append(due, heap.Pop(&d.jobs).(*job))
+	}
+	if len(d.jobs) > 0 {
+		next = d.jobs[0].due
+	}
+	return due, next, true
+}
+
+// len 等待重试的任务数
+func (d *delayQueue) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.jobs)
+}
+
+// close 不再接受任务，返回剩余的任务
+func (d *delayQueue) close() []*job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	d.notify()
+	jobs := d.jobs
+	d.jobs = nil
+	return jobs
+}
+
+// retryLater 任务执行失败后按重试策略放入延迟队列，不重试时返回 false
+func (wp *WorkerPool) retryLater(j *job, err error) bool {
+	p := j.retry
+	if p == nil {
+		p = wp.retry
+	}
+	if p == nil || j.attempt >= p.MaxAttempts || !p.retryable(err) {
+		return false
+	}
+	if wp.ctx.Err() != nil || (j.ctx != nil && j.ctx.Err() != nil) {
+		return false
+	}
+	j.lastErr = err
+	if !wp.retries.push(j, time.Now().Add(p.delay(j.attempt))) {
+		return false
+	}
+	wp.stats.retried.Add(1)
+	return true
+}
+
+// retryLoop 把到期的重试放回队列，直到延迟队列关闭
+func (wp *WorkerPool) retryLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, next, ok := wp.retries.popDue(time.Now())
+		if !ok {
+			return
+		}
+		for _, j := range due {
+			wp.requeue(j)
+		}
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			fire = timer.C
+		}
+		select {
+		case <-fire:
+		case <-wp.retries.wake:
+		}
+	}
+}
+
+// requeue 把到期的重试放回原优先级的队列；队列已满时在新的协程中等待空位，不阻塞其它重试。
+// 占用 key 名额的任务不等待空位，见 taskQueue.pushRetry
+func (wp *WorkerPool) requeue(j *job) {
+	if j.keyHeld {
+		if !wp.queue.pushRetry(j) {
+			wp.failJob(j, j.lastErr)
+		}
+		return
+	}
+	space, err := wp.queue.tryPush(j)
+	switch err {
+	case nil:
+	case ErrQueueFull:
+		wp.queue.cancelWait(space)
+		go wp.requeueWait(j)
+	default:
+		wp.failJob(j, j.lastErr)
+	}
+}
+
+// requeueWait 等待队列有空位后放回任务；提交时的 ctx（没有时为工作池的 ctx）取消或工作池停止时以最后一次的错误结束
+func (wp *WorkerPool) requeueWait(j *job) {
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = wp.ctx
+	}
+	for {
+		space, err := wp.queue.tryPush(j)
+		if err == nil {
+			return
+		}
+		if err != ErrQueueFull {
+			wp.failJob(j, j.lastErr)
+			return
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			wp.queue.cancelWait(space)
+			wp.failJob(j, j.lastErr)
+			return
+		}
+	}
+}
+
+// stopRetries 关闭延迟队列，等待中的重试以最后一次的错误结束
+func (wp *WorkerPool) stopRetries() {
+	for _, j := range wp.retries.close() {
+		wp.failJob(j, j.lastErr)
+	}
+}
@@ -0,0 +1,174 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Jitter: -1}.withDefaults()
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if d := p.delay(i + 1); d != w*time.Millisecond {
+			t.Fatalf("delay(%d) = %v, want %v", i+1, d, w*time.Millisecond)
+		}
+	}
+	p = RetryPolicy{Backoff: 100 * time.Millisecond, Jitter: 0.5}.withDefaults()
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("jittered delay %v out of [50ms, 100ms]", d)
+		}
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []int
+	wp := NewWorkerPool(Config{
+		MinWorkers: 1,
+		Retry:      &RetryPolicy{MaxAttempts: 3, Backoff: 20 * time.Millisecond, Jitter: -1},
+		AfterTask: func(info TaskInfo, err error) {
+			mu.Lock()
+			attempts = append(attempts, info.Attempt)
+			mu.Unlock()
+		},
+	})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	var n atomic.Int32
+	start := time.Now()
+	f, err := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		if n.Add(1) < 3 {
+			return 0, errors.New("transient")
+		}
+		return 7, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f.Wait(context.Background()); v != 7 || err != nil {
+		t.Fatalf("Wait = %d, %v", v, err)
+	}
+	// 等待 20ms + 40ms
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Fatalf("succeeded after %v, backoff not applied", d)
+	}
+	s := wp.Stats()
+	if s.Retried != 2 || s.Completed != 1 || s.Failed != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Fatalf("AfterTask attempts = %v", attempts)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	errs := make(chan error, 10)
+	wp := NewWorkerPool(Config{MinWorkers: 2, OnError: func(err error) { errs <- err }})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	errPermanent := errors.New("permanent")
+	var calls atomic.Int32
+	fail := ContextTaskFunc(func(context.Context) error {
+		if calls.Add(1) == 1 {
+			return errors.New("transient")
+		}
+		return errPermanent
+	})
+	// 不可重试的错误立即结束
+	retry := WithRetry(RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond, Retryable: func(err error) bool {
+		return !errors.Is(err, errPermanent)
+	}})
+	wp.SubmitContext(context.Background(), fail, retry)
+	if err := <-errs; !errors.Is(err, errPermanent) || calls.Load() != 2 {
+		t.Fatalf("final error %v after %d calls", err, calls.Load())
+	}
+
+	// 用完次数后只报告最后一次的错误
+	calls.Store(0)
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error {
+		calls.Add(1)
+		return errors.New("always")
+	}), WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	if err := <-errs; err.Error() != "always" || calls.Load() != 3 {
+		t.Fatalf("final error %v after %d calls", err, calls.Load())
+	}
+
+	// panic 默认不重试
+	calls.Store(0)
+	wp.Submit(TaskFunc(func() {
+		calls.Add(1)
+		panic("bug")
+	}))
+	var pe *PanicError
+	if err := <-errs; !errors.As(err, &pe) || calls.Load() != 1 {
+		t.Fatalf("panic: %v after %d calls", err, calls.Load())
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected error %v", err)
+	default:
+	}
+}
+
+func TestRetryDoesNotHoldWorker(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	retried := make(chan time.Time, 1)
+	var n atomic.Int32
+	f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		if n.Add(1) == 1 {
+			return 0, errors.New("transient")
+		}
+		retried <- time.Now()
+		return 0, nil
+	}, WithRetry(RetryPolicy{Backoff: 100 * time.Millisecond, Jitter: -1}))
+
+	// 唯一的 worker 在等待重试期间执行其它任务
+	other, _ := SubmitFuture(wp, context.Background(), func(context.Context) (time.Time, error) {
+		return time.Now(), nil
+	})
+	ran, _ := other.Wait(context.Background())
+	f.Wait(context.Background())
+	if at := <-retried; !ran.Before(at) {
+		t.Fatal("other task waited for the retry backoff")
+	}
+}
+
+func TestStopEndsPendingRetries(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1})
+	wp.Start()
+
+	errTransient := errors.New("transient")
+	attempted := make(chan struct{})
+	f, _ := SubmitFuture(wp, context.Background(), func(context.Context) (int, error) {
+		close(attempted)
+		return 0, errTransient
+	}, WithRetry(RetryPolicy{Backoff: time.Hour}))
+	<-attempted
+	for wp.Stats().Retrying != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := wp.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Wait(ctx); !errors.Is(err, errTransient) {
+		t.Fatalf("pending retry ended with %v", err)
+	}
+	if s := wp.Stats(); s.Failed != 1 || s.Retrying != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
@@ -0,0 +1,378 @@
+package hotswap
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 定时任务
+// Scheduler 把延迟执行、固定间隔与 cron 表达式的任务按下一次执行时间放在堆中，由一个协程等待最早到期的任务，
+// 到期后以非阻塞方式提交到 WorkerPool（同 TrySubmit，队列已满时本次不执行，计入 Rejected），不为每个任务启动协程。
+// 执行时间晚于计划时间超过 Grace 视为错过（如进程暂停、系统休眠、Start 之前已到期），按 MissedRunPolicy 处理。
+
+// ErrSchedulerStopped 调度器已停止
+var ErrSchedulerStopped = errors.New("scheduler is stopped")
+
+// maxSchedulerSleep 调度协程单次最长等待时间，系统休眠或调整时钟后也能及时检查到期的任务
+const maxSchedulerSleep = time.Minute
+
+// maxCatchUp 一次检查中每个任务最多处理的错过次数，超过后直接跳到下一次执行时间
+const maxCatchUp = 1000
+
+// MissedRunPolicy 错过执行时间的处理方式
+type MissedRunPolicy int
+
+const (
+	MissedRunOnce MissedRunPolicy = iota // 错过的多次合并为立即执行一次（默认）
+	MissedRunAll                         // 每次错过的都补执行
+	MissedRunSkip                        // 跳过错过的，等下一次执行时间
+)
+
+// ScheduleID 定时任务的编号
+type ScheduleID int64
+
+// SchedulerConfig 调度器配置
+type SchedulerConfig struct {
+	Location  *time.Location  // cron 表达式使用的时区，默认 time.Local
+	Grace     time.Duration   // 晚于计划时间超过 Grace 视为错过，默认1秒
+	MissedRun MissedRunPolicy // 默认的错过处理方式，单个任务用 WithMissedRun 设置
+}
+
+// ScheduledTask 定时任务的状态
+type ScheduledTask struct {
+	ID       ScheduleID
+	Name     string
+	Spec     string    // cron 表达式、"@every 间隔" 或 "@at 时间"
+	Next     time.Time // 下一次执行时间
+	Prev     time.Time // 上一次提交的时间
+	Runs     int64     // 提交到工作池的次数
+	Missed   int64     // 错过且没有补执行的次数（包括合并的）
+	Rejected int64     // 因工作池队列已满没有提交的次数
+}
+
+// ScheduleOption 添加定时任务时的可选设置
+type ScheduleOption func(*scheduleEntry)
+
+// WithScheduleName 设置任务名称，用于 List 与日志
+func WithScheduleName(name string) ScheduleOption {
+	return func(e *scheduleEntry) { e.info.Name = name }
+}
+
+// WithMissedRun 设置错过执行时间的处理方式，覆盖 SchedulerConfig.MissedRun
+func WithMissedRun(p MissedRunPolicy) ScheduleOption {
+	return func(e *scheduleEntry) { e.missed = p }
+}
+
+// WithTaskOptions 设置每次提交任务时的选项，如 WithPriority、WithRetry
+func WithTaskOptions(opts ...TaskOption) ScheduleOption {
+	return func(e *scheduleEntry) { e.taskOpts = append(e.taskOpts, opts...) }
+}
+
+// scheduleEntry 一个定时任务
+// schedule 为nil时只执行一次；index 为在堆中的位置
+type scheduleEntry struct {
+	info     ScheduledTask
+	schedule Schedule
+	task     ContextTask
+	taskOpts []TaskOption
+	missed   MissedRunPolicy
+	index    int
+}
+
+// scheduleHeap 按下一次执行时间排列的定时任务
+type scheduleHeap []*scheduleEntry
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, k int) bool { return h[i].info.Next.Before(h[k].info.Next) }
+func (h scheduleHeap) Swap(i, k int) {
+	h[i], h[k] = h[k], h[i]
+	h[i].index, h[k].index = i, k
+}
+func (h *scheduleHeap) Push(x any) {
+	e := x.(*scheduleEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// Scheduler 定时把任务提交到 WorkerPool 的调度器
+type Scheduler struct {
+	pool   *WorkerPool
+	loc    *time.Location
+	grace  time.Duration
+	missed MissedRunPolicy
+
+	mu      sync.Mutex
+	entries scheduleHeap
+	byID    map[ScheduleID]*scheduleEntry
+	lastID  ScheduleID
+	started bool
+	stopped bool
+	wake    chan struct{} // 加入更早到期的任务时通知调度协程
+	stop    chan struct{}
+	done    chan struct{} // 调度协程已退出
+}
+
+// NewScheduler 创建把任务提交到 pool 的调度器，Start 后开始调度
+func NewScheduler(pool *WorkerPool, config SchedulerConfig) *Scheduler {
+	if config.Location == nil {
+		config.Location = time.Local
+	}
+	if config.Grace <= 0 {
+		config.Grace = time.Second
+	}
+	return &Scheduler{
+		pool:   pool,
+		loc:    config.Location,
+		grace:  config.Grace,
+		missed: config.MissedRun,
+		byID:   make(map[ScheduleID]*scheduleEntry),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start 启动调度协程；Start 之前添加且已到期的任务按错过处理
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	go s.loop()
+}
+
+// Stop 停止调度，不再提交任务，已提交到工作池的任务不受影响；工作池停止时调度器随之停止
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	started := s.started
+	close(s.stop)
+	s.mu.Unlock()
+	if started {
+		<-s.done
+	}
+}
+
+// After 在 d 之后执行一次 task
+func (s *Scheduler) After(d time.Duration, task ContextTask, opts ...ScheduleOption) (ScheduleID, error) {
+	at := time.Now().Add(d)
+	return s.add("@after "+d.String(), nil, at, task, opts)
+}
+
+// At 在 t 时执行一次 task，t 已过去时按错过处理
+func (s *Scheduler) At(t time.Time, task ContextTask, opts ...ScheduleOption) (ScheduleID, error) {
+	return s.add("@at "+t.Format(time.RFC3339), nil, t, task, opts)
+}
+
+// Every 每隔 interval 执行一次 task，第一次在 interval 之后
+func (s *Scheduler) Every(interval time.Duration, task ContextTask, opts ...ScheduleOption) (ScheduleID, error) {
+	if interval <= 0 {
+		return 0, fmt.Errorf("interval must be positive")
+	}
+	return s.add("@every "+interval.String(), everySchedule(interval), time.Now().Add(interval), task, opts)
+}
+
+// Cron 按 cron 表达式（见 CronSchedule）执行 task，使用 SchedulerConfig.Location 的时区
+func (s *Scheduler) Cron(spec string, task ContextTask, opts ...ScheduleOption) (ScheduleID, error) {
+	c, err := ParseCron(spec)
+	if err != nil {
+		return 0, err
+	}
+	return s.Schedule(spec, c, task, opts...)
+}
+
+// Schedule 按自定义的时间表执行 task，spec 用于 List 显示
+func (s *Scheduler) Schedule(spec string, schedule Schedule, task ContextTask, opts ...ScheduleOption) (ScheduleID, error) {
+	next := schedule.Next(time.Now().In(s.loc))
+	if next.IsZero() {
+		return 0, fmt.Errorf("schedule %q never runs", spec)
+	}
+	return s.add(spec, schedule, next, task, opts)
+}
+
+func (s *Scheduler) add(spec string, schedule Schedule, next time.Time, task ContextTask, opts []ScheduleOption) (ScheduleID, error) {
+	e := &scheduleEntry{
+		info:     ScheduledTask{Spec: spec, Next: next},
+		schedule: schedule,
+		task:     task,
+		missed:   s.missed,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return 0, ErrSchedulerStopped
+	}
+	s.lastID++
+	e.info.ID = s.lastID
+	s.byID[e.info.ID] = e
+	heap.Push(&s.entries, e)
+	if e.index == 0 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return e.info.ID, nil
+}
+
+// Cancel 取消定时任务，任务不存在（包括一次性任务已执行）时返回 false；已提交的执行不受影响
+func (s *Scheduler) Cancel(id ScheduleID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.entries, e.index)
+	delete(s.byID, id)
+	return true
+}
+
+// List 返回所有定时任务的状态，按下一次执行时间排序
+func (s *Scheduler) List() []ScheduledTask {
+	s.mu.Lock()
+	list := make([]ScheduledTask, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e.info)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].Next.Before(list[k].Next) })
+	return list
+}
+
+// loop 等待最早到期的任务，直到调度器或工作池停止
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	timer := time.NewTimer(maxSchedulerSleep)
+	defer timer.Stop()
+	for {
+		wait := maxSchedulerSleep
+		if next := s.runDue(time.Now()); !next.IsZero() {
+			wait = min(wait, time.Until(next))
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.stop:
+			return
+		case <-s.pool.ctx.Done():
+			s.mu.Lock()
+			s.stopped = true
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// scheduledRun 一次到期的提交
+type scheduledRun struct {
+	entry *scheduleEntry
+	times int
+}
+
+// runDue 提交 now 之前到期的任务，返回下一个任务的执行时间（没有时为零值）
+func (s *Scheduler) runDue(now time.Time) time.Time {
+	s.mu.Lock()
+	var runs []scheduledRun
+	for len(s.entries) > 0 && !s.entries[0].info.Next.After(now) {
+		e := s.entries[0]
+		times, missed, next := s.advance(e, now)
+		e.info.Missed += missed
+		if times > 0 {
+			runs = append(runs, scheduledRun{e, times})
+		}
+		if next.IsZero() {
+			heap.Pop(&s.entries)
+			delete(s.byID, e.info.ID)
+		} else {
+			e.info.Next = next
+			heap.Fix(&s.entries, 0)
+		}
+	}
+	var next time.Time
+	if len(s.entries) > 0 {
+		next = s.entries[0].info.Next
+	}
+	s.mu.Unlock()
+
+	// 提交可能写入死信存储，不持有锁
+	for _, r := range runs {
+		var submitted, rejected int64
+		for i := 0; i < r.times; i++ {
+			err := s.pool.enqueue(context.Background(), newJob(nil, r.entry.task, r.entry.taskOpts), false)
+			switch {
+			case err == nil:
+				submitted++
+			case errors.Is(err, ErrQueueFull):
+				rejected++
+			default:
+				log.Printf("Scheduled task %d %q not submitted: %v", r.entry.info.ID, r.entry.info.Name, err)
+			}
+		}
+		if rejected > 0 {
+			log.Printf("Scheduled task %d %q: %d runs rejected, queue is full", r.entry.info.ID, r.entry.info.Name, rejected)
+		}
+		s.mu.Lock()
+		r.entry.info.Runs += submitted
+		r.entry.info.Rejected += rejected
+		if submitted > 0 {
+			r.entry.info.Prev = now
+		}
+		s.mu.Unlock()
+	}
+	return next
+}
+
+// advance 计算到期任务在 now 之前应执行的次数、错过的次数与下一次执行时间，需持有 s.mu
+func (s *Scheduler) advance(e *scheduleEntry, now time.Time) (times int, missed int64, next time.Time) {
+	t := e.info.Next
+	for n := 0; !t.IsZero() && !t.After(now); n++ {
+		if n == maxCatchUp {
+			// 错过太多次，剩余的不再逐次计算
+			missed++
+			t = e.schedule.Next(now.In(s.loc))
+			break
+		}
+		switch {
+		case now.Sub(t) <= s.grace:
+			times++
+		case e.missed == MissedRunAll:
+			times++
+		default:
+			missed++
+		}
+		if e.schedule == nil {
+			t = time.Time{}
+			break
+		}
+		t = e.schedule.Next(t.In(s.loc))
+	}
+	if e.missed == MissedRunOnce && times == 0 && missed > 0 {
+		times, missed = 1, missed-1
+	}
+	return times, missed, t
+}
@@ -0,0 +1,154 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 2})
+	wp.Start()
+	defer wp.Stop(context.Background())
+	s := NewScheduler(wp, SchedulerConfig{})
+	s.Start()
+	defer s.Stop()
+
+	once := make(chan time.Time, 1)
+	start := time.Now()
+	onceID, err := s.After(20*time.Millisecond, ContextTaskFunc(func(context.Context) error {
+		once <- time.Now()
+		return nil
+	}), WithScheduleName("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ticks atomic.Int32
+	everyID, _ := s.Every(10*time.Millisecond, ContextTaskFunc(func(context.Context) error {
+		ticks.Add(1)
+		return nil
+	}), WithScheduleName("tick"))
+	if _, err := s.Cron("0 2 * * *", ContextTaskFunc(func(context.Context) error { return nil })); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Cron("0 25 * * *", ContextTaskFunc(func(context.Context) error { return nil })); err == nil {
+		t.Fatal("invalid cron expression accepted")
+	}
+	if list := s.List(); len(list) != 3 || list[0].Name != "tick" || list[1].Name != "once" || list[2].Spec != "0 2 * * *" {
+		t.Fatalf("List = %+v", list)
+	}
+
+	if at := <-once; at.Sub(start) < 20*time.Millisecond {
+		t.Fatalf("After(20ms) ran after %v", at.Sub(start))
+	}
+	for ticks.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.Cancel(everyID) {
+		t.Fatal("Cancel of a recurring task failed")
+	}
+	n := ticks.Load()
+	time.Sleep(50 * time.Millisecond)
+	// 取消前已提交的一次可能仍在执行
+	if got := ticks.Load(); got > n+1 {
+		t.Fatalf("%d ticks after Cancel", got-n)
+	}
+	if s.Cancel(onceID) {
+		t.Fatal("Cancel of an executed one-shot task succeeded")
+	}
+	if list := s.List(); len(list) != 1 {
+		t.Fatalf("List after cancel = %+v", list)
+	}
+}
+
+func TestSchedulerMissedRuns(t *testing.T) {
+	for _, tt := range []struct {
+		policy       MissedRunPolicy
+		runs, missed int64
+		oneShotRuns  bool
+	}{
+		{MissedRunOnce, 1, 2, true},
+		{MissedRunAll, 3, 0, true},
+		{MissedRunSkip, 0, 3, false},
+	} {
+		wp := NewWorkerPool(Config{MinWorkers: 1})
+		wp.Start()
+		var ran atomic.Int32
+		task := ContextTaskFunc(func(context.Context) error {
+			ran.Add(1)
+			return nil
+		})
+		// 不启动调度协程，直接用 runDue 模拟3个半小时后才检查
+		s := NewScheduler(wp, SchedulerConfig{MissedRun: tt.policy})
+		start := time.Now()
+		id, _ := s.Every(time.Hour, task)
+		s.At(start.Add(-time.Minute), task)
+		next := s.runDue(start.Add(3*time.Hour + 30*time.Minute))
+		wp.Stop(context.Background())
+
+		list := s.List()
+		if len(list) != 1 || list[0].ID != id {
+			t.Fatalf("policy %d: List = %+v", tt.policy, list)
+		}
+		e := list[0]
+		if d := next.Sub(start); e.Runs != tt.runs || e.Missed != tt.missed || !e.Next.Equal(next) || d < 4*time.Hour || d > 4*time.Hour+time.Second {
+			t.Errorf("policy %d: runs %d missed %d next %v, want %d %d %v", tt.policy, e.Runs, e.Missed, e.Next, tt.runs, tt.missed, start.Add(4*time.Hour))
+		}
+		want := int32(tt.runs)
+		if tt.oneShotRuns {
+			want++
+		}
+		if ran.Load() != want {
+			t.Errorf("policy %d: %d runs executed, want %d", tt.policy, ran.Load(), want)
+		}
+	}
+
+	// 在 Grace 内不算错过
+	wp := NewWorkerPool(Config{MinWorkers: 1})
+	s := NewScheduler(wp, SchedulerConfig{MissedRun: MissedRunSkip})
+	start := time.Now()
+	s.Every(time.Hour, ContextTaskFunc(func(context.Context) error { return nil }))
+	s.runDue(start.Add(time.Hour + 500*time.Millisecond))
+	if e := s.List()[0]; e.Runs != 1 || e.Missed != 0 {
+		t.Fatalf("on-time run: %+v", e)
+	}
+}
+
+func TestSchedulerRejected(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 1})
+	wp.Start()
+	defer wp.Stop(context.Background())
+	release := blockWorkers(t, wp, 1)
+	defer close(release)
+
+	s := NewScheduler(wp, SchedulerConfig{MissedRun: MissedRunAll})
+	start := time.Now()
+	s.Every(time.Minute, ContextTaskFunc(func(context.Context) error { return nil }))
+	s.runDue(start.Add(3*time.Minute + time.Second))
+	if e := s.List()[0]; e.Runs != 1 || e.Rejected != 2 {
+		t.Fatalf("runs %d rejected %d, want 1 and 2", e.Runs, e.Rejected)
+	}
+	if r := wp.Stats().Rejected; r != 2 {
+		t.Fatalf("pool rejected %d", r)
+	}
+}
+
+func TestSchedulerStopsWithPool(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1})
+	wp.Start()
+	s := NewScheduler(wp, SchedulerConfig{})
+	s.Start()
+	s.Every(time.Hour, ContextTaskFunc(func(context.Context) error { return nil }))
+	wp.Stop(context.Background())
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler still running after the pool stopped")
+	}
+	if _, err := s.After(time.Second, ContextTaskFunc(func(context.Context) error { return nil })); !errors.Is(err, ErrSchedulerStopped) {
+		t.Fatalf("After on a stopped scheduler: %v", err)
+	}
+	s.Stop()
+}
@@ -0,0 +1,244 @@
+package hotswap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 统计
+// 计数器与延迟直方图都是原子操作，Stats 随时可以调用；分位数由直方图估算，取所在桶的上界。
+
+// histBuckets 延迟直方图的桶上界：50微秒起每级翻倍，约到 210 秒，之后为溢出桶
+var histBuckets = func() []time.Duration {
+	b := make([]time.Duration, 23)
+	for i := range b {
+		b[i] = 50 * time.Microsecond << i
+	}
+	return b
+}()
+
+// histogram 延迟直方图
+type histogram struct {
+	counts [24]atomic.Int64 // 比 histBuckets 多一个溢出桶
+	count  atomic.Int64
+	sum    atomic.Int64 // 纳秒
+	max    atomic.Int64 // 纳秒
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histBuckets) && d > histBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+	for {
+		m := h.max.Load()
+		if int64(d) <= m || h.max.CompareAndSwap(m, int64(d)) {
+			return
+		}
+	}
+}
+
+// LatencyStats 延迟的统计，分位数为估算值
+type LatencyStats struct {
+	Count int64
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func (h *histogram) snapshot() LatencyStats {
+	var counts [24]int64
+	var total int64
+	for i := range counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	s := LatencyStats{Count: total, Max: time.Duration(h.max.Load())}
+	if total == 0 {
+		return s
+	}
+	s.Mean = time.Duration(h.sum.Load() / max(h.count.Load(), 1))
+	quantile := func(q float64) time.Duration {
+		rank := int64(q*float64(total-1)) + 1
+		var seen int64
+		for i, c := range counts {
+			seen += c
+			if seen >= rank {
+				if i < len(histBuckets) {
+					return min(histBuckets[i], s.Max)
+				}
+				return s.Max
+			}
+		}
+		return s.Max
+	}
+	s.P50, s.P90, s.P99 = quantile(0.5), quantile(0.9), quantile(0.99)
+	return s
+}
+
+// poolStats 工作池的累计计数
+type poolStats struct {
+	submitted  atomic.Int64 // 进入队列的任务数
+	completed  atomic.Int64 // 执行成功的任务数
+	failed     atomic.Int64 // 返回错误或 panic 的任务数
+	panicked   atomic.Int64 // panic 的任务数，同时计入 failed
+	rejected   atomic.Int64 // 因队列已满被拒绝的提交数
+	dropped    atomic.Int64 // 没有执行就被丢弃的任务数
+	retried    atomic.Int64 // 失败后安排重试的次数
+	inFlight   atomic.Int32 // 执行中的任务数
+	keyPending atomic.Int64 // 等待 key 名额的任务数
+	wait       histogram    // 排队时间，任务开始执行时记录
+	exec       histogram    // 执行时间，任务结束时记录
+}
+
+// Stats 工作池状态的快照
+type Stats struct {
+	Submitted int64 // 进入队列的任务数
+	Completed int64 // 执行成功的任务数
+	Failed    int64 // 返回错误或 panic 的任务数
+	Panicked  int64 // panic 的任务数，同时计入 Failed
+	Rejected  int64 // 因队列已满被拒绝的提交数（TrySubmit 失败、SubmitWithTimeout 超时等）
+	Dropped   int64 // 没有执行就被丢弃的任务数（排队期间取消、工作池停止等）
+	Retried   int64 // 失败后安排重试的次数，重试的任务只在最后一次计入 Completed 或 Failed
+
+	InFlight int                // 执行中的任务数
+	Queued   [numPriorities]int // 各优先级排队中的任务数，下标为 Priority
+	Retrying int                // 在延迟队列中等待重试的任务数
+	KeyWait  int                // 等待同一 key 的任务结束的任务数，不占用 worker，但计入所在优先级的队列容量
+	Workers  int                // 运行中的 worker 数
+
+	QueueWait LatencyStats // 排队时间
+	Exec      LatencyStats // 执行时间
+}
+
+// QueuedTotal 所有优先级排队中的任务数
+func (s Stats) QueuedTotal() int {
+	n := 0
+	for _, q := range s.Queued {
+		n += q
+	}
+	return n
+}
+
+// Stats 返回工作池状态的快照
+func (wp *WorkerPool) Stats() Stats {
+	wp.stateMutex.Lock()
+	workers := len(wp.workerSet)
+	wp.stateMutex.Unlock()
+	return Stats{
+		Submitted: wp.stats.submitted.Load(),
+		Completed: wp.stats.completed.Load(),
+		Failed:    wp.stats.failed.Load(),
+		Panicked:  wp.stats.panicked.Load(),
+		Rejected:  wp.stats.rejected.Load(),
+		Dropped:   wp.stats.dropped.Load(),
+		Retried:   wp.stats.retried.Load(),
+		InFlight:  int(wp.stats.inFlight.Load()),
+		Queued:    wp.queue.lens(),
+		Retrying:  wp.retries.len(),
+		KeyWait:   int(wp.stats.keyPending.Load()),
+		Workers:   workers,
+		QueueWait: wp.stats.wait.snapshot(),
+		Exec:      wp.stats.exec.snapshot(),
+	}
+}
+
+// TaskInfo 传给 Config.BeforeTask/AfterTask 的任务信息
+type TaskInfo struct {
+	Priority Priority
+	Enqueued time.Time     // 入队时间
+	Wait     time.Duration // 排队时间
+	Duration time.Duration // 执行时间，只在 AfterTask 中有效
+	Attempt  int           // 第几次执行，重试时大于1
+}
+
+// callHook 调用钩子，钩子 panic 时记录日志，不影响 worker
+func (wp *WorkerPool) callHook(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Task hook panicked: %v", r)
+		}
+	}()
+	f()
+}
+
+// WritePrometheus 以 Prometheus 文本格式输出工作池的指标，pool 为 pool 标签的值
+func (wp *WorkerPool) WritePrometheus(w io.Writer, pool string) error {
+	s := wp.Stats()
+	label := fmt.Sprintf("pool=%q", pool)
+	var err error
+	metric := func(name, typ, help string, value any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %v\n", name, help, name, typ, name, label, value)
+		}
+	}
+	metric("hotswap_pool_tasks_submitted_total", "counter", "Tasks accepted into the queue.", s.Submitted)
+	metric("hotswap_pool_tasks_completed_total", "counter", "Tasks that returned without error.", s.Completed)
+	metric("hotswap_pool_tasks_failed_total", "counter", "Tasks that returned an error or panicked.", s.Failed)
+	metric("hotswap_pool_tasks_panicked_total", "counter", "Tasks that panicked.", s.Panicked)
+	metric("hotswap_pool_tasks_rejected_total", "counter", "Submissions rejected because the queue was full.", s.Rejected)
+	metric("hotswap_pool_tasks_dropped_total", "counter", "Tasks dropped without being executed.", s.Dropped)
+	metric("hotswap_pool_tasks_retried_total", "counter", "Retries scheduled after a failed attempt.", s.Retried)
+	metric("hotswap_pool_tasks_in_flight", "gauge", "Tasks currently executing.", s.InFlight)
+	metric("hotswap_pool_tasks_retrying", "gauge", "Tasks waiting in the delay queue for a retry.", s.Retrying)
+	metric("hotswap_pool_tasks_key_waiting", "gauge", "Keyed tasks waiting for an earlier task with the same key.", s.KeyWait)
+	metric("hotswap_pool_workers", "gauge", "Running workers.", s.Workers)
+	if err == nil {
+		_, err = fmt.Fprintf(w, "# HELP hotswap_pool_queued_tasks Tasks waiting in the queue.\n# TYPE hotswap_pool_queued_tasks gauge\n")
+	}
+	for p, n := range s.Queued {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "hotswap_pool_queued_tasks{%s,priority=\"%d\"} %d\n", label, p, n)
+		}
+	}
+	if err == nil {
+		err = writePromHistogram(w, "hotswap_pool_queue_wait_seconds", "Time tasks spent in the queue.", label, &wp.stats.wait)
+	}
+	if err == nil {
+		err = writePromHistogram(w, "hotswap_pool_exec_seconds", "Task execution time.", label, &wp.stats.exec)
+	}
+	return err
+}
+
+func writePromHistogram(w io.Writer, name, help, label string, h *histogram) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name); err != nil {
+		return err
+	}
+	var cum int64
+	for i, le := range histBuckets {
+		cum += h.counts[i].Load()
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, label, le.Seconds(), cum); err != nil {
+			return err
+		}
+	}
+	cum += h.counts[len(histBuckets)].Load()
+	_, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %g\n%s_count{%s} %d\n",
+		name, label, cum, name, label, time.Duration(h.sum.Load()).Seconds(), name, label, cum)
+	return err
+}
+
+// PrometheusHandler 输出 WritePrometheus 指标的 http.Handler，可挂载到 /metrics
+// 指标先完整生成再写出，生成失败时返回 500；写出失败（如客户端断开）时记录日志
+func (wp *WorkerPool) PrometheusHandler(pool string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		if err := wp.WritePrometheus(&b, pool); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := w.Write(b.Bytes()); err != nil {
+			log.Printf("Prometheus metrics not written: %v", err)
+		}
+	})
+}
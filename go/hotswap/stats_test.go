@@ -0,0 +1,133 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantiles(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	s := h.snapshot()
+	if s.Count != 100 || s.Max != 100*time.Millisecond || s.Mean != 50500*time.Microsecond {
+		t.Fatalf("snapshot %+v", s)
+	}
+	// 分位数取所在桶的上界，最大不超过 Max
+	if s.P50 != 51200*time.Microsecond || s.P90 != 100*time.Millisecond || s.P99 != 100*time.Millisecond {
+		t.Fatalf("quantiles p50=%v p90=%v p99=%v", s.P50, s.P90, s.P99)
+	}
+}
+
+func TestStatsAndHooks(t *testing.T) {
+	var before, after atomic.Int32
+	var hookErrs atomic.Int32
+	wp := NewWorkerPool(Config{
+		MinWorkers: 1,
+		QueueSize:  2,
+		OnError:    func(error) {},
+		BeforeTask: func(info TaskInfo) { before.Add(1) },
+		AfterTask: func(info TaskInfo, err error) {
+			after.Add(1)
+			if err != nil {
+				hookErrs.Add(1)
+			}
+			if info.Duration <= 0 || info.Enqueued.IsZero() {
+				t.Errorf("AfterTask info %+v", info)
+			}
+		},
+	})
+	wp.Start()
+
+	release := blockWorkers(t, wp, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	wp.SubmitContext(ctx, ContextTaskFunc(func(context.Context) error { return nil }), WithPriority(PriorityHigh))
+	wp.Submit(TaskFunc(func() {}))
+	wp.Submit(TaskFunc(func() {}))
+	if wp.TrySubmit(TaskFunc(func() {})) {
+		t.Fatal("queue not full")
+	}
+	s := wp.Stats()
+	if s.InFlight != 1 || s.Workers != 1 || s.Queued[PriorityHigh] != 1 || s.Queued[PriorityNormal] != 2 || s.QueuedTotal() != 3 {
+		t.Fatalf("stats while blocked: %+v", s)
+	}
+	cancel()
+	close(release)
+
+	wp.Submit(TaskFunc(func() { time.Sleep(5 * time.Millisecond) }))
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error { return errors.New("boom") }))
+	wp.Submit(TaskFunc(func() { panic("boom") }))
+	wp.Stop(context.Background())
+
+	s = wp.Stats()
+	want := Stats{Submitted: 7, Completed: 4, Failed: 2, Panicked: 1, Rejected: 1, Dropped: 1}
+	if s.Submitted != want.Submitted || s.Completed != want.Completed || s.Failed != want.Failed ||
+		s.Panicked != want.Panicked || s.Rejected != want.Rejected || s.Dropped != want.Dropped {
+		t.Fatalf("stats %+v, want counts %+v", s, want)
+	}
+	if s.InFlight != 0 || s.Workers != 0 || s.QueuedTotal() != 0 {
+		t.Fatalf("stats after stop: %+v", s)
+	}
+	if s.Exec.Count != 6 || s.Exec.Max < 5*time.Millisecond || s.QueueWait.Count != 6 {
+		t.Fatalf("latency %+v %+v", s.Exec, s.QueueWait)
+	}
+	if before.Load() != 6 || after.Load() != 6 || hookErrs.Load() != 2 {
+		t.Fatalf("hooks: before=%d after=%d errors=%d", before.Load(), after.Load(), hookErrs.Load())
+	}
+
+	var b strings.Builder
+	if err := wp.WritePrometheus(&b, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`hotswap_pool_tasks_submitted_total{pool="test"} 7`,
+		`hotswap_pool_tasks_rejected_total{pool="test"} 1`,
+		`hotswap_pool_queued_tasks{pool="test",priority="2"} 0`,
+		`hotswap_pool_exec_seconds_bucket{pool="test",le="+Inf"} 6`,
+		`hotswap_pool_exec_seconds_count{pool="test"} 6`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("metrics missing %q:\n%s", line, b.String())
+		}
+	}
+}
+
+// failingResponseWriter 写入总是失败的 http.ResponseWriter，模拟客户端断开
+type failingResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *failingResponseWriter) Header() http.Header       { return w.header }
+func (w *failingResponseWriter) WriteHeader(code int)      { w.code = code }
+func (w *failingResponseWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestPrometheusHandler(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1})
+	h := wp.PrometheusHandler("test")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(rec.Body.String(), `hotswap_pool_workers{pool="test"} 0`) {
+		t.Fatalf("response %d %q:\n%s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	// 写出失败时记录日志
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	h.ServeHTTP(&failingResponseWriter{header: http.Header{}}, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(logs.String(), "connection reset") {
+		t.Fatalf("write error not logged: %q", logs.String())
+	}
+}
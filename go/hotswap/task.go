@@ -0,0 +1,81 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPoolStopped 工作池已停止，不再接受任务；也是 Stop 取消执行中任务时 ctx 的 Cause
+var ErrPoolStopped = errors.New("worker pool is stopped")
+
+// ErrQueueFull 任务队列已满
+var ErrQueueFull = errors.New("worker pool queue is full")
+
+// ContextTask 支持取消与返回错误的任务接口
+// ctx 在工作池停止、提交时的 ctx 取消或超过执行时限时取消，任务应及时返回
+type ContextTask interface {
+	Execute(ctx context.Context) error
+}
+
+// ContextTaskFunc 函数类型任务适配器
+type ContextTaskFunc func(ctx context.Context) error
+
+func (f ContextTaskFunc) Execute(ctx context.Context) error { return f(ctx) }
+
+// taskAdapter 把 Task 适配为 ContextTask，不响应取消
+type taskAdapter struct {
+	task Task
+}
+
+func (t taskAdapter) Execute(context.Context) error {
+	t.task.Execute()
+	return nil
+}
+
+// TaskOption 提交任务时的可选设置
+type TaskOption func(*job)
+
+// WithTaskTimeout 设置任务的执行时限，从开始执行时计算，覆盖 Config.TaskTimeout；小于0表示不限时
+// 包含排队时间的截止时间可以通过提交时 ctx 的 deadline 设置
+func WithTaskTimeout(d time.Duration) TaskOption {
+	return func(j *job) { j.timeout = d }
+}
+
+// WithPriority 设置任务的优先级，默认为 PriorityNormal
+func WithPriority(p Priority) TaskOption {
+	return func(j *job) { j.priority = p.valid() }
+}
+
+// job 队列中的任务
+// ctx: 提交时的 ctx，为nil时使用工作池的 ctx；执行前已取消的任务不再执行
+// timeout: 执行时限，0表示使用 Config.TaskTimeout
+// done: 任务完成或被丢弃时调用，为nil时错误交给 Config.OnError
+// enqueued: 入队时间，用于老化
+// retry: 重试策略，为nil时使用 Config.Retry；attempt 为已开始执行的次数，lastErr 为等待重试时上一次的错误，due 为重试的到期时间
+// key: 为空时不限制；keyHeld 为占用了该 key 的名额，结束时归还；reserved 为在队列中预留了容量，放入队列时使用
+type job struct {
+	task     ContextTask
+	ctx      context.Context
+	timeout  time.Duration
+	done     func(err error)
+	priority Priority
+	enqueued time.Time
+
+	retry   *RetryPolicy
+	attempt int
+	lastErr error
+	due     time.Time
+
+	key      string
+	keyHeld  bool
+	reserved bool
+}
+
+func newJob(ctx context.Context, task ContextTask, opts []TaskOption) *job {
+	j := &job{task: task, ctx: ctx, priority: PriorityNormal}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
@@ -0,0 +1,90 @@
+package hotswap
+
+import "sync/atomic"
+
+// worker 一个工作协程
+// stopped: 已收到停止信号，执行完手上的任务后退出，由 taskQueue.mu 保护
+// busy: 正在执行任务，停止时优先选择空闲的 worker
+type worker struct {
+	stopped bool
+	busy    atomic.Bool
+}
+
+// startWorkerLocked 启动一个 worker，需持有 stateMutex
+func (wp *WorkerPool) startWorkerLocked() {
+	w := &worker{}
+	wp.workerSet[w] = struct{}{}
+	wp.wg.Add(1)
+	go wp.worker(w)
+}
+
+// worker 从队列取任务执行，队列关闭且为空或收到停止信号时退出
+func (wp *WorkerPool) worker(w *worker) {
+	defer wp.wg.Done()
+
+	for {
+		j := wp.queue.pop(w)
+		if j == nil {
+			wp.stateMutex.Lock()
+			delete(wp.workerSet, w)
+			wp.stateMutex.Unlock()
+			return
+		}
+		w.busy.Store(true)
+		wp.run(j)
+		w.busy.Store(false)
+	}
+}
+
+// scaleWorkers 调整 worker 数量：增加时启动新 worker，减少时停止多余的 worker
+func (wp *WorkerPool) scaleWorkers(num int) error {
+	wp.stateMutex.Lock()
+	defer wp.stateMutex.Unlock()
+	return wp.scaleWorkersLocked(num)
+}
+
+// scaleWorkersLocked 同 scaleWorkers，需持有 stateMutex；Start 之前只修改数量
+// 减少时先停止空闲的 worker，不够再停止执行中的，后者执行完手上的任务后退出
+func (wp *WorkerPool) scaleWorkersLocked(num int) error {
+	if wp.closed {
+		return ErrPoolStopped
+	}
+	if wp.started {
+		live := wp.liveWorkersLocked()
+		for i := len(live); i < num; i++ {
+			wp.startWorkerLocked()
+		}
+		n := len(live)
+		for _, busy := range []bool{false, true} {
+			for _, w := range live {
+				if n <= num {
+					break
+				}
+				if w.busy.Load() == busy && wp.stopWorkerLocked(w) {
+					n--
+				}
+			}
+		}
+	}
+	wp.workers = num
+	return nil
+}
+
+// liveWorkersLocked 运行中且没有停止的 worker，需持有 stateMutex
+func (wp *WorkerPool) liveWorkersLocked() []*worker {
+	live := make([]*worker, 0, len(wp.workerSet))
+	for w := range wp.workerSet {
+		live = append(live, w)
+	}
+	return live
+}
+
+// stopWorkerLocked 向 w 发出停止信号并从运行中的集合移除，需持有 stateMutex
+func (wp *WorkerPool) stopWorkerLocked(w *worker) bool {
+	if _, ok := wp.workerSet[w]; !ok {
+		return false
+	}
+	delete(wp.workerSet, w)
+	wp.queue.stop(w)
+	return true
+}
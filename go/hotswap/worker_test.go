@@ -0,0 +1,161 @@
+package hotswap
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrency 提交 n 个任务，返回同时执行的最大任务数
+func concurrency(t *testing.T, wp *WorkerPool, n int) int32 {
+	t.Helper()
+	var cur, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		wp.Submit(TaskFunc(func() {
+			defer wg.Done()
+			c := cur.Add(1)
+			for {
+				p := peak.Load()
+				if c <= p || peak.CompareAndSwap(p, c) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			cur.Add(-1)
+		}))
+	}
+	wg.Wait()
+	return peak.Load()
+}
+
+func TestUpdateWorkersRetiresWithoutRebuild(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 8, QueueSize: 100})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	// 两个 worker 正在执行任务时缩容，优先停止空闲的 worker，执行中的任务不受影响
+	release := blockWorkers(t, wp, 2)
+	if err := wp.UpdateWorkers(4); err != nil {
+		t.Fatal(err)
+	}
+	var ran atomic.Int32
+	for i := 0; i < 10; i++ {
+		wp.Submit(TaskFunc(func() { ran.Add(1) }))
+	}
+	close(release)
+	if peak := concurrency(t, wp, 20); peak > 4 {
+		t.Fatalf("%d tasks ran concurrently with 4 workers", peak)
+	}
+	if ran.Load() != 10 {
+		t.Fatalf("%d of 10 tasks queued during shrink ran", ran.Load())
+	}
+
+	if err := wp.UpdateWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	if peak := concurrency(t, wp, 5); peak != 1 {
+		t.Fatalf("%d tasks ran concurrently with 1 worker", peak)
+	}
+	if err := wp.UpdateWorkers(6); err != nil {
+		t.Fatal(err)
+	}
+	if peak := concurrency(t, wp, 30); peak != 6 {
+		t.Fatalf("%d tasks ran concurrently with 6 workers", peak)
+	}
+}
+
+// TestResizeStress 持续提交任务的同时随机调整 worker 数量与队列大小，每个被接受的任务恰好执行一次
+func TestResizeStress(t *testing.T) {
+	var dropped atomic.Int32
+	wp := NewWorkerPool(Config{MinWorkers: 4, MaxWorkers: 16, QueueSize: 32, OnError: func(error) { dropped.Add(1) }})
+	wp.Start()
+
+	const submitters, perSubmitter = 8, 500
+	runs := make([]atomic.Int32, submitters*perSubmitter)
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for s := 0; s < submitters; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSubmitter; i++ {
+				id := s*perSubmitter + i
+				task := TaskFunc(func() { runs[id].Add(1) })
+				ok := true
+				switch i % 4 {
+				case 0:
+					wp.Submit(task)
+				case 1:
+					ok = wp.TrySubmitPriority(task, Priority(i%3))
+				case 2:
+					ok = wp.SubmitWithTimeout(task, time.Millisecond)
+				case 3:
+					ok = wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error {
+						task()
+						return nil
+					}), WithPriority(PriorityHigh)) == nil
+				}
+				if ok {
+					accepted.Add(1)
+				} else {
+					runs[id].Store(-1)
+				}
+			}
+		}(s)
+	}
+
+	stop := make(chan struct{})
+	resized := make(chan int)
+	go func() {
+		rnd := rand.New(rand.NewSource(1))
+		n := 0
+		for {
+			select {
+			case <-stop:
+				resized <- n
+				return
+			default:
+			}
+			if err := wp.UpdateWorkers(1 + rnd.Intn(16)); err != nil {
+				t.Error(err)
+			}
+			if err := wp.UpdateQueueSize(1 + rnd.Intn(64)); err != nil {
+				t.Error(err)
+			}
+			if err := wp.UpdatePriorityQueueSize(PriorityHigh, 1+rnd.Intn(8)); err != nil {
+				t.Error(err)
+			}
+			n++
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	n := <-resized
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dropped.Load() != 0 {
+		t.Fatalf("%d tasks dropped", dropped.Load())
+	}
+	var executed int32
+	for id := range runs {
+		switch r := runs[id].Load(); r {
+		case -1:
+		case 1:
+			executed++
+		default:
+			t.Fatalf("task %d ran %d times", id, r)
+		}
+	}
+	if executed != accepted.Load() {
+		t.Fatalf("%d tasks executed, %d accepted", executed, accepted.Load())
+	}
+	t.Logf("%d of %d tasks accepted, %d resizes", accepted.Load(), len(runs), n)
+}
@@ -2,11 +2,11 @@ package hotswap
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -27,22 +27,71 @@ func (f TaskFunc) Execute() { f() }
 
 // WorkerPool 工作池
 type WorkerPool struct {
-	workers    int
-	taskQueue  chan Task
-	quit       chan struct{}
+	workers    int                  // 目标 worker 数量
+	workerSet  map[*worker]struct{} // 运行中且没有停止的 worker
+	minWorkers int
+	queue      *taskQueue
+	classCaps  map[Priority]int // 单独设置了容量的优先级
 	wg         sync.WaitGroup
-	queueSize  int32
 	maxWorkers int
-	mutex      sync.RWMutex
 	stateMutex sync.Mutex // 保护状态变更操作
-	stopped    bool       // 标记是否已经停止
+
+	ctx         context.Context         // 工作池的 ctx，传给每个任务
+	cancel      context.CancelCauseFunc // 取消工作池的 ctx
+	taskTimeout time.Duration
+	onError     func(err error)
+	autoscale   *AutoscaleConfig
+	closed      bool // 已调用 Stop
+	started     bool // 已调用 Start
+
+	beforeTask func(info TaskInfo)
+	afterTask  func(info TaskInfo, err error)
+	deadLetter DeadLetterSink
+
+	retry   *RetryPolicy // 默认的重试策略
+	retries *delayQueue  // 等待重试的任务
+
+	keyMu          sync.Mutex
+	keys           map[string]*keyState // 有任务的 key
+	keyLimits      map[string]int       // SetKeyConcurrency 设置的并发上限
+	keyConcurrency int                  // key 默认的并发上限
+
+	stats poolStats
 }
 
 // Config 配置
 type Config struct {
 	MinWorkers int // 最小工作线程数
 	MaxWorkers int // 最大工作线程数（动态扩展用）
-	QueueSize  int // 队列大小
+	QueueSize  int // 每个优先级的队列大小
+
+	// PriorityQueues 单独设置部分优先级的队列大小，未设置的使用 QueueSize
+	PriorityQueues map[Priority]int
+	// Aging 低优先级任务每等待 Aging 提升一级，避免饿死；0表示默认1秒，小于0表示不提升
+	Aging time.Duration
+
+	Context     context.Context // 工作池的 ctx，取消后执行中的任务随之取消，未执行的任务不再执行；为nil时使用 context.Background()
+	TaskTimeout time.Duration   // 每个任务的默认执行时限，0表示不限时
+
+	// Retry 不为nil时作为所有任务默认的重试策略，单个任务用 WithRetry 覆盖
+	Retry *RetryPolicy
+
+	// KeyConcurrency 同一 key 的任务（SubmitKeyed、WithKey）默认的并发上限，0表示1，即按提交顺序逐个执行
+	KeyConcurrency int
+
+	// Autoscale 不为nil时启用自动伸缩，在 MinWorkers 与 MaxWorkers（为0时取 MinWorkers 的4倍）之间调整 worker 数量
+	Autoscale *AutoscaleConfig
+
+	// BeforeTask/AfterTask 每个任务执行前后在 worker 中调用，可用于日志、链路追踪等；应尽快返回
+	BeforeTask func(info TaskInfo)
+	AfterTask  func(info TaskInfo, err error)
+
+	// DeadLetter 不为nil时，没有 Future 的可序列化任务被拒绝、丢弃或执行失败时写入该存储，可用 ReplayDeadLetters 重新提交
+	DeadLetter DeadLetterSink
+
+	// OnError 没有 Future 的任务返回错误、panic（*PanicError）或被丢弃（ErrTaskDropped）时调用，
+	// 在 worker 或提交的协程中执行，应尽快返回；为nil时记录日志
+	OnError func(err error)
 }
 
 // NewWorkerPool 创建工作池
@@ -53,100 +102,331 @@ func NewWorkerPool(config Config) *WorkerPool {
 	if config.QueueSize <= 0 {
 		config.QueueSize = config.MinWorkers * 10
 	}
+	if config.Aging == 0 {
+		config.Aging = defaultAging
+	}
+	if config.KeyConcurrency <= 0 {
+		config.KeyConcurrency = 1
+	}
+	var caps [numPriorities]int
+	classCaps := make(map[Priority]int)
+	for p := PriorityLow; p < numPriorities; p++ {
+		caps[p] = config.QueueSize
+		if n, ok := config.PriorityQueues[p]; ok && n > 0 {
+			caps[p] = n
+			classCaps[p] = n
+		}
+	}
+
+	if config.Autoscale != nil {
+		if config.MaxWorkers <= 0 {
+			config.MaxWorkers = config.MinWorkers * 4
+		}
+		ac := config.Autoscale.withDefaults()
+		config.Autoscale = &ac
+	}
+
+	if config.Retry != nil {
+		rp := config.Retry.withDefaults()
+		config.Retry = &rp
+	}
+
+	if config.Context == nil {
+		config.Context = context.Background()
+	}
+	ctx, cancel := context.WithCancelCause(config.Context)
 
 	return &WorkerPool{
-		workers:    config.MinWorkers,
-		maxWorkers: config.MaxWorkers,
-		taskQueue:  make(chan Task, config.QueueSize),
-		quit:       make(chan struct{}),
+		workers:     config.MinWorkers,
+		workerSet:   make(map[*worker]struct{}),
+		minWorkers:  config.MinWorkers,
+		maxWorkers:  config.MaxWorkers,
+		queue:       newTaskQueue(caps, config.Aging),
+		classCaps:   classCaps,
+		ctx:         ctx,
+		cancel:      cancel,
+		taskTimeout: config.TaskTimeout,
+		onError:     config.OnError,
+		autoscale:   config.Autoscale,
+		beforeTask:  config.BeforeTask,
+		afterTask:   config.AfterTask,
+		deadLetter:  config.DeadLetter,
+		retry:       config.Retry,
+		retries:     newDelayQueue(),
+
+		keys:           make(map[string]*keyState),
+		keyLimits:      make(map[string]int),
+		keyConcurrency: config.KeyConcurrency,
 	}
 }
 
-// Start 启动工作池
+// Start 启动工作池与重试的延迟队列，启用了自动伸缩时同时启动自动伸缩
 func (wp *WorkerPool) Start() {
+	wp.stateMutex.Lock()
+	defer wp.stateMutex.Unlock()
+	if wp.started {
+		return
+	}
+	wp.started = true
 	for i := 0; i < wp.workers; i++ {
-		wp.wg.Add(1)
-		go wp.worker()
+		wp.startWorkerLocked()
+	}
+	go wp.retryLoop()
+	if wp.autoscale != nil {
+		go wp.autoscaleLoop(*wp.autoscale)
 	}
 }
 
+// Workers 当前的 worker 数量（目标值，减少时正在执行任务的 worker 完成后才退出）
+func (wp *WorkerPool) Workers() int {
+	wp.stateMutex.Lock()
+	defer wp.stateMutex.Unlock()
+	return wp.workers
+}
+
 // Submit 提交任务（阻塞）
-// 如果任务队列已满，则会等待直至任务队列有空闲位置。
+// 如果任务队列已满，则会等待直至任务队列有空闲位置。工作池已停止时丢弃任务。
 func (wp *WorkerPool) Submit(task Task) {
-	wp.taskQueue <- task
-	// 原子操作，更新队列大小
-	atomic.StoreInt32(&wp.queueSize, int32(len(wp.taskQueue)))
+	wp.SubmitPriority(task, PriorityNormal)
+}
+
+// SubmitPriority 以指定优先级提交任务（阻塞），同 Submit
+func (wp *WorkerPool) SubmitPriority(task Task, priority Priority) {
+	j := newJob(nil, taskAdapter{task}, []TaskOption{WithPriority(priority)})
+	if err := wp.enqueue(context.Background(), j, true); err != nil {
+		wp.dropJob(j, err)
+	}
 }
 
 // TrySubmit 尝试提交任务（非阻塞）
 // 如果任务队列已满，则不等待，立即返回false。
-// 也可使用SubmitWithTimeout。然后把超时失败的任务放到监控统计中，以便后续优化。
+// 也可使用SubmitWithTimeout。失败计入 Stats().Rejected，可序列化的任务写入死信存储（Config.DeadLetter），以便后续优化与重放。
 func (wp *WorkerPool) TrySubmit(task Task) bool {
-	select {
-	case wp.taskQueue <- task:
-		// 原子操作，更新队列大小
-		atomic.StoreInt32(&wp.queueSize, int32(len(wp.taskQueue)))
-		return true
-	default:
-		return false
-	}
+	return wp.TrySubmitPriority(task, PriorityNormal)
+}
+
+// TrySubmitPriority 以指定优先级尝试提交任务（非阻塞），该优先级的队列已满时返回false
+func (wp *WorkerPool) TrySubmitPriority(task Task, priority Priority) bool {
+	j := newJob(nil, taskAdapter{task}, []TaskOption{WithPriority(priority)})
+	return wp.enqueue(context.Background(), j, false) == nil
 }
 
 // SubmitWithTimeout 带超时提交
 // 如果任务队列已满，则指定等待时间（默认3秒），如超过等待时间，且队列仍然满则放弃。返回false。
-// 例如等待时间超3秒，已严重影响用户体验。放弃后加入监控统计的失败池中，以便后续优化。
+// 例如等待时间超3秒，已严重影响用户体验。放弃后计入 Stats().Rejected，可序列化的任务写入死信存储，以便后续优化与重放。
 func (wp *WorkerPool) SubmitWithTimeout(task Task, timeout time.Duration) bool {
+	return wp.SubmitWithTimeoutPriority(task, PriorityNormal, timeout)
+}
+
+// SubmitWithTimeoutPriority 以指定优先级带超时提交，同 SubmitWithTimeout
+func (wp *WorkerPool) SubmitWithTimeoutPriority(task Task, priority Priority, timeout time.Duration) bool {
 	if timeout <= 0 {
 		timeout = 3 * time.Second
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	j := newJob(nil, taskAdapter{task}, []TaskOption{WithPriority(priority)})
+	return wp.enqueue(ctx, j, true) == nil
+}
 
-	select {
-	case wp.taskQueue <- task:
-		// 原子操作，更新队列大小
-		atomic.StoreInt32(&wp.queueSize, int32(len(wp.taskQueue)))
-		return true
-	case <-ctx.Done():
-		return false
+// SubmitContext 提交支持取消的任务（阻塞）
+// 等待队列有空闲位置，ctx 取消时返回 ctx.Err()，工作池已停止时返回 ErrPoolStopped。
+// 任务执行时的 ctx 派生自提交时的 ctx：排队期间 ctx 取消的任务不再执行，执行中的任务在 ctx 取消、
+// 工作池停止或超过执行时限（WithTaskTimeout 或 Config.TaskTimeout）时收到取消。
+// 优先级用 WithPriority 设置，默认为 PriorityNormal。
+func (wp *WorkerPool) SubmitContext(ctx context.Context, task ContextTask, opts ...TaskOption) error {
+	return wp.enqueue(ctx, newJob(ctx, task, opts), true)
+}
+
+// enqueue 把任务放入对应优先级的队列，wait 为 false 时队列已满立即返回 ErrQueueFull
+// key 任务同样占用队列容量，有容量但没有 key 名额时加入该 key 的等待列表，立即返回nil
+func (wp *WorkerPool) enqueue(ctx context.Context, j *job, wait bool) error {
+	if j.key == "" {
+		return wp.push(ctx, j, wait, wp.queue.tryPush)
+	}
+	// key 任务先预留容量，与其它任务一样在队列已满时等待或被拒绝；等待 key 名额期间保持预留
+	if err := wp.push(ctx, j, wait, wp.queue.tryReserve); err != nil {
+		return err
 	}
+	if wp.acquireKey(j) {
+		wp.pushReleased([]*job{j})
+	}
+	return nil
 }
 
-// QueueSize 获取当前队列大小
+// push 用 add 把任务放入队列（或预留容量），wait 为 true 时等待空位直到 ctx 取消，否则返回 ErrQueueFull
+func (wp *WorkerPool) push(ctx context.Context, j *job, wait bool, add func(*job) (<-chan struct{}, error)) error {
+	for {
+		space, err := add(j)
+		if err == nil {
+			wp.stats.submitted.Add(1)
+		}
+		if err != ErrQueueFull {
+			return err
+		}
+		if !wait {
+			wp.queue.cancelWait(space)
+			wp.stats.rejected.Add(1)
+			wp.saveDeadLetter(j, err)
+			return err
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			wp.queue.cancelWait(space)
+			wp.stats.rejected.Add(1)
+			wp.saveDeadLetter(j, fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err()))
+			return ctx.Err()
+		}
+	}
+}
+
+// QueueSize 获取当前队列大小（所有优先级合计）
 func (wp *WorkerPool) QueueSize() int {
-	// 原子操作，获取队列大小
-	return int(atomic.LoadInt32(&wp.queueSize))
+	return wp.queue.len()
 }
 
 // Stop 停止工作池
-func (wp *WorkerPool) Stop() {
+// 不再接受新任务，由 worker 继续执行队列中的任务，全部完成后返回nil；等待中的重试不再执行，以最后一次的错误结束。
+// ctx 取消时不再等待：取消执行中任务的 ctx（Cause 为 ErrPoolStopped），丢弃未执行的任务，
+// 等待 worker 退出后返回 ctx.Err()。重复调用立即返回nil。
+func (wp *WorkerPool) Stop(ctx context.Context) error {
 	wp.stateMutex.Lock()
-	wp.stopped = true // 添加这行
+	if wp.closed {
+		wp.stateMutex.Unlock()
+		return nil
+	}
+	wp.closed = true
 	wp.stateMutex.Unlock()
-	close(wp.quit)
-	wp.wg.Wait()
+	wp.queue.close()
+	wp.stopRetries()
+
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		wp.cancel(ErrPoolStopped)
+		<-done
+	}
+	wp.cancel(ErrPoolStopped)
+
+	// 没有启动 worker 时队列中可能还有任务；丢弃 key 任务时同一 key 的下一个任务会放入队列，直到取空
+	for jobs := wp.queue.drain(); len(jobs) > 0; jobs = wp.queue.drain() {
+		for _, j := range jobs {
+			wp.dropJob(j, ErrPoolStopped)
+		}
+	}
+	return err
+}
 
-	// 处理队列中剩余的任务
-	close(wp.taskQueue)
-	for task := range wp.taskQueue {
-		task.Execute()
+// run 执行一个任务，执行前 ctx 已取消的任务不再执行；任务的 panic 转换为错误，不影响 worker
+func (wp *WorkerPool) run(j *job) {
+	ctx, cancel := wp.taskContext(j)
+	defer cancel()
+	// 工作池 ctx 的取消异步传递到任务的 ctx，需要单独检查
+	if wp.ctx.Err() != nil {
+		wp.dropJob(j, context.Cause(wp.ctx))
+		return
+	}
+	if ctx.Err() != nil {
+		wp.dropJob(j, context.Cause(ctx))
+		return
+	}
+	j.attempt++
+	start := time.Now()
+	info := TaskInfo{Priority: j.priority, Enqueued: j.enqueued, Wait: start.Sub(j.enqueued), Attempt: j.attempt}
+	wp.stats.wait.observe(info.Wait)
+	wp.stats.inFlight.Add(1)
+	if wp.beforeTask != nil {
+		wp.callHook(func() { wp.beforeTask(info) })
+	}
+	err := execute(ctx, j.task)
+	info.Duration = time.Since(start)
+	wp.stats.inFlight.Add(-1)
+	wp.stats.exec.observe(info.Duration)
+	if wp.afterTask != nil {
+		wp.callHook(func() { wp.afterTask(info, err) })
+	}
+	if err == nil {
+		wp.stats.completed.Add(1)
+		wp.finish(j, nil)
+		return
+	}
+	if !wp.retryLater(j, err) {
+		wp.failJob(j, err)
 	}
 }
 
-func (wp *WorkerPool) worker() {
-	defer wp.wg.Done()
+// failJob 以错误结束任务，计入失败数
+func (wp *WorkerPool) failJob(j *job, err error) {
+	wp.stats.failed.Add(1)
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		wp.stats.panicked.Add(1)
+	}
+	wp.finish(j, err)
+}
 
-	for {
-		select {
-		case task := <-wp.taskQueue:
-			// 原子操作，更新队列大小
-			// TODO 读取 len(wp.taskQueue) 和实际的队列操作不是原子的，可能导致队列大小不准确。此问题应该无伤大雅。
-			atomic.StoreInt32(&wp.queueSize, int32(len(wp.taskQueue)))
-			task.Execute()
-		case <-wp.quit:
-			return
+// finish 归还 key 的名额并交付任务的结果：有 Future 时交给 Future，否则写入死信存储并把错误交给 OnError
+func (wp *WorkerPool) finish(j *job, err error) {
+	wp.releaseKey(j)
+	if j.done != nil {
+		j.done(err)
+		return
+	}
+	if err == nil {
+		return
+	}
+	wp.saveDeadLetter(j, err)
+	if wp.onError != nil {
+		wp.onError(err)
+		return
+	}
+	log.Printf("Task error: %v", err)
+}
+
+// taskContext 任务执行时的 ctx：派生自提交时的 ctx（没有时为工作池的 ctx），工作池的 ctx 取消时随之取消，并加上执行时限
+func (wp *WorkerPool) taskContext(j *job) (context.Context, context.CancelFunc) {
+	parent := j.ctx
+	if parent == nil {
+		parent = wp.ctx
+	}
+	ctx, cancelCause := context.WithCancelCause(parent)
+	stop := context.AfterFunc(wp.ctx, func() { cancelCause(context.Cause(wp.ctx)) })
+	cancel := func() {
+		stop()
+		cancelCause(context.Canceled)
+	}
+
+	timeout := j.timeout
+	if timeout == 0 {
+		timeout = wp.taskTimeout
+	}
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		return ctx, func() {
+			cancelTimeout()
+			cancel()
 		}
 	}
+	return ctx, cancel
+}
+
+// dropJob 丢弃未执行的任务，以 ErrTaskDropped 结束；等待重试的任务以最后一次的错误结束
+func (wp *WorkerPool) dropJob(j *job, reason error) {
+	if j.lastErr != nil {
+		wp.failJob(j, j.lastErr)
+		return
+	}
+	wp.stats.dropped.Add(1)
+	wp.finish(j, droppedError(reason))
 }
 
 // UpdateWorkers 动态更新工作协程数量
@@ -160,34 +440,12 @@ func (wp *WorkerPool) UpdateWorkers(num int) error {
 		num = wp.maxWorkers
 	}
 
-	wp.stateMutex.Lock()
-	defer wp.stateMutex.Unlock()
-
-	if wp.stopped {
-		return fmt.Errorf("worker pool is stopped")
-	}
-
-	oldWorkers := wp.workers
-
-	// 如果增加worker，直接启动新的worker
-	if num > oldWorkers {
-		wp.workers = num
-		for i := oldWorkers; i < num; i++ {
-			wp.wg.Add(1)
-			go wp.worker()
-		}
-		return nil
-	}
-
-	// 如果减少worker，需要重建工作池
-	if num < oldWorkers {
-		return wp.rebuildWorkerPool(num, cap(wp.taskQueue))
-	}
-
-	return nil
+	// 增加时直接启动新的worker；减少时逐个停止worker（优先停止空闲的），执行中的任务不受影响，队列中的任务由其余worker执行
+	return wp.scaleWorkers(num)
 }
 
-// UpdateQueueSize 动态更新队列大小
+// UpdateQueueSize 动态更新队列大小，作用于没有在 Config.PriorityQueues 中单独设置的优先级
+// 缩小时已在队列中的任务保留，队列长度低于新的大小后才接受新任务
 func (wp *WorkerPool) UpdateQueueSize(size int) error {
 	if size <= 0 {
 		return fmt.Errorf("queue size must be positive")
@@ -196,103 +454,32 @@ func (wp *WorkerPool) UpdateQueueSize(size int) error {
 	wp.stateMutex.Lock()
 	defer wp.stateMutex.Unlock()
 
-	if wp.stopped {
-		return fmt.Errorf("worker pool is stopped")
-	}
-
-	currentCap := cap(wp.taskQueue)
-
-	// 如果大小相同，无需更改
-	if currentCap == size {
-		return nil
+	if wp.closed {
+		return ErrPoolStopped
 	}
 
-	// 重建工作池，保持当前的worker数量
-	return wp.rebuildWorkerPool(wp.workers, size)
-}
-
-// rebuildWorkerPool 重建工作池，这是关键的实现部分
-func (wp *WorkerPool) rebuildWorkerPool(workerCount, queueSize int) error {
-	// 1. 创建临时队列，收集新任务（缓冲更大防止阻塞）
-	tempQueue := make(chan Task, queueSize*2)
-
-	// 2. 用 stateMutex 保护状态变更
-	wp.stateMutex.Lock()
-	wp.stopped = true
-	wp.stateMutex.Unlock()
-
-	// 3. 用 mutex 加锁，保护队列切换的状态变更。切断原队列的新任务添加
-	wp.mutex.Lock()
-	// 创建一个新的变量 oldTaskQueue，它指向原来的任务队列。
-	// 这样，我们可以通过 oldTaskQueue 继续处理原队列中剩余的任务
-	oldTaskQueue := wp.taskQueue
-	wp.taskQueue = tempQueue
-	// 信道为引用类型。将 wp.taskQueue 指向新的临时队列 tempQueue。
-	// 这样，在重建过程中，新提交的任务就会进入 tempQueue，而不会进入旧队列。
-	wp.mutex.Unlock()
-
-	// 4. 排空原队列
-	pendingTasks := wp.drainTaskQueue(oldTaskQueue)
-
-	// 5. 发送停止信号给所有worker，停止原worker池
-	close(wp.quit)
-	// 等待所有原worker结束
-	wp.wg.Wait()
-
-	// 6. 重建工作池（不需要加锁，因为stateMutex已保证单线程）
-	wp.taskQueue = make(chan Task, queueSize)
-	wp.quit = make(chan struct{})
-	wp.workers = workerCount
-
-	// 7. 合并任务：原队列剩余任务 + 临时队列新任务
-	wp.mergeTasks(pendingTasks, tempQueue)
-
-	// 8. 启动新worker
-	for i := 0; i < workerCount; i++ {
-		wp.wg.Add(1)
-		go wp.worker()
+	for p := PriorityLow; p < numPriorities; p++ {
+		if _, ok := wp.classCaps[p]; !ok {
+			wp.queue.setCap(p, size)
+		}
 	}
-
-	// 9. 重置状态
-	wp.stateMutex.Lock()
-	wp.stopped = false
-	wp.stateMutex.Unlock()
-
-	// 更新队列大小
-	atomic.StoreInt32(&wp.queueSize, int32(len(wp.taskQueue)))
-
 	return nil
 }
 
-// drainTaskQueue 排空原队列的剩余任务
-func (wp *WorkerPool) drainTaskQueue(queue chan Task) []Task {
-	var tasks []Task
-	close(queue) // 关闭以便遍历
-	for task := range queue {
-		tasks = append(tasks, task)
+// UpdatePriorityQueueSize 动态更新一个优先级的队列大小，之后 UpdateQueueSize 不再影响该优先级
+func (wp *WorkerPool) UpdatePriorityQueueSize(priority Priority, size int) error {
+	if size <= 0 {
+		return fmt.Errorf("queue size must be positive")
 	}
-	return tasks
-}
 
-func (wp *WorkerPool) mergeTasks(pendingTasks []Task, tempQueue chan Task) {
-	// 先处理原队列剩余任务
-	for _, task := range pendingTasks {
-		select {
-		case wp.taskQueue <- task:
-		default:
-			// TODO 新队列已满，任务丢弃。记录到日志和数据库
-			log.Printf("Task dropped during pool rebuild")
-		}
-	}
+	wp.stateMutex.Lock()
+	defer wp.stateMutex.Unlock()
 
-	// 再处理临时队列中的新任务
-	close(tempQueue)
-	for task := range tempQueue {
-		select {
-		case wp.taskQueue <- task:
-		default:
-			// TODO 新队列已满，任务丢弃。记录到日志和数据库
-			log.Printf("Task dropped during pool rebuild")
-		}
+	if wp.closed {
+		return ErrPoolStopped
 	}
+	priority = priority.valid()
+	wp.classCaps[priority] = size
+	wp.queue.setCap(priority, size)
+	return nil
 }
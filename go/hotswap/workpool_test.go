@@ -0,0 +1,175 @@
+package hotswap
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockWorkers 提交 n 个阻塞任务占满 n 个 worker，关闭返回的 channel 后释放
+func blockWorkers(t *testing.T, wp *WorkerPool, n int) chan struct{} {
+	t.Helper()
+	release := make(chan struct{})
+	started := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		wp.Submit(TaskFunc(func() {
+			started <- struct{}{}
+			<-release
+		}))
+	}
+	for i := 0; i < n; i++ {
+		<-started
+	}
+	return release
+}
+
+func TestTaskTimeout(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 2, TaskTimeout: 20 * time.Millisecond})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	errs := make(chan error, 2)
+	wait := ContextTaskFunc(func(ctx context.Context) error {
+		start := time.Now()
+		<-ctx.Done()
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("cancelled after %v", d)
+		}
+		errs <- ctx.Err()
+		return ctx.Err()
+	})
+	if err := wp.SubmitContext(context.Background(), wait); err != nil {
+		t.Fatal(err)
+	}
+	// WithTaskTimeout 覆盖默认时限
+	if err := wp.SubmitContext(context.Background(), wait, WithTaskTimeout(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("task ctx err = %v, want deadline exceeded", err)
+		}
+	}
+}
+
+func TestSubmitContextCancelledWhileQueued(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 4})
+	wp.Start()
+	defer wp.Stop(context.Background())
+	release := blockWorkers(t, wp, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran atomic.Bool
+	if err := wp.SubmitContext(ctx, ContextTaskFunc(func(context.Context) error {
+		ran.Store(true)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	close(release)
+
+	done := make(chan struct{})
+	wp.Submit(TaskFunc(func() { close(done) }))
+	<-done
+	if ran.Load() {
+		t.Fatal("task cancelled while queued was executed")
+	}
+
+	// 队列已满时 SubmitContext 随 ctx 返回
+	release = blockWorkers(t, wp, 1)
+	defer close(release)
+	for i := 0; i < 4; i++ {
+		wp.Submit(TaskFunc(func() {}))
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.SubmitContext(ctx, ContextTaskFunc(func(context.Context) error { return nil })); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("submit to a full queue: %v", err)
+	}
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 2, QueueSize: 100})
+	wp.Start()
+	var n atomic.Int32
+	for i := 0; i < 100; i++ {
+		wp.Submit(TaskFunc(func() {
+			time.Sleep(time.Millisecond)
+			n.Add(1)
+		}))
+	}
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n.Load() != 100 {
+		t.Fatalf("%d of 100 tasks executed before Stop returned", n.Load())
+	}
+	if err := wp.SubmitContext(context.Background(), ContextTaskFunc(func(context.Context) error { return nil })); !errors.Is(err, ErrPoolStopped) {
+		t.Fatalf("submit after stop: %v", err)
+	}
+	if wp.TrySubmit(TaskFunc(func() {})) {
+		t.Fatal("TrySubmit accepted a task after stop")
+	}
+	wp.Submit(TaskFunc(func() {}))
+	if err := wp.Stop(context.Background()); err != nil {
+		t.Fatalf("second stop: %v", err)
+	}
+}
+
+func TestStopCancelsInFlight(t *testing.T) {
+	wp := NewWorkerPool(Config{MinWorkers: 1, QueueSize: 10})
+	wp.Start()
+
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		cause <- context.Cause(ctx)
+		return ctx.Err()
+	}))
+	<-started
+	var queued atomic.Int32
+	for i := 0; i < 5; i++ {
+		wp.Submit(TaskFunc(func() { queued.Add(1) }))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := wp.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop = %v, want deadline exceeded", err)
+	}
+	if err := <-cause; !errors.Is(err, ErrPoolStopped) {
+		t.Fatalf("in-flight task cancelled with %v", err)
+	}
+	if queued.Load() != 0 {
+		t.Fatalf("%d queued tasks executed after Stop timed out", queued.Load())
+	}
+	if wp.QueueSize() != 0 {
+		t.Fatalf("queue size %d after stop", wp.QueueSize())
+	}
+}
+
+func TestPoolContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	wp := NewWorkerPool(Config{MinWorkers: 1, Context: parent})
+	wp.Start()
+	defer wp.Stop(context.Background())
+
+	started := make(chan struct{})
+	errs := make(chan error, 1)
+	wp.SubmitContext(context.Background(), ContextTaskFunc(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return nil
+	}))
+	<-started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("task ctx err = %v after the pool context was cancelled", err)
+	}
+}
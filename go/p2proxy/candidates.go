@@ -0,0 +1,305 @@
+package p2proxy
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// 候选地址与连通性检查（类似 ICE）
+// 节点注册时带上自己的候选地址：本机网卡地址（host）以及各个 tracker 看到的公网/映射地址（srflx，
+// 从 tracker 的 registered 回复中得知）。同时向 IPv4 与 IPv6 的 tracker 注册的节点因此拥有两个协议族的候选地址。
+// tracker 在 peer 与 notify 消息中交换双方的候选地址列表，双方向对方的每个候选地址发送 check，
+// 收到 check 的一方回复 check_ok；这些包同时起到打洞的作用。
+// 收到来自未知地址的 check 时（对端位于对称型 NAT 之后，为我们分配了新的映射地址），把该地址加入检查列表（peer-reflexive）。
+// 发起方在收到回复的候选地址中选择优先级最高的一个：同一局域网的 host 地址 > IPv6 > IPv4 映射地址 > 其他。
+// 对端或 tracker 不支持候选地址，或所有检查都失败时，退回到 tracker 看到的地址。
+
+const (
+	candidateHost  = "host"  // 本机网卡地址
+	candidateSrflx = "srflx" // tracker 看到的公网/映射地址
+
+	maxCandidates = 16                     // 每个节点最多的候选地址数量
+	checkInterval = 100 * time.Millisecond // 重发 check 的间隔
+	checkTimeout  = 2 * time.Second        // 连通性检查的最长时间
+	checkGrace    = 200 * time.Millisecond // 第一个候选地址成功后，等待更高优先级的候选地址回复的时间
+)
+
+// Candidate 节点的候选地址
+// Addr: ip:port
+// Type: host 或 srflx
+type Candidate struct {
+	Addr string `json:"addr"`
+	Type string `json:"type"`
+}
+
+// interfaceAddrser 可以列出本机地址的网络，netsim.Host 与真实网络都实现了该接口
+type interfaceAddrser interface {
+	InterfaceAddrs() ([]net.Addr, error)
+}
+
+func (realNetwork) InterfaceAddrs() ([]net.Addr, error) {
+	return net.InterfaceAddrs()
+}
+
+// localNets 本机网卡的网段，忽略回环与链路本地地址
+func (n *Node) localNets() []*net.IPNet {
+	ia, ok := n.network.(interfaceAddrser)
+	if !ok {
+		return nil
+	}
+	addrs, err := ia.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLoopback() || ipn.IP.IsLinkLocalUnicast() || ipn.IP.IsUnspecified() {
+			continue
+		}
+		nets = append(nets, ipn)
+	}
+	return nets
+}
+
+// localCandidates 本节点的候选地址：UDP 套接字绑定的本机地址，以及各个 tracker 看到的地址
+func (n *Node) localCandidates() []Candidate {
+	var cands []Candidate
+	seen := make(map[string]bool)
+	add := func(addr, typ string) {
+		if !seen[addr] && len(cands) < maxCandidates {
+			seen[addr] = true
+			cands = append(cands, Candidate{Addr: addr, Type: typ})
+		}
+	}
+	if la, ok := n.conn.LocalAddr().(*net.UDPAddr); ok {
+		if la.IP == nil || la.IP.IsUnspecified() {
+			// 双栈套接字（[::]）可以使用两个协议族的地址，0.0.0.0 只能使用 IPv4
+			v4only := la.IP != nil && la.IP.To4() != nil
+			for _, ipn := range n.localNets() {
+				if v4only && ipn.IP.To4() == nil {
+					continue
+				}
+				add((&net.UDPAddr{IP: ipn.IP, Port: la.Port}).String(), candidateHost)
+			}
+		} else if !la.IP.IsLoopback() {
+			add(la.String(), candidateHost)
+		}
+	}
+	n.mu.Lock()
+	reflexive := make([]string, 0, len(n.reflexive))
+	for _, a := range n.reflexive {
+		reflexive = append(reflexive, a)
+	}
+	n.mu.Unlock()
+	sort.Strings(reflexive)
+	for _, a := range reflexive {
+		add(a, candidateSrflx)
+	}
+	return cands
+}
+
+// onRegistered 处理 tracker 的注册确认，记录该 tracker 看到的本节点地址；
+// 发现新的地址时立即重新注册，让所有 tracker 尽快得到完整的候选地址列表。
+// 只接受配置的 tracker 发来的确认，每个 tracker 只记录一个地址，伪造的确认不能注入候选地址或引发重新注册
+func (n *Node) onRegistered(m ProtoMsg, from *net.UDPAddr) {
+	t := n.trackerFor(from)
+	if t == nil {
+		n.pktLog.Debug("registered from unknown tracker dropped", logKeyAddr, from.String())
+		return
+	}
+	if ap, err := netip.ParseAddrPort(m.Addr); err != nil || ap.Addr().IsUnspecified() {
+		return
+	}
+	key := t.String()
+	n.mu.Lock()
+	changed := n.reflexive[key] != m.Addr
+	n.reflexive[key] = m.Addr
+	n.mu.Unlock()
+	if changed {
+		n.log.Debug("learned reflexive address", logKeyAddr, m.Addr, "tracker", key)
+		go n.Register()
+	}
+}
+
+// checkSession 一次进行中的连通性检查
+// results: 回复了 check_ok 的候选地址；learned: 对端发来 check 的地址
+type checkSession struct {
+	peer    string
+	results chan string
+	learned chan *net.UDPAddr
+}
+
+// candidatePriority 候选地址的优先级，数值越大越优先
+func candidatePriority(c Candidate, ip net.IP, local []*net.IPNet) int {
+	if c.Type == candidateHost {
+		for _, ipn := range local {
+			if ipn.Contains(ip) {
+				return 4 // 同一局域网，直接连接
+			}
+		}
+	}
+	switch {
+	case ip.To4() == nil:
+		return 3 // IPv6 通常没有 NAT
+	case c.Type == candidateSrflx:
+		return 2
+	}
+	return 1
+}
+
+// checkCandidates 向 peer 的所有候选地址发送 check，返回回复了 check_ok 的优先级最高的地址，全部失败时返回nil
+func (n *Node) checkCandidates(peer string, cands []Candidate) *net.UDPAddr {
+	type target struct {
+		addr *net.UDPAddr
+		prio int
+	}
+	local := n.localNets()
+	var targets []target
+	prio := make(map[string]int)
+	for _, c := range cands {
+		ua, err := net.ResolveUDPAddr("udp", c.Addr)
+		if err != nil || ua.IP == nil || ua.IP.IsUnspecified() {
+			continue
+		}
+		key := ua.String()
+		p := candidatePriority(c, ua.IP, local)
+		if old, ok := prio[key]; ok {
+			// 同一地址可能既是 host 又是 srflx（公网主机），取较高的优先级
+			prio[key] = max(old, p)
+			continue
+		}
+		prio[key] = p
+		targets = append(targets, target{addr: ua})
+		if len(targets) == maxCandidates {
+			break
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	best := 0
+	for i := range targets {
+		targets[i].prio = prio[targets[i].addr.String()]
+		best = max(best, targets[i].prio)
+	}
+
+	token := newReqID()
+	cs := &checkSession{peer: peer, results: make(chan string, maxCandidates*4), learned: make(chan *net.UDPAddr, maxCandidates)}
+	n.mu.Lock()
+	n.checks[token] = cs
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.checks, token)
+		n.mu.Unlock()
+	}()
+
+	lg := n.log.With(logKeyPeer, peer)
+	sendTo := func(addr *net.UDPAddr) {
+		if err := n.sendProto(addr, ProtoMsg{Type: "check", From: n.ID, To: peer, ReqID: token, Addr: addr.String()}); err != nil {
+			n.pktLog.Debug("send check error", logKeyPeer, peer, logKeyAddr, addr.String(), "err", err)
+		}
+	}
+	send := func() {
+		for _, t := range targets {
+			sendTo(t.addr)
+		}
+	}
+	send()
+	resend := time.NewTicker(checkInterval)
+	defer resend.Stop()
+	timeout := time.NewTimer(checkTimeout)
+	defer timeout.Stop()
+	var grace <-chan time.Time
+	var selected *target
+	for {
+		select {
+		case ua := <-cs.learned:
+			if _, ok := prio[ua.String()]; ok || len(targets) >= 2*maxCandidates {
+				continue
+			}
+			p := candidatePriority(Candidate{Type: candidateSrflx}, ua.IP, nil)
+			prio[ua.String()] = p
+			targets = append(targets, target{addr: ua, prio: p})
+			if selected != nil {
+				// append 可能重新分配了 targets，按地址重新定位已选中的候选地址
+				for i := range targets {
+					if targets[i].addr.String() == selected.addr.String() {
+						selected = &targets[i]
+					}
+				}
+			}
+			lg.Debug("learned peer-reflexive candidate", logKeyAddr, ua.String())
+			sendTo(ua)
+		case r := <-cs.results:
+			for i := range targets {
+				t := &targets[i]
+				if t.addr.String() == r && (selected == nil || t.prio > selected.prio) {
+					selected = t
+				}
+			}
+			if selected == nil {
+				continue
+			}
+			if selected.prio == best {
+				lg.Debug("candidate selected", logKeyAddr, selected.addr.String(), "priority", selected.prio)
+				return selected.addr
+			}
+			if grace == nil {
+				grace = time.After(checkGrace)
+			}
+		case <-grace:
+			lg.Debug("candidate selected", logKeyAddr, selected.addr.String(), "priority", selected.prio)
+			return selected.addr
+		case <-resend.C:
+			send()
+		case <-timeout.C:
+			lg.Debug("all candidate checks failed", "candidates", len(targets))
+			return nil
+		case <-n.quit:
+			return nil
+		}
+	}
+}
+
+// onCheck 回复对端的连通性检查，并把来源地址交给对同一对端进行中的检查
+func (n *Node) onCheck(m ProtoMsg, from *net.UDPAddr) {
+	if m.To != "" && m.To != n.ID {
+		return
+	}
+	n.sendProto(from, ProtoMsg{Type: "check_ok", From: n.ID, ReqID: m.ReqID, Addr: m.Addr})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, cs := range n.checks {
+		if cs.peer == m.From {
+			select {
+			case cs.learned <- from:
+			default:
+			}
+		}
+	}
+}
+
+// onCheckOK 把检查结果交给进行中的 checkCandidates
+func (n *Node) onCheckOK(m ProtoMsg) {
+	n.mu.Lock()
+	cs := n.checks[m.ReqID]
+	n.mu.Unlock()
+	if cs == nil {
+		return
+	}
+	select {
+	case cs.results <- m.Addr:
+	default:
+	}
+}
+
+// connectCandidates 收到 notify 后向发起方的候选地址发送检查（同时完成打洞），成功时缓存选出的地址
+func (n *Node) connectCandidates(peer string, cands []Candidate) {
+	if addr := n.checkCandidates(peer, cands); addr != nil {
+		n.cachePeer(peer, addr)
+	}
+}
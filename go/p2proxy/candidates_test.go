@@ -0,0 +1,190 @@
+package p2proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+)
+
+// newCandidateNodes 在给定的主机上创建 nodeA、nodeB，向 trackers 注册，并等待两个节点都得到 tracker 看到的地址
+func newCandidateNodes(t *testing.T, trackers []string, ha, hb *netsim.Host) (a, b *Node) {
+	t.Helper()
+	newNode := func(id string, h *netsim.Host) *Node {
+		n, err := NewNodeWithConfig(NodeConfig{ID: id, Trackers: trackers, Logger: quietLogger(), Network: h})
+		if err != nil {
+			t.Fatalf("create %s: %v", id, err)
+		}
+		t.Cleanup(n.Close)
+		return n
+	}
+	a, b = newNode("nodeA", ha), newNode("nodeB", hb)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.Register()
+		b.Register()
+		time.Sleep(50 * time.Millisecond)
+		a.mu.Lock()
+		ra := len(a.reflexive)
+		a.mu.Unlock()
+		b.mu.Lock()
+		rb := len(b.reflexive)
+		b.mu.Unlock()
+		if ra == len(trackers) && rb == len(trackers) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes not registered: %d/%d reflexive addresses", ra, rb)
+		}
+	}
+	// 再注册一次，确保 tracker 记录的是完整的候选地址列表
+	a.Register()
+	b.Register()
+	time.Sleep(50 * time.Millisecond)
+	return a, b
+}
+
+// checkEcho 经 peer 连接回显服务器，发送 size 字节并校验回显的数据
+func checkEcho(t *testing.T, n *Node, peer, echo string, size int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := n.DialPeer(ctx, peer, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	payload := bytes.Repeat([]byte("candidate"), size/9+1)[:size]
+	go func() {
+		c.Write(payload)
+		c.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo: got %d bytes, err %v", len(got), err)
+	}
+}
+
+// startSimTracker 在模拟主机 h 上启动 tracker
+func startSimTracker(t *testing.T, h *netsim.Host, addr string) {
+	t.Helper()
+	tr := NewTracker(addr)
+	tr.Network = h
+	tr.Logger = quietLogger()
+	go tr.Run()
+	t.Cleanup(func() { tr.Close() })
+}
+
+func TestCandidatesSameLAN(t *testing.T) {
+	// 两个节点位于同一个对称型 NAT 之后，只能通过局域网地址直接连接
+	nw := netsim.New(netsim.Config{Seed: 13})
+	startSimTracker(t, nw.AddHost("203.0.113.1", nil), simTrackerAddr)
+	nat := nw.AddNAT("198.51.100.1", netsim.Symmetric)
+	a, b := newCandidateNodes(t, []string{simTrackerAddr}, nw.AddHost("10.0.9.2", nat), nw.AddHost("10.0.9.3", nat))
+
+	addr, err := a.Lookup("nodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := b.conn.LocalAddr().(*net.UDPAddr).Port; !addr.IP.Equal(net.ParseIP("10.0.9.3")) || addr.Port != want {
+		t.Fatalf("selected %s, want 10.0.9.3:%d", addr, want)
+	}
+	echo := startEchoServer(t)
+	checkEcho(t, a, "nodeB", echo, 64*1024)
+}
+
+func TestCandidatesPreferIPv6(t *testing.T) {
+	// 两个节点的 IPv4 都在对称型 NAT 之后，但都有公网 IPv6 地址；tracker 是双栈的
+	nw := netsim.New(netsim.Config{Seed: 14})
+	th := nw.AddHost("203.0.113.1", nil)
+	th.AddIPv6("2001:db8::1")
+	startSimTracker(t, th, ":40000")
+	ha := nw.AddHost("10.0.1.2", nw.AddNAT("198.51.100.1", netsim.Symmetric))
+	ha.AddIPv6("2001:db8:1::2")
+	hb := nw.AddHost("10.0.2.2", nw.AddNAT("198.51.100.2", netsim.Symmetric))
+	hb.AddIPv6("2001:db8:2::2")
+	a, _ := newCandidateNodes(t, []string{simTrackerAddr, "[2001:db8::1]:40000"}, ha, hb)
+
+	addr, err := a.Lookup("nodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.ParseIP("2001:db8:2::2")) {
+		t.Fatalf("selected %s, want nodeB's IPv6 address", addr)
+	}
+	echo := startEchoServer(t)
+	checkEcho(t, a, "nodeB", echo, 64*1024)
+}
+
+func TestMergeCandidates(t *testing.T) {
+	observed := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5000}
+	if got := mergeCandidates(observed, nil); got != nil {
+		t.Fatalf("legacy node got candidates %v", got)
+	}
+	got := mergeCandidates(observed, []Candidate{
+		{Addr: "10.0.0.2:5000", Type: candidateHost},
+		{Addr: "198.51.100.1:5000", Type: candidateSrflx},
+		{Addr: "not an address", Type: candidateHost},
+		{Addr: "0.0.0.0:5000", Type: candidateHost},
+		{Addr: "10.0.0.2:5000", Type: candidateHost},
+		{Addr: "10.0.0.3:5000", Type: "relay"},
+	})
+	want := []Candidate{
+		{Addr: "198.51.100.1:5000", Type: candidateSrflx},
+		{Addr: "10.0.0.2:5000", Type: candidateHost},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("merged %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRegisteredOnlyFromTrackers(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 15})
+	n, err := NewNodeWithConfig(NodeConfig{ID: "nodeA", Trackers: []string{simTrackerAddr}, Logger: quietLogger(), Network: nw.AddHost("10.0.1.2", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	reflexive := func() map[string]string {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return maps.Clone(n.reflexive)
+	}
+
+	// 伪造的确认不记录地址
+	for i := 0; i < 100; i++ {
+		spoofed := &net.UDPAddr{IP: net.ParseIP("192.0.2.66"), Port: 1000 + i}
+		n.onRegistered(ProtoMsg{Type: "registered", Addr: fmt.Sprintf("192.0.2.66:%d", i+1)}, spoofed)
+	}
+	if got := reflexive(); len(got) != 0 {
+		t.Fatalf("spoofed registered accepted: %v", got)
+	}
+
+	tracker, _ := net.ResolveUDPAddr("udp", simTrackerAddr)
+	n.onRegistered(ProtoMsg{Type: "registered", Addr: "not an address"}, tracker)
+	n.onRegistered(ProtoMsg{Type: "registered", Addr: "198.51.100.1:4000"}, tracker)
+	n.onRegistered(ProtoMsg{Type: "registered", Addr: "198.51.100.1:4001"}, tracker)
+	if got := reflexive(); len(got) != 1 || got[tracker.String()] != "198.51.100.1:4001" {
+		t.Fatalf("reflexive = %v, want one address for the tracker", got)
+	}
+
+	// 更换 tracker 后不再使用旧 tracker 看到的地址
+	if err := n.SetTrackers([]string{"203.0.113.9:7000"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := reflexive(); len(got) != 0 {
+		t.Fatalf("reflexive after SetTrackers = %v", got)
+	}
+}
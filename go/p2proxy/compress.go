@@ -0,0 +1,262 @@
+package p2proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 数据流压缩
+// 启用压缩的节点在 stream_open 中带上支持的算法（compress 字段，逗号分隔，按优先顺序），
+// 出口节点选择第一个自己也支持的算法，在 stream_ready 中回复（compress 字段），没有共同的算法时不回复。
+// 之后双方各自压缩发出的 stream_data，压缩的包带 enc 字段标明算法，接收方按 enc 解压；
+// 每个包独立压缩，重传、乱序不影响解压。零往返打开的发起方在收到 stream_ready 之前不压缩。
+//
+// 采样
+// 每个方向先压缩 compressSample 个包，合计压缩后超过原始大小的 compressMaxRatio 时认为数据不可压缩，
+// 之后 compressBackoff 个包不压缩，再重新采样。压缩后没有变小的包按原样发送。
+//
+// 带宽限制与流量配额按实际传输的（压缩后的）字节计算。
+
+const (
+	compressDeflate       = "deflate"
+	defaultCompressLevel  = flate.BestSpeed
+	compressMinSize       = 128 // 小于该字节数的包不压缩
+	compressSample        = 4   // 每次采样压缩的包数
+	compressMaxRatio      = 0.9 // 采样的压缩后大小超过原始大小的该比例时停止压缩
+	compressBackoff       = 64  // 停止压缩的包数，之后重新采样
+	compressStatsInterval = 5 * time.Minute
+)
+
+// errBadCompressedData 无法解压对端发来的数据
+var errBadCompressedData = errors.New("bad compressed data")
+
+// CompressionConfig 数据流压缩设置，零值表示不压缩
+type CompressionConfig struct {
+	Enabled bool // 在本节点发起的数据流中提议压缩，并接受对端的提议
+	Level   int  // deflate 压缩级别 1-9，0 表示默认的 1（最快）
+}
+
+func (c CompressionConfig) level() int {
+	if c.Level < flate.BestSpeed || c.Level > flate.BestCompression {
+		return defaultCompressLevel
+	}
+	return c.Level
+}
+
+// offer stream_open 中提议的算法，未启用时为空
+func (c CompressionConfig) offer() string {
+	if !c.Enabled {
+		return ""
+	}
+	return compressDeflate
+}
+
+// choose 从对端提议的算法中选择本节点支持的第一个，未启用或没有共同的算法时返回空
+func (c CompressionConfig) choose(offer string) string {
+	if !c.Enabled {
+		return ""
+	}
+	for _, alg := range strings.Split(offer, ",") {
+		if strings.TrimSpace(alg) == compressDeflate {
+			return compressDeflate
+		}
+	}
+	return ""
+}
+
+// CompressionStats 与一个对端之间 stream_data 的字节数：Raw 为压缩前，Wire 为实际传输的
+type CompressionStats struct {
+	RawSent  int64
+	WireSent int64
+	RawRecv  int64
+	WireRecv int64
+}
+
+// Ratio 压缩比，即压缩前与实际传输的字节数之比，没有数据时为1
+func (s CompressionStats) Ratio() float64 {
+	wire := s.WireSent + s.WireRecv
+	if wire == 0 {
+		return 1
+	}
+	return float64(s.RawSent+s.RawRecv) / float64(wire)
+}
+
+// compressStats 按对端节点统计的压缩字节数
+type compressStats struct {
+	mu     sync.Mutex
+	peers  map[string]*CompressionStats
+	logged map[string]CompressionStats // 上次输出日志时的值
+}
+
+func newCompressStats() *compressStats {
+	return &compressStats{peers: make(map[string]*CompressionStats), logged: make(map[string]CompressionStats)}
+}
+
+func (c *compressStats) get(peer string) *CompressionStats {
+	s := c.peers[peer]
+	if s == nil {
+		s = &CompressionStats{}
+		c.peers[peer] = s
+	}
+	return s
+}
+
+func (c *compressStats) sent(peer string, raw, wire int) {
+	c.mu.Lock()
+	s := c.get(peer)
+	s.RawSent += int64(raw)
+	s.WireSent += int64(wire)
+	c.mu.Unlock()
+}
+
+func (c *compressStats) recv(peer string, raw, wire int) {
+	c.mu.Lock()
+	s := c.get(peer)
+	s.RawRecv += int64(raw)
+	s.WireRecv += int64(wire)
+	c.mu.Unlock()
+}
+
+// changed 返回上次调用以来有变化的对端的统计
+func (c *compressStats) changed() map[string]CompressionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]CompressionStats)
+	for peer, s := range c.peers {
+		if *s != c.logged[peer] {
+			out[peer] = *s
+			c.logged[peer] = *s
+		}
+	}
+	return out
+}
+
+// streamCompressor 数据流一个方向的压缩状态，只在 pumpLocal 中使用
+type streamCompressor struct {
+	alg     string
+	level   int
+	w       *flate.Writer
+	buf     bytes.Buffer
+	skip    int // 剩余不压缩的包数
+	samples int // 本次采样已压缩的包数
+	rawSum  int
+	outSum  int
+}
+
+func newStreamCompressor(alg string, level int) *streamCompressor {
+	return &streamCompressor{alg: alg, level: level}
+}
+
+// compress 压缩一个包，返回要发送的数据及其 enc，不压缩时 enc 为空
+func (c *streamCompressor) compress(p []byte) ([]byte, string) {
+	if len(p) < compressMinSize {
+		return p, ""
+	}
+	if c.skip > 0 {
+		c.skip--
+		return p, ""
+	}
+	c.buf.Reset()
+	if c.w == nil {
+		// level 已经过校验，不会出错
+		c.w, _ = flate.NewWriter(&c.buf, c.level)
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	c.w.Write(p)
+	c.w.Close()
+	out := c.buf.Bytes()
+
+	c.samples++
+	c.rawSum += len(p)
+	c.outSum += min(len(out), len(p))
+	if c.samples >= compressSample {
+		if float64(c.outSum) > compressMaxRatio*float64(c.rawSum) {
+			c.skip = compressBackoff
+		}
+		c.samples, c.rawSum, c.outSum = 0, 0, 0
+	}
+	if len(out) >= len(p) {
+		return p, ""
+	}
+	return out, c.alg
+}
+
+// streamDecompressor 数据流接收方向的解压状态，在持有 st.wmu 时使用
+type streamDecompressor struct {
+	r   io.ReadCloser
+	src bytes.Reader
+	out bytes.Buffer
+}
+
+// decompress 按 enc 解压一个包；解压后超过 streamChunkSize 的包视为错误
+func (d *streamDecompressor) decompress(enc string, p []byte) ([]byte, error) {
+	if enc == "" {
+		return p, nil
+	}
+	if enc != compressDeflate {
+		return nil, errBadCompressedData
+	}
+	d.src.Reset(p)
+	if d.r == nil {
+		d.r = flate.NewReader(&d.src)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return nil, err
+	}
+	d.out.Reset()
+	n, err := d.out.ReadFrom(io.LimitReader(d.r, streamChunkSize+1))
+	if err != nil || n > streamChunkSize {
+		return nil, errBadCompressedData
+	}
+	return d.out.Bytes(), nil
+}
+
+// SetCompression 更新压缩设置，在之后打开的数据流上生效
+func (n *Node) SetCompression(c CompressionConfig) {
+	n.mu.Lock()
+	n.compression = c
+	n.mu.Unlock()
+}
+
+func (n *Node) getCompression() CompressionConfig {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.compression
+}
+
+// CompressionStats 返回与各个对端之间数据流的压缩统计
+func (n *Node) CompressionStats() map[string]CompressionStats {
+	n.compressStats.mu.Lock()
+	defer n.compressStats.mu.Unlock()
+	out := make(map[string]CompressionStats, len(n.compressStats.peers))
+	for peer, s := range n.compressStats.peers {
+		out[peer] = *s
+	}
+	return out
+}
+
+// compressStatsLoop 定期输出有变化的对端的压缩比，直到节点关闭
+func (n *Node) compressStatsLoop() {
+	ticker := time.NewTicker(compressStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+		for peer, s := range n.compressStats.changed() {
+			if s.WireSent == s.RawSent && s.WireRecv == s.RawRecv {
+				continue
+			}
+			n.log.Info("stream compression", logKeyPeer, peer,
+				"raw_sent", s.RawSent, "wire_sent", s.WireSent, "raw_recv", s.RawRecv, "wire_recv", s.WireRecv,
+				"ratio", s.Ratio())
+		}
+	}
+}
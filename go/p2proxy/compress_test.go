@@ -0,0 +1,95 @@
+package p2proxy
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// jsonPayload 类似 JSON API 响应的可压缩数据
+func jsonPayload(size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"name":"item-%d","tags":["alpha","beta"],"active":true},`, i, i%97)
+	}
+	return b.Bytes()[:size]
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 23, simPeer{}, simPeer{}, Timeouts{})
+	env.a.SetCompression(CompressionConfig{Enabled: true})
+	env.b.SetCompression(CompressionConfig{Enabled: true, Level: 6})
+	d := env.startSocks(t)
+
+	payload := jsonPayload(256 * 1024)
+	got, err := echoThrough(d, echo, payload, 10*time.Second)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo: err=%v, got %d of %d bytes", err, len(got), len(payload))
+	}
+	for _, side := range []struct {
+		n    *Node
+		peer string
+	}{{env.a, "nodeB"}, {env.b, "nodeA"}} {
+		s := side.n.CompressionStats()[side.peer]
+		if s.RawSent != int64(len(payload)) || s.RawRecv != int64(len(payload)) {
+			t.Fatalf("%s: raw bytes %+v, want %d each way", side.n.ID, s, len(payload))
+		}
+		if s.Ratio() < 3 {
+			t.Fatalf("%s: compression ratio %.2f (%+v)", side.n.ID, s.Ratio(), s)
+		}
+	}
+}
+
+func TestCompressionOneSided(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 24, simPeer{}, simPeer{}, Timeouts{})
+	env.a.SetCompression(CompressionConfig{Enabled: true})
+	d := env.startSocks(t)
+
+	payload := jsonPayload(64 * 1024)
+	got, err := echoThrough(d, echo, payload, 10*time.Second)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo: err=%v, got %d of %d bytes", err, len(got), len(payload))
+	}
+	// 出口节点没有启用压缩，双方都不压缩
+	s := env.a.CompressionStats()["nodeB"]
+	if s.WireSent != s.RawSent || s.WireRecv != s.RawRecv {
+		t.Fatalf("compressed without agreement: %+v", s)
+	}
+}
+
+func TestStreamCompressorSampling(t *testing.T) {
+	c := newStreamCompressor(compressDeflate, defaultCompressLevel)
+	rnd := rand.New(rand.NewSource(1))
+	chunk := make([]byte, streamChunkSize)
+	for i := 0; i < compressSample; i++ {
+		rnd.Read(chunk)
+		if out, enc := c.compress(chunk); enc != "" || len(out) != len(chunk) {
+			t.Fatalf("incompressible chunk sent as %q with %d bytes", enc, len(out))
+		}
+	}
+	if c.skip != compressBackoff {
+		t.Fatalf("skip = %d after sampling incompressible data, want %d", c.skip, compressBackoff)
+	}
+	// 停止压缩期间即使数据可压缩也原样发送，之后重新采样
+	text := jsonPayload(streamChunkSize)
+	for i := 0; i < compressBackoff; i++ {
+		if _, enc := c.compress(text); enc != "" {
+			t.Fatalf("chunk %d compressed during backoff", i)
+		}
+	}
+	out, enc := c.compress(text)
+	if enc != compressDeflate || len(out) >= len(text)/3 {
+		t.Fatalf("after backoff: enc=%q, %d bytes", enc, len(out))
+	}
+	var d streamDecompressor
+	if plain, err := d.decompress(enc, out); err != nil || !bytes.Equal(plain, text) {
+		t.Fatalf("decompress: %v", err)
+	}
+	if _, err := d.decompress(compressDeflate, []byte("not deflate")); err == nil {
+		t.Fatal("garbage decompressed without error")
+	}
+}
@@ -0,0 +1,201 @@
+package p2proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 数据流连接
+// DialPeer 与 Listen 返回的连接是一对内存连接的一端，另一端作为数据流的本地连接交给 pumpLocal 与 readLoop。
+// 每个方向有 streamConnBuffer 字节的缓冲区：readLoop 写入时通常不会阻塞，应用长时间不读取时才阻塞，
+// 与本地连接是 TCP 时对端接收缓冲区写满的效果相同。
+
+// streamConnBuffer 每个方向的缓冲区大小，与数据流的发送窗口相当
+const streamConnBuffer = streamWindow * streamChunkSize
+
+// PeerAddr 数据流连接的地址
+// Node: 节点ID
+// Target: 数据流的目标，host:port 或 svc:<服务名>；发起方一端的地址为空
+type PeerAddr struct {
+	Node   string
+	Target string
+}
+
+func (a PeerAddr) Network() string { return "p2proxy" }
+
+func (a PeerAddr) String() string {
+	if a.Target == "" {
+		return a.Node
+	}
+	return a.Node + "/" + a.Target
+}
+
+// connBuffer 一个方向的数据
+// eof: 写入方已关闭写端；rclosed: 读取方已关闭
+type connBuffer struct {
+	data    []byte
+	eof     bool
+	rclosed bool
+}
+
+// connPair 一对连接共享的状态，bufs[i] 是第 i 端读取的数据
+type connPair struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	bufs [2]connBuffer
+}
+
+// streamConn 实现 net.Conn，支持读写超时与半关闭（CloseWrite）
+type streamConn struct {
+	p             *connPair
+	side          int
+	local, remote net.Addr
+
+	// 以下字段由 p.mu 保护
+	closed     bool
+	wclosed    bool
+	rdl, wdl   time.Time
+	rtmr, wtmr *time.Timer
+}
+
+// newConnPair 创建一对相连的连接，a 的地址为 (local, remote)，b 的地址相反
+func newConnPair(local, remote net.Addr) (a, b *streamConn) {
+	p := &connPair{}
+	p.cond = sync.NewCond(&p.mu)
+	return &streamConn{p: p, side: 0, local: local, remote: remote},
+		&streamConn{p: p, side: 1, local: remote, remote: local}
+}
+
+// expired 截止时间是否已过，需持有 p.mu
+func expired(dl time.Time) bool {
+	return !dl.IsZero() && !time.Now().Before(dl)
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	buf := &c.p.bufs[c.side]
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(buf.data) > 0:
+			n := copy(b, buf.data)
+			buf.data = buf.data[n:]
+			if len(buf.data) == 0 {
+				buf.data = nil
+			}
+			c.p.cond.Broadcast()
+			return n, nil
+		case buf.eof:
+			return 0, io.EOF
+		case expired(c.rdl):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.p.cond.Wait()
+	}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	buf := &c.p.bufs[1-c.side]
+	written := 0
+	for written < len(b) {
+		switch {
+		case c.closed:
+			return written, net.ErrClosed
+		case c.wclosed:
+			return written, errors.New("write after CloseWrite")
+		case buf.rclosed:
+			return written, io.ErrClosedPipe
+		case expired(c.wdl):
+			return written, os.ErrDeadlineExceeded
+		}
+		if space := streamConnBuffer - len(buf.data); space > 0 {
+			n := min(space, len(b)-written)
+			buf.data = append(buf.data, b[written:written+n]...)
+			written += n
+			c.p.cond.Broadcast()
+			continue
+		}
+		c.p.cond.Wait()
+	}
+	return written, nil
+}
+
+// CloseWrite 关闭写端：对端读完已写入的数据后收到 io.EOF，本端仍可继续读取
+func (c *streamConn) CloseWrite() error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.wclosed = true
+	c.p.bufs[1-c.side].eof = true
+	c.p.cond.Broadcast()
+	return nil
+}
+
+func (c *streamConn) Close() error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.p.bufs[c.side] = connBuffer{rclosed: true}
+	c.p.bufs[1-c.side].eof = true
+	for _, t := range []*time.Timer{c.rtmr, c.wtmr} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	c.p.cond.Broadcast()
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.rdl = t
+	c.rtmr = c.resetTimer(c.rtmr, t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.wdl = t
+	c.wtmr = c.resetTimer(c.wtmr, t)
+	return nil
+}
+
+// resetTimer 在截止时间到达时唤醒等待中的读写，需持有 p.mu
+func (c *streamConn) resetTimer(t *time.Timer, dl time.Time) *time.Timer {
+	if t != nil {
+		t.Stop()
+	}
+	// 唤醒正在等待的读写，按新的截止时间重新检查
+	c.p.cond.Broadcast()
+	if dl.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(dl), func() {
+		c.p.mu.Lock()
+		c.p.cond.Broadcast()
+		c.p.mu.Unlock()
+	})
+}
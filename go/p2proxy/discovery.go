@@ -0,0 +1,167 @@
+package p2proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// 局域网发现
+// 启用后节点加入一个 IPv4 组播组，定期从节点的 UDP 套接字向组内发送 announce，
+// 同一局域网的节点由此得知彼此的局域网地址，不经过 tracker 直接连接。
+// 收到未知节点的 announce 时立即单播回复一个 announce，新加入的节点不必等待下一个周期。
+// 查询节点地址时局域网内发现的地址优先于缓存和 tracker；查询本地未知的节点时发送带 to 的 announce，该节点收到后立即回复。
+// 没有配置 tracker 时节点只使用局域网发现（无 tracker 模式）。
+
+const (
+	// DefaultDiscoveryGroup 默认的组播组地址
+	DefaultDiscoveryGroup    = "239.255.77.77:40077"
+	defaultDiscoveryInterval = 5 * time.Second
+	lanPeerTTLFactor         = 3 // 局域网节点连续 3 个周期没有 announce 时过期
+)
+
+// DiscoveryConfig 局域网发现配置
+type DiscoveryConfig struct {
+	Enabled  bool
+	Group    string        // 组播组地址，默认 DefaultDiscoveryGroup
+	Interval time.Duration // 发送 announce 的间隔，默认5秒
+}
+
+// multicastNetwork 支持组播的网络，netsim.Host 与真实网络都实现了该接口
+type multicastNetwork interface {
+	ListenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+func (realNetwork) ListenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenMulticastUDP(network, ifi, gaddr)
+}
+
+// discovery 运行中的局域网发现
+// conn: 加入组播组的套接字，只用于接收；announce 从节点的 UDP 套接字发出，对端据此得知节点的地址
+type discovery struct {
+	group    *net.UDPAddr
+	conn     net.PacketConn
+	interval time.Duration
+}
+
+// lanPeer 局域网内发现的节点
+type lanPeer struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// startDiscovery 加入组播组并开始定期发送 announce
+func (n *Node) startDiscovery(cfg DiscoveryConfig) error {
+	if cfg.Group == "" {
+		cfg.Group = DefaultDiscoveryGroup
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultDiscoveryInterval
+	}
+	gaddr, err := net.ResolveUDPAddr("udp4", cfg.Group)
+	if err != nil {
+		return err
+	}
+	if !gaddr.IP.IsMulticast() {
+		return fmt.Errorf("discovery group %s is not a multicast address", cfg.Group)
+	}
+	mn, ok := n.network.(multicastNetwork)
+	if !ok {
+		return errors.New("network does not support multicast discovery")
+	}
+	conn, err := mn.ListenMulticastUDP("udp4", nil, gaddr)
+	if err != nil {
+		return err
+	}
+	n.discovery = &discovery{group: gaddr, conn: conn, interval: cfg.Interval}
+	go n.discoveryLoop(conn)
+	go n.announceLoop()
+	n.log.Info("lan discovery started", "group", gaddr.String())
+	return nil
+}
+
+// announce 向组播组宣告本节点，to 不为空时请求该节点立即回复
+func (n *Node) announce(to string) {
+	if n.discovery == nil {
+		return
+	}
+	if err := n.sendProto(n.discovery.group, ProtoMsg{Type: "announce", From: n.ID, To: to}); err != nil {
+		n.pktLog.Debug("send announce error", "err", err)
+	}
+}
+
+// announceLoop 定期发送 announce，直到节点关闭
+func (n *Node) announceLoop() {
+	ticker := time.NewTicker(n.discovery.interval)
+	defer ticker.Stop()
+	for {
+		n.announce("")
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// discoveryLoop 读取组播组中的 announce
+func (n *Node) discoveryLoop(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		nread, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			n.log.Debug("discovery read loop stopped", "err", err)
+			return
+		}
+		addr := toUDPAddr(raddr)
+		if addr == nil {
+			continue
+		}
+		var m ProtoMsg
+		if err := json.Unmarshal(buf[:nread], &m); err != nil || m.Type != "announce" {
+			continue
+		}
+		if !verifyMsg(n.key, &m) {
+			n.pktLog.Warn("bad signature", logKeyAddr, addr.String())
+			continue
+		}
+		n.onAnnounce(m, addr, true)
+	}
+}
+
+// onAnnounce 记录局域网节点的地址，并完成对该节点进行中的查询
+// multicast 为 true 表示来自组播组，此时对新节点或指名请求本节点的 announce 单播回复
+func (n *Node) onAnnounce(m ProtoMsg, addr *net.UDPAddr, multicast bool) {
+	if m.From == "" || m.From == n.ID || n.discovery == nil {
+		return
+	}
+	now := time.Now()
+	n.mu.Lock()
+	old, known := n.lanPeers[m.From]
+	known = known && now.Before(old.expires) && old.addr.String() == addr.String()
+	n.lanPeers[m.From] = lanPeer{addr: addr, expires: now.Add(lanPeerTTLFactor * n.discovery.interval)}
+	if f := n.inflight[m.From]; f != nil {
+		n.completeLookupLocked(f, addr, nil)
+	}
+	n.mu.Unlock()
+
+	if !known {
+		n.log.Info("discovered lan peer", logKeyPeer, m.From, logKeyAddr, addr.String())
+	}
+	if multicast && (!known || m.To == n.ID) {
+		n.sendProto(addr, ProtoMsg{Type: "announce", From: n.ID})
+	}
+}
+
+// lanPeerLocked 返回局域网内发现的未过期的节点地址，需持有 n.mu
+func (n *Node) lanPeerLocked(peerID string) *net.UDPAddr {
+	if p, ok := n.lanPeers[peerID]; ok && time.Now().Before(p.expires) {
+		return p.addr
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package p2proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+)
+
+func TestDiscoveryTrackerless(t *testing.T) {
+	// nodeA、nodeB 位于同一个对称型 NAT 之后，nodeC 在另一个局域网；没有 tracker
+	nw := netsim.New(netsim.Config{Seed: 15})
+	nat := nw.AddNAT("198.51.100.1", netsim.Symmetric)
+	newNode := func(id string, h *netsim.Host) *Node {
+		n, err := NewNodeWithConfig(NodeConfig{
+			ID:        id,
+			Logger:    quietLogger(),
+			Network:   h,
+			Timeouts:  Timeouts{Lookup: 500 * time.Millisecond},
+			Discovery: DiscoveryConfig{Enabled: true, Interval: 200 * time.Millisecond},
+		})
+		if err != nil {
+			t.Fatalf("create %s: %v", id, err)
+		}
+		t.Cleanup(n.Close)
+		return n
+	}
+	a := newNode("nodeA", nw.AddHost("10.0.5.2", nat))
+	b := newNode("nodeB", nw.AddHost("10.0.5.3", nat))
+	newNode("nodeC", nw.AddHost("10.0.6.2", nw.AddNAT("198.51.100.2", netsim.Symmetric)))
+
+	addr, err := a.Lookup("nodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := b.conn.LocalAddr().(*net.UDPAddr).Port; !addr.IP.Equal(net.ParseIP("10.0.5.3")) || addr.Port != want {
+		t.Fatalf("discovered %s, want 10.0.5.3:%d", addr, want)
+	}
+	checkEcho(t, a, "nodeB", startEchoServer(t), 64*1024)
+
+	// 组播不跨越局域网
+	if _, err := a.Lookup("nodeC"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("lookup nodeC in another LAN: %v, want ErrPeerNotFound", err)
+	}
+
+	if _, err := NewNodeWithConfig(NodeConfig{ID: "nodeD", Logger: quietLogger(), Network: nw.AddHost("10.0.7.2", nil)}); err == nil {
+		t.Fatal("node without trackers or discovery created")
+	}
+}
@@ -0,0 +1,106 @@
+package p2proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ListenHTTPProxy 在本地监听一个 HTTP 代理，并把连接流量通过 peerID 的远端节点转发
+// 支持 CONNECT 隧道（HTTPS 等）以及普通的绝对 URI 请求（http://host/path）
+// listenAddr: 本地HTTP代理监听地址
+// peerID: 用于转发流量的远端节点ID
+func (n *Node) ListenHTTPProxy(listenAddr string, peerID string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	n.log.Info("http proxy listening", logKeyAddr, listenAddr, logKeyPeer, peerID)
+	go n.acceptLoop(ln, "http", func(c net.Conn) { n.handleHTTPConn(c, peerID) })
+	return ln, nil
+}
+
+// ListenForward 在本地监听一个端口转发：所有连接都经 peerID 的远端节点转发到固定目标 target
+// listenAddr: 本地监听地址
+// peerID: 用于转发流量的远端节点ID
+// target: 远端节点要连接的目标地址(host:port)
+func (n *Node) ListenForward(listenAddr string, peerID string, target string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	n.log.Info("forward listening", logKeyAddr, listenAddr, logKeyPeer, peerID, logKeyTarget, target)
+	go n.acceptLoop(ln, "forward", func(c net.Conn) { n.openStream(c, peerID, target) })
+	return ln, nil
+}
+
+// handleHTTPConn 处理来自HTTP代理客户端的连接请求
+func (n *Node) handleHTTPConn(c net.Conn, peerID string) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		n.log.Debug("http proxy read request error", "err", err)
+		c.Close()
+		return
+	}
+	if err := n.quota.check(peerID); err != nil {
+		n.log.Warn("refuse http proxy request", logKeyPeer, peerID, "err", err)
+		c.Write([]byte("HTTP/1.1 429 Too Many Requests\r\nConnection: close\r\n\r\n"))
+		c.Close()
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		// CONNECT 隧道：先回复建立成功，之后的字节原样转发
+		dstAddr := req.Host
+		if _, _, err := net.SplitHostPort(dstAddr); err != nil {
+			dstAddr = net.JoinHostPort(dstAddr, "443")
+		}
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		n.openStream(&prefixConn{Conn: c, r: br}, peerID, dstAddr)
+		return
+	}
+
+	// 普通代理请求：改写为源站形式的请求，作为数据流的首段数据发出
+	if req.URL.Host == "" {
+		n.log.Warn("http proxy: request has no absolute URL", "url", req.URL.String())
+		c.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		c.Close()
+		return
+	}
+	dstAddr := req.URL.Host
+	if _, _, err := net.SplitHostPort(dstAddr); err != nil {
+		dstAddr = net.JoinHostPort(dstAddr, "80")
+	}
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	// 同一连接上的后续请求可能指向其他主机，这里只转发一个请求
+	req.Close = true
+	var head bytes.Buffer
+	if err := req.Write(&head); err != nil {
+		n.log.Warn("http proxy: rewrite request error", "err", err)
+		c.Close()
+		return
+	}
+	n.openStream(&prefixConn{Conn: c, r: io.MultiReader(&head, br)}, peerID, dstAddr)
+}
+
+// prefixConn 先读出已缓冲/改写过的数据，再读底层连接
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// CloseWrite 透传给底层连接，保持半关闭语义
+func (p *prefixConn) CloseWrite() error {
+	if cw, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return p.Conn.Close()
+}
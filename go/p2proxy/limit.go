@@ -0,0 +1,129 @@
+package p2proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// 带宽限制
+// 使用令牌桶限制本节点经 P2P 通道收发的数据速率，分为全局、每个对端节点、每条数据流三级，
+// 一块数据需要同时从三个令牌桶取得令牌。全局与对端节点的令牌桶由收发两个方向共用，每条数据流收发各有一个。
+// 发送方向在发送前等待令牌；接收方向不能阻塞读取循环，收到数据后取走令牌，
+// 把需要等待的时长放在 data_ack 的 pause 中，发送方在该时长内暂停发送，
+// 因此接收方向的速率最多超出一个发送窗口（streamWindow 个数据块）。
+// SOCKS 侧节点的限制因此同时作用于上传与下载，不需要在出口节点上配置。
+
+// RateLimits 带宽限制，单位为字节/秒，0 表示不限制
+type RateLimits struct {
+	Global    int64            // 本节点所有数据流合计
+	PerPeer   int64            // 每个对端节点的所有数据流合计
+	PerStream int64            // 每条数据流
+	Peers     map[string]int64 // 按节点ID覆盖 PerPeer
+}
+
+// tokenBucket 令牌桶，容量为一秒的令牌（至少一个数据块），允许透支：
+// 取走令牌后若余额为负，调用方需等待余额恢复到零所需的时间
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 创建速率为 rate 字节/秒的令牌桶，rate <= 0 时返回 nil 表示不限制
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	if burst < streamChunkSize {
+		burst = streamChunkSize
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve 取走 n 个令牌，返回需要等待的时长
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter 按 RateLimits 创建的一组令牌桶，重新加载配置时整体替换
+type rateLimiter struct {
+	cfg    RateLimits
+	global *tokenBucket
+	mu     sync.Mutex
+	peers  map[string]*tokenBucket
+}
+
+func newRateLimiter(cfg RateLimits) *rateLimiter {
+	return &rateLimiter{cfg: cfg, global: newTokenBucket(cfg.Global), peers: make(map[string]*tokenBucket)}
+}
+
+// peer 返回对端节点的令牌桶，首次使用时创建
+func (l *rateLimiter) peer(id string) *tokenBucket {
+	rate, ok := l.cfg.Peers[id]
+	if !ok {
+		rate = l.cfg.PerPeer
+	}
+	if rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.peers[id]
+	if b == nil {
+		b = newTokenBucket(rate)
+		l.peers[id] = b
+	}
+	return b
+}
+
+// newStreamBucket 为一条数据流创建令牌桶
+func (l *rateLimiter) newStreamBucket() *tokenBucket {
+	return newTokenBucket(l.cfg.PerStream)
+}
+
+// reserve 从全局、对端节点、数据流三个令牌桶取走 n 个令牌，返回全部满足需要等待的时长
+func (l *rateLimiter) reserve(peer string, streamBucket *tokenBucket, n int) time.Duration {
+	d := l.global.reserve(n)
+	if pd := l.peer(peer).reserve(n); pd > d {
+		d = pd
+	}
+	if sd := streamBucket.reserve(n); sd > d {
+		d = sd
+	}
+	return d
+}
+
+// wait 取走 n 个令牌，阻塞到全部满足为止
+func (l *rateLimiter) wait(peer string, streamBucket *tokenBucket, n int) {
+	if d := l.reserve(peer, streamBucket, n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// SetRateLimits 更新带宽限制，全局与对端节点的限制立即生效，
+// 每条数据流的限制在该数据流下一次收发数据时生效
+func (n *Node) SetRateLimits(l RateLimits) {
+	lim := newRateLimiter(l)
+	n.mu.Lock()
+	n.limiter = lim
+	n.mu.Unlock()
+}
+
+func (n *Node) getLimiter() *rateLimiter {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.limiter
+}
@@ -0,0 +1,151 @@
+package p2proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if d := (*tokenBucket)(nil).reserve(1 << 20); d != 0 {
+		t.Fatalf("nil bucket should not wait, got %v", d)
+	}
+	b := newTokenBucket(64 * 1024)
+	// 初始有一秒的令牌
+	if d := b.reserve(64 * 1024); d != 0 {
+		t.Fatalf("burst should not wait, got %v", d)
+	}
+	// 透支半秒的令牌
+	d := b.reserve(32 * 1024)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("want about 500ms wait, got %v", d)
+	}
+}
+
+func TestRateLimitThroughput(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 1, simPeer{}, simPeer{}, Timeouts{})
+	// 出口侧每条数据流 128KB/s，回显 256KB 除去一秒的初始令牌至少需要一秒
+	env.b.SetRateLimits(RateLimits{PerStream: 128 * 1024})
+	d := env.startSocks(t)
+
+	payload := bytes.Repeat([]byte("x"), 256*1024)
+	start := time.Now()
+	got, err := echoThrough(d, echo, payload, 10*time.Second)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("echo through proxy: %v (got %d bytes)", err, len(got))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("transfer finished in %v, rate limit not applied", elapsed)
+	}
+}
+
+func TestRateLimitDownload(t *testing.T) {
+	// 目标服务器连接后直接发送 3MB，上传方向没有数据
+	payload := bytes.Repeat([]byte("y"), 3*1024*1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write(payload)
+			}()
+		}
+	}()
+
+	env := newSimEnv(t, 1, simPeer{}, simPeer{}, Timeouts{})
+	// 只在 SOCKS 侧限制每条数据流 512KB/s，出口侧不限制；
+	// 除去一秒的初始令牌和对端在收到暂停前发出的一个窗口（1MB），剩余 1.5MB 至少需要三秒
+	env.a.SetRateLimits(RateLimits{PerStream: 512 * 1024})
+	d := env.startSocks(t)
+
+	start := time.Now()
+	c, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("download through proxy: %v (got %d bytes)", err, len(got))
+	}
+	if elapsed := time.Since(start); elapsed < 2500*time.Millisecond {
+		t.Fatalf("download finished in %v, receive rate limit not applied", elapsed)
+	}
+}
+
+func TestQuotaPersistAndRoll(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	cfg := QuotaConfig{File: file, Default: Quota{Daily: 100}, Peers: map[string]Quota{"vip": {}}}
+	q, err := newQuotaStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+	q.now = func() time.Time { return now }
+
+	q.add("nodeA", 100)
+	q.add("vip", 1000)
+	if err := q.check("nodeA"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded, got %v", err)
+	}
+	if err := q.check("vip"); err != nil {
+		t.Fatalf("unlimited peer refused: %v", err)
+	}
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后用量仍在
+	q2, err := newQuotaStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q2.now = q.now
+	if err := q2.check("nodeA"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("usage not persisted: %v", err)
+	}
+
+	// 跨日、跨月后清零
+	now = now.Add(2 * time.Hour)
+	if err := q2.check("nodeA"); err != nil {
+		t.Fatalf("quota not reset on new day: %v", err)
+	}
+	if u := q2.usageOf("vip"); u.Month != "2026-02" || u.MonthBytes != 0 {
+		t.Fatalf("monthly usage not reset: %+v", u)
+	}
+}
+
+func TestQuotaRefusesStreams(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 2, simPeer{}, simPeer{}, Timeouts{Open: 500 * time.Millisecond})
+	env.b.SetQuotas(QuotaConfig{Default: Quota{Daily: 1024}})
+	d := env.startSocks(t)
+
+	// 第一条数据流用掉配额
+	payload := bytes.Repeat([]byte("y"), 1024)
+	if _, err := echoThrough(d, echo, payload, 5*time.Second); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+	if u := env.b.QuotaUsage("nodeA"); u.DayBytes < 1024 {
+		t.Fatalf("usage not counted: %+v", u)
+	}
+	// 之后出口侧拒绝新的数据流
+	got, err := echoThrough(d, echo, []byte("more"), 5*time.Second)
+	if err == nil && len(got) > 0 {
+		t.Fatalf("stream accepted after quota exhausted, got %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+package p2proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 日志字段名，Node 与 Tracker 统一使用，便于日志管道解析
+const (
+	logKeyNode     = "node"
+	logKeyPeer     = "peer"
+	logKeyStreamID = "stream_id"
+	logKeyTarget   = "target"
+	logKeyAddr     = "addr"
+)
+
+// SampleConfig 日志采样配置：每个 Interval 内同一级别的同一条消息先输出 First 条，之后每 Thereafter 条输出一条
+// 用于每个数据包都会触发的日志（探测包、数据写入失败等），避免刷屏；Error 及以上级别不采样
+type SampleConfig struct {
+	First      int
+	Thereafter int
+	Interval   time.Duration
+}
+
+func (c SampleConfig) withDefaults() SampleConfig {
+	if c.First <= 0 {
+		c.First = 5
+	}
+	if c.Thereafter <= 0 {
+		c.Thereafter = 100
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	return c
+}
+
+// NewSampledHandler 创建一个按消息内容采样的 slog.Handler，未输出的记录直接丢弃
+func NewSampledHandler(h slog.Handler, cfg SampleConfig) slog.Handler {
+	return &sampledHandler{h: h, cfg: cfg.withDefaults(), state: &sampleState{counts: make(map[string]int)}}
+}
+
+type sampleState struct {
+	mu     sync.Mutex
+	reset  time.Time
+	counts map[string]int
+}
+
+type sampledHandler struct {
+	h     slog.Handler
+	cfg   SampleConfig
+	state *sampleState
+}
+
+func (s *sampledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.h.Enabled(ctx, level)
+}
+
+func (s *sampledHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		return s.h.Handle(ctx, r)
+	}
+	st := s.state
+	st.mu.Lock()
+	if r.Time.Sub(st.reset) >= s.cfg.Interval {
+		st.reset = r.Time
+		clear(st.counts)
+	}
+	key := r.Level.String() + r.Message
+	st.counts[key]++
+	cnt := st.counts[key]
+	st.mu.Unlock()
+
+	if cnt > s.cfg.First && (cnt-s.cfg.First)%s.cfg.Thereafter != 0 {
+		return nil
+	}
+	return s.h.Handle(ctx, r)
+}
+
+func (s *sampledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampledHandler{h: s.h.WithAttrs(attrs), cfg: s.cfg, state: s.state}
+}
+
+func (s *sampledHandler) WithGroup(name string) slog.Handler {
+	return &sampledHandler{h: s.h.WithGroup(name), cfg: s.cfg, state: s.state}
+}
+
+// loggerOrDefault 返回 l，为 nil 时返回 slog.Default()
+func loggerOrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
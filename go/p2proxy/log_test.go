@@ -0,0 +1,81 @@
+package p2proxy
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler 记录收到的消息
+type countingHandler struct {
+	msgs *[]string
+}
+
+func (h countingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h countingHandler) Handle(_ context.Context, r slog.Record) error {
+	*h.msgs = append(*h.msgs, r.Level.String()+" "+r.Message)
+	return nil
+}
+func (h countingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h countingHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestSampledHandler(t *testing.T) {
+	var msgs []string
+	h := NewSampledHandler(countingHandler{&msgs}, SampleConfig{First: 2, Thereafter: 3, Interval: time.Minute})
+	start := time.Now()
+	emit := func(at time.Duration, level slog.Level, msg string) {
+		h.Handle(context.Background(), slog.NewRecord(start.Add(at), level, msg, 0))
+	}
+	count := func(s string) int {
+		n := 0
+		for _, m := range msgs {
+			if m == s {
+				n++
+			}
+		}
+		return n
+	}
+
+	// 前2条输出，之后每3条输出1条：10条中输出第1、2、5、8条
+	for i := 0; i < 10; i++ {
+		emit(time.Duration(i)*time.Second, slog.LevelDebug, "probe")
+	}
+	if n := count("DEBUG probe"); n != 4 {
+		t.Fatalf("%d of 10 records passed, want 4", n)
+	}
+	// 按级别加消息分别计数
+	emit(10*time.Second, slog.LevelWarn, "probe")
+	emit(10*time.Second, slog.LevelDebug, "other")
+	if count("WARN probe") != 1 || count("DEBUG other") != 1 {
+		t.Fatalf("records with a new level or message were sampled: %v", msgs)
+	}
+	// Error 不采样
+	for i := 0; i < 10; i++ {
+		emit(10*time.Second, slog.LevelError, "write failed")
+	}
+	if n := count("ERROR write failed"); n != 10 {
+		t.Fatalf("%d of 10 error records passed", n)
+	}
+	// 新的采样窗口重新计数
+	emit(time.Minute+10*time.Second, slog.LevelDebug, "probe")
+	emit(time.Minute+11*time.Second, slog.LevelDebug, "probe")
+	if n := count("DEBUG probe"); n != 6 {
+		t.Fatalf("%d probe records after a new window, want 6", n)
+	}
+}
+
+func TestSampledHandlerDerivedShareState(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(NewSampledHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		SampleConfig{First: 1, Thereafter: 1000, Interval: time.Hour}))
+	// With/WithGroup 派生的 Logger 与原 Logger 共用计数
+	base.Debug("probe")
+	base.With(logKeyPeer, "nodeB").Debug("probe")
+	base.WithGroup("g").Debug("probe", "k", "v")
+	if n := strings.Count(buf.String(), "msg=probe"); n != 1 {
+		t.Fatalf("%d probe records passed through derived loggers, want 1:\n%s", n, buf.String())
+	}
+}
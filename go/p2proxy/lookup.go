@@ -0,0 +1,260 @@
+package p2proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+)
+
+// peer 地址查询
+// 每次查询带一个请求ID（req_id），tracker 在 peer/notfound 回复中原样带回，节点据此把回复交给对应的查询。
+// 对同一节点的并发查询合并为一次；查询结果与 notify、probe 学到的地址一起放入带有效期的缓存。
+// 启用了局域网发现时，局域网内发现的地址优先，见 discovery.go。
+
+var (
+	// ErrPeerNotFound 所有 tracker 都回复该节点未注册，或无 tracker 模式下局域网内没有发现该节点
+	ErrPeerNotFound = errors.New("peer not found")
+	// ErrLookupTimeout 在 Timeouts.Lookup 内没有收到 tracker 的回复
+	ErrLookupTimeout = errors.New("peer lookup timeout")
+)
+
+// lookupResendInterval 未收到回复时重发 lookup 的间隔
+const lookupResendInterval = time.Second
+
+// LookupFuture 一次 peer 地址查询的结果，收到 peer 回复或所有 tracker 都回复 notfound 时完成
+type LookupFuture struct {
+	peer     string
+	reqID    string
+	trackers int             // 发出查询时的 tracker 数量
+	notfound map[string]bool // 已回复 notfound 的 tracker 地址，由 n.mu 保护
+	checking bool            // 正在对候选地址做连通性检查，由 n.mu 保护
+	done     chan struct{}
+	addr     *net.UDPAddr
+	err      error
+}
+
+// Done 查询完成时关闭
+func (f *LookupFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result 返回查询结果，只能在 Done 关闭后调用
+func (f *LookupFuture) Result() (*net.UDPAddr, error) {
+	return f.addr, f.err
+}
+
+// Wait 等待查询完成或 ctx 结束
+func (f *LookupFuture) Wait(ctx context.Context) (*net.UDPAddr, error) {
+	select {
+	case <-f.done:
+		return f.addr, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// peerEntry 缓存的 peer 地址
+type peerEntry struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// LookupAsync 发起 peer 地址查询并立即返回。局域网内发现了该节点或缓存中有未过期的地址时返回已完成的查询，
+// 同一节点已有进行中的查询时返回该查询
+func (n *Node) LookupAsync(peerID string) *LookupFuture {
+	n.mu.Lock()
+	addr := n.lanPeerLocked(peerID)
+	if e, ok := n.peers[peerID]; addr == nil && ok && time.Now().Before(e.expires) {
+		addr = e.addr
+	}
+	if addr != nil {
+		n.mu.Unlock()
+		f := &LookupFuture{peer: peerID, done: make(chan struct{}), addr: addr}
+		close(f.done)
+		return f
+	}
+	if f := n.inflight[peerID]; f != nil {
+		n.mu.Unlock()
+		return f
+	}
+	f := &LookupFuture{peer: peerID, reqID: newReqID(), trackers: len(n.trackers), notfound: make(map[string]bool), done: make(chan struct{})}
+	n.inflight[peerID] = f
+	n.lookups[f.reqID] = f
+	n.mu.Unlock()
+
+	go n.runLookup(f)
+	return f
+}
+
+// LookupContext 查询 peer 地址，ctx 结束时返回 ctx.Err()
+func (n *Node) LookupContext(ctx context.Context, peerID string) (*net.UDPAddr, error) {
+	return n.LookupAsync(peerID).Wait(ctx)
+}
+
+// Lookup 向 tracker 请求指定 peer 节点的地址信息
+// peerID: 要查找的节点ID
+// 返回查找到的节点地址，节点未注册时返回 ErrPeerNotFound，超时返回 ErrLookupTimeout
+func (n *Node) Lookup(peerID string) (*net.UDPAddr, error) {
+	return n.LookupContext(context.Background(), peerID)
+}
+
+// runLookup 向所有 tracker 发送查询（启用局域网发现时同时在局域网内询问），未完成时定期重发以应对丢包，
+// 超时后以 ErrLookupTimeout 结束；没有 tracker 时以 ErrPeerNotFound 结束。
+// 超时时已收到 tracker 回复、正在检查候选地址的，等待检查结束（最多 checkTimeout）后以检查结果完成
+func (n *Node) runLookup(f *LookupFuture) {
+	m := ProtoMsg{Type: "lookup", From: n.ID, To: f.peer, ReqID: f.reqID}
+	timeout := time.NewTimer(n.getTimeouts().Lookup)
+	defer timeout.Stop()
+	resend := time.NewTicker(lookupResendInterval)
+	defer resend.Stop()
+	for {
+		n.announce(f.peer)
+		if err := n.sendTrackers(m); err != nil {
+			n.completeLookup(f, nil, err)
+			return
+		}
+		select {
+		case <-f.done:
+			return
+		case <-n.quit:
+			n.completeLookup(f, nil, net.ErrClosed)
+			return
+		case <-timeout.C:
+			n.mu.Lock()
+			checking := f.checking
+			n.mu.Unlock()
+			if checking {
+				select {
+				case <-f.done:
+				case <-n.quit:
+					n.completeLookup(f, nil, net.ErrClosed)
+				}
+				return
+			}
+			if f.trackers == 0 {
+				n.completeLookup(f, nil, ErrPeerNotFound)
+			} else {
+				n.completeLookup(f, nil, ErrLookupTimeout)
+			}
+			return
+		case <-resend.C:
+		}
+	}
+}
+
+// completeLookup 以给定结果完成查询，重复调用时忽略
+func (n *Node) completeLookup(f *LookupFuture, addr *net.UDPAddr, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.completeLookupLocked(f, addr, err)
+}
+
+// completeLookupLocked 同 completeLookup，需持有 n.mu
+func (n *Node) completeLookupLocked(f *LookupFuture, addr *net.UDPAddr, err error) {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	f.addr, f.err = addr, err
+	close(f.done)
+	delete(n.lookups, f.reqID)
+	if n.inflight[f.peer] == f {
+		delete(n.inflight, f.peer)
+	}
+}
+
+// onPeerReply 处理 tracker 的 peer 回复：缓存地址并完成对应的查询
+// 不带 req_id 的回复（旧版本 tracker）交给该节点进行中的查询；读循环只把已配置 tracker 发来的回复交给这里
+func (n *Node) onPeerReply(m ProtoMsg, addr *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cachePeerLocked(m.From, addr)
+	f := n.lookups[m.ReqID]
+	if f == nil && m.ReqID == "" {
+		f = n.inflight[m.From]
+	}
+	if f != nil && f.peer == m.From {
+		n.completeLookupLocked(f, addr, nil)
+	}
+}
+
+// onPeerCandidates 处理带候选地址的 peer 回复：对候选地址做连通性检查，以选出的地址完成查询，
+// 全部检查失败时使用 tracker 看到的地址 addr。对重发的查询的重复回复只检查一次
+func (n *Node) onPeerCandidates(m ProtoMsg, addr *net.UDPAddr) {
+	n.mu.Lock()
+	f := n.lookups[m.ReqID]
+	if f == nil || f.peer != m.From || f.checking {
+		n.mu.Unlock()
+		return
+	}
+	f.checking = true
+	n.mu.Unlock()
+
+	go func() {
+		if best := n.checkCandidates(m.From, m.Candidates); best != nil {
+			addr = best
+		}
+		n.onPeerReply(m, addr)
+	}()
+}
+
+// onNotFound 处理 tracker 的 notfound 回复，所有 tracker 都回复 notfound 时查询以 ErrPeerNotFound 结束；
+// from 必须是已配置的 tracker（由读循环检查），否则伪造的 notfound 会被计入 tracker 数量
+func (n *Node) onNotFound(m ProtoMsg, from *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f := n.lookups[m.ReqID]
+	if f == nil && m.ReqID == "" {
+		f = n.inflight[m.To]
+	}
+	if f == nil {
+		return
+	}
+	// 同一个 tracker 对重发的查询会再次回复 notfound，按 tracker 地址去重
+	f.notfound[from.String()] = true
+	if len(f.notfound) >= f.trackers {
+		n.completeLookupLocked(f, nil, ErrPeerNotFound)
+	}
+}
+
+// cachePeer 缓存 peer 地址，有效期为 Timeouts.PeerTTL
+func (n *Node) cachePeer(peerID string, addr *net.UDPAddr) {
+	n.mu.Lock()
+	n.cachePeerLocked(peerID, addr)
+	n.mu.Unlock()
+}
+
+// cachePeerLocked 同 cachePeer，需持有 n.mu
+func (n *Node) cachePeerLocked(peerID string, addr *net.UDPAddr) {
+	n.peers[peerID] = peerEntry{addr: addr, expires: time.Now().Add(n.timeouts.PeerTTL)}
+}
+
+// cachedPeer 返回缓存中未过期的 peer 地址
+func (n *Node) cachedPeer(peerID string) *net.UDPAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, ok := n.peers[peerID]; ok && time.Now().Before(e.expires) {
+		return e.addr
+	}
+	return nil
+}
+
+// InvalidatePeer 从缓存中删除 peer 地址（包括局域网内发现的地址）并断开会话，下次查询会重新询问 tracker
+func (n *Node) InvalidatePeer(peerID string) {
+	n.mu.Lock()
+	delete(n.peers, peerID)
+	delete(n.lanPeers, peerID)
+	delete(n.sessions, peerID)
+	n.mu.Unlock()
+}
+
+// newReqID 生成随机的请求ID
+func newReqID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
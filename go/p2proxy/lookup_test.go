@@ -0,0 +1,159 @@
+package p2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+)
+
+func TestLookupFuture(t *testing.T) {
+	env := newSimEnv(t, 3, simPeer{}, simPeer{}, Timeouts{Lookup: 2 * time.Second})
+
+	// 并发查询同一节点合并为一次
+	f1 := env.a.LookupAsync("nodeB")
+	f2 := env.a.LookupAsync("nodeB")
+	if f1 != f2 {
+		t.Fatal("concurrent lookups for the same peer were not coalesced")
+	}
+	addr, err := f1.Wait(context.Background())
+	if err != nil || addr.String() != "198.51.100.2:30001" {
+		t.Fatalf("lookup nodeB = %v, %v", addr, err)
+	}
+
+	// 未注册的节点立即返回 notfound，而不是等到超时
+	start := time.Now()
+	if _, err := env.a.Lookup("nobody"); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("lookup unknown peer: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("notfound took %v", d)
+	}
+
+	// 缓存命中不再询问 tracker；失效后重新查询
+	env.a.cachePeer("nodeB", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9})
+	if addr, _ := env.a.Lookup("nodeB"); addr.String() != "192.0.2.1:9" {
+		t.Fatalf("cached lookup = %v", addr)
+	}
+	env.a.InvalidatePeer("nodeB")
+	if addr, _ := env.a.Lookup("nodeB"); addr.String() != "198.51.100.2:30001" {
+		t.Fatalf("lookup after invalidation = %v", addr)
+	}
+
+	// tracker 不可用时：取消 ctx 立即返回，后台查询最终超时
+	env.tracker.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := env.a.LookupContext(ctx, "nodeC"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lookup with cancelled ctx: %v", err)
+	}
+	if _, err := env.a.LookupAsync("nodeC").Wait(context.Background()); !errors.Is(err, ErrLookupTimeout) {
+		t.Fatalf("lookup without tracker: %v", err)
+	}
+}
+
+// readLookup 充当 tracker 从 conn 读取节点发来的 lookup 消息
+func readLookup(t *testing.T, conn net.PacketConn) (ProtoMsg, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 65535)
+	for {
+		nread, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m ProtoMsg
+		if json.Unmarshal(buf[:nread], &m) == nil && m.Type == "lookup" {
+			return m, addr
+		}
+	}
+}
+
+func TestLookupIgnoresSpoofedReplies(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 17})
+	tconn, err := nw.AddHost("203.0.113.1", nil).ListenPacket("udp", simTrackerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tconn.Close()
+	evil, err := nw.AddHost("192.0.2.66", nil).ListenPacket("udp", ":40000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer evil.Close()
+	n, err := NewNodeWithConfig(NodeConfig{ID: "nodeA", Trackers: []string{simTrackerAddr}, Logger: quietLogger(),
+		Network: nw.AddHost("198.51.100.1", nil), Timeouts: Timeouts{Lookup: 2 * time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	f := n.LookupAsync("nodeB")
+	// 充当 tracker 收取查询，得到节点地址与 req_id
+	lookup, nodeAddr := readLookup(t, tconn)
+	send := func(c net.PacketConn, m ProtoMsg) {
+		b, _ := json.Marshal(&m)
+		if _, err := c.WriteTo(b, nodeAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 其他地址发来的 peer/notfound 回复，带或不带 req_id 都被丢弃
+	send(evil, ProtoMsg{Type: "peer", From: "nodeB", Addr: "192.0.2.66:1", ReqID: lookup.ReqID})
+	send(evil, ProtoMsg{Type: "peer", From: "nodeB", Addr: "192.0.2.66:2"})
+	send(evil, ProtoMsg{Type: "notfound", To: "nodeB", ReqID: lookup.ReqID})
+	send(evil, ProtoMsg{Type: "notfound", To: "nodeB"})
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-f.Done():
+		addr, err := f.Result()
+		t.Fatalf("lookup completed by spoofed reply: %v, %v", addr, err)
+	default:
+	}
+	if addr := n.cachedPeer("nodeB"); addr != nil {
+		t.Fatalf("spoofed peer address cached: %v", addr)
+	}
+
+	// tracker 的回复正常处理
+	send(tconn, ProtoMsg{Type: "notfound", To: "nodeB", ReqID: lookup.ReqID})
+	if _, err := f.Wait(context.Background()); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatalf("lookup after tracker notfound: %v", err)
+	}
+}
+
+func TestLookupWaitsForCandidateCheck(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 19})
+	tconn, err := nw.AddHost("203.0.113.1", nil).ListenPacket("udp", simTrackerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tconn.Close()
+	n, err := NewNodeWithConfig(NodeConfig{ID: "nodeA", Trackers: []string{simTrackerAddr}, Logger: quietLogger(),
+		Network: nw.AddHost("198.51.100.1", nil), Timeouts: Timeouts{Lookup: 300 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	f := n.LookupAsync("nodeB")
+	lookup, nodeAddr := readLookup(t, tconn)
+	// tracker 按时回复，但候选地址都不通，检查持续 checkTimeout，超过剩余的查询时间
+	reply := ProtoMsg{Type: "peer", From: "nodeB", Addr: "198.51.100.2:30001", ReqID: lookup.ReqID,
+		Candidates: []Candidate{{Type: candidateHost, Addr: "10.0.2.2:30001"}, {Type: candidateSrflx, Addr: "198.51.100.2:30001"}}}
+	b, _ := json.Marshal(&reply)
+	if _, err := tconn.WriteTo(b, nodeAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	addr, err := f.Wait(context.Background())
+	if err != nil || addr.String() != "198.51.100.2:30001" {
+		t.Fatalf("lookup = %v, %v, want the tracker address after the check", addr, err)
+	}
+	if d := time.Since(start); d < checkTimeout/2 {
+		t.Fatalf("lookup finished after %v, before the candidate check", d)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix 环境变量覆盖配置的前缀。
+// 变量名由 yaml 字段路径转大写并以下划线连接，如 P2PROXY_KEYS_PSK、P2PROXY_TIMEOUTS_LOOKUP。
+// 字符串列表用逗号分隔，如 P2PROXY_TRACKERS=1.2.3.4:40000,5.6.7.8:40000
+const envPrefix = "P2PROXY"
+
+// Config p2proxy 命令行程序的配置文件（YAML）
+// 身份相关的字段（mode、id、keys、listen、tracker）只在启动时读取，SIGHUP 重载时忽略其变化
+type Config struct {
+	Mode        string            `yaml:"mode"`     // node、tracker、send 或 recv
+	ID          string            `yaml:"id"`       // 节点ID
+	Keys        KeysConfig        `yaml:"keys"`     // 密钥
+	Listen      string            `yaml:"listen"`   // 节点本地UDP监听地址，默认 :0
+	Tracker     TrackerConfig     `yaml:"tracker"`  // tracker 模式的配置
+	Trackers    []string          `yaml:"trackers"` // 节点要注册的 tracker 地址，启用 discovery 时可以为空
+	Peer        string            `yaml:"peer"`     // 监听器未指定 peer 时使用的默认远端节点
+	Listeners   ListenersConfig   `yaml:"listeners"`
+	Exit        ExitConfig        `yaml:"exit"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Quotas      QuotasConfig      `yaml:"quotas"`
+	Transfer    TransferConfig    `yaml:"transfer"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Compression CompressionConfig `yaml:"compression"`
+	Log         LogConfig         `yaml:"log"`
+
+	// Profiles 命名的配置片段，通过 -profile 选择后覆盖到上面的配置
+	Profiles map[string]interface{} `yaml:"profiles"`
+}
+
+// KeysConfig 密钥配置
+type KeysConfig struct {
+	PSK     string `yaml:"psk"`     // 与 tracker 及对端共享的预共享密钥
+	Control string `yaml:"control"` // tracker 控制连接的认证密钥，为空时使用 psk
+}
+
+// TrackerConfig tracker 模式的配置
+type TrackerConfig struct {
+	Listen  string        `yaml:"listen"`   // tracker UDP 监听地址
+	Store   string        `yaml:"store"`    // 注册信息的持久化文件，为空只保存在内存中
+	NodeTTL time.Duration `yaml:"node_ttl"` // 注册的有效期，默认 360s
+	Control string        `yaml:"control"`  // 管理控制连接的地址，unix:/path 或 host:port，为空不启动
+	Limits  TrackerLimits `yaml:"limits"`   // 滥用防护
+}
+
+// TrackerLimits tracker 的滥用防护，0 表示使用默认值，负数表示不限制
+type TrackerLimits struct {
+	PerIPRate     float64 `yaml:"per_ip_rate"`      // 每个来源 IP 每秒处理的包数，默认 20
+	PerIPBurst    int     `yaml:"per_ip_burst"`     // 默认为 per_ip_rate 的 2 倍
+	MaxNodesPerIP int     `yaml:"max_nodes_per_ip"` // 每个 IP 最多注册的节点数，默认 64
+	Amplification float64 `yaml:"amplification"`    // 对未注册地址的回复不超过请求的该倍数，默认 3
+	RequireCookie bool    `yaml:"require_cookie"`   // 新地址注册前需回显 cookie
+}
+
+// ListenersConfig 本地监听器
+type ListenersConfig struct {
+	Socks    []ListenerConfig `yaml:"socks"`
+	HTTP     []ListenerConfig `yaml:"http"`
+	Forwards []ForwardConfig  `yaml:"forwards"`
+}
+
+// ListenerConfig SOCKS5 或 HTTP 代理监听器
+type ListenerConfig struct {
+	Listen string `yaml:"listen"`
+	Peer   string `yaml:"peer"`
+}
+
+// ForwardConfig 端口转发：本地 listen 经 peer 转发到固定的 target
+type ForwardConfig struct {
+	Listen string `yaml:"listen"`
+	Peer   string `yaml:"peer"`
+	Target string `yaml:"target"`
+}
+
+// ExitConfig 作为出口节点时的策略，规则格式见 p2proxy.ExitPolicy
+type ExitConfig struct {
+	AllowPeers []string `yaml:"allow_peers"`
+	Allow      []string `yaml:"allow"`
+	Deny       []string `yaml:"deny"`
+}
+
+// TimeoutsConfig 超时设置，使用 Go 的时长格式，如 5s、2m
+type TimeoutsConfig struct {
+	Register time.Duration `yaml:"register"` // 重新注册间隔，默认 120s
+	Lookup   time.Duration `yaml:"lookup"`
+	Open     time.Duration `yaml:"open"`
+	Dial     time.Duration `yaml:"dial"`
+	PeerTTL  time.Duration `yaml:"peer_ttl"` // peer 地址缓存的有效期，默认 60s
+	Idle     time.Duration `yaml:"idle"`     // 数据流空闲超时，默认 5m
+}
+
+// TransferConfig send/recv 模式的文件传输配置
+type TransferConfig struct {
+	Path string `yaml:"path"` // send 模式要发送的文件或目录
+	Dir  string `yaml:"dir"`  // recv 模式保存文件的目录，默认当前目录
+	// AllowPeers recv 模式接受哪些节点发送的文件，为空时使用 peer，两者都为空拒绝启动
+	AllowPeers []string `yaml:"allow_peers"`
+}
+
+// DiscoveryConfig 局域网发现，仅启动时生效
+type DiscoveryConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Group    string        `yaml:"group"`    // 组播组地址，默认 239.255.77.77:40077
+	Interval time.Duration `yaml:"interval"` // 发送 announce 的间隔，默认 5s
+}
+
+// CompressionConfig 数据流压缩，双方都启用时才压缩
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Level   int  `yaml:"level"` // deflate 压缩级别 1-9，默认 1
+}
+
+// LimitsConfig 带宽限制（每秒字节数），作用于本节点经 P2P 通道收发的数据，0 表示不限制
+type LimitsConfig struct {
+	Global    ByteSize            `yaml:"global"`
+	PerPeer   ByteSize            `yaml:"per_peer"`
+	PerStream ByteSize            `yaml:"per_stream"`
+	Peers     map[string]ByteSize `yaml:"peers"` // 按节点ID覆盖 per_peer
+}
+
+// QuotasConfig 按对端节点的流量配额，0 表示不限制
+type QuotasConfig struct {
+	File    string                 `yaml:"file"` // 用量持久化文件，仅启动时生效
+	Daily   ByteSize               `yaml:"daily"`
+	Monthly ByteSize               `yaml:"monthly"`
+	Peers   map[string]QuotaConfig `yaml:"peers"` // 按节点ID覆盖 daily/monthly
+}
+
+// QuotaConfig 一个节点的流量配额
+type QuotaConfig struct {
+	Daily   ByteSize `yaml:"daily"`
+	Monthly ByteSize `yaml:"monthly"`
+}
+
+// ByteSize 字节数，配置中可写为整数或带单位的字符串，如 512KB、10MB、1.5GB（1KB = 1024 字节）
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	n      float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// parseByteSize 解析带单位的字节数
+func parseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.Replace(str, "IB", "B", 1)
+	mult := 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str, mult = strings.TrimSpace(strings.TrimSuffix(str, u.suffix)), u.n
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return ByteSize(f * mult), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// LogConfig 日志配置
+type LogConfig struct {
+	File   string          `yaml:"file"`   // 日志文件路径，为空输出到标准错误
+	Level  string          `yaml:"level"`  // debug、info、warn、error，默认 info
+	Format string          `yaml:"format"` // text 或 json，默认 text
+	Sample LogSampleConfig `yaml:"sample"` // 每个数据包都会触发的日志的采样，仅启动时生效
+}
+
+// LogSampleConfig 日志采样：每个 interval 内同一条消息先输出 first 条，之后每 thereafter 条输出一条
+type LogSampleConfig struct {
+	First      int           `yaml:"first"`
+	Thereafter int           `yaml:"thereafter"`
+	Interval   time.Duration `yaml:"interval"`
+}
+
+// defaultConfig 与命令行参数默认值一致的配置
+func defaultConfig() *Config {
+	return &Config{
+		Mode:     "node",
+		ID:       "node1",
+		Tracker:  TrackerConfig{Listen: ":40000"},
+		Trackers: []string{"127.0.0.1:40000"},
+		Timeouts: TimeoutsConfig{Register: 120 * time.Second},
+	}
+}
+
+// loadConfig 按 默认值 -> 配置文件 -> profile -> 环境变量 的顺序生成配置并校验
+func loadConfig(path, profile string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+	if profile != "" {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("config: profile %q not found", profile)
+		}
+		b, err := yaml.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("config: profiles.%s: %w", profile, err)
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("config: profiles.%s: %w", profile, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv 递归地用环境变量覆盖结构体中的标量字段和字符串列表
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, name); err != nil {
+				return err
+			}
+			continue
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch {
+		case fv.Type() == reflect.TypeOf(ByteSize(0)):
+			b, err := parseByteSize(val)
+			if err != nil {
+				return fmt.Errorf("config: env %s: %w", name, err)
+			}
+			fv.SetInt(int64(b))
+		case fv.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("config: env %s: %w", name, err)
+			}
+			fv.SetInt(int64(d))
+		case fv.Kind() == reflect.String:
+			fv.SetString(val)
+		case fv.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return fmt.Errorf("config: env %s: %w", name, err)
+			}
+			fv.SetFloat(f)
+		case fv.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("config: env %s: %w", name, err)
+			}
+			fv.SetBool(b)
+		case fv.Kind() == reflect.Int:
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("config: env %s: %w", name, err)
+			}
+			fv.SetInt(int64(i))
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+			var items []string
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					items = append(items, s)
+				}
+			}
+			fv.Set(reflect.ValueOf(items))
+		}
+	}
+	return nil
+}
+
+// fieldError 指向出错字段的校验错误
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("config: %s: %v", e.Field, e.Err)
+}
+
+func (e *fieldError) Unwrap() error { return e.Err }
+
+// Validate 校验配置，返回所有出错字段
+func (c *Config) Validate() error {
+	var errs []error
+	bad := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &fieldError{Field: field, Err: fmt.Errorf(format, args...)})
+	}
+	checkAddr := func(field, addr string) {
+		if addr == "" {
+			bad(field, "is required")
+			return
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			bad(field, "invalid address %q: %v", addr, err)
+		}
+	}
+
+	if _, err := parseLevel(c.Log.Level); err != nil {
+		bad("log.level", "%v", err)
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		bad("log.format", "must be text or json, got %q", c.Log.Format)
+	}
+	if c.Log.Sample.First < 0 || c.Log.Sample.Thereafter < 0 || c.Log.Sample.Interval < 0 {
+		bad("log.sample", "must not be negative")
+	}
+
+	switch c.Mode {
+	case "tracker":
+		checkAddr("tracker.listen", c.Tracker.Listen)
+		if c.Tracker.NodeTTL < 0 {
+			bad("tracker.node_ttl", "must not be negative")
+		}
+		if c.Tracker.Control != "" && c.controlKey() == "" {
+			bad("keys.control", "is required when tracker.control is set (or set keys.psk)")
+		}
+		return errors.Join(errs...)
+	case "node":
+	case "send":
+		if c.Transfer.Path == "" {
+			bad("transfer.path", "is required in send mode")
+		} else if _, err := os.Stat(c.Transfer.Path); err != nil {
+			bad("transfer.path", "%v", err)
+		}
+		if c.Peer == "" {
+			bad("peer", "is required in send mode")
+		}
+	case "recv":
+		if len(c.recvPeers()) == 0 {
+			bad("transfer.allow_peers", "is required in recv mode (or set peer)")
+		}
+	default:
+		bad("mode", "must be node, tracker, send or recv, got %q", c.Mode)
+		return errors.Join(errs...)
+	}
+
+	if c.ID == "" {
+		bad("id", "is required")
+	}
+	if c.Listen != "" {
+		checkAddr("listen", c.Listen)
+	}
+	if len(c.Trackers) == 0 && !c.Discovery.Enabled {
+		bad("trackers", "at least one tracker is required (or enable discovery)")
+	}
+	if c.Discovery.Group != "" {
+		checkAddr("discovery.group", c.Discovery.Group)
+	}
+	if c.Compression.Level < 0 || c.Compression.Level > 9 {
+		bad("compression.level", "must be between 1 and 9, or 0 for the default")
+	}
+	if c.Discovery.Interval < 0 {
+		bad("discovery.interval", "must not be negative")
+	}
+	for i, t := range c.Trackers {
+		checkAddr(fmt.Sprintf("trackers[%d]", i), t)
+	}
+	seen := make(map[string]string)
+	checkListen := func(field, addr string) {
+		checkAddr(field, addr)
+		if prev, ok := seen[addr]; ok && addr != "" {
+			bad(field, "address %s already used by %s", addr, prev)
+		}
+		seen[addr] = field
+	}
+	checkPeer := func(field, peer string) {
+		if peer == "" && c.Peer == "" {
+			bad(field, "is required (or set the top-level peer)")
+		}
+	}
+	for i, l := range c.Listeners.Socks {
+		field := fmt.Sprintf("listeners.socks[%d]", i)
+		checkListen(field+".listen", l.Listen)
+		checkPeer(field+".peer", l.Peer)
+	}
+	for i, l := range c.Listeners.HTTP {
+		field := fmt.Sprintf("listeners.http[%d]", i)
+		checkListen(field+".listen", l.Listen)
+		checkPeer(field+".peer", l.Peer)
+	}
+	for i, f := range c.Listeners.Forwards {
+		field := fmt.Sprintf("listeners.forwards[%d]", i)
+		checkListen(field+".listen", f.Listen)
+		checkPeer(field+".peer", f.Peer)
+		checkAddr(field+".target", f.Target)
+	}
+	for i, r := range c.Exit.Allow {
+		if _, err := p2proxy.NewExitPolicy(nil, []string{r}, nil); err != nil {
+			bad(fmt.Sprintf("exit.allow[%d]", i), "%v", err)
+		}
+	}
+	for i, r := range c.Exit.Deny {
+		if _, err := p2proxy.NewExitPolicy(nil, nil, []string{r}); err != nil {
+			bad(fmt.Sprintf("exit.deny[%d]", i), "%v", err)
+		}
+	}
+	for _, d := range []struct {
+		field string
+		val   time.Duration
+	}{
+		{"timeouts.register", c.Timeouts.Register},
+		{"timeouts.lookup", c.Timeouts.Lookup},
+		{"timeouts.open", c.Timeouts.Open},
+		{"timeouts.dial", c.Timeouts.Dial},
+		{"timeouts.peer_ttl", c.Timeouts.PeerTTL},
+		{"timeouts.idle", c.Timeouts.Idle},
+	} {
+		if d.val < 0 {
+			bad(d.field, "must not be negative")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// controlKey tracker 控制连接的认证密钥
+func (c *Config) controlKey() string {
+	if c.Keys.Control != "" {
+		return c.Keys.Control
+	}
+	return c.Keys.PSK
+}
+
+// recvPeers recv 模式接受哪些节点发送的文件
+func (c *Config) recvPeers() []string {
+	if len(c.Transfer.AllowPeers) > 0 {
+		return c.Transfer.AllowPeers
+	}
+	if c.Peer != "" {
+		return []string{c.Peer}
+	}
+	return nil
+}
+
+// peerFor 返回监听器实际使用的远端节点
+func (c *Config) peerFor(peer string) string {
+	if peer != "" {
+		return peer
+	}
+	return c.Peer
+}
+
+// exitPolicy 根据配置生成出口策略，未配置任何规则时返回 nil
+func (c *Config) exitPolicy() *p2proxy.ExitPolicy {
+	if len(c.Exit.AllowPeers) == 0 && len(c.Exit.Allow) == 0 && len(c.Exit.Deny) == 0 {
+		return nil
+	}
+	// 规则已在 Validate 中校验过
+	p, _ := p2proxy.NewExitPolicy(c.Exit.AllowPeers, c.Exit.Allow, c.Exit.Deny)
+	return p
+}
+
+// timeouts 转换为节点的超时设置
+func (c *Config) timeouts() p2proxy.Timeouts {
+	return p2proxy.Timeouts{Lookup: c.Timeouts.Lookup, Open: c.Timeouts.Open, Dial: c.Timeouts.Dial, PeerTTL: c.Timeouts.PeerTTL, Idle: c.Timeouts.Idle}
+}
+
+// rateLimits 转换为节点的带宽限制
+func (c *Config) rateLimits() p2proxy.RateLimits {
+	l := p2proxy.RateLimits{
+		Global:    int64(c.Limits.Global),
+		PerPeer:   int64(c.Limits.PerPeer),
+		PerStream: int64(c.Limits.PerStream),
+	}
+	if len(c.Limits.Peers) > 0 {
+		l.Peers = make(map[string]int64, len(c.Limits.Peers))
+		for id, v := range c.Limits.Peers {
+			l.Peers[id] = int64(v)
+		}
+	}
+	return l
+}
+
+// quotas 转换为节点的流量配额
+func (c *Config) quotas() p2proxy.QuotaConfig {
+	q := p2proxy.QuotaConfig{
+		File:    c.Quotas.File,
+		Default: p2proxy.Quota{Daily: int64(c.Quotas.Daily), Monthly: int64(c.Quotas.Monthly)},
+	}
+	if len(c.Quotas.Peers) > 0 {
+		q.Peers = make(map[string]p2proxy.Quota, len(c.Quotas.Peers))
+		for id, v := range c.Quotas.Peers {
+			q.Peers[id] = p2proxy.Quota{Daily: int64(v.Daily), Monthly: int64(v.Monthly)}
+		}
+	}
+	return q
+}
+
+// logSample 转换为 p2proxy 的日志采样配置
+func (c *Config) logSample() p2proxy.SampleConfig {
+	return p2proxy.SampleConfig{First: c.Log.Sample.First, Thereafter: c.Log.Sample.Thereafter, Interval: c.Log.Sample.Interval}
+}
+
+// registerInterval 重新注册间隔
+func (c *Config) registerInterval() time.Duration {
+	if c.Timeouts.Register <= 0 {
+		return 120 * time.Second
+	}
+	return c.Timeouts.Register
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig 把 YAML 写入临时文件并返回路径
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "p2proxy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	tests := []struct {
+		name, yaml, profile, want string
+	}{
+		{"unknown top-level key", "id: a\ntrackerz: [1.2.3.4:40000]\n", "", "trackerz"},
+		{"unknown nested key", "timeouts:\n  lookupp: 5s\n", "", "lookupp"},
+		{"unknown key in profile", "profiles:\n  dev:\n    exit:\n      denyy: []\n", "dev", "profiles.dev"},
+		{"bad value type", "timeouts:\n  lookup: soon\n", "", "config"},
+		{"missing profile", "id: a\n", "prod", `profile "prod" not found`},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeConfig(t, tt.yaml), tt.profile)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+id: file
+trackers: [1.1.1.1:40000, 2.2.2.2:40000]
+timeouts:
+  lookup: 5s
+  open: 7s
+exit:
+  deny: ["10.0.0.0/8:*"]
+profiles:
+  dev:
+    id: dev
+    timeouts:
+      lookup: 1s
+    exit:
+      deny: ["192.168.0.0/16:*"]
+`)
+
+	// 默认值 -> 配置文件 -> profile -> 环境变量
+	t.Setenv("P2PROXY_TIMEOUTS_LOOKUP", "2s")
+	cfg, err := loadConfig(path, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != "node" || cfg.Tracker.Listen != ":40000" {
+		t.Errorf("defaults lost: mode %q tracker.listen %q", cfg.Mode, cfg.Tracker.Listen)
+	}
+	if cfg.ID != "dev" {
+		t.Errorf("id = %q, want the profile value", cfg.ID)
+	}
+	if len(cfg.Trackers) != 2 || cfg.Timeouts.Open != 7*time.Second {
+		t.Errorf("file values not kept: trackers %v open %v", cfg.Trackers, cfg.Timeouts.Open)
+	}
+	if !reflect.DeepEqual(cfg.Exit.Deny, []string{"192.168.0.0/16:*"}) {
+		t.Errorf("exit.deny = %v, want the profile list", cfg.Exit.Deny)
+	}
+	if cfg.Timeouts.Lookup != 2*time.Second {
+		t.Errorf("timeouts.lookup = %v, want the env value", cfg.Timeouts.Lookup)
+	}
+
+	// 不选择 profile 时只使用配置文件
+	cfg, err = loadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ID != "file" || !reflect.DeepEqual(cfg.Exit.Deny, []string{"10.0.0.0/8:*"}) {
+		t.Errorf("without profile: id %q exit.deny %v", cfg.ID, cfg.Exit.Deny)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+		check func(*Config) bool
+	}{
+		{"P2PROXY_ID", "envnode", func(c *Config) bool { return c.ID == "envnode" }},
+		{"P2PROXY_KEYS_PSK", "secret", func(c *Config) bool { return c.Keys.PSK == "secret" }},
+		{"P2PROXY_TIMEOUTS_PEER_TTL", "90s", func(c *Config) bool { return c.Timeouts.PeerTTL == 90*time.Second }},
+		{"P2PROXY_TRACKER_LIMITS_PER_IP_RATE", "2.5", func(c *Config) bool { return c.Tracker.Limits.PerIPRate == 2.5 }},
+		{"P2PROXY_TRACKER_LIMITS_MAX_NODES_PER_IP", "8", func(c *Config) bool { return c.Tracker.Limits.MaxNodesPerIP == 8 }},
+		{"P2PROXY_TRACKER_LIMITS_REQUIRE_COOKIE", "true", func(c *Config) bool { return c.Tracker.Limits.RequireCookie }},
+		{"P2PROXY_LIMITS_GLOBAL", "1.5MB", func(c *Config) bool { return c.Limits.Global == 3<<19 }},
+		{"P2PROXY_LOG_SAMPLE_INTERVAL", "2s", func(c *Config) bool { return c.Log.Sample.Interval == 2*time.Second }},
+		{"P2PROXY_TRACKERS", " 1.1.1.1:40000, ,2.2.2.2:40000 ", func(c *Config) bool {
+			return reflect.DeepEqual(c.Trackers, []string{"1.1.1.1:40000", "2.2.2.2:40000"})
+		}},
+		{"P2PROXY_EXIT_ALLOW_PEERS", "nodeA,nodeB", func(c *Config) bool {
+			return reflect.DeepEqual(c.Exit.AllowPeers, []string{"nodeA", "nodeB"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			cfg := defaultConfig()
+			if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Fatalf("%s=%q not applied: %+v", tt.env, tt.value, cfg)
+			}
+		})
+	}
+
+	for env, value := range map[string]string{
+		"P2PROXY_TIMEOUTS_LOOKUP":               "soon",
+		"P2PROXY_LIMITS_PER_PEER":               "lots",
+		"P2PROXY_TRACKER_LIMITS_PER_IP_RATE":    "fast",
+		"P2PROXY_TRACKER_LIMITS_REQUIRE_COOKIE": "maybe",
+		"P2PROXY_COMPRESSION_LEVEL":             "high",
+	} {
+		t.Run(env+" invalid", func(t *testing.T) {
+			t.Setenv(env, value)
+			err := applyEnv(reflect.ValueOf(defaultConfig()).Elem(), envPrefix)
+			if err == nil || !strings.Contains(err.Error(), env) {
+				t.Fatalf("err = %v, want it to name %s", err, env)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string // 出错字段，为空表示校验通过
+	}{
+		{"defaults", func(*Config) {}, nil},
+		{"bad mode", func(c *Config) { c.Mode = "relay" }, []string{"mode"}},
+		{"node without trackers", func(c *Config) { c.Trackers = nil }, []string{"trackers"}},
+		{"discovery without trackers", func(c *Config) { c.Trackers, c.Discovery.Enabled = nil, true }, nil},
+		{"bad tracker address", func(c *Config) { c.Trackers = []string{"ok:1", "nope"} }, []string{"trackers[1]"}},
+		{"listener without peer", func(c *Config) {
+			c.Listeners.Socks = []ListenerConfig{{Listen: "127.0.0.1:1080"}}
+		}, []string{"listeners.socks[0].peer"}},
+		{"duplicate listen address", func(c *Config) {
+			c.Peer = "nodeB"
+			c.Listeners.Socks = []ListenerConfig{{Listen: "127.0.0.1:1080"}}
+			c.Listeners.HTTP = []ListenerConfig{{Listen: "127.0.0.1:1080"}}
+		}, []string{"listeners.http[0].listen"}},
+		{"bad exit rules", func(c *Config) {
+			c.Exit.Allow = []string{"*:80", "*:90-80"}
+			c.Exit.Deny = []string{"10.0.0.0/33:*"}
+		}, []string{"exit.allow[1]", "exit.deny[0]"}},
+		{"several errors", func(c *Config) {
+			c.ID = ""
+			c.Timeouts.Idle = -time.Second
+			c.Log.Format = "xml"
+		}, []string{"log.format", "id", "timeouts.idle"}},
+		{"recv without allowed senders", func(c *Config) { c.Mode = "recv" }, []string{"transfer.allow_peers"}},
+		{"recv from peer", func(c *Config) { c.Mode, c.Peer = "recv", "nodeA" }, nil},
+		{"recv with allowed senders", func(c *Config) {
+			c.Mode = "recv"
+			c.Transfer.AllowPeers = []string{"nodeA", "nodeC"}
+		}, nil},
+		{"tracker control without key", func(c *Config) {
+			c.Mode = "tracker"
+			c.Tracker.Control = "127.0.0.1:9000"
+		}, []string{"keys.control"}},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.modify(cfg)
+		err := cfg.Validate()
+		var fields []string
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				var fe *fieldError
+				if !errors.As(e, &fe) {
+					t.Fatalf("%s: %v is not a fieldError", tt.name, e)
+				}
+				if !strings.HasPrefix(e.Error(), "config: "+fe.Field+": ") || errors.Unwrap(fe) != fe.Err {
+					t.Errorf("%s: fieldError output %q", tt.name, e.Error())
+				}
+				fields = append(fields, fe.Field)
+			}
+		}
+		if !reflect.DeepEqual(fields, tt.want) {
+			t.Errorf("%s: error fields %v, want %v (%v)", tt.name, fields, tt.want, err)
+		}
+	}
+}
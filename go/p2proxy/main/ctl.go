@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy"
+)
+
+// ctlCommands 通过控制连接管理运行中 tracker 的子命令
+var ctlCommands = map[string]bool{"list": true, "inspect": true, "evict": true}
+
+// runCtl 执行 list、inspect <id>、evict <id> 子命令，返回进程退出码
+// 控制地址与密钥默认取自配置文件中的 tracker.control 与 keys.control（或 keys.psk）
+func runCtl(cmd string, args []string) int {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	configPath := fs.String("config", "", "config file (yaml)")
+	profile := fs.String("profile", "", "profile name in the config file")
+	control := fs.String("control", "", "tracker control address, unix:/path or host:port")
+	key := fs.String("key", "", "tracker control key")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s list|inspect <id>|evict <id> [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// 节点ID可以写在参数前面：inspect nodeA -config p2proxy.yaml
+	var id string
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		id, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if id == "" {
+		id = fs.Arg(0)
+	}
+	if cmd != "list" && id == "" {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	tc := &p2proxy.TrackerControl{Addr: cfg.Tracker.Control, Key: cfg.controlKey()}
+	if *control != "" {
+		tc.Addr = *control
+	}
+	if *key != "" {
+		tc.Key = *key
+	}
+	if tc.Addr == "" {
+		fmt.Fprintln(os.Stderr, "tracker control address is required (-control or tracker.control)")
+		return 2
+	}
+
+	switch cmd {
+	case "list":
+		var nodes []p2proxy.NodeInfo
+		if nodes, err = tc.List(); err != nil {
+			break
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tADDR\tLAST SEEN\tEXPIRES")
+		for _, n := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n.ID, n.Addr, n.LastSeen.Format(time.DateTime), n.Expires.Format(time.DateTime))
+		}
+		w.Flush()
+	case "inspect":
+		var n p2proxy.NodeInfo
+		if n, err = tc.Inspect(id); err != nil {
+			break
+		}
+		fmt.Printf("id:         %s\n", n.ID)
+		fmt.Printf("addr:       %s\n", n.Addr)
+		for _, c := range n.Candidates {
+			fmt.Printf("candidate:  %s (%s)\n", c.Addr, c.Type)
+		}
+		fmt.Printf("registered: %s\n", n.Registered.Format(time.RFC3339))
+		fmt.Printf("last seen:  %s (%s ago)\n", n.LastSeen.Format(time.RFC3339), time.Since(n.LastSeen).Round(time.Second))
+		fmt.Printf("expires:    %s (in %s)\n", n.Expires.Format(time.RFC3339), time.Until(n.Expires).Round(time.Second))
+	case "evict":
+		if err = tc.Evict(id); err == nil {
+			fmt.Printf("evicted %s\n", id)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
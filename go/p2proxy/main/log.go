@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// parseLevel 解析日志级别名称：debug、info、warn、error
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return l, fmt.Errorf("unknown level %q", s)
+	}
+	return l, nil
+}
+
+// newLogHandler 按格式创建 slog.Handler，format 为 json 或 text
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// reloadableHandler 可以在运行中替换底层输出的 slog.Handler，
+// 由它派生出的 Logger（With/WithGroup）在替换后同样生效
+type reloadableHandler struct {
+	root  *atomic.Pointer[slog.Handler]
+	ops   []func(slog.Handler) slog.Handler
+	cache atomic.Pointer[derivedHandler]
+}
+
+type derivedHandler struct {
+	root *slog.Handler
+	h    slog.Handler
+}
+
+func newReloadableHandler(h slog.Handler) *reloadableHandler {
+	root := new(atomic.Pointer[slog.Handler])
+	root.Store(&h)
+	return &reloadableHandler{root: root}
+}
+
+// Swap 替换底层的 Handler
+func (r *reloadableHandler) Swap(h slog.Handler) {
+	r.root.Store(&h)
+}
+
+// current 返回应用了 With/WithGroup 之后的当前 Handler
+func (r *reloadableHandler) current() slog.Handler {
+	root := r.root.Load()
+	if d := r.cache.Load(); d != nil && d.root == root {
+		return d.h
+	}
+	h := *root
+	for _, op := range r.ops {
+		h = op(h)
+	}
+	r.cache.Store(&derivedHandler{root: root, h: h})
+	return h
+}
+
+func (r *reloadableHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return r.current().Enabled(ctx, level)
+}
+
+func (r *reloadableHandler) Handle(ctx context.Context, rec slog.Record) error {
+	return r.current().Handle(ctx, rec)
+}
+
+func (r *reloadableHandler) derive(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := append(append([]func(slog.Handler) slog.Handler{}, r.ops...), op)
+	return &reloadableHandler{root: r.root, ops: ops}
+}
+
+func (r *reloadableHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return r.derive(func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })
+}
+
+func (r *reloadableHandler) WithGroup(name string) slog.Handler {
+	return r.derive(func(h slog.Handler) slog.Handler { return h.WithGroup(name) })
+}
+
+// logOutput 管理日志文件与全局日志
+type logOutput struct {
+	handler *reloadableHandler
+	level   slog.LevelVar
+	file    *os.File
+}
+
+// apply 按配置设置日志输出、格式和级别，并设为全局默认日志
+func (o *logOutput) apply(cfg LogConfig) {
+	level, _ := parseLevel(cfg.Level) // 已在 Validate 中校验
+	o.level.Set(level)
+
+	var w io.Writer = os.Stderr
+	var f *os.File
+	if cfg.File != "" {
+		var err error
+		f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			slog.Error("open log file error", "file", cfg.File, "err", err)
+			return
+		}
+		w = f
+	}
+	h := newLogHandler(w, cfg.Format, &o.level)
+	if o.handler == nil {
+		o.handler = newReloadableHandler(h)
+		slog.SetDefault(slog.New(o.handler))
+	} else {
+		o.handler.Swap(h)
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = f
+}
+
+func (o *logOutput) close() {
+	if o.file != nil {
+		o.file.Close()
+	}
+}
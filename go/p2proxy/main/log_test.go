@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lockedBuffer 可并发写入的 bytes.Buffer
+type lockedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	lines atomic.Int64
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines.Add(1)
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestReloadableHandler(t *testing.T) {
+	var first, second lockedBuffer
+	h := newReloadableHandler(newLogHandler(&first, "text", slog.LevelInfo))
+	logger := slog.New(h).With("node", "nodeA").WithGroup("stream")
+
+	logger.Info("opened", "id", 1)
+	logger.Debug("hidden")
+	if got := first.String(); !strings.Contains(got, "node=nodeA stream.id=1") || strings.Contains(got, "hidden") {
+		t.Fatalf("before swap: %q", got)
+	}
+
+	// 替换后已派生的 Logger 输出到新的 Handler，保留 With/WithGroup
+	h.Swap(newLogHandler(&second, "json", slog.LevelDebug))
+	logger.Debug("visible", "id", 2)
+	if got := second.String(); !strings.Contains(got, `"node":"nodeA","stream":{"id":2}`) {
+		t.Fatalf("after swap: %q", got)
+	}
+	if strings.Contains(first.String(), "visible") {
+		t.Fatal("old handler still used after swap")
+	}
+}
+
+func TestReloadableHandlerConcurrentSwap(t *testing.T) {
+	var bufs [2]lockedBuffer
+	h := newReloadableHandler(newLogHandler(&bufs[0], "text", slog.LevelInfo))
+	base := slog.New(h)
+
+	const workers, records = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger := base.With("worker", i)
+			for j := 0; j < records; j++ {
+				logger.WithGroup("g").Info("tick", "k", "v")
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+swap:
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			break swap
+		default:
+			h.Swap(newLogHandler(&bufs[i%2], "text", slog.LevelInfo))
+		}
+	}
+
+	// 每条记录完整地输出到某一个 Handler
+	if n := bufs[0].lines.Load() + bufs[1].lines.Load(); n != workers*records {
+		t.Fatalf("%d records written, want %d", n, workers*records)
+	}
+	for i := range bufs {
+		for _, line := range strings.Split(strings.TrimSpace(bufs[i].String()), "\n") {
+			if line != "" && (!strings.Contains(line, "msg=tick worker=") || !strings.HasSuffix(line, " g.k=v")) {
+				t.Fatalf("malformed line %q", line)
+			}
+		}
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,62 +16,302 @@ import (
 )
 
 func main() {
-	mode := flag.String("mode", "node", "mode: tracker or node")
-	listen := flag.String("listen", ":40000", "tracker listen address (udp)")
-	id := flag.String("id", "node1", "node id")
-	trackerAddr := flag.String("tracker", "127.0.0.1:40000", "tracker udp addr")
-	socks := flag.String("socks", "", "start local socks5 listen address, e.g. 127.0.0.1:1080")
-	peer := flag.String("peer", "", "default peer id to forward socks connections to")
+	if len(os.Args) > 1 && ctlCommands[os.Args[1]] {
+		os.Exit(runCtl(os.Args[1], os.Args[2:]))
+	}
+	configPath := flag.String("config", "", "config file (yaml)")
+	profile := flag.String("profile", "", "profile name in the config file")
+	flag.String("mode", "node", "mode: tracker, node, send or recv")
+	flag.String("listen", ":40000", "tracker listen address (udp)")
+	flag.String("id", "node1", "node id")
+	flag.String("tracker", "127.0.0.1:40000", "tracker udp addr, comma separated for several trackers, empty for none")
+	flag.Bool("discovery", false, "discover peers on the local network by multicast")
+	flag.String("socks", "", "start local socks5 listen address, e.g. 127.0.0.1:1080")
+	flag.String("peer", "", "default peer id to forward socks connections to, to send files to, or to accept files from in recv mode")
+	flag.String("path", "", "file or directory to send in send mode")
+	flag.String("dir", "", "directory to save received files in recv mode")
 	flag.Parse()
 
-	if *mode == "tracker" {
-		t := p2proxy.NewTracker(*listen)
+	load := func() (*Config, error) {
+		cfg, err := loadConfig(*configPath, *profile)
+		if err != nil {
+			return nil, err
+		}
+		// 命令行中显式指定的参数优先级最高
+		applyFlags(cfg)
+		return cfg, cfg.Validate()
+	}
+	cfg, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	a := &app{listeners: make(map[string]net.Listener)}
+	a.log.apply(cfg.Log)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	if cfg.Mode == "tracker" {
+		t := p2proxy.NewTracker(cfg.Tracker.Listen)
+		t.Key = cfg.Keys.PSK
+		t.LogSample = cfg.logSample()
+		t.StorePath = cfg.Tracker.Store
+		t.NodeTTL = cfg.Tracker.NodeTTL
+		t.ControlAddr = cfg.Tracker.Control
+		t.ControlKey = cfg.controlKey()
+		t.Limits = p2proxy.TrackerLimits(cfg.Tracker.Limits)
+		a.tracker = t
 		go func() {
 			if err := t.Run(); err != nil {
-				log.Fatalf("tracker run error: %v", err)
+				fatal("tracker run error", err)
 			}
 		}()
-		// wait for ctrl-c
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		<-sig
-		log.Printf("tracker shutting down")
-		return
+		a.cfg = cfg
+	} else if err := a.startNode(cfg); err != nil {
+		fatal("new node error", err)
+	}
+	switch cfg.Mode {
+	case "send":
+		os.Exit(a.send(cfg, sig))
+	case "recv":
+		dir := cfg.Transfer.Dir
+		if dir == "" {
+			dir = "."
+		}
+		if err := a.node.ReceiveFiles(dir, cfg.recvPeers(), newProgressPrinter(os.Stderr).print); err != nil {
+			fatal("receive files error", err)
+		}
+		slog.Info("receiving files", "dir", dir, "from", cfg.recvPeers())
 	}
 
-	// node mode
-	n, err := p2proxy.NewNode(*id, *trackerAddr)
+	// wait for ctrl-c, SIGHUP 重新加载配置
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		newCfg, err := load()
+		if err != nil {
+			slog.Error("reload config failed, keep running with the old one", "err", err)
+			continue
+		}
+		a.reload(newCfg)
+	}
+	slog.Info("shutting down", "mode", cfg.Mode)
+	a.close()
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// applyFlags 把命令行中显式设置的参数写入配置
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "mode":
+			cfg.Mode = v
+		case "listen":
+			cfg.Tracker.Listen = v
+		case "id":
+			cfg.ID = v
+		case "tracker":
+			cfg.Trackers = nil
+			if v != "" {
+				cfg.Trackers = strings.Split(v, ",")
+			}
+		case "discovery":
+			cfg.Discovery.Enabled = v == "true"
+		case "socks":
+			cfg.Listeners.Socks = []ListenerConfig{{Listen: v}}
+		case "peer":
+			cfg.Peer = v
+		case "path":
+			cfg.Transfer.Path = v
+		case "dir":
+			cfg.Transfer.Dir = v
+		}
+	})
+}
+
+// app 保存运行中的节点及其可热更新的部分
+type app struct {
+	mu        sync.Mutex
+	cfg       *Config
+	node      *p2proxy.Node
+	tracker   *p2proxy.Tracker
+	listeners map[string]net.Listener // listenerKey -> listener
+	log       logOutput
+	stop      chan struct{}
+}
+
+func (a *app) startNode(cfg *Config) error {
+	n, err := p2proxy.NewNodeWithConfig(p2proxy.NodeConfig{
+		ID:         cfg.ID,
+		Trackers:   cfg.Trackers,
+		ListenAddr: cfg.Listen,
+		Key:        cfg.Keys.PSK,
+		Timeouts:   cfg.timeouts(),
+		ExitPolicy: cfg.exitPolicy(),
+		LogSample:  cfg.logSample(),
+		RateLimits: cfg.rateLimits(),
+		Quotas:     cfg.quotas(),
+		Discovery: p2proxy.DiscoveryConfig{
+			Enabled:  cfg.Discovery.Enabled,
+			Group:    cfg.Discovery.Group,
+			Interval: cfg.Discovery.Interval,
+		},
+		Compression: p2proxy.CompressionConfig(cfg.Compression),
+	})
 	if err != nil {
-		log.Fatalf("new node error: %v", err)
+		return err
 	}
-	defer n.Close()
+	a.node = n
+	a.cfg = cfg
+	a.stop = make(chan struct{})
+
 	// register periodically
 	if err := n.Register(); err != nil {
-		log.Printf("register error: %v", err)
+		slog.Warn("register error", "err", err)
 	}
-	// re-register every 120s
-	// 每两分钟重新注册，防止连接意外断开
+	// 按 timeouts.register 定期重新注册（默认两分钟），防止连接意外断开
 	go func() {
-		ticker := time.NewTicker(120 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			n.Register()
+		for {
+			a.mu.Lock()
+			every := a.cfg.registerInterval()
+			a.mu.Unlock()
+			select {
+			case <-time.After(every):
+				n.Register()
+			case <-a.stop:
+				return
+			}
 		}
 	}()
 
-	if *socks != "" {
-		if *peer == "" {
-			log.Fatalf("when using socks mode you must set -peer to the remote node id to forward to")
+	if err := a.applyListeners(cfg); err != nil {
+		n.Close()
+		return err
+	}
+	slog.Info("node running", "node", cfg.ID, "trackers", strings.Join(cfg.Trackers, ","), "discovery", cfg.Discovery.Enabled)
+	return nil
+}
+
+// listenerKey 唯一标识一个监听器，配置不变的监听器在重载时保持运行
+func listenerKey(kind, listen, peer, target string) string {
+	return fmt.Sprintf("%s|%s|%s|%s", kind, listen, peer, target)
+}
+
+// applyListeners 按配置启动缺少的监听器，关闭配置中已删除的监听器
+func (a *app) applyListeners(cfg *Config) error {
+	type spec struct {
+		kind, listen, peer, target string
+	}
+	var specs []spec
+	for _, l := range cfg.Listeners.Socks {
+		specs = append(specs, spec{"socks", l.Listen, cfg.peerFor(l.Peer), ""})
+	}
+	for _, l := range cfg.Listeners.HTTP {
+		specs = append(specs, spec{"http", l.Listen, cfg.peerFor(l.Peer), ""})
+	}
+	for _, f := range cfg.Listeners.Forwards {
+		specs = append(specs, spec{"forward", f.Listen, cfg.peerFor(f.Peer), f.Target})
+	}
+
+	want := make(map[string]spec)
+	for _, s := range specs {
+		want[listenerKey(s.kind, s.listen, s.peer, s.target)] = s
+	}
+	// 先关闭不再需要的监听器，释放端口
+	for key, ln := range a.listeners {
+		if _, ok := want[key]; !ok {
+			ln.Close()
+			delete(a.listeners, key)
+		}
+	}
+	var firstErr error
+	for key, s := range want {
+		if _, ok := a.listeners[key]; ok {
+			continue
 		}
-		if err := n.StartSocks5(*socks, *peer); err != nil {
-			log.Fatalf("start socks error: %v", err)
+		var ln net.Listener
+		var err error
+		switch s.kind {
+		case "socks":
+			ln, err = a.node.ListenSocks5(s.listen, s.peer)
+		case "http":
+			ln, err = a.node.ListenHTTPProxy(s.listen, s.peer)
+		case "forward":
+			ln, err = a.node.ListenForward(s.listen, s.peer, s.target)
 		}
+		if err != nil {
+			err = fmt.Errorf("start %s listener %s: %w", s.kind, s.listen, err)
+			slog.Error("start listener failed", "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		a.listeners[key] = ln
 	}
+	return firstErr
+}
 
-	log.Printf("node %s running (tracker=%s)", *id, *trackerAddr)
-	// wait for ctrl-c
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	<-sig
-	log.Printf("node shutting down")
+// reload 应用新配置中可热更新的部分
+func (a *app) reload(cfg *Config) {
+	a.mu.Lock()
+	old := a.cfg
+	a.mu.Unlock()
+
+	a.log.apply(cfg.Log)
+	if cfg.Mode != old.Mode || cfg.ID != old.ID || cfg.Keys != old.Keys ||
+		cfg.Listen != old.Listen || cfg.Tracker != old.Tracker || cfg.Discovery != old.Discovery {
+		slog.Warn("reload: mode/id/keys/listen/tracker/discovery changed, restart required for them to take effect")
+	}
+	if a.node == nil {
+		// tracker 模式下只有日志配置可以热更新
+		slog.Info("config reloaded")
+		return
+	}
+
+	// 保留身份相关的字段
+	cfg.Mode, cfg.ID, cfg.Keys, cfg.Listen, cfg.Tracker, cfg.Discovery = old.Mode, old.ID, old.Keys, old.Listen, old.Tracker, old.Discovery
+	if err := a.node.SetTrackers(cfg.Trackers); err != nil {
+		slog.Error("reload trackers error, keep the old trackers", "err", err)
+		cfg.Trackers = old.Trackers
+	}
+	a.node.SetTimeouts(cfg.timeouts())
+	a.node.SetExitPolicy(cfg.exitPolicy())
+	a.node.SetRateLimits(cfg.rateLimits())
+	a.node.SetCompression(p2proxy.CompressionConfig(cfg.Compression))
+	if cfg.Quotas.File != old.Quotas.File {
+		slog.Warn("reload: quotas.file changed, restart required for it to take effect")
+	}
+	a.node.SetQuotas(cfg.quotas())
+	if err := a.applyListeners(cfg); err != nil {
+		slog.Error("reload listeners error", "err", err)
+	}
+	a.mu.Lock()
+	a.cfg = cfg
+	a.mu.Unlock()
+	a.node.Register()
+	slog.Info("config reloaded")
+}
+
+func (a *app) close() {
+	for _, ln := range a.listeners {
+		ln.Close()
+	}
+	if a.stop != nil {
+		close(a.stop)
+	}
+	if a.node != nil {
+		a.node.Close()
+	}
+	if a.tracker != nil {
+		a.tracker.Close()
+	}
+	a.log.close()
 }
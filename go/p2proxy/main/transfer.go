@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy"
+)
+
+// send 把 transfer.path 发送给 peer，收到信号时取消，返回进程退出码
+func (a *app) send(cfg *Config, sig <-chan os.Signal) int {
+	defer a.close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	start := time.Now()
+	err := a.node.SendFiles(ctx, cfg.Peer, cfg.Transfer.Path, newProgressPrinter(os.Stderr).print)
+	if err != nil {
+		slog.Error("send files failed", "peer", cfg.Peer, "path", cfg.Transfer.Path, "err", err)
+		return 1
+	}
+	slog.Info("send files done", "peer", cfg.Peer, "path", cfg.Transfer.Path, "elapsed", time.Since(start).Round(time.Millisecond).String())
+	return 0
+}
+
+// progressPrinter 把传输进度逐行输出，同一文件的进度在同一行刷新
+type progressPrinter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start map[string]time.Time // peer -> 本次传输开始时间
+	last  string               // 上次输出的文件，用于判断是否换行
+}
+
+func newProgressPrinter(w io.Writer) *progressPrinter {
+	return &progressPrinter{w: w, start: make(map[string]time.Time)}
+}
+
+func (pp *progressPrinter) print(p p2proxy.TransferProgress) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	now := time.Now()
+	start, ok := pp.start[p.Peer]
+	if !ok {
+		start = now
+		pp.start[p.Peer] = start
+	}
+	key := p.Peer + "|" + p.Path
+	if pp.last != "" && pp.last != key {
+		fmt.Fprintln(pp.w)
+	}
+	pp.last = key
+	pct := 100
+	if p.FileSize > 0 {
+		pct = int(p.FileDone * 100 / p.FileSize)
+	}
+	rate := ""
+	if d := now.Sub(start).Seconds(); d > 0 {
+		rate = formatBytes(int64(float64(p.Done)/d)) + "/s"
+	}
+	fmt.Fprintf(pp.w, "\r[%s] %s %s/%s %3d%%  total %s/%s %s  ", p.Peer, p.Path,
+		formatBytes(p.FileDone), formatBytes(p.FileSize), pct, formatBytes(p.Done), formatBytes(p.Total), rate)
+	if p.Done == p.Total && p.FileDone == p.FileSize {
+		fmt.Fprintln(pp.w)
+		pp.last = ""
+		delete(pp.start, p.Peer)
+	}
+}
+
+// formatBytes 以 KB、MB、GB 为单位显示字节数（1KB = 1024 字节）
+func formatBytes(n int64) string {
+	for _, u := range byteUnits[:4] {
+		if float64(n) >= u.n {
+			return fmt.Sprintf("%.1f%s", float64(n)/u.n, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
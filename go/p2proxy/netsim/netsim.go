@@ -0,0 +1,607 @@
+// Package netsim 为 p2proxy 测试提供内存中的 UDP 网络模拟器。
+//
+// 模拟器由若干主机（Host）和 NAT 组成：公网主机直接拥有公网 IP，内网主机位于某个 NAT 之后。
+// 每个主机实现 p2proxy.Network，可以注入到 Node 和 Tracker 中。
+// 支持的 NAT 类型：完全锥形、受限锥形、端口受限锥形和对称型；主机可以另外拥有一个 IPv6 地址（双栈），IPv6 不经过 NAT；
+// IPv4 组播只在同一局域网（同一个 NAT 之后，或同一 /24 网段的公网主机）内投递，不经过 NAT。
+// 每个主机的出口链路可以配置丢包、延迟、抖动（乱序）和重复。
+// 所有随机行为由 Config.Seed 决定，相同的种子和相同的发包顺序得到相同的结果。
+package netsim
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NATType NAT 的映射与过滤行为
+type NATType int
+
+const (
+	// FullCone 完全锥形：同一内网端点映射到固定的公网端口，任何外部地址都可以发包进来
+	FullCone NATType = iota + 1
+	// RestrictedCone 受限锥形：只放行内网端点发送过的外部 IP
+	RestrictedCone
+	// PortRestrictedCone 端口受限锥形：只放行内网端点发送过的外部 IP:端口
+	PortRestrictedCone
+	// Symmetric 对称型：每个外部目的地址使用不同的公网端口，且只放行该目的地址
+	Symmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case FullCone:
+		return "full-cone"
+	case RestrictedCone:
+		return "restricted-cone"
+	case PortRestrictedCone:
+		return "port-restricted-cone"
+	case Symmetric:
+		return "symmetric"
+	}
+	return "none"
+}
+
+// Link 主机出口链路的特性
+// Loss: 丢包概率 [0,1]
+// Latency: 固定单向延迟
+// Jitter: 在 Latency 之上随机增加 [0,Jitter) 的延迟，会造成乱序
+// Duplicate: 包被重复发送一次的概率 [0,1]
+// Reorder: 包被额外延迟 Latency+Jitter（从而被后面的包超过）的概率 [0,1]
+type Link struct {
+	Loss      float64
+	Latency   time.Duration
+	Jitter    time.Duration
+	Duplicate float64
+	Reorder   float64
+}
+
+// Config 模拟网络配置
+type Config struct {
+	Seed int64 // 随机数种子
+	// QueueLen 每个端点的接收队列长度，队列满时丢包，默认 1024
+	QueueLen int
+}
+
+// Network 模拟网络
+type Network struct {
+	cfg Config
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	hosts     map[string]*Host // ip -> host
+	nats      map[string]*NAT  // public ip -> nat
+	endpoints map[string]*endpoint
+	groups    map[string][]*endpoint // 组播组 ip:port -> 加入该组的端点
+	stats     Stats
+}
+
+// Stats 模拟网络的收发统计
+type Stats struct {
+	Sent       int // 发出的包
+	Delivered  int // 成功投递的包
+	Lost       int // 链路丢弃的包
+	Filtered   int // 被 NAT 过滤的包
+	Unroutable int // 找不到目的地址的包
+}
+
+// New 创建模拟网络
+func New(cfg Config) *Network {
+	if cfg.QueueLen <= 0 {
+		cfg.QueueLen = 1024
+	}
+	return &Network{
+		cfg:       cfg,
+		rng:       rand.New(rand.NewSource(cfg.Seed)),
+		hosts:     make(map[string]*Host),
+		nats:      make(map[string]*NAT),
+		endpoints: make(map[string]*endpoint),
+		groups:    make(map[string][]*endpoint),
+	}
+}
+
+// Stats 返回当前的收发统计
+func (nw *Network) Stats() Stats {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.stats
+}
+
+// NAT 一台 NAT 设备，拥有一个公网 IP
+type NAT struct {
+	Type     NATType
+	PublicIP net.IP
+
+	nextPort int
+	// 端点无关映射（锥形）：内网端点 -> 映射
+	byInside map[string]*mapping
+	// 对称映射：内网端点|外部目的 -> 映射
+	bySession map[string]*mapping
+	// 公网端口 -> 映射
+	byPort map[int]*mapping
+}
+
+type mapping struct {
+	inside  *net.UDPAddr
+	port    int
+	dest    string          // 对称型：唯一允许的外部地址 ip:port
+	allowIP map[string]bool // 受限锥形：发送过的外部 IP
+	allowEP map[string]bool // 端口受限锥形：发送过的外部 ip:port
+}
+
+// AddNAT 添加一台 NAT 设备
+func (nw *Network) AddNAT(publicIP string, typ NATType) *NAT {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nat := &NAT{
+		Type:      typ,
+		PublicIP:  net.ParseIP(publicIP),
+		nextPort:  20000,
+		byInside:  make(map[string]*mapping),
+		bySession: make(map[string]*mapping),
+		byPort:    make(map[int]*mapping),
+	}
+	nw.nats[nat.PublicIP.String()] = nat
+	return nat
+}
+
+// Host 一台主机，实现 p2proxy.Network
+// IP: IPv4 地址，nat 非nil时为内网地址
+// IP6: IPv6 地址，为nil表示没有 IPv6 连接；IPv6 地址总是可以直接访问
+type Host struct {
+	nw       *Network
+	IP       net.IP
+	IP6      net.IP
+	nat      *NAT // 为nil表示公网主机
+	link     Link
+	nextPort int
+}
+
+// AddHost 添加一台主机；nat 为 nil 表示主机直接位于公网
+func (nw *Network) AddHost(ip string, nat *NAT) *Host {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	h := &Host{nw: nw, IP: net.ParseIP(ip), nat: nat, nextPort: 30000}
+	nw.hosts[h.IP.String()] = h
+	return h
+}
+
+// AddIPv6 为主机添加 IPv6 地址，之后以 udp 或 udp6 创建的端点同时可以收发 IPv6 包
+func (h *Host) AddIPv6(ip string) {
+	h.nw.mu.Lock()
+	defer h.nw.mu.Unlock()
+	h.IP6 = net.ParseIP(ip)
+	h.nw.hosts[h.IP6.String()] = h
+}
+
+// InterfaceAddrs 返回主机的地址，IPv4 按 /24、IPv6 按 /64 划分网段，用于判断是否位于同一局域网
+func (h *Host) InterfaceAddrs() ([]net.Addr, error) {
+	addrs := []net.Addr{&net.IPNet{IP: h.IP, Mask: net.CIDRMask(24, 32)}}
+	if h.IP6 != nil {
+		addrs = append(addrs, &net.IPNet{IP: h.IP6, Mask: net.CIDRMask(64, 128)})
+	}
+	return addrs, nil
+}
+
+// SetLink 设置主机出口链路的特性
+func (h *Host) SetLink(l Link) {
+	h.nw.mu.Lock()
+	h.link = l
+	h.nw.mu.Unlock()
+}
+
+// ListenPacket 在主机上创建 UDP 端点，端口为 0 时自动分配
+// network 为 udp 且 address 的 IP 部分省略或为未指定地址时，端点同时使用主机的 IPv4 与 IPv6 地址（双栈），
+// udp4/udp6 或指定了主机的某个 IP 时只使用该协议族
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, fmt.Errorf("netsim: unsupported network %s", network)
+	}
+	ua, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	v4, v6 := network != "udp6", network != "udp4" && h.IP6 != nil
+	switch {
+	case ua.IP == nil || ua.IP.IsUnspecified():
+	case ua.IP.Equal(h.IP):
+		v6 = false
+	case h.IP6 != nil && ua.IP.Equal(h.IP6):
+		v4 = false
+	default:
+		return nil, fmt.Errorf("netsim: host %s cannot bind %s", h.IP, address)
+	}
+	if !v4 && !v6 {
+		return nil, fmt.Errorf("netsim: host %s has no address for %s", h.IP, network)
+	}
+	nw := h.nw
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	keys := func(port int) []string {
+		var ks []string
+		if v4 {
+			ks = append(ks, udpKey(h.IP, port))
+		}
+		if v6 {
+			ks = append(ks, udpKey(h.IP6, port))
+		}
+		return ks
+	}
+	free := func(port int) bool {
+		for _, k := range keys(port) {
+			if _, used := nw.endpoints[k]; used {
+				return false
+			}
+		}
+		return true
+	}
+	port := ua.Port
+	if port == 0 {
+		for {
+			h.nextPort++
+			if free(h.nextPort) {
+				port = h.nextPort
+				break
+			}
+		}
+	} else if !free(port) {
+		return nil, fmt.Errorf("netsim: address %s already in use", address)
+	}
+	ep := &endpoint{
+		host:  h,
+		queue: make(chan packet, nw.cfg.QueueLen),
+		done:  make(chan struct{}),
+	}
+	if v4 {
+		ep.addr = &net.UDPAddr{IP: h.IP, Port: port}
+	}
+	if v6 {
+		ep.addr6 = &net.UDPAddr{IP: h.IP6, Port: port}
+	}
+	for _, k := range keys(port) {
+		nw.endpoints[k] = ep
+	}
+	return ep, nil
+}
+
+// ListenMulticastUDP 在主机上创建加入组播组 gaddr 的 UDP 端点，只用于接收组播包，ifi 被忽略
+// 与设置了 SO_REUSEADDR 的套接字一样，同一主机上的多个端点可以加入同一个组
+func (h *Host) ListenMulticastUDP(network string, ifi *net.Interface, gaddr *net.UDPAddr) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" {
+		return nil, fmt.Errorf("netsim: unsupported network %s", network)
+	}
+	if gaddr == nil || gaddr.IP.To4() == nil || !gaddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("netsim: %v is not an IPv4 multicast address", gaddr)
+	}
+	nw := h.nw
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	ep := &endpoint{
+		host:  h,
+		addr:  &net.UDPAddr{IP: h.IP, Port: gaddr.Port},
+		group: (&net.UDPAddr{IP: gaddr.IP.To4(), Port: gaddr.Port}).String(),
+		queue: make(chan packet, nw.cfg.QueueLen),
+		done:  make(chan struct{}),
+	}
+	nw.groups[ep.group] = append(nw.groups[ep.group], ep)
+	return ep, nil
+}
+
+// DialContext 出口侧的 TCP 连接不经过模拟网络，直接使用真实网络（测试中的目标服务器位于本机）
+func (h *Host) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func udpKey(ip net.IP, port int) string {
+	return (&net.UDPAddr{IP: ip, Port: port}).String()
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// send 从端点 ep 向 dst 发送一个包：先经过出口链路，再经过 NAT 转换，最后投递给目的端点
+func (nw *Network) send(ep *endpoint, data []byte, dst *net.UDPAddr) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.stats.Sent++
+	h := ep.host
+	l := h.link
+	if l.Loss > 0 && nw.rng.Float64() < l.Loss {
+		nw.stats.Lost++
+		return
+	}
+	copies := 1
+	if l.Duplicate > 0 && nw.rng.Float64() < l.Duplicate {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		delay := l.Latency
+		if l.Jitter > 0 {
+			delay += time.Duration(nw.rng.Int63n(int64(l.Jitter)))
+		}
+		if l.Reorder > 0 && nw.rng.Float64() < l.Reorder {
+			delay += l.Latency + l.Jitter + time.Millisecond
+		}
+		b := append([]byte(nil), data...)
+		if delay <= 0 {
+			nw.route(ep, b, dst)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			nw.mu.Lock()
+			defer nw.mu.Unlock()
+			nw.route(ep, b, dst)
+		})
+	}
+}
+
+// route 对包做 NAT 转换并投递，调用时需持有 nw.mu
+func (nw *Network) route(ep *endpoint, data []byte, dst *net.UDPAddr) {
+	h := ep.host
+	if dst.IP.To4() == nil {
+		nw.route6(ep, data, dst)
+		return
+	}
+	if dst.IP.IsMulticast() {
+		nw.multicast(ep, data, dst)
+		return
+	}
+	src := ep.addr
+	if src == nil {
+		nw.stats.Unroutable++
+		return
+	}
+	dstHost := nw.hosts[dst.IP.String()]
+	// 源主机位于 NAT 之后，且目的地址不在同一局域网内：做源地址转换
+	if h.nat != nil && (dstHost == nil || dstHost.nat != h.nat) {
+		src = h.nat.outbound(src, dst)
+	}
+	// 目的地址是 NAT 的公网 IP：做目的地址转换并检查过滤规则
+	if nat := nw.nats[dst.IP.String()]; nat != nil {
+		inside, ok := nat.inbound(src, dst.Port)
+		if !ok {
+			nw.stats.Filtered++
+			return
+		}
+		dst = inside
+	} else if dstHost != nil && dstHost.nat != nil && (h.nat != dstHost.nat) {
+		// 不能从局域网外直接访问 NAT 之后的内网地址
+		nw.stats.Unroutable++
+		return
+	}
+	nw.deliver(data, src, dst)
+}
+
+// route6 投递 IPv6 包：IPv6 不经过 NAT，源端点没有 IPv6 地址时不可达，调用时需持有 nw.mu
+func (nw *Network) route6(ep *endpoint, data []byte, dst *net.UDPAddr) {
+	if ep.addr6 == nil {
+		nw.stats.Unroutable++
+		return
+	}
+	nw.deliver(data, ep.addr6, dst)
+}
+
+// multicast 把组播包投递给同一局域网内加入该组的端点，调用时需持有 nw.mu
+func (nw *Network) multicast(ep *endpoint, data []byte, dst *net.UDPAddr) {
+	if ep.addr == nil {
+		nw.stats.Unroutable++
+		return
+	}
+	for _, m := range nw.groups[dst.String()] {
+		if !sameLAN(ep.host, m.host) {
+			continue
+		}
+		select {
+		case m.queue <- packet{data: data, from: ep.addr}:
+			nw.stats.Delivered++
+		default:
+			nw.stats.Lost++
+		}
+	}
+}
+
+// sameLAN 两台主机是否位于同一局域网：同一个 NAT 之后，或都是同一 /24 网段的公网主机
+func sameLAN(a, b *Host) bool {
+	if a.nat != nil || b.nat != nil {
+		return a.nat == b.nat
+	}
+	return a.IP.Mask(net.CIDRMask(24, 32)).Equal(b.IP.Mask(net.CIDRMask(24, 32)))
+}
+
+// deliver 把包放入目的端点的接收队列，调用时需持有 nw.mu
+func (nw *Network) deliver(data []byte, src, dst *net.UDPAddr) {
+	target := nw.endpoints[dst.String()]
+	if target == nil {
+		nw.stats.Unroutable++
+		return
+	}
+	select {
+	case target.queue <- packet{data: data, from: src}:
+		nw.stats.Delivered++
+	default:
+		nw.stats.Lost++
+	}
+}
+
+// outbound 为内网端点 inside 发往 dst 的包分配公网地址，并记录放行规则
+func (nat *NAT) outbound(inside, dst *net.UDPAddr) *net.UDPAddr {
+	var m *mapping
+	if nat.Type == Symmetric {
+		key := inside.String() + "|" + dst.String()
+		m = nat.bySession[key]
+		if m == nil {
+			m = nat.newMapping(inside)
+			m.dest = dst.String()
+			nat.bySession[key] = m
+		}
+	} else {
+		m = nat.byInside[inside.String()]
+		if m == nil {
+			m = nat.newMapping(inside)
+			nat.byInside[inside.String()] = m
+		}
+		m.allowIP[dst.IP.String()] = true
+		m.allowEP[dst.String()] = true
+	}
+	return &net.UDPAddr{IP: nat.PublicIP, Port: m.port}
+}
+
+func (nat *NAT) newMapping(inside *net.UDPAddr) *mapping {
+	nat.nextPort++
+	m := &mapping{
+		inside:  inside,
+		port:    nat.nextPort,
+		allowIP: make(map[string]bool),
+		allowEP: make(map[string]bool),
+	}
+	nat.byPort[m.port] = m
+	return m
+}
+
+// inbound 查找公网端口 port 对应的内网端点，并按 NAT 类型检查来源 src 是否放行
+func (nat *NAT) inbound(src *net.UDPAddr, port int) (*net.UDPAddr, bool) {
+	m := nat.byPort[port]
+	if m == nil {
+		return nil, false
+	}
+	switch nat.Type {
+	case FullCone:
+	case RestrictedCone:
+		if !m.allowIP[src.IP.String()] {
+			return nil, false
+		}
+	case PortRestrictedCone:
+		if !m.allowEP[src.String()] {
+			return nil, false
+		}
+	case Symmetric:
+		if m.dest != src.String() {
+			return nil, false
+		}
+	}
+	return m.inside, true
+}
+
+// endpoint 模拟的 UDP 端点，实现 net.PacketConn
+// addr/addr6: 端点的 IPv4/IPv6 地址，没有使用该协议族时为nil
+type endpoint struct {
+	host  *Host
+	addr  *net.UDPAddr
+	addr6 *net.UDPAddr
+	group string // 组播端点加入的组，普通端点为空
+	queue chan packet
+
+	mu           sync.Mutex
+	done         chan struct{}
+	closed       bool
+	readDeadline time.Time
+}
+
+func (ep *endpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	ep.mu.Lock()
+	dl := ep.readDeadline
+	ep.mu.Unlock()
+	var timeout <-chan time.Time
+	if !dl.IsZero() {
+		d := time.Until(dl)
+		if d <= 0 {
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: ep.LocalAddr(), Err: errTimeout{}}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-ep.queue:
+		return copy(b, p.data), p.from, nil
+	case <-ep.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: ep.LocalAddr(), Err: net.ErrClosed}
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: ep.LocalAddr(), Err: errTimeout{}}
+	}
+}
+
+func (ep *endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ep.mu.Lock()
+	closed := ep.closed
+	ep.mu.Unlock()
+	if closed {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: ep.LocalAddr(), Err: net.ErrClosed}
+	}
+	dst, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if dst, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	if dst.IP.To4() != nil {
+		dst = &net.UDPAddr{IP: dst.IP.To4(), Port: dst.Port}
+	}
+	ep.host.nw.send(ep, b, dst)
+	return len(b), nil
+}
+
+func (ep *endpoint) Close() error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.closed {
+		return nil
+	}
+	ep.closed = true
+	close(ep.done)
+	nw := ep.host.nw
+	nw.mu.Lock()
+	if ep.group != "" {
+		members := nw.groups[ep.group]
+		for i, m := range members {
+			if m == ep {
+				nw.groups[ep.group] = append(members[:i:i], members[i+1:]...)
+				break
+			}
+		}
+	} else {
+		for _, a := range []*net.UDPAddr{ep.addr, ep.addr6} {
+			if a != nil {
+				delete(nw.endpoints, a.String())
+			}
+		}
+	}
+	nw.mu.Unlock()
+	return nil
+}
+
+// LocalAddr 双栈端点返回 [::]:port，与操作系统的双栈套接字一致
+func (ep *endpoint) LocalAddr() net.Addr {
+	switch {
+	case ep.addr6 == nil:
+		return ep.addr
+	case ep.addr == nil:
+		return ep.addr6
+	}
+	return &net.UDPAddr{IP: net.IPv6unspecified, Port: ep.addr.Port}
+}
+
+func (ep *endpoint) SetDeadline(t time.Time) error { return ep.SetReadDeadline(t) }
+
+func (ep *endpoint) SetReadDeadline(t time.Time) error {
+	ep.mu.Lock()
+	ep.readDeadline = t
+	ep.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 写入从不阻塞，忽略
+func (ep *endpoint) SetWriteDeadline(t time.Time) error { return nil }
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
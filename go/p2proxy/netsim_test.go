@@ -0,0 +1,233 @@
+package p2proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+	"golang.org/x/net/proxy"
+)
+
+// 基于 netsim 模拟网络的测试：节点之间的 UDP 通信全部经过模拟器，
+// SOCKS5 前端与目标服务器仍使用本机回环地址。
+
+const simTrackerAddr = "203.0.113.1:40000"
+
+// simPeer 模拟网络中的一个节点位置：natType 为 0 表示公网主机
+type simPeer struct {
+	natType netsim.NATType
+	link    netsim.Link
+}
+
+// simEnv 一套模拟网络环境：tracker、nodeA（发起方）、nodeB（出口）
+type simEnv struct {
+	nw      *netsim.Network
+	tracker *Tracker
+	a, b    *Node
+}
+
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newSimEnv 搭建模拟网络并完成两个节点的注册
+func newSimEnv(t testing.TB, seed int64, pa, pb simPeer, timeouts Timeouts) *simEnv {
+	t.Helper()
+	nw := netsim.New(netsim.Config{Seed: seed})
+	th := nw.AddHost("203.0.113.1", nil)
+	host := func(i int, p simPeer) *netsim.Host {
+		var h *netsim.Host
+		if p.natType == 0 {
+			h = nw.AddHost(fmt.Sprintf("198.51.100.%d", i), nil)
+		} else {
+			nat := nw.AddNAT(fmt.Sprintf("198.51.100.%d", i), p.natType)
+			h = nw.AddHost(fmt.Sprintf("10.0.%d.2", i), nat)
+		}
+		h.SetLink(p.link)
+		return h
+	}
+	ha, hb := host(1, pa), host(2, pb)
+
+	tr := NewTracker(simTrackerAddr)
+	tr.Network = th
+	tr.Logger = quietLogger()
+	go tr.Run()
+	t.Cleanup(func() { tr.Close() })
+
+	newNode := func(id string, h *netsim.Host) *Node {
+		n, err := NewNodeWithConfig(NodeConfig{
+			ID:       id,
+			Trackers: []string{simTrackerAddr},
+			Timeouts: timeouts,
+			Logger:   quietLogger(),
+			Network:  h,
+		})
+		if err != nil {
+			t.Fatalf("create %s: %v", id, err)
+		}
+		t.Cleanup(n.Close)
+		return n
+	}
+	env := &simEnv{nw: nw, tracker: tr, a: newNode("nodeA", ha), b: newNode("nodeB", hb)}
+
+	// 注册可能因丢包失败，重复注册直到 tracker 记录了两个节点
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		env.a.Register()
+		env.b.Register()
+		time.Sleep(50 * time.Millisecond)
+		tr.mu.Lock()
+		done := tr.nodes["nodeA"] != nil && tr.nodes["nodeB"] != nil
+		tr.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes not registered")
+		}
+	}
+	return env
+}
+
+// startEchoServer 启动一个回显服务器，客户端半关闭后回显完剩余数据再关闭
+func startEchoServer(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startSocks 在 nodeA 上启动 SOCKS5 前端，经 nodeB 转发
+func (e *simEnv) startSocks(t testing.TB) proxy.Dialer {
+	t.Helper()
+	ln, err := e.a.ListenSocks5("127.0.0.1:0", "nodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return socksDialer(t, ln.Addr().String())
+}
+
+// socksDialer 通过 addr 上的 SOCKS5 代理拨号
+func socksDialer(t testing.TB, addr string) proxy.Dialer {
+	t.Helper()
+	d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// echoThrough 通过 SOCKS5 把 payload 发给回显服务器并读回全部数据
+func echoThrough(d proxy.Dialer, target string, payload []byte, timeout time.Duration) ([]byte, error) {
+	c, err := d.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(payload)
+		if err == nil {
+			err = c.(*net.TCPConn).CloseWrite()
+		}
+		errc <- err
+	}()
+	got, err := io.ReadAll(c)
+	if werr := <-errc; werr != nil && err == nil {
+		err = werr
+	}
+	return got, err
+}
+
+// punchExpected 当前的打洞策略（双方互发探测包 + 学习探测包的来源地址）能否穿透 a、b 两种 NAT
+// 对称型 NAT 与对称型或端口受限锥形 NAT 之间无法穿透
+func punchExpected(a, b netsim.NATType) bool {
+	hard := func(x netsim.NATType) bool { return x == netsim.Symmetric || x == netsim.PortRestrictedCone }
+	if a == netsim.Symmetric && hard(b) {
+		return false
+	}
+	if b == netsim.Symmetric && hard(a) {
+		return false
+	}
+	return true
+}
+
+// TestPunchMatrix 遍历两端所有 NAT 类型的组合，验证打洞成功/失败与预期一致
+func TestPunchMatrix(t *testing.T) {
+	types := []netsim.NATType{0, netsim.FullCone, netsim.RestrictedCone, netsim.PortRestrictedCone, netsim.Symmetric}
+	echo := startEchoServer(t)
+	timeouts := Timeouts{Lookup: 2 * time.Second, Open: 300 * time.Millisecond}
+	for i, ta := range types {
+		for j, tb := range types {
+			ta, tb := ta, tb
+			seed := int64(i*len(types) + j)
+			t.Run(ta.String()+"/"+tb.String(), func(t *testing.T) {
+				t.Parallel()
+				env := newSimEnv(t, seed, simPeer{natType: ta}, simPeer{natType: tb}, timeouts)
+				d := env.startSocks(t)
+				payload := []byte("hello through " + ta.String() + " and " + tb.String())
+				got, err := echoThrough(d, echo, payload, 5*time.Second)
+				ok := err == nil && bytes.Equal(got, payload)
+				if want := punchExpected(ta, tb); ok != want {
+					t.Fatalf("punch %s -> %s: got success=%v (err=%v), want %v", ta, tb, ok, err, want)
+				}
+			})
+		}
+	}
+}
+
+// TestStreamIntegrityAdverse 在丢包、延迟抖动、乱序和重复的链路上传输数据，验证数据流完整且有序
+func TestStreamIntegrityAdverse(t *testing.T) {
+	links := map[string]netsim.Link{
+		"loss":      {Loss: 0.1, Latency: 2 * time.Millisecond},
+		"reorder":   {Latency: 5 * time.Millisecond, Jitter: 10 * time.Millisecond, Reorder: 0.2},
+		"duplicate": {Latency: time.Millisecond, Duplicate: 0.3},
+		"all":       {Loss: 0.05, Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Duplicate: 0.05, Reorder: 0.05},
+	}
+	echo := startEchoServer(t)
+	for name, link := range links {
+		link := link
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			p := simPeer{natType: netsim.PortRestrictedCone, link: link}
+			env := newSimEnv(t, 42, p, p, Timeouts{Open: time.Second})
+			d := env.startSocks(t)
+
+			payload := make([]byte, 256*1024)
+			rand.New(rand.NewSource(7)).Read(payload)
+			got, err := echoThrough(d, echo, payload, 30*time.Second)
+			if err != nil {
+				t.Fatalf("echo through proxy: %v (got %d bytes)", err, len(got))
+			}
+			if sha256.Sum256(got) != sha256.Sum256(payload) {
+				t.Fatalf("payload corrupted: sent %d bytes, got %d bytes", len(payload), len(got))
+			}
+			st := env.nw.Stats()
+			t.Logf("sim stats: %+v", st)
+		})
+	}
+}
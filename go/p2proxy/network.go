@@ -0,0 +1,46 @@
+package p2proxy
+
+import (
+	"context"
+	"net"
+)
+
+// Network 节点与 tracker 使用的网络。默认使用真实网络，测试中可替换为 netsim 包提供的模拟网络
+// ListenPacket: 创建 UDP 端点（节点间与 tracker 的通信）
+// DialContext: 出口侧连接目标服务器
+type Network interface {
+	ListenPacket(network, address string) (net.PacketConn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// realNetwork 使用操作系统网络
+type realNetwork struct{}
+
+func (realNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+func (realNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// networkOrDefault 返回 nw，为 nil 时返回真实网络
+func networkOrDefault(nw Network) Network {
+	if nw == nil {
+		return realNetwork{}
+	}
+	return nw
+}
+
+// toUDPAddr 把 net.Addr 转换为 *net.UDPAddr
+func toUDPAddr(a net.Addr) *net.UDPAddr {
+	if ua, ok := a.(*net.UDPAddr); ok {
+		return ua
+	}
+	ua, err := net.ResolveUDPAddr("udp", a.String())
+	if err != nil {
+		return nil
+	}
+	return ua
+}
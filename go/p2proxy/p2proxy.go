@@ -1,15 +1,14 @@
 package p2proxy
 
 import (
-	"bufio"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +24,14 @@ import (
 // StreamID: 数据流标识符，用于标识一个特定的数据传输通道
 // Target: 目标服务器地址(host:port格式)
 // Data: base64编码的数据载荷
+// Seq: 数据流内的包序号（stream_data/stream_close）
+// Ack: 累计确认，接收方下一个期望的序号（data_ack）
+// ReqID: 请求ID，tracker 在 lookup 的回复（peer/notfound）中原样带回
+// Error: 拒绝或重置数据流的原因（stream_reset）
+// Candidates: 节点的候选地址（register 中为本节点的，peer/notify 中为对端的）
+// Compress: stream_open 中为提议的压缩算法，stream_ready 中为选择的算法，见 compress.go
+// Enc: stream_data 的压缩算法，为空表示未压缩
+// Mac: 消息签名（配置了预共享密钥时使用）
 type ProtoMsg struct {
 	Type     string `json:"type"`
 	From     string `json:"from,omitempty"`
@@ -33,41 +40,106 @@ type ProtoMsg struct {
 	StreamID string `json:"stream_id,omitempty"` // 用于数据流标识
 	Target   string `json:"target,omitempty"`    // 目标服务器 address host:port
 	Data     string `json:"data,omitempty"`      // base64 编码的 payload
+	Seq      uint64 `json:"seq,omitempty"`       // 数据流包序号
+	Ack      uint64 `json:"ack,omitempty"`       // 累计确认序号
+	ReqID    string `json:"req_id,omitempty"`    // lookup 请求ID
+	Error    string `json:"error,omitempty"`     // stream_reset 的原因
+	Cookie   string `json:"cookie,omitempty"`    // tracker 的注册 cookie，见 tracker_guard.go
+	Compress string `json:"compress,omitempty"`  // 提议或选择的压缩算法
+	Enc      string `json:"enc,omitempty"`       // stream_data 的压缩算法
+	Mac      string `json:"mac,omitempty"`       // HMAC-SHA256 签名
+	Pause    int64  `json:"pause,omitempty"`     // data_ack 的接收限速：要求发送方暂停的毫秒数
+
+	Candidates []Candidate `json:"candidates,omitempty"` // 候选地址
 }
 
 // Tracker: 在公网服务器上运行，接受节点注册并互相交换地址用于 UDP 打洞
 // Tracker 是整个 P2P 网络的核心协调者，负责帮助各个节点发现彼此的网络地址
 // ListenAddr: Tracker 监听的 UDP 地址
 // conn: Tracker 的 UDP 连接
-// mu: 用于保护 nodes 映射的互斥锁
-// nodes: 存储已注册节点的 ID 到其网络地址的映射
+// mu: 用于保护 nodes、store、ctlLn 的互斥锁
+// nodes: 存储已注册节点的 ID 到其注册信息的映射，超过 NodeTTL 未重新注册的节点视为离线
+// Key: 预共享密钥，非空时只接受签名正确的消息，并为回复签名
+// Logger: 日志输出，为nil时使用 slog.Default()
+// LogSample: 每个数据包都会触发的日志的采样配置
+// Network: 使用的网络，为nil时使用真实网络
+// NodeTTL: 注册的有效期，默认 360 秒（节点默认每 120 秒重新注册）
+// StorePath: 注册信息的持久化文件，非空时启动时恢复未过期的注册，为空只保存在内存中
+// ControlAddr: 管理控制连接的监听地址，unix:/path 或 host:port，为空不启动
+// ControlKey: 控制连接的认证密钥，启动控制连接时必填
+// Limits: 滥用防护设置，见 tracker_guard.go
 type Tracker struct {
-	ListenAddr string
-	conn       *net.UDPConn
-	mu         sync.Mutex
-	nodes      map[string]*net.UDPAddr
+	ListenAddr  string
+	Key         string
+	Logger      *slog.Logger
+	LogSample   SampleConfig
+	Network     Network
+	NodeTTL     time.Duration
+	StorePath   string
+	ControlAddr string
+	ControlKey  string
+	Limits      TrackerLimits
+	log         *slog.Logger
+	pktLog      *slog.Logger
+	conn        net.PacketConn
+	mu          sync.Mutex
+	nodes       map[string]*trackerNode
+	store       *nodeStore
+	ctlLn       net.Listener
+	guard       *trackerGuard
+	quit        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NodeInfo tracker 记录的一个节点的注册信息
+type NodeInfo struct {
+	ID         string      `json:"id"`
+	Addr       string      `json:"addr"`                 // 最近一次注册时 tracker 看到的公网/映射地址
+	Candidates []Candidate `json:"candidates,omitempty"` // 节点上报的候选地址，包含 Addr
+	Registered time.Time   `json:"registered"`           // 首次注册时间
+	LastSeen   time.Time   `json:"last_seen"`            // 最近一次注册时间
+	Expires    time.Time   `json:"expires"`              // 注册过期时间
+}
+
+// trackerNode 注册信息及解析后的地址
+type trackerNode struct {
+	NodeInfo
+	addr *net.UDPAddr
 }
 
 // NewTracker 创建一个新的 Tracker 实例
 // listenAddr: Tracker 监听的 UDP 地址
 func NewTracker(listenAddr string) *Tracker {
-	return &Tracker{ListenAddr: listenAddr, nodes: make(map[string]*net.UDPAddr)}
+	return &Tracker{ListenAddr: listenAddr, nodes: make(map[string]*trackerNode), quit: make(chan struct{})}
 }
 
 // Run 启动 Tracker 服务，开始监听和处理来自节点的消息
 // 该方法会持续运行，处理节点的注册和地址查询请求
 func (t *Tracker) Run() error {
-	// 解析并监听指定的 UDP 地址
-	udpAddr, err := net.ResolveUDPAddr("udp", t.ListenAddr)
-	if err != nil {
+	t.log = loggerOrDefault(t.Logger)
+	t.pktLog = slog.New(NewSampledHandler(t.log.Handler(), t.LogSample))
+	if err := t.openStore(); err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP("udp", udpAddr)
+
+	// 监听指定的 UDP 地址
+	conn, err := networkOrDefault(t.Network).ListenPacket("udp", t.ListenAddr)
 	if err != nil {
+		t.closeStore()
 		return err
 	}
 	t.conn = conn
-	log.Printf("tracker listening %s", t.ListenAddr)
+	if t.ControlAddr != "" {
+		if err := t.startControl(); err != nil {
+			conn.Close()
+			t.closeStore()
+			return err
+		}
+	}
+	t.log.Info("tracker listening", logKeyAddr, t.ListenAddr)
+	go t.sweepLoop()
+	t.guard = newTrackerGuard(t.Limits)
+	lastSweep := time.Now()
 
 	// 创建缓冲区用于接收UDP数据包
 	buf := make([]byte, 65535)
@@ -75,21 +147,38 @@ func (t *Tracker) Run() error {
 	// 持续监听并处理来自节点的消息
 	for {
 		// 从UDP连接读取数据
-		n, addr, err := conn.ReadFromUDP(buf)
+		n, raddr, err := conn.ReadFrom(buf)
 		if err != nil {
 			// 如果是连接关闭的错误，直接退出循环
-			if strings.Contains(err.Error(), "closed") {
-				log.Printf("tracker shutting down...")
+			if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "closed") {
+				t.log.Info("tracker shutting down")
 				return nil
 			}
-			log.Printf("tracker read error: %v", err)
+			t.log.Warn("tracker read error", "err", err)
+			continue
+		}
+		addr := toUDPAddr(raddr)
+		if addr == nil {
+			continue
+		}
+		if now := time.Now(); now.Sub(lastSweep) >= trackerSweepPeriod {
+			t.guard.sweep(now)
+			lastSweep = now
+		}
+		// 超出来源 IP 速率的包在解析之前丢弃
+		if !t.guard.allow(addr.IP) {
+			t.pktLog.Warn("tracker: rate limited", logKeyAddr, addr.String())
 			continue
 		}
 
 		// 解析收到的JSON消息
 		var m ProtoMsg
 		if err := json.Unmarshal(buf[:n], &m); err != nil {
-			log.Printf("tracker: invalid json from %s: %v", addr, err)
+			t.pktLog.Warn("tracker: invalid json", logKeyAddr, addr.String(), "err", err)
+			continue
+		}
+		if !verifyMsg([]byte(t.Key), &m) {
+			t.pktLog.Warn("tracker: bad signature", logKeyAddr, addr.String())
 			continue
 		}
 
@@ -97,169 +186,378 @@ func (t *Tracker) Run() error {
 		switch m.Type {
 		case "register":
 			// 处理节点注册请求
-			// 将节点ID与其网络地址关联存储
-			t.mu.Lock()
-			t.nodes[m.From] = addr
-			t.mu.Unlock()
-			log.Printf("registered %s -> %s", m.From, addr.String())
+			if !t.admit(m, addr, n) {
+				continue
+			}
+			// 将节点ID与其网络地址、候选地址关联存储
+			t.register(m.From, addr, m.Candidates)
+			t.pktLog.Debug("registered", logKeyNode, m.From, logKeyAddr, addr.String(), "candidates", len(m.Candidates))
 
-			// 回复注册确认消息
-			resp := ProtoMsg{Type: "registered"}
-			b, _ := json.Marshal(&resp)
-			conn.WriteToUDP(b, addr)
+			// 回复注册确认消息，告诉节点 tracker 看到的地址
+			t.reply(m.From, addr, n, ProtoMsg{Type: "registered", Addr: addr.String()})
 
 		case "lookup":
 			// 处理节点地址查询请求
-			t.mu.Lock()
 			// 查找目标节点的地址
-			peerAddr, ok := t.nodes[m.To]
-			t.mu.Unlock()
+			peerAddr, peerCands := t.lookup(m.To)
 
-			if ok {
-				// 如果找到目标节点，回复其地址给请求方
-				resp := ProtoMsg{Type: "peer", From: m.To, Addr: peerAddr.String()}
-				b, _ := json.Marshal(&resp)
-				conn.WriteToUDP(b, addr)
+			if peerAddr != nil {
+				// 如果找到目标节点，回复其地址与候选地址给请求方
+				t.reply(m.From, addr, n, ProtoMsg{Type: "peer", From: m.To, Addr: peerAddr.String(), ReqID: m.ReqID, Candidates: peerCands})
 
 				// 同时通知目标节点有关请求方的信息，帮助双向NAT打洞
-				t.mu.Lock()
-				requesterAddr := t.nodes[m.From]
-				t.mu.Unlock()
-				if requesterAddr != nil {
-					notify := ProtoMsg{Type: "notify", From: m.From, Addr: requesterAddr.String()}
-					nb, _ := json.Marshal(&notify)
-					conn.WriteToUDP(nb, peerAddr)
+				// 请求方的地址使用本次 lookup 的来源地址，它可能是请求方在另一个协议族上的地址；
+				// 来源地址必须是请求方注册时的地址，重发的 lookup 不重复通知
+				_, requesterCands := t.lookup(m.From)
+				if t.registeredFrom(m.From, addr, true) && t.guard.shouldNotify(m.From, m.To, time.Now()) {
+					t.send(peerAddr, ProtoMsg{Type: "notify", From: m.From, Addr: addr.String(), Candidates: requesterCands})
 				}
 			} else {
 				// 如果未找到目标节点，回复未找到消息
-				resp := ProtoMsg{Type: "notfound", To: m.To}
-				b, _ := json.Marshal(&resp)
-				conn.WriteToUDP(b, addr)
+				t.reply(m.From, addr, n, ProtoMsg{Type: "notfound", To: m.To, ReqID: m.ReqID})
 			}
 
 		default:
 			// 处理未知类型的消息
-			log.Printf("tracker: unknown type %s from %s", m.Type, addr)
+			t.pktLog.Warn("tracker: unknown message type", "type", m.Type, logKeyAddr, addr.String())
 		}
 	}
 }
 
+// send 签名并发送消息到指定地址
+func (t *Tracker) send(addr *net.UDPAddr, m ProtoMsg) {
+	signMsg([]byte(t.Key), &m)
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return
+	}
+	t.conn.WriteTo(b, addr)
+}
+
 // Node: 代表运行在 NAT/内网的节点
 // Node 是P2P网络中的参与者，可以发起连接请求或作为中继转发数据
 // ID: 节点唯一标识符
-// TrackerAddr: Tracker服务器的UDP地址
+// TrackerAddr: 首个Tracker服务器的UDP地址，没有配置 tracker 时为nil
 // conn: 节点的UDP连接
-// mu: 用于保护 peers、streams 和 ready 映射的互斥锁
-// peers: 存储已知其他节点的ID到其网络地址的映射
-// streams: 存储数据流ID到本地TCP连接的映射（用于SOCKS代理侧）
-// ready: 存储数据流ID到就绪信号通道的映射
+// key: 预共享密钥，用于消息签名
+// mu: 用于保护 peers、streams、nextStreamID 以及可热更新的配置
+// trackers: 全部Tracker服务器地址，注册和查找会发往每一个
+// timeouts: 各类超时设置
+// policy: 出口策略，为nil表示不限制
+// peers: 已知其他节点的地址缓存，有效期为 Timeouts.PeerTTL
+// lookups/inflight: 进行中的地址查询，分别按请求ID和节点ID索引
+// streams: 数据流表，以 (对端节点ID, 数据流ID) 为键（SOCKS代理侧与出口侧）
+// nextStreamID: 向每个对端发起的下一个数据流ID
+// services: 本节点注册的内部服务，见 service.go
+// reflexive: 各个 tracker 看到的本节点地址；checks: 进行中的连通性检查，见 candidates.go
+// discovery: 局域网发现，未启用时为nil；lanPeers: 局域网内发现的节点，见 discovery.go
+// log: 带 node 字段的日志；pktLog: 经过采样的日志，用于每个数据包都会触发的消息
+// limiter: 带宽限制；quota: 按对端节点的流量配额；quit: 节点关闭时关闭
 type Node struct {
-	ID          string
-	TrackerAddr *net.UDPAddr
-	conn        *net.UDPConn
-	mu          sync.Mutex
-	peers       map[string]*net.UDPAddr  // id -> addr
-	streams     map[string]net.Conn      // streamID -> local TCP conn (for SOCKS side)
-	ready       map[string]chan struct{} // streamID -> ready signal
+	ID            string
+	TrackerAddr   *net.UDPAddr
+	conn          net.PacketConn
+	network       Network
+	key           []byte
+	log           *slog.Logger
+	pktLog        *slog.Logger
+	mu            sync.Mutex
+	trackers      []*net.UDPAddr
+	timeouts      Timeouts
+	policy        *ExitPolicy
+	peers         map[string]peerEntry     // id -> addr
+	lookups       map[string]*LookupFuture // reqID -> lookup
+	inflight      map[string]*LookupFuture // peerID -> lookup
+	streams       map[streamKey]*stream
+	nextStreamID  map[string]uint64
+	services      map[string]serviceHandler
+	reflexive     map[string]string        // tracker addr -> 本节点的映射地址
+	checks        map[string]*checkSession // token -> 进行中的连通性检查
+	discovery     *discovery
+	lanPeers      map[string]lanPeer
+	sessions      map[string]*peerSession // id -> 与对端的会话，见 session.go
+	compression   CompressionConfig
+	compressStats *compressStats
+	limiter       *rateLimiter
+	quota         *quotaStore
+	quit          chan struct{}
+	closeOnce     sync.Once
+}
+
+// Timeouts 节点使用的超时设置，零值表示使用默认值
+type Timeouts struct {
+	Lookup time.Duration // 等待tracker返回peer地址，默认5秒
+	Open   time.Duration // 每次发送stream_open后等待stream_ready，默认5秒
+	Dial   time.Duration // 出口侧连接目标服务器，默认10秒
+	// PeerTTL peer 地址缓存的有效期，默认60秒
+	PeerTTL time.Duration
+	// Idle 数据流两个方向都没有数据的最长时间，超过后重置数据流，默认5分钟
+	Idle time.Duration
+	// Retransmit 数据包未被确认时的重传间隔，默认200毫秒
+	Retransmit time.Duration
+	// AckTimeout 有未确认的数据包时持续收不到任何确认的最长时间，超过后重置数据流，默认15秒
+	AckTimeout time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Lookup <= 0 {
+		t.Lookup = 5 * time.Second
+	}
+	if t.Open <= 0 {
+		t.Open = 5 * time.Second
+	}
+	if t.Dial <= 0 {
+		t.Dial = 10 * time.Second
+	}
+	if t.Retransmit <= 0 {
+		t.Retransmit = 200 * time.Millisecond
+	}
+	if t.AckTimeout <= 0 {
+		t.AckTimeout = 15 * time.Second
+	}
+	if t.PeerTTL <= 0 {
+		t.PeerTTL = 60 * time.Second
+	}
+	if t.Idle <= 0 {
+		t.Idle = 5 * time.Minute
+	}
+	return t
+}
+
+// NodeConfig 节点配置
+type NodeConfig struct {
+	ID          string            // 节点ID
+	Trackers    []string          // Tracker服务器地址，未启用局域网发现时至少一个
+	ListenAddr  string            // 本地UDP监听地址，默认 :0
+	Key         string            // 预共享密钥，需与tracker及对端一致，为空表示不签名
+	Timeouts    Timeouts          // 超时设置
+	ExitPolicy  *ExitPolicy       // 出口策略
+	Logger      *slog.Logger      // 日志输出，为nil时使用 slog.Default()
+	LogSample   SampleConfig      // 每个数据包都会触发的日志的采样配置
+	Network     Network           // 使用的网络，为nil时使用真实网络
+	RateLimits  RateLimits        // 带宽限制
+	Quotas      QuotaConfig       // 按对端节点的流量配额
+	Discovery   DiscoveryConfig   // 局域网发现
+	Compression CompressionConfig // 数据流压缩
 }
 
 // NewNode 创建一个新的节点实例
 // id: 节点ID
 // tracker: Tracker服务器地址
 func NewNode(id string, tracker string) (*Node, error) {
-	// 解析Tracker地址
-	taddr, err := net.ResolveUDPAddr("udp", tracker)
+	return NewNodeWithConfig(NodeConfig{ID: id, Trackers: []string{tracker}})
+}
+
+// NewNodeWithConfig 根据配置创建一个新的节点实例
+func NewNodeWithConfig(cfg NodeConfig) (*Node, error) {
+	// 解析Tracker地址，启用局域网发现时可以不配置 tracker
+	if len(cfg.Trackers) == 0 && !cfg.Discovery.Enabled {
+		return nil, errTrackerRequired
+	}
+	trackers, err := resolveTrackers(cfg.Trackers)
 	if err != nil {
 		return nil, err
 	}
 
-	// 在本地随机端口创建UDP连接
-	laddr, err := net.ResolveUDPAddr("udp", ":0")
+	// 默认在本地随机端口创建UDP连接
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":0"
+	}
+	quota, err := newQuotaStore(cfg.Quotas)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.ListenUDP("udp", laddr)
+	network := networkOrDefault(cfg.Network)
+	conn, err := network.ListenPacket("udp", cfg.ListenAddr)
 	if err != nil {
 		return nil, err
 	}
 
 	// 初始化节点并启动消息读取循环
+	logger := loggerOrDefault(cfg.Logger).With(logKeyNode, cfg.ID)
 	n := &Node{
-		ID:          id,
-		TrackerAddr: taddr,
-		conn:        conn,
-		peers:       make(map[string]*net.UDPAddr),
-		streams:     make(map[string]net.Conn),
-		ready:       make(map[string]chan struct{}),
+		ID:            cfg.ID,
+		conn:          conn,
+		network:       network,
+		key:           []byte(cfg.Key),
+		log:           logger,
+		pktLog:        slog.New(NewSampledHandler(logger.Handler(), cfg.LogSample)),
+		trackers:      trackers,
+		timeouts:      cfg.Timeouts.withDefaults(),
+		policy:        cfg.ExitPolicy,
+		peers:         make(map[string]peerEntry),
+		lookups:       make(map[string]*LookupFuture),
+		inflight:      make(map[string]*LookupFuture),
+		streams:       make(map[streamKey]*stream),
+		nextStreamID:  make(map[string]uint64),
+		services:      make(map[string]serviceHandler),
+		reflexive:     make(map[string]string),
+		checks:        make(map[string]*checkSession),
+		lanPeers:      make(map[string]lanPeer),
+		sessions:      make(map[string]*peerSession),
+		compression:   cfg.Compression,
+		compressStats: newCompressStats(),
+		limiter:       newRateLimiter(cfg.RateLimits),
+		quota:         quota,
+		quit:          make(chan struct{}),
+	}
+
+	if len(trackers) > 0 {
+		n.TrackerAddr = trackers[0]
 	}
 
 	// 启动异步消息读取循环
 	go n.readLoop()
+	go n.flushLoop(quota)
+	go n.sessionLoop()
+	go n.compressStatsLoop()
+	if cfg.Discovery.Enabled {
+		if err := n.startDiscovery(cfg.Discovery); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
 	return n, nil
 }
 
-// Close 关闭节点的UDP连接
-func (n *Node) Close() {
-	if n.conn != nil {
-		n.conn.Close()
+var errTrackerRequired = errors.New("at least one tracker is required")
+
+func resolveTrackers(addrs []string) ([]*net.UDPAddr, error) {
+	var trackers []*net.UDPAddr
+	for _, a := range addrs {
+		taddr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			return nil, err
+		}
+		trackers = append(trackers, taddr)
 	}
+	return trackers, nil
+}
+
+// SetTrackers 替换Tracker服务器列表，下一次注册和查找生效；启用了局域网发现时可以为空
+func (n *Node) SetTrackers(addrs []string) error {
+	if len(addrs) == 0 && n.discovery == nil {
+		return errTrackerRequired
+	}
+	trackers, err := resolveTrackers(addrs)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.trackers = trackers
+	// 只保留仍在列表中的 tracker 看到的地址
+	for key := range n.reflexive {
+		if !slices.ContainsFunc(trackers, func(t *net.UDPAddr) bool { return t.String() == key }) {
+			delete(n.reflexive, key)
+		}
+	}
+	n.mu.Unlock()
+	return nil
+}
+
+// trackerFor 返回与 from 相同的已配置 tracker 地址，from 不是 tracker 时返回nil
+func (n *Node) trackerFor(from *net.UDPAddr) *net.UDPAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, t := range n.trackers {
+		if t.IP.Equal(from.IP) && t.Port == from.Port {
+			return t
+		}
+	}
+	return nil
+}
+
+// SetTimeouts 更新超时设置，对之后发起的操作生效
+func (n *Node) SetTimeouts(t Timeouts) {
+	n.mu.Lock()
+	n.timeouts = t.withDefaults()
+	n.mu.Unlock()
+}
+
+// SetExitPolicy 更新出口策略，nil 表示不限制
+func (n *Node) SetExitPolicy(p *ExitPolicy) {
+	n.mu.Lock()
+	n.policy = p
+	n.mu.Unlock()
+}
+
+// getTimeouts 获取当前的超时设置
+func (n *Node) getTimeouts() Timeouts {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.timeouts
+}
+
+// sendTrackers 发送消息到所有Tracker，只要有一个发送成功即返回nil
+func (n *Node) sendTrackers(m ProtoMsg) error {
+	n.mu.Lock()
+	trackers := n.trackers
+	n.mu.Unlock()
+	var lastErr error
+	sent := false
+	for _, t := range trackers {
+		if err := n.sendProto(t, m); err != nil {
+			lastErr = err
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	return lastErr
+}
+
+// Close 关闭节点的UDP连接，并保存流量用量
+func (n *Node) Close() {
+	n.closeOnce.Do(func() {
+		close(n.quit)
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		if n.discovery != nil {
+			n.discovery.conn.Close()
+		}
+		if err := n.quota.save(); err != nil {
+			n.log.Warn("save quota usage error", "err", err)
+		}
+	})
 }
 
 // sendProto 发送ProtoMsg消息到指定地址
 // addr: 目标地址
 // m: 要发送的消息
 func (n *Node) sendProto(addr *net.UDPAddr, m ProtoMsg) error {
-	// 将消息序列化为JSON格式
+	// 签名并将消息序列化为JSON格式
+	signMsg(n.key, &m)
 	b, err := json.Marshal(&m)
 	if err != nil {
 		return err
 	}
 
 	// 通过UDP连接发送消息
-	_, err = n.conn.WriteToUDP(b, addr)
+	_, err = n.conn.WriteTo(b, addr)
 	return err
 }
 
 // Register 向 tracker 注册自己的 ID 和地址信息
 // 节点需要定期调用此方法以保持在Tracker中的注册状态
 func (n *Node) Register() error {
-	// 构造注册消息
-	m := ProtoMsg{Type: "register", From: n.ID}
+	// 构造注册消息，带上本节点的候选地址
+	m := ProtoMsg{Type: "register", From: n.ID, Candidates: n.localCandidates()}
 
-	// 发送注册消息到Tracker
-	return n.sendProto(n.TrackerAddr, m)
+	// 发送注册消息到所有Tracker
+	return n.sendTrackers(m)
 }
 
-// Lookup 向 tracker 请求指定 peer 节点的地址信息
-// peerID: 要查找的节点ID
-// 返回查找到的节点地址或错误信息
-func (n *Node) Lookup(peerID string) (*net.UDPAddr, error) {
-	// 构造查找消息
-	m := ProtoMsg{Type: "lookup", From: n.ID, To: peerID}
-
-	// 发送查找消息到Tracker
-	if err := n.sendProto(n.TrackerAddr, m); err != nil {
-		return nil, err
+// onCookie 回显 tracker 的 cookie 重新注册，只回复配置的 tracker
+func (n *Node) onCookie(m ProtoMsg, from *net.UDPAddr) {
+	if m.Cookie == "" {
+		return
 	}
-
-	// 等待最多5秒以获取peer地址（通过readLoop处理返回的消息）
-	deadline := time.Now().Add(5 * time.Second)
-	for time.Now().Before(deadline) {
-		n.mu.Lock()
-		pa := n.peers[peerID]
-		n.mu.Unlock()
-
-		// 如果已获取到peer地址，立即返回
-		if pa != nil {
-			return pa, nil
-		}
-
-		// 短暂休眠后重试
-		time.Sleep(100 * time.Millisecond)
+	if t := n.trackerFor(from); t != nil {
+		n.sendProto(t, ProtoMsg{Type: "register", From: n.ID, Candidates: n.localCandidates(), Cookie: m.Cookie})
 	}
-
-	// 超时未获取到peer地址
-	return nil, errors.New("peer lookup timeout")
 }
 
 // readLoop 节点的消息读取循环，持续监听并处理来自其他节点或Tracker的消息
@@ -270,39 +568,80 @@ func (n *Node) readLoop() {
 	// 持续监听并处理消息
 	for {
 		// 从UDP连接读取数据
-		nread, addr, err := n.conn.ReadFromUDP(buf)
+		nread, raddr, err := n.conn.ReadFrom(buf)
 		if err != nil {
 			// 处理临时网络错误
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				time.Sleep(100 * time.Millisecond)
 				continue
 			}
-			log.Printf("node read error: %v", err)
+			n.log.Info("node read loop stopped", "err", err)
 			return
 		}
+		addr := toUDPAddr(raddr)
+		if addr == nil {
+			continue
+		}
 
 		// 解析收到的JSON消息
 		var m ProtoMsg
 		if err := json.Unmarshal(buf[:nread], &m); err != nil {
-			log.Printf("node: invalid json from %s: %v", addr, err)
+			n.pktLog.Warn("invalid json", logKeyAddr, addr.String(), "err", err)
+			continue
+		}
+		if !verifyMsg(n.key, &m) {
+			n.pktLog.Warn("bad signature", logKeyAddr, addr.String())
 			continue
 		}
 
+		// tracker 消息只接受来自已配置 tracker 的包，伪造的回复不能完成或终止查询、污染地址缓存
+		if trackerMsgTypes[m.Type] && n.trackerFor(addr) == nil {
+			n.pktLog.Debug("tracker message from unknown address dropped", "type", m.Type, logKeyAddr, addr.String())
+			continue
+		}
+
+		// 对端直接发来的包说明与对端之间的路径是通的
+		if m.From != "" && m.From != n.ID && !trackerMsgTypes[m.Type] {
+			n.touchSession(m.From, addr)
+		}
+
 		// 根据消息类型进行处理
 		switch m.Type {
 		case "registered":
-			// 忽略Tracker的注册确认消息
+			// Tracker的注册确认，带有 tracker 看到的本节点地址
+			n.onRegistered(m, addr)
+
+		case "cookie":
+			// tracker 要求回显 cookie 以证明本节点能收到发往该地址的包
+			n.onCookie(m, addr)
+
+		case "notfound":
+			// Tracker 上没有该节点的注册
+			n.onNotFound(m, addr)
 
 		case "peer", "notify":
 			// 来自Tracker的peer地址信息或通知消息
-			// 更新本地peer地址映射
+			// 更新本地peer地址缓存，peer 回复同时完成对应的查询
 			if m.From != "" && m.Addr != "" {
 				pa, err := net.ResolveUDPAddr("udp", m.Addr)
 				if err == nil {
-					n.mu.Lock()
-					n.peers[m.From] = pa
-					n.mu.Unlock()
-					log.Printf("node %s learned peer %s -> %s", n.ID, m.From, pa)
+					n.log.Debug("learned peer", logKeyPeer, m.From, logKeyAddr, pa.String(), "candidates", len(m.Candidates))
+					switch {
+					case m.Type == "peer" && len(m.Candidates) > 0:
+						// 先对候选地址做连通性检查，再以选出的地址完成查询
+						n.onPeerCandidates(m, pa)
+					case m.Type == "peer":
+						n.onPeerReply(m, pa)
+					case len(m.Candidates) > 0:
+						// 对端正在检查我们的候选地址，同时检查对端的候选地址，
+						// 在本方 NAT 上建立到对端的映射，受限型 NAT 才会放行对端的包
+						n.cachePeer(m.From, pa)
+						go n.connectCandidates(m.From, m.Candidates)
+					default:
+						// 对端不支持候选地址：向 tracker 看到的地址发送探测包
+						n.cachePeer(m.From, pa)
+						go n.punch(m.From, pa)
+					}
 				}
 			}
 
@@ -310,72 +649,68 @@ func (n *Node) readLoop() {
 			// 探测包，记录对端地址以帮助NAT穿透
 			// 探测包用于在正式通信前建立NAT映射关系
 			if m.From != "" {
-				n.mu.Lock()
 				// 更新peer地址信息，可能比从tracker获取的更新
-				n.peers[m.From] = addr
-				n.mu.Unlock()
-				log.Printf("node %s received probe from %s (%s)", n.ID, m.From, addr)
+				n.cachePeer(m.From, addr)
+				n.pktLog.Debug("received probe", logKeyPeer, m.From, logKeyAddr, addr.String())
 			}
 
+		case "announce":
+			// 局域网节点对我们的 announce 的单播回复
+			n.onAnnounce(m, addr, false)
+
+		case "check":
+			// 对端的连通性检查
+			n.onCheck(m, addr)
+
+		case "check_ok":
+			n.onCheckOK(m)
+
 		case "stream_open":
 			// 对端请求我们代表它建立到目标服务器的 TCP 连接
 			// 这是P2P代理的核心功能，由远端节点发起
-			go n.handleStreamOpen(m, addr)
+			// 在读取循环中登记数据流，零往返打开时紧随其后的数据包能找到数据流；连接目标在新的协程中进行
+			n.handleStreamOpen(m, addr)
 
 		case "stream_ready":
 			// peer通知其已准备好接收/发送该数据流的数据
 			// 这表示远端节点已成功连接到目标服务器
-			if m.StreamID != "" {
-				n.mu.Lock()
-				ch := n.ready[m.StreamID]
-				if ch != nil {
-					// 关闭通道以通知等待方已就绪
-					close(ch)
-					delete(n.ready, m.StreamID)
-				}
-				n.mu.Unlock()
+			if st := n.getStream(m.From, m.StreamID); st != nil {
+				// 通知等待方已就绪，同时得到对端选择的压缩算法
+				st.onReady(m.Compress)
 			}
 
-		case "stream_data":
-			// 数据转发消息：查找本地对应的数据流并写入数据
-			// 这是从远端节点转发过来的目标服务器数据
-			if m.StreamID != "" {
-				n.mu.Lock()
-				c := n.streams[m.StreamID]
-				n.mu.Unlock()
-				if c != nil {
-					// 解码base64数据并写入本地连接
-					data, err := base64.StdEncoding.DecodeString(m.Data)
-					if err == nil {
-						// 如果写入失败，需要清理对应的 stream，避免后续写入到已关闭连接导致 RST
-						if _, werr := c.Write(data); werr != nil {
-							log.Printf("write to local conn error: %v, cleaning stream %s", werr, m.StreamID)
-							n.mu.Lock()
-							delete(n.streams, m.StreamID)
-							n.mu.Unlock()
-							// 优雅关闭写端，避免触发 RST
-							closeConnWrite(c)
-						}
-					}
-				}
+		case "stream_ack":
+			// 对端已收到 stream_open，正在连接目标服务器
+
+		case "stream_data", "stream_close":
+			// 数据转发消息：查找本地对应的数据流，按序写入数据或关闭写端
+			if m.StreamID == "" {
+				continue
+			}
+			if st := n.getStream(m.From, m.StreamID); st != nil {
+				st.onPacket(m, addr)
+			} else if m.Type == "stream_close" {
+				// 数据流已从表中移除，对端的确认丢失后会重传 stream_close，直接确认以便对端释放
+				n.sendProto(addr, ProtoMsg{Type: "data_ack", From: n.ID, StreamID: m.StreamID, Ack: m.Seq + 1})
+			} else {
+				// 未知的数据流，通知对端停止发送
+				n.sendProto(addr, ProtoMsg{Type: "stream_reset", From: n.ID, StreamID: m.StreamID, Error: errUnknownStream})
 			}
 
-		case "stream_close":
-			// 远端节点通知关闭数据流
-			if m.StreamID != "" {
-				n.mu.Lock()
-				c := n.streams[m.StreamID]
-				delete(n.streams, m.StreamID)
-				n.mu.Unlock()
-				if c != nil {
-					// 优雅地半关闭写端，让对端能优雅结束读操作
-					closeConnWrite(c)
-				}
+		case "data_ack":
+			if st := n.getStream(m.From, m.StreamID); st != nil {
+				st.onAck(m.Ack, time.Duration(m.Pause)*time.Millisecond)
+			}
+
+		case "stream_reset":
+			// 对端异常终止了数据流
+			if st := n.getStream(m.From, m.StreamID); st != nil {
+				st.onRemoteReset(m.Error)
 			}
 
 		default:
 			// 处理未知类型的消息
-			log.Printf("node %s got unknown msg type %s", n.ID, m.Type)
+			n.pktLog.Warn("unknown message type", "type", m.Type, logKeyAddr, addr.String())
 		}
 	}
 }
@@ -384,79 +719,135 @@ func (n *Node) readLoop() {
 // m: 包含目标地址和数据流ID的请求消息
 // fromAddr: 请求方的网络地址
 func (n *Node) handleStreamOpen(m ProtoMsg, fromAddr *net.UDPAddr) {
-	log.Printf("node %s received stream_open request from %s (%s) for target %s with stream_id %s",
-		n.ID, m.From, fromAddr.String(), m.Target, m.StreamID)
+	lg := n.log.With(logKeyPeer, m.From, logKeyStreamID, m.StreamID, logKeyTarget, m.Target)
+	lg.Debug("received stream_open", logKeyAddr, fromAddr.String())
 
 	// 检查必要参数
 	if m.Target == "" || m.StreamID == "" {
-		log.Printf("invalid stream_open request: missing target or stream_id")
+		lg.Warn("invalid stream_open request: missing target or stream_id")
+		return
+	}
+
+	// 发起方在收不到 stream_ready 时会重发 stream_open：
+	// 已建立的数据流重新回复 stream_ready，正在连接中的直接忽略，已重置的重新回复 stream_reset
+	reset := func(reason string) {
+		n.sendProto(fromAddr, ProtoMsg{Type: "stream_reset", From: n.ID, StreamID: m.StreamID, Error: reason})
+	}
+	n.mu.Lock()
+	st := n.streams[streamKey{m.From, m.StreamID}]
+	isNew := st == nil && n.validRemoteStreamID(m.From, m.StreamID)
+	if isNew {
+		st = n.newStreamLocked(m.StreamID, m.From, fromAddr, nil)
+	}
+	policy := n.policy
+	n.mu.Unlock()
+	if !isNew {
+		if st == nil {
+			lg.Warn("refuse stream: stream id not in the peer's id space")
+			reset("invalid stream id")
+			return
+		}
+		switch st.getState() {
+		case streamOpen, streamHalfClosedLocal, streamHalfClosedRemote:
+			n.sendProto(fromAddr, st.readyMsg())
+		case streamReset:
+			reset("stream reset")
+		}
 		return
 	}
 
+	// 检查出口策略与流量配额；内部服务只检查 AllowPeers，
+	// 目标地址的规则可能需要解析域名，在 dialTarget 中检查，不阻塞读循环
+	var svc serviceHandler
+	name, isService := strings.CutPrefix(m.Target, servicePrefix)
+	err := policy.PermitPeer(m.From)
+	if err == nil && isService {
+		if svc = n.getService(name); svc == nil {
+			err = fmt.Errorf("no such service %q", name)
+		}
+	}
+	if err == nil {
+		err = n.quota.check(m.From)
+	}
+	if err != nil {
+		lg.Warn("refuse stream", "err", err)
+		st.reset(err.Error(), true)
+		return
+	}
+
+	// 对端提议压缩时选择双方都支持的算法，在 stream_ready 中告知对端
+	st.setCompress(n.getCompression().choose(m.Compress))
+
 	// 立即回复确认收到
 	ackMsg := ProtoMsg{Type: "stream_ack", From: n.ID, StreamID: m.StreamID}
 	n.sendProto(fromAddr, ackMsg)
-
-	// 连接到目标服务器
-	log.Printf("node %s: opening stream %s to target %s for peer %s", n.ID, m.StreamID, m.Target, m.From)
-	c, err := net.Dial("tcp", m.Target)
-	if err != nil {
-		log.Printf("failed connect to target %s: %v", m.Target, err)
-		// 连接失败，通知远端节点
-		closeMsg := ProtoMsg{Type: "stream_close", From: n.ID, StreamID: m.StreamID}
-		if sendErr := n.sendProto(fromAddr, closeMsg); sendErr != nil {
-			log.Printf("failed to send stream_close: %v", sendErr)
+	n.useSession(m.From)
+
+	if svc != nil {
+		// 通过内存连接把数据流交给服务
+		svcConn, stConn := newConnPair(PeerAddr{Node: n.ID, Target: m.Target}, PeerAddr{Node: m.From})
+		if !st.attach(stConn) {
+			svcConn.Close()
+			stConn.Close()
+			return
 		}
+		lg.Info("stream connected to service")
+		go st.pumpLocal()
+		go svc(m.From, svcConn)
+		n.sendProto(fromAddr, st.readyMsg())
 		return
 	}
-	log.Printf("successfully connected to target %s for stream %s", m.Target, m.StreamID)
 
-	// 存储数据流与本地TCP连接的映射关系
-	n.mu.Lock()
-	n.streams[m.StreamID] = c
-	n.mu.Unlock()
+	go n.dialTarget(st, m, fromAddr, policy, lg)
+}
 
-	// 启动goroutine从目标服务器读取数据并转发给远端节点
-	go func() {
-		br := bufio.NewReader(c)
-		buf := make([]byte, 4096)
-		for {
-			// 从目标服务器读取数据
-			nr, err := br.Read(buf)
-			if nr > 0 {
-				// 将数据编码为base64并发送给远端节点
-				enc := base64.StdEncoding.EncodeToString(buf[:nr])
-				dm := ProtoMsg{Type: "stream_data", From: n.ID, StreamID: m.StreamID, Data: enc}
-				if err := n.sendProto(fromAddr, dm); err != nil {
-					log.Printf("sendProto error: %v", err)
-					break
-				}
-			}
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("read target error: %v", err)
-				}
-				// 读取结束或出错，通知远端节点关闭数据流
-				cm := ProtoMsg{Type: "stream_close", From: n.ID, StreamID: m.StreamID}
-				n.sendProto(fromAddr, cm)
+// dialTarget 出口侧按出口策略检查目标并连接目标服务器，成功后绑定数据流并回复 stream_ready
+// 策略解析了目标域名时连接检查过的 IP，而不是再次解析域名
+func (n *Node) dialTarget(st *stream, m ProtoMsg, fromAddr *net.UDPAddr, policy *ExitPolicy, lg *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.getTimeouts().Dial)
+	defer cancel()
+	target, err := policy.Resolve(ctx, m.From, m.Target)
+	if err != nil {
+		lg.Warn("refuse stream", "err", err)
+		st.reset(err.Error(), true)
+		return
+	}
 
-				// 清理本地流映射并优雅关闭目标连接（只做一次删除）
-				n.mu.Lock()
-				delete(n.streams, m.StreamID)
-				n.mu.Unlock()
+	// 连接到目标服务器
+	lg.Debug("opening stream to target", "addr", target)
+	c, err := n.network.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		lg.Warn("failed connect to target", "err", err)
+		// 连接失败，通知远端节点
+		st.reset("connect to target failed: "+err.Error(), true)
+		return
+	}
+	lg.Info("stream connected to target")
 
-				// 优雅半关闭写端，避免触发 RST
-				closeConnWrite(c)
-				return
-			}
-		}
-	}()
+	// 绑定数据流与目标连接，并启动goroutine从目标服务器读取数据转发给远端节点
+	if !st.attach(c) {
+		c.Close()
+		return
+	}
+	go st.pumpLocal()
 
 	// 通知发起方节点已准备好接收数据
-	readyMsg := ProtoMsg{Type: "stream_ready", From: n.ID, StreamID: m.StreamID}
-	log.Printf("sending stream_ready to %s for stream %s", m.From, m.StreamID)
+	readyMsg := st.readyMsg()
+	lg.Debug("sending stream_ready", "compress", readyMsg.Compress)
 	if err := n.sendProto(fromAddr, readyMsg); err != nil {
-		log.Printf("failed to send stream_ready message to %s: %v", fromAddr, err)
+		lg.Warn("failed to send stream_ready", logKeyAddr, fromAddr.String(), "err", err)
+	}
+}
+
+// punch 在约一秒内向对端发送探测包，在本方 NAT 上打开到对端的映射，
+// 覆盖对端收到 tracker 回复后开始探测的时间窗口
+func (n *Node) punch(peerID string, addr *net.UDPAddr) {
+	for i := 0; i < 10; i++ {
+		if err := n.sendProto(addr, ProtoMsg{Type: "probe", From: n.ID}); err != nil {
+			n.pktLog.Warn("failed to send probe packet", logKeyPeer, peerID, "err", err)
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -464,27 +855,43 @@ func (n *Node) handleStreamOpen(m ProtoMsg, fromAddr *net.UDPAddr) {
 // listenAddr: 本地SOCKS5代理监听地址
 // peerID: 用于转发流量的远端节点ID
 func (n *Node) StartSocks5(listenAddr string, peerID string) error {
+	_, err := n.ListenSocks5(listenAddr, peerID)
+	return err
+}
+
+// ListenSocks5 与 StartSocks5 相同，但返回监听器，关闭监听器即停止该 SOCKS5 服务
+func (n *Node) ListenSocks5(listenAddr string, peerID string) (net.Listener, error) {
 	// 创建TCP监听器
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("socks5 listening %s (forward via %s)", listenAddr, peerID)
+	n.log.Info("socks5 listening", logKeyAddr, listenAddr, logKeyPeer, peerID)
 
+	// 预先打通与出口节点的会话，第一个连接不必等待打洞
+	n.prewarm(peerID)
 	// 启动异步处理循环
-	go func() {
-		for {
-			// 接受客户端连接
-			c, err := ln.Accept()
-			if err != nil {
-				log.Printf("socks accept error: %v", err)
-				continue
+	go n.acceptLoop(ln, "socks", func(c net.Conn) { n.handleSocksConn(c, peerID) })
+	return ln, nil
+}
+
+// acceptLoop 持续接受连接并交给 handle 处理，监听器关闭后退出
+func (n *Node) acceptLoop(ln net.Listener, name string, handle func(net.Conn)) {
+	for {
+		// 接受客户端连接
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				n.log.Info("listener closed", "listener", name, logKeyAddr, ln.Addr().String())
+				return
 			}
-			// 为每个连接启动一个处理goroutine
-			go n.handleSocksConn(c, peerID)
+			n.log.Warn("accept error", "listener", name, "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
 		}
-	}()
-	return nil
+		// 为每个连接启动一个处理goroutine
+		go handle(c)
+	}
 }
 
 // handleSocksConn 处理来自SOCKS5客户端的连接请求
@@ -495,7 +902,7 @@ func (n *Node) handleSocksConn(c net.Conn, peerID string) {
 	// 读取版本号、方法数和方法列表
 	hdr := make([]byte, 2)
 	if _, err := io.ReadFull(c, hdr); err != nil {
-		log.Printf("socks handshake read error: %v", err)
+		n.log.Debug("socks handshake read error", "err", err)
 		return
 	}
 	ver := hdr[0]
@@ -503,20 +910,21 @@ func (n *Node) handleSocksConn(c net.Conn, peerID string) {
 
 	// 检查SOCKS版本（只支持SOCKS5）
 	if ver != 0x05 {
-		log.Printf("unsupported socks ver: %d (this server only supports SOCKS5)", ver)
+		hint := ""
 		// 尝试处理可能是HTTP代理的请求
 		if ver == 'G' || ver == 'P' || ver == 'H' { // GET, POST, PUT, HEAD, etc.
-			log.Printf("this appears to be an HTTP request, not a SOCKS request - please configure your browser to use SOCKS5 proxy")
+			hint = "this appears to be an HTTP request, not a SOCKS request - please configure your browser to use SOCKS5 proxy"
 		} else if ver == 0x04 {
-			log.Printf("this appears to be a SOCKS4 request, not SOCKS5 - this server only supports SOCKS5")
+			hint = "this appears to be a SOCKS4 request, not SOCKS5 - this server only supports SOCKS5"
 		}
+		n.log.Warn("unsupported socks version (this server only supports SOCKS5)", "ver", ver, "hint", hint)
 		return
 	}
 
 	// 读取客户端支持的认证方法
 	methods := make([]byte, nmethods)
 	if _, err := io.ReadFull(c, methods); err != nil {
-		log.Printf("socks methods read error: %v", err)
+		n.log.Debug("socks methods read error", "err", err)
 		return
 	}
 
@@ -526,13 +934,13 @@ func (n *Node) handleSocksConn(c net.Conn, peerID string) {
 	// 读取客户端请求
 	reqHdr := make([]byte, 4)
 	if _, err := io.ReadFull(c, reqHdr); err != nil {
-		log.Printf("socks req hdr err: %v", err)
+		n.log.Debug("socks request header read error", "err", err)
 		return
 	}
 
 	// 检查命令类型（只支持CONNECT）
 	if reqHdr[1] != 0x01 { // CONNECT
-		log.Printf("socks only support CONNECT")
+		n.log.Warn("socks only support CONNECT", "cmd", reqHdr[1])
 		return
 	}
 
@@ -582,7 +990,15 @@ func (n *Node) handleSocksConn(c net.Conn, peerID string) {
 		dstAddr = fmt.Sprintf("[%s]:%d", ip.String(), int(portb[0])<<8|int(portb[1]))
 
 	default:
-		log.Printf("unsupported atyp %d", atyp)
+		n.log.Warn("unsupported socks address type", "atyp", atyp)
+		return
+	}
+
+	// 流量配额已用完时回复 0x02（规则不允许的连接）
+	if err := n.quota.check(peerID); err != nil {
+		n.log.Warn("refuse socks request", logKeyPeer, peerID, logKeyTarget, dstAddr, "err", err)
+		c.Write([]byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		c.Close()
 		return
 	}
 
@@ -597,129 +1013,133 @@ func (n *Node) handleSocksConn(c net.Conn, peerID string) {
 	}
 	c.Write(reply)
 
-	// 通过Tracker获取远端节点地址
-	peerAddr, err := n.Lookup(peerID)
+	n.openStream(c, peerID, dstAddr)
+}
+
+// openStream 通过 peerID 对应的远端节点打开到 dstAddr 的数据流，并在本地连接 c 与远端之间转发数据
+// 失败时关闭 c
+func (n *Node) openStream(c net.Conn, peerID string, dstAddr string) {
+	// 内部服务只能通过 DialPeer 访问
+	if strings.HasPrefix(dstAddr, servicePrefix) {
+		n.log.Warn("refuse stream to internal service", logKeyPeer, peerID, logKeyTarget, dstAddr)
+		c.Close()
+		return
+	}
+	st, err := n.establishStream(context.Background(), c, peerID, dstAddr, true)
 	if err != nil {
-		log.Printf("lookup peer %s failed: %v", peerID, err)
 		return
 	}
+	// 启动goroutine从本地SOCKS客户端读取数据并可靠地转发给远端节点
+	// 数据流的写入端（从远端节点到本地）由readLoop处理，它会按序写入到本地连接中
+	go st.pumpLocal()
+}
 
-	// 发送探测包帮助 NAT 穿透，增加尝试次数
-	log.Printf("sending probe packets to help NAT traversal")
-
-	// 第一阶段：快速发送探测包
-	for i := 0; i < 5; i++ {
-		err := n.sendProto(peerAddr, ProtoMsg{Type: "probe", From: n.ID})
-		if err != nil {
-			log.Printf("failed to send probe packet %d: %v", i, err)
-		}
-		time.Sleep(20 * time.Millisecond)
+// errStreamOpenTimeout 多次发送 stream_open 都没有收到对端回复，通常是 NAT 穿透失败
+var errStreamOpenTimeout = errors.New("stream_open timeout, NAT hole punching failed")
+
+// establishStream 通过与 peerID 的会话发送 stream_open，等待对端回复 stream_ready
+// 会话未打通时先预热会话，见 session.go；early 为 true 且会话已打通时零往返打开：
+// 发送 stream_open 后立即返回，在后台等待 stream_ready，失败时重置数据流
+// 成功时返回已绑定本地连接 c 的数据流，由调用方启动 pumpLocal；失败或 ctx 结束时关闭 c 并返回错误
+func (n *Node) establishStream(ctx context.Context, c net.Conn, peerID string, dstAddr string, early bool) (*stream, error) {
+	lg := n.log.With(logKeyPeer, peerID, logKeyTarget, dstAddr)
+	if err := n.quota.check(peerID); err != nil {
+		lg.Warn("refuse stream", "err", err)
+		c.Close()
+		return nil, err
 	}
-
-	// 第二阶段：等待对方可能的探测包
-	time.Sleep(200 * time.Millisecond)
-
-	// 第三阶段：再次发送探测包，增加成功率
-	for i := 0; i < 5; i++ {
-		err := n.sendProto(peerAddr, ProtoMsg{Type: "probe", From: n.ID})
-		if err != nil {
-			log.Printf("failed to send probe packet %d: %v", i, err)
+	early = early && n.liveSession(peerID) != nil
+	// 复用已打通的会话，没有时查询地址并打洞
+	peerAddr, err := n.warmSession(ctx, peerID)
+	if err != nil {
+		lg.Warn("lookup peer failed", "err", err)
+		c.Close()
+		return nil, err
+	}
+	n.useSession(peerID)
+
+	// 分配数据流ID，登记本地连接与数据流的映射关系
+	st := n.openLocalStream(peerID, peerAddr, c)
+	st.setOffer(n.getCompression().offer())
+	lg = lg.With(logKeyStreamID, st.id)
+	if early {
+		st.setEarly()
+		if err := n.sendProto(peerAddr, n.streamOpenMsg(st, dstAddr)); err != nil {
+			lg.Warn("send stream_open error", "err", err)
 		}
-		time.Sleep(50 * time.Millisecond)
+		lg.Debug("stream opened early")
+		go n.awaitReady(context.Background(), st, peerAddr, dstAddr, lg, 1)
+		return st, nil
 	}
+	if err := n.awaitReady(ctx, st, peerAddr, dstAddr, lg, 0); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
 
-	log.Printf("sent 10 probe packets, waiting for NAT to stabilize")
-	time.Sleep(500 * time.Millisecond)
-
-	// 创建数据流ID
-	sid := fmt.Sprintf("%d", rand.Int63())
-
-	// 存储本地连接与数据流的映射关系
-	n.mu.Lock()
-	n.streams[sid] = c
-	// 创建就绪信号通道并等待远端节点准备就绪
-	ch := make(chan struct{})
-	n.ready[sid] = ch
-	n.mu.Unlock()
+// streamOpenMsg 数据流 st 的 stream_open
+func (n *Node) streamOpenMsg(st *stream, dstAddr string) ProtoMsg {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return ProtoMsg{Type: "stream_open", From: n.ID, StreamID: st.id, Target: dstAddr, Compress: st.offer}
+}
 
-	// 在发送 stream_open 前添加重试机制
-	maxRetries := 3
+// awaitReady 发送 stream_open 并等待 stream_ready，超时重发，共尝试 3 次；sent 为已经发送过的次数
+// 失败时重置数据流
+func (n *Node) awaitReady(ctx context.Context, st *stream, peerAddr *net.UDPAddr, dstAddr string, lg *slog.Logger, sent int) error {
+	const maxRetries = 3
 	for retry := 0; retry < maxRetries; retry++ {
-		if retry > 0 {
-			log.Printf("retry %d for stream_open", retry)
-			// 重新发送探测包
-			for i := 0; i < 3; i++ {
-				n.sendProto(peerAddr, ProtoMsg{Type: "probe", From: n.ID})
-				time.Sleep(50 * time.Millisecond)
+		if retry >= sent {
+			if retry > 0 {
+				lg.Debug("retry stream_open", "retry", retry)
+				// 重新发送探测包，对端的地址可能已经变化
+				if pa := n.cachedPeer(st.peer); pa != nil {
+					peerAddr = pa
+				}
+				for i := 0; i < 3; i++ {
+					n.sendProto(peerAddr, ProtoMsg{Type: "probe", From: n.ID})
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+			// 向远端节点发送连接请求
+			lg.Debug("sending stream_open")
+			if err := n.sendProto(peerAddr, n.streamOpenMsg(st, dstAddr)); err != nil {
+				lg.Warn("send stream_open error", "err", err)
+				continue
 			}
-		}
-
-		// 向远端节点发送连接请求
-		open := ProtoMsg{Type: "stream_open", From: n.ID, StreamID: sid, Target: dstAddr}
-		log.Printf("sending stream_open request to peer %s for target %s", peerID, dstAddr)
-		if err := n.sendProto(peerAddr, open); err != nil {
-			log.Printf("send stream_open error: %v", err)
-			continue
 		}
 
 		// 等待远端节点准备就绪
-		log.Printf("waiting for stream_ready from peer (attempt %d)", retry+1)
+		lg.Debug("waiting for stream_ready", "attempt", retry+1)
 		select {
-		case <-ch:
-			log.Printf("received stream_ready, connection established")
-			break // 成功，跳出重试循环
-		case <-time.After(5 * time.Second): // 每次尝试等待5秒
-			if retry == maxRetries-1 {
-				log.Printf("warning: all %d attempts failed, NAT hole punching failed", maxRetries)
-				log.Printf("diagnostic info:")
-				log.Printf("  - Peer address: %s", peerAddr.String())
-				log.Printf("  - Local UDP address: %s", n.conn.LocalAddr().String())
-				log.Printf("  - This may be caused by strict NAT/firewall settings")
-				log.Printf("tip: try placing one node on a public IP, or configure your firewall/NAT to allow UDP traffic")
-				n.mu.Lock()
-				delete(n.ready, sid)
-				delete(n.streams, sid)
-				n.mu.Unlock()
-				return
-			}
-			continue // 继续重试
-		}
-		break // 成功建立连接，跳出循环
-	}
-
-	// 启动goroutine从本地SOCKS客户端读取数据并转发给远端节点
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			// 从本地客户端读取数据
-			nr, err := c.Read(buf)
-			if nr > 0 {
-				// 将数据编码为base64并发送给远端节点
-				enc := base64.StdEncoding.EncodeToString(buf[:nr])
-				dm := ProtoMsg{Type: "stream_data", From: n.ID, StreamID: sid, Data: enc}
-				if err := n.sendProto(peerAddr, dm); err != nil {
-					log.Printf("sendProto error: %v", err)
-					break
-				}
-			}
+		case err := <-st.ready:
 			if err != nil {
-				if err != io.EOF {
-					log.Printf("local read err: %v", err)
-				}
-				// 读取结束，通知远端节点关闭数据流
-				cm := ProtoMsg{Type: "stream_close", From: n.ID, StreamID: sid}
-				n.sendProto(peerAddr, cm)
-				n.mu.Lock()
-				delete(n.streams, sid)
-				n.mu.Unlock()
-				// 优雅关闭写端，避免触发 RST 给对端
-				closeConnWrite(c)
-				return
+				lg.Warn("stream refused by peer", "err", err)
+				st.reset(err.Error(), false)
+				return err
+			}
+			lg.Info("stream established")
+			return nil
+		case <-ctx.Done():
+			st.reset("stream_open canceled", true)
+			return ctx.Err()
+		case <-time.After(n.getTimeouts().Open): // 每次尝试等待 Timeouts.Open
+			if retry == maxRetries-1 {
+				lg.Warn("all stream_open attempts failed, NAT hole punching failed",
+					"attempts", maxRetries,
+					"peer_addr", peerAddr.String(),
+					"local_addr", n.conn.LocalAddr().String(),
+					"hint", "this may be caused by strict NAT/firewall settings; try placing one node on a public IP, or configure your firewall/NAT to allow UDP traffic")
+				// 缓存的地址可能已失效（对端重启或 NAT 映射变化），下次重新向 tracker 查询
+				n.InvalidatePeer(st.peer)
+				st.reset("stream_open timeout", true)
+				return errStreamOpenTimeout
 			}
 		}
-	}()
-
-	// 数据流的写入端（从远端节点到本地）由readLoop处理，它会写入到n.streams[sid]连接中
+	}
+	// 每次发送 stream_open 都失败
+	st.reset("send stream_open failed", false)
+	return errors.New("send stream_open failed")
 }
 
 // 新增：优雅地关闭连接的写端，优先使用 TCP 的 CloseWrite，避免触发 RST
@@ -727,7 +1147,7 @@ func closeConnWrite(c net.Conn) {
 	if c == nil {
 		return
 	}
-	if tc, ok := c.(*net.TCPConn); ok {
+	if tc, ok := c.(interface{ CloseWrite() error }); ok {
 		// 忽略错误，尽力半关闭写端
 		_ = tc.CloseWrite()
 		return
@@ -736,10 +1156,21 @@ func closeConnWrite(c net.Conn) {
 	_ = c.Close()
 }
 
-// Close 优雅关闭 Tracker
+// Close 优雅关闭 Tracker，同时关闭控制连接并保存注册信息
 func (t *Tracker) Close() error {
-	if t.conn != nil {
-		return t.conn.Close()
-	}
-	return nil
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.quit)
+		t.mu.Lock()
+		ln := t.ctlLn
+		t.mu.Unlock()
+		if ln != nil {
+			ln.Close()
+		}
+		if t.conn != nil {
+			err = t.conn.Close()
+		}
+		t.closeStore()
+	})
+	return err
 }
@@ -0,0 +1,228 @@
+package p2proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ExitPolicy 出口策略：决定本节点是否愿意代表某个 peer 连接某个目标地址
+// AllowPeers: 允许使用本节点作为出口的 peer ID 列表，为空表示不限制
+// Allow: 允许的目标规则，为空表示不限制
+// Deny: 拒绝的目标规则，优先级高于 Allow
+//
+// 目标规则格式为 host:port
+// host 可以是 *、IP、CIDR（如 10.0.0.0/8）、域名或 *.example.com 形式的域名后缀
+// port 可以是 *、单个端口或端口范围（如 8000-9000）
+// 有 IP 或 CIDR 规则时，目标为域名的先解析出 IP 再检查，解析失败时拒绝
+type ExitPolicy struct {
+	AllowPeers []string
+	Allow      []string
+	Deny       []string
+
+	allow  []targetRule
+	deny   []targetRule
+	needIP bool // 有 IP 或 CIDR 规则，需要解析域名
+
+	// lookupIPAddr 解析域名，为nil时使用 net.DefaultResolver，测试时替换
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type targetRule struct {
+	raw     string
+	any     bool
+	ipnet   *net.IPNet
+	host    string
+	suffix  string
+	portLo  int
+	portHi  int
+	anyPort bool
+}
+
+// NewExitPolicy 解析并创建出口策略，规则格式错误时返回错误
+func NewExitPolicy(allowPeers, allow, deny []string) (*ExitPolicy, error) {
+	p := &ExitPolicy{AllowPeers: allowPeers, Allow: allow, Deny: deny}
+	for _, s := range allow {
+		r, err := parseTargetRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.allow = append(p.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseTargetRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.deny = append(p.deny, r)
+	}
+	for _, r := range slices.Concat(p.allow, p.deny) {
+		if r.ipnet != nil || net.ParseIP(r.host) != nil {
+			p.needIP = true
+		}
+	}
+	return p, nil
+}
+
+// parseTargetRule 解析单条目标规则
+func parseTargetRule(s string) (targetRule, error) {
+	r := targetRule{raw: s}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return r, fmt.Errorf("invalid rule %q: %w", s, err)
+	}
+	switch {
+	case port == "*":
+		r.anyPort = true
+	case strings.Contains(port, "-"):
+		lo, hi, _ := strings.Cut(port, "-")
+		r.portLo, err = parsePort(lo)
+		if err == nil {
+			r.portHi, err = parsePort(hi)
+		}
+		if err != nil || r.portLo > r.portHi {
+			return r, fmt.Errorf("invalid rule %q: bad port range", s)
+		}
+	default:
+		r.portLo, err = parsePort(port)
+		if err != nil {
+			return r, fmt.Errorf("invalid rule %q: %w", s, err)
+		}
+		r.portHi = r.portLo
+	}
+	switch {
+	case host == "*":
+		r.any = true
+	case strings.Contains(host, "/"):
+		_, ipnet, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, fmt.Errorf("invalid rule %q: %w", s, err)
+		}
+		r.ipnet = ipnet
+	case strings.HasPrefix(host, "*."):
+		r.suffix = strings.ToLower(host[1:])
+	case host == "":
+		return r, fmt.Errorf("invalid rule %q: empty host", s)
+	default:
+		r.host = strings.ToLower(host)
+	}
+	return r, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 65535 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return p, nil
+}
+
+// match 判断规则是否匹配目标：域名规则匹配 host，IP 与 CIDR 规则匹配 ip（host 本身或解析出的 IP，未解析时为nil）
+func (r targetRule) match(host string, ip net.IP, port int) bool {
+	if !r.anyPort && (port < r.portLo || port > r.portHi) {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.ipnet != nil:
+		return ip != nil && r.ipnet.Contains(ip)
+	case r.suffix != "":
+		return strings.HasSuffix(strings.ToLower(host), r.suffix)
+	default:
+		if rip := net.ParseIP(r.host); rip != nil {
+			return rip.Equal(ip)
+		}
+		return strings.EqualFold(r.host, host)
+	}
+}
+
+// Permit 判断是否允许 peerID 通过本节点连接 target，拒绝时返回原因
+// nil 策略表示全部允许
+func (p *ExitPolicy) Permit(peerID, target string) error {
+	_, err := p.Resolve(context.Background(), peerID, target)
+	return err
+}
+
+// Resolve 同 Permit，并返回应当连接的地址。
+// 有 IP 或 CIDR 规则且 target 是域名时，解析域名并逐个检查解析出的 IP，返回第一个允许的 IP 地址；
+// 连接返回的地址而不是域名，避免连接时再次解析得到被拒绝的 IP。解析失败时拒绝
+func (p *ExitPolicy) Resolve(ctx context.Context, peerID, target string) (string, error) {
+	if p == nil {
+		return target, nil
+	}
+	if err := p.PermitPeer(peerID); err != nil {
+		return "", err
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if ip := net.ParseIP(host); ip != nil || !p.needIP {
+		if err := p.check(target, host, ip, port); err != nil {
+			return "", err
+		}
+		return target, nil
+	}
+
+	lookup := p.lookupIPAddr
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	addrs, err := lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no address for %s", host)
+	}
+	if err != nil {
+		return "", fmt.Errorf("target %s denied: %w", target, err)
+	}
+	var first error
+	for _, a := range addrs {
+		err := p.check(target, host, a.IP, port)
+		if err == nil {
+			return net.JoinHostPort(a.IP.String(), portStr), nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return "", first
+}
+
+// check 按 Deny、Allow 规则检查目标，ip 为 host 本身或解析出的 IP
+func (p *ExitPolicy) check(target, host string, ip net.IP, port int) error {
+	for _, r := range p.deny {
+		if r.match(host, ip, port) {
+			return fmt.Errorf("target %s denied by rule %s", target, r.raw)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, r := range p.allow {
+		if r.match(host, ip, port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("target %s not in allow list", target)
+}
+
+// PermitPeer 只检查 AllowPeers，用于不连接目标地址的本地服务
+func (p *ExitPolicy) PermitPeer(peerID string) error {
+	if p == nil || len(p.AllowPeers) == 0 {
+		return nil
+	}
+	for _, id := range p.AllowPeers {
+		if id == peerID {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %s is not allowed to use this exit", peerID)
+}
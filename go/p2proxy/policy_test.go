@@ -0,0 +1,120 @@
+package p2proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExitPolicyResolve(t *testing.T) {
+	p, err := NewExitPolicy(nil, nil, []string{"10.0.0.0/8:*", "127.0.0.1:*", "*.internal:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string][]string{
+		"public.example":  {"93.184.216.34"},
+		"private.example": {"10.1.2.3"},
+		"loop.example":    {"127.0.0.1"},
+		"mixed.example":   {"10.1.2.3", "93.184.216.35"},
+	}
+	p.lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+
+	tests := []struct {
+		target string
+		want   string // 为空表示拒绝
+	}{
+		{"93.184.216.34:80", "93.184.216.34:80"},
+		{"10.9.9.9:80", ""},
+		{"public.example:443", "93.184.216.34:443"},
+		// 解析到被拒绝网段的域名
+		{"private.example:443", ""},
+		{"loop.example:22", ""},
+		// 只连接允许的 IP
+		{"mixed.example:80", "93.184.216.35:80"},
+		// 解析失败时拒绝
+		{"unknown.example:80", ""},
+		{"db.internal:5432", ""},
+	}
+	for _, tt := range tests {
+		got, err := p.Resolve(context.Background(), "nodeA", tt.target)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("Resolve(%s) = %q, %v, want %q", tt.target, got, err, tt.want)
+		}
+		if err := p.Permit("nodeA", tt.target); (err == nil) != (tt.want != "") {
+			t.Errorf("Permit(%s) = %v", tt.target, err)
+		}
+	}
+
+	// 没有 IP 规则时不解析域名
+	p, _ = NewExitPolicy(nil, []string{"*.example:*"}, nil)
+	p.lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		t.Fatal("resolved a host without IP rules")
+		return nil, nil
+	}
+	if got, err := p.Resolve(context.Background(), "nodeA", "unknown.example:80"); err != nil || got != "unknown.example:80" {
+		t.Fatalf("Resolve without IP rules = %q, %v", got, err)
+	}
+	if err := p.Permit("nodeA", "other.test:80"); err == nil || !strings.Contains(err.Error(), "not in allow list") {
+		t.Fatalf("Permit outside allow list: %v", err)
+	}
+}
+
+func TestExitPolicyRules(t *testing.T) {
+	for _, rule := range []string{"*", "*:", ":80", "host:0-", "host:9-1", "host:65536", "host:http", "10.0.0.0/33:*", "/8:*"} {
+		if _, err := NewExitPolicy(nil, []string{rule}, nil); err == nil {
+			t.Errorf("rule %q accepted", rule)
+		}
+	}
+
+	p, err := NewExitPolicy([]string{"nodeA"},
+		[]string{"*:80", "*:443", "*.example.com:*", "192.168.1.0/24:8000-9000", "[2001:db8::1]:22"},
+		[]string{"10.0.0.0/8:*", "bad.example.com:*", "*:25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+	}
+	tests := []struct {
+		target string
+		allow  bool
+	}{
+		{"1.2.3.4:80", true},
+		{"1.2.3.4:8080", false},
+		{"10.1.1.1:80", false},
+		{"WWW.Example.COM:22", true},
+		{"bad.example.com:80", false},
+		{"www.example.com:25", false},
+		{"192.168.1.7:8000", true},
+		{"192.168.1.7:9000", true},
+		{"192.168.1.7:9001", false},
+		{"192.168.2.7:8500", false},
+		{"[2001:db8::1]:22", true},
+		{"[2001:db8::2]:22", false},
+		{"no-port", false},
+	}
+	for _, tt := range tests {
+		if err := p.Permit("nodeA", tt.target); (err == nil) != tt.allow {
+			t.Errorf("Permit(%s) = %v, want allow=%v", tt.target, err, tt.allow)
+		}
+	}
+	if err := p.Permit("nodeB", "1.2.3.4:80"); err == nil {
+		t.Error("peer outside allow_peers permitted")
+	}
+	var nilPolicy *ExitPolicy
+	if err := nilPolicy.Permit("anyone", "10.0.0.1:25"); err != nil {
+		t.Errorf("nil policy: %v", err)
+	}
+}
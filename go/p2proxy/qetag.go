@@ -0,0 +1,75 @@
+package p2proxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"io"
+	"os"
+)
+
+// 七牛云存储的文件 etag 算法（https://github.com/qiniu/qetag，同 single/qetag.go）：
+// 文件按 4MB 分块，不超过一块时为 0x16 + sha1(内容)，
+// 否则为 0x96 + sha1(各块 sha1 依次拼接)，结果使用 URL 安全的 base64 编码。
+
+const qetagBlockSize = 1 << 22
+
+// qetag 以流的方式计算 etag，写入全部内容后调用 Sum
+type qetag struct {
+	block  hash.Hash // 当前块的 sha1
+	n      int64     // 当前块已写入的字节数
+	blocks []byte    // 已写满的块的 sha1
+}
+
+func newQetag() *qetag {
+	return &qetag{block: sha1.New()}
+}
+
+func (q *qetag) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if rest := qetagBlockSize - q.n; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		q.block.Write(chunk)
+		q.n += int64(len(chunk))
+		p = p[len(chunk):]
+		if q.n == qetagBlockSize {
+			q.blocks = q.block.Sum(q.blocks)
+			q.block.Reset()
+			q.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Sum 返回已写入内容的 etag
+func (q *qetag) Sum() string {
+	sums := q.blocks
+	if q.n > 0 || len(sums) == 0 {
+		sums = q.block.Sum(sums[:len(sums):len(sums)])
+	}
+	var out []byte
+	if len(sums) <= sha1.Size {
+		out = append([]byte{0x16}, sums...)
+	} else {
+		h := sha1.Sum(sums)
+		out = append([]byte{0x96}, h[:]...)
+	}
+	return base64.URLEncoding.EncodeToString(out)
+}
+
+// fileQetag 计算文件的 etag
+func fileQetag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	q := newQetag()
+	if _, err := io.Copy(q, f); err != nil {
+		return "", err
+	}
+	return q.Sum(), nil
+}
@@ -0,0 +1,205 @@
+package p2proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 流量配额
+// 按对端节点统计经本节点转发的字节数（收发两个方向），分为自然日与自然月两个周期（本地时间）。
+// 用量定期写入磁盘，重启后继续累计；配额用完后拒绝该节点的新数据流，正在传输的数据流停止发送。
+
+// ErrQuotaExceeded 对端节点的流量配额已用完
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaFlushInterval 用量写入磁盘的间隔
+const quotaFlushInterval = 10 * time.Second
+
+// Quota 流量配额，单位为字节，0 表示不限制
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaConfig 按对端节点的流量配额
+// File: 用量持久化文件（JSON），为空时只在内存中统计
+// Default: 每个对端节点的默认配额
+// Peers: 按节点ID覆盖默认配额
+type QuotaConfig struct {
+	File    string
+	Default Quota
+	Peers   map[string]Quota
+}
+
+// QuotaUsage 一个对端节点在当前周期内的用量
+type QuotaUsage struct {
+	Day        string `json:"day"` // 2006-01-02
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"` // 2006-01
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// roll 进入新的日/月周期时清零对应的用量
+func (u *QuotaUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// quotaStore 配额与用量
+type quotaStore struct {
+	file  string
+	mu    sync.Mutex
+	cfg   QuotaConfig
+	usage map[string]*QuotaUsage
+	dirty bool
+	now   func() time.Time
+}
+
+// newQuotaStore 创建配额统计，配置了 File 时从文件加载已有用量
+func newQuotaStore(cfg QuotaConfig) (*quotaStore, error) {
+	q := &quotaStore{file: cfg.File, cfg: cfg, usage: make(map[string]*QuotaUsage), now: time.Now}
+	if cfg.File == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(q.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, fmt.Errorf("load quota usage %s: %w", q.file, err)
+	}
+	return q, nil
+}
+
+func (q *quotaStore) limit(peer string) Quota {
+	if l, ok := q.cfg.Peers[peer]; ok {
+		return l
+	}
+	return q.cfg.Default
+}
+
+// get 返回对端节点当前周期的用量，需持有 q.mu
+func (q *quotaStore) get(peer string) *QuotaUsage {
+	u := q.usage[peer]
+	if u == nil {
+		u = &QuotaUsage{}
+		q.usage[peer] = u
+	}
+	u.roll(q.now())
+	return u
+}
+
+// check 配额用完时返回 ErrQuotaExceeded
+func (q *quotaStore) check(peer string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l := q.limit(peer)
+	if l.Daily <= 0 && l.Monthly <= 0 {
+		return nil
+	}
+	u := q.get(peer)
+	if l.Daily > 0 && u.DayBytes >= l.Daily {
+		return fmt.Errorf("%w: peer %s used %d of %d bytes today", ErrQuotaExceeded, peer, u.DayBytes, l.Daily)
+	}
+	if l.Monthly > 0 && u.MonthBytes >= l.Monthly {
+		return fmt.Errorf("%w: peer %s used %d of %d bytes this month", ErrQuotaExceeded, peer, u.MonthBytes, l.Monthly)
+	}
+	return nil
+}
+
+// add 累计对端节点的用量
+func (q *quotaStore) add(peer string, n int) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	u := q.get(peer)
+	u.DayBytes += int64(n)
+	u.MonthBytes += int64(n)
+	q.dirty = true
+	q.mu.Unlock()
+}
+
+// usageOf 返回对端节点当前周期用量的副本
+func (q *quotaStore) usageOf(peer string) QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.get(peer)
+}
+
+// setConfig 更新配额，已有用量保留；持久化文件路径（q.file）不变
+func (q *quotaStore) setConfig(cfg QuotaConfig) {
+	q.mu.Lock()
+	q.cfg = cfg
+	q.mu.Unlock()
+}
+
+// save 用量有变化时写入文件：先写临时文件再改名，避免中途退出留下不完整的文件
+func (q *quotaStore) save() error {
+	if q.file == "" {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.file), filepath.Base(q.file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), q.file)
+}
+
+// flushLoop 定期保存用量，直到节点关闭
+func (n *Node) flushLoop(q *quotaStore) {
+	ticker := time.NewTicker(quotaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				n.log.Warn("save quota usage error", "err", err)
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// SetQuotas 更新流量配额，已累计的用量保留；持久化文件只能在创建节点时指定
+func (n *Node) SetQuotas(cfg QuotaConfig) {
+	n.quota.setConfig(cfg)
+}
+
+// QuotaUsage 返回对端节点在当前日/月周期内的用量
+func (n *Node) QuotaUsage(peer string) QuotaUsage {
+	return n.quota.usageOf(peer)
+}
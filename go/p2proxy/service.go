@@ -0,0 +1,139 @@
+package p2proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 节点内部服务与库接口
+// stream_open 的目标以 servicePrefix 开头时（如 svc:file），出口侧不连接 TCP 地址，
+// 而是把数据流交给本节点通过 Listen 注册的同名服务处理。服务只受出口策略中 AllowPeers 的限制。
+//
+// DialPeer 与 Listen 让 Go 程序直接使用 P2P 通道，例如：
+//
+//	tr := &http.Transport{DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+//		return node.DialPeer(ctx, "nodeB", addr)
+//	}}
+
+// servicePrefix 服务目标的前缀
+const servicePrefix = "svc:"
+
+// serviceBacklog 每个服务等待 Accept 的连接数量
+const serviceBacklog = 16
+
+// serviceHandler 处理一条对端发起的服务数据流，peer 为对端节点ID，处理结束后应关闭 c
+type serviceHandler func(peer string, c net.Conn)
+
+// registerService 注册名为 name 的服务，已注册时返回错误
+func (n *Node) registerService(name string, h serviceHandler) error {
+	if name == "" {
+		return errors.New("empty service name")
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.services[name]; ok {
+		return fmt.Errorf("service %q already registered", name)
+	}
+	n.services[name] = h
+	return nil
+}
+
+// unregisterService 取消注册名为 name 的服务
+func (n *Node) unregisterService(name string) {
+	n.mu.Lock()
+	delete(n.services, name)
+	n.mu.Unlock()
+}
+
+// getService 返回名为 name 的服务，未注册时返回nil
+func (n *Node) getService(name string) serviceHandler {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.services[name]
+}
+
+// DialPeer 通过 peerID 节点打开一条数据流，返回的连接支持读写超时，并实现 CloseWrite 用于半关闭
+// target 为 host:port 时由对端节点代为连接该地址（受对端出口策略限制），
+// 为 "svc:<name>" 时连接对端通过 Listen(name) 注册的服务
+// ctx 只作用于建立连接的过程，连接建立后结束 ctx 不影响连接
+func (n *Node) DialPeer(ctx context.Context, peerID, target string) (net.Conn, error) {
+	local, remote := newConnPair(PeerAddr{Node: n.ID}, PeerAddr{Node: peerID, Target: target})
+	st, err := n.establishStream(ctx, remote, peerID, target, false)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	go st.pumpLocal()
+	return local, nil
+}
+
+// Listen 注册名为 service 的服务，返回接受对端数据流的监听器，其他节点通过 DialPeer(ctx, id, "svc:"+service) 连接
+// 关闭监听器即取消注册；Accept 返回的连接与 DialPeer 的相同
+func (n *Node) Listen(service string) (net.Listener, error) {
+	service = strings.TrimPrefix(service, servicePrefix)
+	l := &serviceListener{
+		n:     n,
+		name:  service,
+		conns: make(chan net.Conn, serviceBacklog),
+		done:  make(chan struct{}),
+	}
+	err := n.registerService(service, func(peer string, c net.Conn) {
+		select {
+		case l.conns <- c:
+		case <-l.done:
+			c.Close()
+		case <-n.quit:
+			c.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.log.Info("service listening", "service", service)
+	return l, nil
+}
+
+// serviceListener Listen 返回的监听器
+type serviceListener struct {
+	n     *Node
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *serviceListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.n.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *serviceListener) Close() error {
+	l.once.Do(func() {
+		l.n.unregisterService(l.name)
+		close(l.done)
+		// 关闭已到达但还没有 Accept 的连接
+		for {
+			select {
+			case c := <-l.conns:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *serviceListener) Addr() net.Addr {
+	return PeerAddr{Node: l.n.ID, Target: servicePrefix + l.name}
+}
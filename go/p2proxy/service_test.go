@@ -0,0 +1,133 @@
+package p2proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDialPeerHTTPTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	env := newSimEnv(t, 11, simPeer{}, simPeer{}, Timeouts{})
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return env.a.DialPeer(ctx, "nodeB", addr)
+		}},
+	}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "hello "+path {
+			t.Fatalf("GET %s = %q", path, b)
+		}
+	}
+}
+
+func TestListenHalfClose(t *testing.T) {
+	env := newSimEnv(t, 12, simPeer{}, simPeer{}, Timeouts{})
+	ln, err := env.b.Listen("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := env.b.Listen("count"); err == nil {
+		t.Fatal("duplicate Listen succeeded")
+	}
+	// 服务读到 EOF 后回复收到的字节数
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				fmt.Fprintf(c, "%d from %s", n, c.RemoteAddr())
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := env.a.DialPeer(ctx, "nodeB", "svc:count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	payload := make([]byte, 100*1024)
+	if _, err := c.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d from nodeA", len(payload)); string(got) != want {
+		t.Fatalf("reply = %q, want %q", got, want)
+	}
+
+	if _, err := env.a.DialPeer(ctx, "nodeB", "svc:missing"); err == nil {
+		t.Fatal("dial to unregistered service succeeded")
+	}
+}
+
+func TestStreamConnDeadline(t *testing.T) {
+	a, b := newConnPair(PeerAddr{Node: "a"}, PeerAddr{Node: "b"})
+	defer a.Close()
+	defer b.Close()
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 8)
+	_, err := a.Read(buf)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past deadline: %v", err)
+	}
+	// 清除截止时间后可以继续读取
+	a.SetReadDeadline(time.Time{})
+	go b.Write([]byte("ok"))
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("read after clearing deadline: %q, %v", buf[:n], err)
+	}
+
+	// 对端不读取时写满缓冲区后阻塞，直到写超时
+	b.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := b.Write(make([]byte, streamConnBuffer+1))
+	if n != streamConnBuffer || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past deadline: n=%d err=%v", n, err)
+	}
+
+	// 关闭一端后，另一端读完缓冲的数据再收到 EOF，写入失败
+	b.Close()
+	if n, err := io.Copy(io.Discard, a); n != streamConnBuffer || err != nil {
+		t.Fatalf("drain after close: n=%d err=%v", n, err)
+	}
+	if _, err := a.Write([]byte("x")); err == nil {
+		t.Fatal("write to closed peer succeeded")
+	}
+}
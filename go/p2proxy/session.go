@@ -0,0 +1,219 @@
+package p2proxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// 对端会话
+// 与一个对端之间打通的 UDP 路径称为会话：最近 sessionTTL 内收到过对端的任意包，路径就是通的。
+// 数据流复用已打通的会话，不再为每条数据流查询地址、发送探测包；
+// 会话未打通时由 warmSession 预热：查询地址后持续发送探测包与检查，收到对端的包立即结束，
+// 同一对端的并发预热合并为一次。
+// 会话上近期打开过数据流时，sessionLoop 定期发送检查维持 NAT 映射，保持会话打通。
+//
+// 零往返打开
+// SOCKS5 前端在连接目标之前已经回复了客户端，会话打通时发送 stream_open 后立即开始转发客户端的数据，
+// 不等待 stream_ready；出口侧在连接目标期间缓存先到的数据，连接成功后按序交付。
+
+const (
+	sessionTTL          = 20 * time.Second      // 超过该时间没有收到对端的包，会话视为断开
+	sessionKeepalive    = 10 * time.Second      // 维持会话的检查间隔，小于 sessionTTL
+	sessionPunchTimeout = time.Second           // 预热时等待对端的包的最长时间
+	sessionProbeGap     = 50 * time.Millisecond // 预热时发送探测包的间隔
+)
+
+// trackerMsgTypes tracker 发来的消息类型，其中的 From 是对端节点而不是发送方，不能用来判断会话
+var trackerMsgTypes = map[string]bool{"registered": true, "cookie": true, "notfound": true, "peer": true, "notify": true}
+
+// peerSession 与一个对端之间的会话
+// addr: 最近一次收到对端的包的来源地址
+// lastRecv: 最近一次收到对端的包的时间
+// lastUsed: 最近一次在该会话上打开数据流的时间，近期使用过的会话才发送保活检查
+// warming: 进行中的预热，没有时为nil
+// touched: 预热时等待对端的包，收到时关闭
+type peerSession struct {
+	addr     *net.UDPAddr
+	lastRecv time.Time
+	lastUsed time.Time
+	warming  *sessionWarm
+	touched  chan struct{}
+}
+
+// sessionWarm 一次预热的结果，done 关闭后 addr/err 有效
+type sessionWarm struct {
+	done chan struct{}
+	addr *net.UDPAddr
+	err  error
+}
+
+// sessionLocked 返回 peer 的会话，不存在时创建，需持有 n.mu
+func (n *Node) sessionLocked(peer string) *peerSession {
+	s := n.sessions[peer]
+	if s == nil {
+		s = &peerSession{}
+		n.sessions[peer] = s
+	}
+	return s
+}
+
+// liveSessionLocked 会话打通时返回对端地址，否则返回nil，需持有 n.mu
+func (n *Node) liveSessionLocked(peer string) *net.UDPAddr {
+	if s := n.sessions[peer]; s != nil && s.addr != nil && time.Since(s.lastRecv) < sessionTTL {
+		return s.addr
+	}
+	return nil
+}
+
+// liveSession 同 liveSessionLocked
+func (n *Node) liveSession(peer string) *net.UDPAddr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.liveSessionLocked(peer)
+}
+
+// touchSession 收到对端 peer 从 addr 发来的包，会话打通
+func (n *Node) touchSession(peer string, addr *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.sessionLocked(peer)
+	s.addr = addr
+	s.lastRecv = time.Now()
+	if s.touched != nil {
+		close(s.touched)
+		s.touched = nil
+	}
+}
+
+// useSession 记录在与 peer 的会话上打开了数据流
+func (n *Node) useSession(peer string) {
+	n.mu.Lock()
+	n.sessionLocked(peer).lastUsed = time.Now()
+	n.mu.Unlock()
+}
+
+// warmSession 返回与 peer 的会话地址：会话已打通时立即返回，否则预热会话，并发的调用等待同一次预热
+// 预热时对端没有回应也返回查询到的地址，由 stream_open 的重试继续打洞
+func (n *Node) warmSession(ctx context.Context, peer string) (*net.UDPAddr, error) {
+	n.mu.Lock()
+	if addr := n.liveSessionLocked(peer); addr != nil {
+		n.mu.Unlock()
+		return addr, nil
+	}
+	s := n.sessionLocked(peer)
+	w := s.warming
+	if w == nil {
+		w = &sessionWarm{done: make(chan struct{})}
+		s.warming = w
+		go n.runWarm(peer, s, w)
+	}
+	n.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return w.addr, w.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runWarm 执行一次预热；不使用调用方的 ctx，一个调用方取消不影响等待同一次预热的其他调用方
+func (n *Node) runWarm(peer string, s *peerSession, w *sessionWarm) {
+	w.addr, w.err = n.punchSession(peer)
+	n.mu.Lock()
+	s.warming = nil
+	n.mu.Unlock()
+	close(w.done)
+}
+
+// punchSession 查询 peer 的地址，然后每隔 sessionProbeGap 发送探测包与检查，直到收到对端的包或 sessionPunchTimeout
+func (n *Node) punchSession(peer string) (*net.UDPAddr, error) {
+	addr, err := n.Lookup(peer)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	if live := n.liveSessionLocked(peer); live != nil {
+		// 对候选地址的连通性检查已经打通了会话
+		n.mu.Unlock()
+		return live, nil
+	}
+	s := n.sessionLocked(peer)
+	if s.touched == nil {
+		s.touched = make(chan struct{})
+	}
+	touched := s.touched
+	n.mu.Unlock()
+
+	lg := n.log.With(logKeyPeer, peer)
+	start := time.Now()
+	timeout := time.NewTimer(sessionPunchTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(sessionProbeGap)
+	defer ticker.Stop()
+	for {
+		// 对端的探测包可能来自与 tracker 所见不同的地址（如对称型 NAT），优先使用最新学到的地址
+		if pa := n.cachedPeer(peer); pa != nil {
+			addr = pa
+		}
+		n.sendProto(addr, ProtoMsg{Type: "probe", From: n.ID})
+		// 对端回复 check_ok，收到后会话即打通
+		n.sendProto(addr, ProtoMsg{Type: "check", From: n.ID, To: peer})
+		select {
+		case <-touched:
+			live := n.liveSession(peer)
+			lg.Debug("session established", logKeyAddr, live.String(), "took", time.Since(start).String())
+			return live, nil
+		case <-timeout.C:
+			lg.Debug("no reply from peer while warming session", logKeyAddr, addr.String())
+			return addr, nil
+		case <-n.quit:
+			return nil, net.ErrClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+// prewarm 在后台预热与 peer 的会话，失败只记录日志
+func (n *Node) prewarm(peer string) {
+	go func() {
+		if _, err := n.warmSession(context.Background(), peer); err != nil {
+			n.log.Debug("prewarm session failed", logKeyPeer, peer, "err", err)
+		}
+	}()
+}
+
+// sessionLoop 定期向近期使用过的会话发送检查维持 NAT 映射，并清理长时间没有活动的会话
+func (n *Node) sessionLoop() {
+	ticker := time.NewTicker(sessionKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+		type target struct {
+			peer string
+			addr *net.UDPAddr
+		}
+		var keep []target
+		now := time.Now()
+		idle := n.getTimeouts().Idle
+		n.mu.Lock()
+		for peer, s := range n.sessions {
+			switch {
+			case s.warming != nil:
+			case s.addr != nil && now.Sub(s.lastUsed) < idle && now.Sub(s.lastRecv) < sessionTTL:
+				keep = append(keep, target{peer, s.addr})
+			case now.Sub(s.lastRecv) > idle && now.Sub(s.lastUsed) > idle:
+				delete(n.sessions, peer)
+			}
+		}
+		n.mu.Unlock()
+		for _, k := range keep {
+			n.sendProto(k.addr, ProtoMsg{Type: "check", From: n.ID, To: k.peer})
+		}
+	}
+}
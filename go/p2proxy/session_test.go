@@ -0,0 +1,95 @@
+package p2proxy
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+	"golang.org/x/net/proxy"
+)
+
+// socksTTFB 同时打开 conns 个 SOCKS5 连接，每个连接发送一个字节并等待回显，返回每个连接从拨号到收到回显的时间
+func socksTTFB(t testing.TB, d proxy.Dialer, echo string, conns int) []time.Duration {
+	t.Helper()
+	ttfb := make([]time.Duration, conns)
+	errs := make(chan error, conns)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			c, err := d.Dial("tcp", echo)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.Write([]byte{byte(i)}); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				errs <- err
+				return
+			}
+			ttfb[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("socks connection: %v", err)
+	}
+	sort.Slice(ttfb, func(i, j int) bool { return ttfb[i] < ttfb[j] })
+	return ttfb
+}
+
+// sessionLink 节点之间每个方向 5 毫秒的延迟
+var sessionLink = netsim.Link{Latency: 5 * time.Millisecond}
+
+// TestSessionReuse 会话打通后，并发的 SOCKS5 连接零往返打开，不再查询地址与打洞
+func TestSessionReuse(t *testing.T) {
+	echo := startEchoServer(t)
+	p := simPeer{natType: netsim.PortRestrictedCone, link: sessionLink}
+	// 地址缓存立即过期，之后的连接如果查询地址就会因为 tracker 已关闭而失败
+	env := newSimEnv(t, 20, p, p, Timeouts{PeerTTL: time.Millisecond, Lookup: time.Second})
+	d := env.startSocks(t)
+
+	first := socksTTFB(t, d, echo, 1)
+	if env.a.liveSession("nodeB") == nil {
+		t.Fatal("no live session after the first connection")
+	}
+	env.tracker.Close()
+
+	ttfb := socksTTFB(t, d, echo, 100)
+	// 零往返打开：客户端的数据紧随 stream_open 发出，出口侧连接目标期间缓存，约一个往返（10 毫秒）即可收到回显
+	if max := ttfb[len(ttfb)-1]; max > 300*time.Millisecond {
+		t.Fatalf("slowest of 100 connections on a live session took %v (first connection %v)", max, first[0])
+	}
+}
+
+// BenchmarkSocksTTFB 在已打通的会话上同时打开 100 个 SOCKS5 连接，报告首字节时间的中位数与 P99
+func BenchmarkSocksTTFB(b *testing.B) {
+	echo := startEchoServer(b)
+	p := simPeer{natType: netsim.PortRestrictedCone, link: sessionLink}
+	env := newSimEnv(b, 22, p, p, Timeouts{})
+	d := env.startSocks(b)
+	socksTTFB(b, d, echo, 1)
+	b.ResetTimer()
+
+	var all []time.Duration
+	for i := 0; i < b.N; i++ {
+		all = append(all, socksTTFB(b, d, echo, 100)...)
+	}
+	b.StopTimer()
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	b.ReportMetric(ms(all[len(all)/2]), "ttfb-p50-ms")
+	b.ReportMetric(ms(all[len(all)*99/100]), "ttfb-p99-ms")
+}
@@ -0,0 +1,634 @@
+package p2proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 数据流的可靠传输
+// stream_data 与 stream_close 都带有序号（Seq），接收方按序交付给本地连接、丢弃重复包，
+// 并回复累计确认 data_ack（Ack 为下一个期望的序号）；发送方对超时未确认的包进行重传。
+// 这样在丢包、乱序、重复的 UDP 通道上也能保证数据流完整。
+//
+// 数据流表
+// 数据流以 (对端节点ID, 数据流ID) 为键。数据流ID由发起方分配，两个节点各用一半的ID空间：
+// 节点ID较小的一方使用偶数，另一方使用奇数，因此双方同时发起的数据流不会冲突。
+// 每个对端的ID从随机位置开始递增，节点重启后不会与对端表中残留的数据流重复。
+//
+// 状态机
+//
+//	opening --stream_ready/连接目标成功--> open
+//	open --发送 stream_close--> half-closed(local) --收到对端 stream_close 且全部确认--> closed
+//	open --收到 stream_close--> half-closed(remote) --发送 stream_close 且全部确认--> closed
+//	任意状态 --stream_reset/写入失败/确认超时/空闲超时--> reset
+//
+// closed 与 reset 的数据流在表中保留 streamLinger，用于回应迟到的重传包，避免重复的 stream_open 再次连接目标。
+// 出口侧在 opening 状态收到的数据（零往返打开时发起方不等待 stream_ready，见 session.go）先缓存，连接目标成功后交付。
+
+const (
+	streamChunkSize = 4096             // 每个 stream_data 携带的最大字节数
+	streamWindow    = 256              // 未确认数据包的最大数量，超过后发送方阻塞
+	streamLinger    = 30 * time.Second // 结束后在表中保留的时间
+)
+
+// errUnknownStream 收到不在数据流表中的数据流的数据时，stream_reset 中的原因
+const errUnknownStream = "unknown stream"
+
+// streamState 数据流状态
+type streamState int
+
+const (
+	streamOpening streamState = iota
+	streamOpen
+	streamHalfClosedLocal
+	streamHalfClosedRemote
+	streamClosed
+	streamReset
+)
+
+func (s streamState) String() string {
+	switch s {
+	case streamOpening:
+		return "opening"
+	case streamOpen:
+		return "open"
+	case streamHalfClosedLocal:
+		return "half-closed(local)"
+	case streamHalfClosedRemote:
+		return "half-closed(remote)"
+	case streamClosed:
+		return "closed"
+	case streamReset:
+		return "reset"
+	}
+	return "unknown"
+}
+
+// streamKey 数据流表的键
+type streamKey struct {
+	peer string
+	id   string
+}
+
+// stream 一条经 P2P 通道转发的数据流
+// conn: 本地连接（SOCKS 侧为客户端连接，出口侧为目标服务器连接），出口侧连接目标前为nil
+// ready: 发起方等待 stream_ready 的通道，成功时收到nil，被对端拒绝或重置时收到错误
+// addr: 对端节点地址，收到对端的包后更新
+// sendNext/unacked: 发送侧的下一个序号及未确认的包
+// recvNext/recvBuf: 接收侧下一个期望的序号及提前到达的包
+// localDone: 本地读取结束并已发送 stream_close
+// remoteDone: 已按序收到对端的 stream_close
+// lastActive: 最近一次收发数据的时间，用于空闲超时
+// lim/bucket: 发送数据使用的带宽限制及本数据流的令牌桶，只在 pumpLocal 中使用
+// rxLim/rxBucket: 接收数据使用的带宽限制及本数据流接收方向的令牌桶，持有 wmu 时使用
+// pauseUntil: 对端在 data_ack 中要求暂停发送的截止时间，见 limit.go
+// early: 零往返打开，发起方在收到 stream_ready 之前就开始发送数据
+// acked: 对端确认过数据，之后对端一定已经登记了该数据流
+// offer/compress: 发起方在 stream_open 中提议的压缩算法，以及双方协商的算法（为空不压缩），见 compress.go
+// comp: 发送方向的压缩状态，只在 pumpLocal 中使用；decomp: 接收方向的解压状态，持有 wmu 时使用
+// wmu: 保证按序写入本地连接，读取循环与出口侧 attach 都会交付数据，先于 mu 加锁
+type stream struct {
+	n      *Node
+	id     string
+	peer   string
+	ready  chan error
+	lim    *rateLimiter
+	bucket *tokenBucket
+	comp   *streamCompressor
+	wmu    sync.Mutex
+	decomp streamDecompressor
+
+	rxLim    *rateLimiter
+	rxBucket *tokenBucket
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	conn         net.Conn
+	state        streamState
+	addr         *net.UDPAddr
+	sendNext     uint64
+	unacked      map[uint64]*outPacket
+	recvNext     uint64
+	recvBuf      map[uint64]ProtoMsg
+	localDone    bool
+	remoteDone   bool
+	early        bool
+	acked        bool
+	offer        string
+	compress     string
+	lastProgress time.Time
+	lastActive   time.Time
+	pauseUntil   time.Time
+}
+
+type outPacket struct {
+	msg  ProtoMsg
+	sent time.Time
+}
+
+// streamIDParity 本节点向 peer 发起的数据流ID的奇偶性
+func (n *Node) streamIDParity(peer string) uint64 {
+	if n.ID < peer {
+		return 0
+	}
+	return 1
+}
+
+// allocStreamID 在本节点的ID空间中为发往 peer 的数据流分配ID，需持有 n.mu
+func (n *Node) allocStreamIDLocked(peer string) string {
+	parity := n.streamIDParity(peer)
+	next, ok := n.nextStreamID[peer]
+	if !ok {
+		next = uint64(rand.Uint32())
+	}
+	for {
+		next = next&^1 | parity
+		id := strconv.FormatUint(next, 10)
+		next += 2
+		if _, used := n.streams[streamKey{peer, id}]; !used {
+			n.nextStreamID[peer] = next
+			return id
+		}
+	}
+}
+
+// validRemoteStreamID 对端发起的数据流ID是否属于对端的ID空间
+func (n *Node) validRemoteStreamID(peer, id string) bool {
+	v, err := strconv.ParseUint(id, 10, 64)
+	return err == nil && v&1 != n.streamIDParity(peer)
+}
+
+// newStreamLocked 创建 opening 状态的数据流、登记到数据流表并启动重传循环，需持有 n.mu
+func (n *Node) newStreamLocked(id, peer string, addr *net.UDPAddr, conn net.Conn) *stream {
+	now := time.Now()
+	st := &stream{
+		n:            n,
+		id:           id,
+		peer:         peer,
+		ready:        make(chan error, 1),
+		conn:         conn,
+		addr:         addr,
+		unacked:      make(map[uint64]*outPacket),
+		recvBuf:      make(map[uint64]ProtoMsg),
+		lastProgress: now,
+		lastActive:   now,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	n.streams[streamKey{peer, id}] = st
+	go st.retransmitLoop()
+	return st
+}
+
+// openLocalStream 为本地连接 conn 分配ID并创建发往 peer 的数据流
+func (n *Node) openLocalStream(peer string, addr *net.UDPAddr, conn net.Conn) *stream {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.newStreamLocked(n.allocStreamIDLocked(peer), peer, addr, conn)
+}
+
+// getStream 按 (对端, ID) 查找数据流
+func (n *Node) getStream(peer, id string) *stream {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.streams[streamKey{peer, id}]
+}
+
+// retireStream 数据流结束后在表中保留 streamLinger 再移除
+func (n *Node) retireStream(st *stream) {
+	time.AfterFunc(streamLinger, func() {
+		n.mu.Lock()
+		key := streamKey{st.peer, st.id}
+		if n.streams[key] == st {
+			delete(n.streams, key)
+		}
+		n.mu.Unlock()
+	})
+}
+
+// getState 返回数据流当前状态
+func (st *stream) getState() streamState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.state
+}
+
+// attach 出口侧连接目标成功后绑定连接，进入 open 状态，并交付连接期间缓存的数据；数据流已被重置时返回false
+func (st *stream) attach(conn net.Conn) bool {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	st.mu.Lock()
+	if st.state != streamOpening {
+		st.mu.Unlock()
+		return false
+	}
+	st.conn = conn
+	st.state = streamOpen
+	deliver := st.takeInOrderLocked()
+	ack, addr := st.recvNext, st.addr
+	st.mu.Unlock()
+
+	if len(deliver) == 0 {
+		return true
+	}
+	if pause, ok := st.deliver(conn, deliver); ok {
+		st.n.sendProto(addr, ProtoMsg{Type: "data_ack", From: st.n.ID, StreamID: st.id, Ack: ack, Pause: pause.Milliseconds()})
+		st.maybeFinish()
+	}
+	return true
+}
+
+// setEarly 标记为零往返打开
+func (st *stream) setEarly() {
+	st.mu.Lock()
+	st.early = true
+	st.mu.Unlock()
+}
+
+// setOffer 记录发起方提议的压缩算法
+func (st *stream) setOffer(offer string) {
+	st.mu.Lock()
+	st.offer = offer
+	st.mu.Unlock()
+}
+
+// setCompress 出口侧记录协商的压缩算法
+func (st *stream) setCompress(alg string) {
+	st.mu.Lock()
+	st.compress = alg
+	st.mu.Unlock()
+}
+
+// readyMsg 出口侧的 stream_ready，带上协商的压缩算法
+func (st *stream) readyMsg() ProtoMsg {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return ProtoMsg{Type: "stream_ready", From: st.n.ID, StreamID: st.id, Compress: st.compress}
+}
+
+// onReady 发起方收到 stream_ready，alg 为对端选择的压缩算法，只接受本方提议过的
+func (st *stream) onReady(alg string) {
+	st.mu.Lock()
+	if alg != "" && alg == st.offer {
+		st.compress = alg
+	}
+	if st.state == streamOpening {
+		st.state = streamOpen
+		select {
+		case st.ready <- nil:
+		default:
+		}
+	}
+	st.mu.Unlock()
+}
+
+// pumpLocal 从本地连接读取数据并可靠地发送给对端，读取结束后发送 stream_close
+func (st *stream) pumpLocal() {
+	buf := make([]byte, streamChunkSize)
+	for {
+		nr, err := st.conn.Read(buf)
+		if nr > 0 {
+			if qerr := st.n.quota.check(st.peer); qerr != nil {
+				st.n.log.Warn("stop stream", logKeyPeer, st.peer, logKeyStreamID, st.id, "err", qerr)
+				st.send(ProtoMsg{Type: "stream_close"})
+				return
+			}
+			payload, enc := st.compressChunk(buf[:nr])
+			st.throttle(len(payload))
+			st.n.quota.add(st.peer, len(payload))
+			st.n.compressStats.sent(st.peer, nr, len(payload))
+			data := base64.StdEncoding.EncodeToString(payload)
+			if serr := st.send(ProtoMsg{Type: "stream_data", Data: data, Enc: enc}); serr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				st.n.log.Debug("local read error", logKeyPeer, st.peer, logKeyStreamID, st.id, "err", err)
+			}
+			st.n.log.Debug("stream closed by local side", logKeyPeer, st.peer, logKeyStreamID, st.id)
+			st.send(ProtoMsg{Type: "stream_close"})
+			return
+		}
+	}
+}
+
+// compressChunk 协商了压缩算法时压缩一块数据，返回要发送的数据及其 enc
+func (st *stream) compressChunk(p []byte) ([]byte, string) {
+	st.mu.Lock()
+	alg := st.compress
+	st.mu.Unlock()
+	if alg == "" {
+		return p, ""
+	}
+	if st.comp == nil {
+		st.comp = newStreamCompressor(alg, st.n.getCompression().level())
+	}
+	return st.comp.compress(p)
+}
+
+// throttle 按带宽限制等待发送 n 字节，并等到对端要求的暂停结束；配置重新加载后改用新的令牌桶
+func (st *stream) throttle(n int) {
+	if lim := st.n.getLimiter(); lim != st.lim {
+		st.lim = lim
+		st.bucket = lim.newStreamBucket()
+	}
+	st.lim.wait(st.peer, st.bucket, n)
+	st.mu.Lock()
+	until := st.pauseUntil
+	st.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// done 数据流是否已结束，需持有 st.mu
+func (st *stream) done() bool {
+	return st.state == streamClosed || st.state == streamReset
+}
+
+// send 为消息分配序号并发送，窗口已满时阻塞等待确认
+func (st *stream) send(m ProtoMsg) error {
+	st.mu.Lock()
+	for len(st.unacked) >= streamWindow && !st.done() {
+		st.cond.Wait()
+	}
+	if st.done() || st.localDone {
+		st.mu.Unlock()
+		return errors.New("stream closed")
+	}
+	m.From = st.n.ID
+	m.StreamID = st.id
+	m.Seq = st.sendNext
+	st.sendNext++
+	now := time.Now()
+	st.lastActive = now
+	if m.Type == "stream_close" {
+		st.localDone = true
+		if st.state == streamOpen {
+			st.state = streamHalfClosedLocal
+		}
+	}
+	if len(st.unacked) == 0 {
+		// 窗口为空时从现在开始计算确认超时，空闲之后的第一次写入不会因为上次确认太久而被重置
+		st.lastProgress = now
+	}
+	st.unacked[m.Seq] = &outPacket{msg: m, sent: now}
+	addr := st.addr
+	st.mu.Unlock()
+
+	if err := st.n.sendProto(addr, m); err != nil {
+		// 发送失败交给重传处理
+		st.n.pktLog.Warn("send stream packet error", logKeyPeer, st.peer, logKeyStreamID, st.id, "err", err)
+	}
+	return nil
+}
+
+// onPacket 处理对端发来的 stream_data / stream_close：去重、排序、按序交付，并回复确认
+func (st *stream) onPacket(m ProtoMsg, from *net.UDPAddr) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+	st.mu.Lock()
+	switch {
+	case st.state == streamReset:
+		st.mu.Unlock()
+		st.n.sendProto(from, ProtoMsg{Type: "stream_reset", From: st.n.ID, StreamID: st.id, Error: "stream reset"})
+		return
+	case st.state == streamClosed:
+		// 对端没有收到最后的确认，重新确认
+		ack := st.recvNext
+		st.mu.Unlock()
+		st.n.sendProto(from, ProtoMsg{Type: "data_ack", From: st.n.ID, StreamID: st.id, Ack: ack})
+		return
+	}
+	st.addr = from
+	st.lastActive = time.Now()
+	if m.Seq >= st.recvNext && m.Seq < st.recvNext+streamWindow {
+		if _, dup := st.recvBuf[m.Seq]; !dup {
+			st.recvBuf[m.Seq] = m
+		}
+	}
+	if st.conn == nil {
+		// 出口侧还在连接目标，先缓存，连接成功后由 attach 交付并确认
+		st.mu.Unlock()
+		return
+	}
+	if st.state == streamOpening {
+		// 对端连接目标成功后才会发送数据，stream_ready 丢失或晚于数据到达时据此进入 open 状态
+		st.state = streamOpen
+		select {
+		case st.ready <- nil:
+		default:
+		}
+	}
+	deliver := st.takeInOrderLocked()
+	ack := st.recvNext
+	conn := st.conn
+	st.mu.Unlock()
+
+	pause, ok := st.deliver(conn, deliver)
+	if !ok {
+		return
+	}
+	st.n.sendProto(from, ProtoMsg{Type: "data_ack", From: st.n.ID, StreamID: st.id, Ack: ack, Pause: pause.Milliseconds()})
+	st.maybeFinish()
+}
+
+// takeInOrderLocked 取出缓存中从 recvNext 开始连续的包，需持有 st.mu
+func (st *stream) takeInOrderLocked() []ProtoMsg {
+	var deliver []ProtoMsg
+	for {
+		next, ok := st.recvBuf[st.recvNext]
+		if !ok {
+			return deliver
+		}
+		delete(st.recvBuf, st.recvNext)
+		st.recvNext++
+		deliver = append(deliver, next)
+	}
+}
+
+// deliver 把按序的包写入本地连接，需持有 st.wmu；返回按接收限速对端需要暂停发送的时长，
+// 写入失败重置数据流并返回false
+func (st *stream) deliver(conn net.Conn, deliver []ProtoMsg) (time.Duration, bool) {
+	var pause time.Duration
+	for _, dm := range deliver {
+		if dm.Type == "stream_close" {
+			st.mu.Lock()
+			st.remoteDone = true
+			if st.state == streamOpen {
+				st.state = streamHalfClosedRemote
+			}
+			st.mu.Unlock()
+			// 优雅地半关闭写端，让对端能优雅结束读操作
+			closeConnWrite(conn)
+			continue
+		}
+		wire, err := base64.StdEncoding.DecodeString(dm.Data)
+		if err != nil {
+			continue
+		}
+		data, err := st.decomp.decompress(dm.Enc, wire)
+		if err != nil {
+			st.n.pktLog.Warn("decompress stream data error, resetting stream", logKeyPeer, st.peer, logKeyStreamID, st.id, "enc", dm.Enc, "err", err)
+			st.reset(err.Error(), true)
+			return 0, false
+		}
+		// 如果写入失败，重置数据流，避免后续写入到已关闭连接导致 RST
+		if _, werr := conn.Write(data); werr != nil {
+			st.n.pktLog.Warn("write to local conn error, resetting stream", logKeyPeer, st.peer, logKeyStreamID, st.id, "err", werr)
+			st.reset("write to local connection failed", true)
+			return 0, false
+		}
+		st.n.quota.add(st.peer, len(wire))
+		st.n.compressStats.recv(st.peer, len(data), len(wire))
+		if d := st.throttleRecv(len(wire)); d > pause {
+			pause = d
+		}
+	}
+	return pause, true
+}
+
+// throttleRecv 按带宽限制为收到的 n 字节取走令牌，返回对端需要暂停发送的时长，需持有 st.wmu
+func (st *stream) throttleRecv(n int) time.Duration {
+	if lim := st.n.getLimiter(); lim != st.rxLim {
+		st.rxLim = lim
+		st.rxBucket = lim.newStreamBucket()
+	}
+	return st.rxLim.reserve(st.peer, st.rxBucket, n)
+}
+
+// onAck 处理对端的累计确认，pause 为对端按接收限速要求暂停发送的时长
+func (st *stream) onAck(ack uint64, pause time.Duration) {
+	st.mu.Lock()
+	if pause > 0 {
+		if until := time.Now().Add(pause); until.After(st.pauseUntil) {
+			st.pauseUntil = until
+		}
+	}
+	progressed := false
+	for seq := range st.unacked {
+		if seq < ack {
+			delete(st.unacked, seq)
+			progressed = true
+		}
+	}
+	if progressed {
+		st.acked = true
+		st.lastProgress = time.Now()
+		st.cond.Broadcast()
+	}
+	st.mu.Unlock()
+	st.maybeFinish()
+}
+
+// maybeFinish 双向都已结束且所有数据均被确认时，进入 closed 状态并关闭本地连接
+func (st *stream) maybeFinish() {
+	st.mu.Lock()
+	finish := !st.done() && st.localDone && st.remoteDone && len(st.unacked) == 0
+	if finish {
+		st.state = streamClosed
+		st.cond.Broadcast()
+	}
+	st.mu.Unlock()
+	if finish {
+		st.n.retireStream(st)
+		st.conn.Close()
+	}
+}
+
+// onRemoteReset 处理对端的 stream_reset
+// 零往返打开的数据流在 stream_open 之前到达对端的数据会被当作未知数据流重置，这样的重置可能晚于 stream_ready 到达，
+// 对端确认数据之前都忽略；这时 stream_open 通常已经到达，立即重传未确认的数据，不必等待重传间隔
+func (st *stream) onRemoteReset(reason string) {
+	st.mu.Lock()
+	if !st.early || st.acked || reason != errUnknownStream {
+		st.mu.Unlock()
+		st.reset(reason, false)
+		return
+	}
+	now := time.Now()
+	var resend []ProtoMsg
+	for _, p := range st.unacked {
+		p.sent = now
+		resend = append(resend, p.msg)
+	}
+	addr := st.addr
+	st.mu.Unlock()
+	for _, m := range resend {
+		st.n.sendProto(addr, m)
+	}
+}
+
+// reset 异常终止数据流：进入 reset 状态，关闭本地连接，通知等待 stream_ready 的一方；
+// notify 为 true 时向对端发送 stream_reset
+func (st *stream) reset(reason string, notify bool) {
+	st.mu.Lock()
+	if st.done() {
+		st.mu.Unlock()
+		return
+	}
+	st.state = streamReset
+	st.unacked = nil
+	st.cond.Broadcast()
+	conn, addr := st.conn, st.addr
+	select {
+	case st.ready <- errors.New(reason):
+	default:
+	}
+	st.mu.Unlock()
+
+	st.n.log.Debug("stream reset", logKeyPeer, st.peer, logKeyStreamID, st.id, "reason", reason, "by_peer", !notify)
+	if notify {
+		st.n.sendProto(addr, ProtoMsg{Type: "stream_reset", From: st.n.ID, StreamID: st.id, Error: reason})
+	}
+	st.n.retireStream(st)
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// retransmitLoop 定期重传超时未确认的包，长时间没有进展或空闲超时则重置数据流
+func (st *stream) retransmitLoop() {
+	t := st.n.getTimeouts()
+	rto := t.Retransmit
+	ticker := time.NewTicker(rto / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		st.mu.Lock()
+		if st.done() {
+			st.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		if len(st.unacked) > 0 && now.Sub(st.lastProgress) > t.AckTimeout {
+			st.mu.Unlock()
+			st.n.log.Warn("stream gave up waiting for ack", logKeyPeer, st.peer, logKeyStreamID, st.id)
+			st.reset("ack timeout", true)
+			return
+		}
+		if st.state != streamOpening && now.Sub(st.lastActive) > t.Idle {
+			st.mu.Unlock()
+			st.n.log.Info("stream idle timeout", logKeyPeer, st.peer, logKeyStreamID, st.id, "idle", t.Idle.String())
+			st.reset("idle timeout", true)
+			return
+		}
+		var resend []ProtoMsg
+		for _, p := range st.unacked {
+			if now.Sub(p.sent) >= rto {
+				p.sent = now
+				resend = append(resend, p.msg)
+			}
+		}
+		addr := st.addr
+		st.mu.Unlock()
+		for _, m := range resend {
+			st.n.sendProto(addr, m)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package p2proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+	"golang.org/x/net/proxy"
+)
+
+func TestStreamIDSpaces(t *testing.T) {
+	a := &Node{ID: "nodeA", streams: make(map[streamKey]*stream), nextStreamID: make(map[string]uint64)}
+	b := &Node{ID: "nodeB", streams: make(map[streamKey]*stream), nextStreamID: make(map[string]uint64)}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ida := a.allocStreamIDLocked("nodeB")
+		idb := b.allocStreamIDLocked("nodeA")
+		if !b.validRemoteStreamID("nodeA", ida) || !a.validRemoteStreamID("nodeB", idb) {
+			t.Fatalf("ids %s/%s not accepted by the other side", ida, idb)
+		}
+		if a.validRemoteStreamID("nodeB", ida) || b.validRemoteStreamID("nodeA", idb) {
+			t.Fatalf("ids %s/%s accepted as remote by their own side", ida, idb)
+		}
+		if seen[ida] || seen[idb] {
+			t.Fatalf("duplicate id %s/%s", ida, idb)
+		}
+		seen[ida], seen[idb] = true, true
+	}
+	if b.validRemoteStreamID("nodeA", "not-a-number") {
+		t.Fatal("non-numeric id accepted")
+	}
+}
+
+// TestStreamSameIDBothDirections 两个节点同时向对方发起数据流，各自的ID空间保证不会串线
+func TestStreamSameIDBothDirections(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 4, simPeer{}, simPeer{}, Timeouts{})
+	// 让双方从同一个位置开始分配
+	env.a.mu.Lock()
+	env.a.nextStreamID["nodeB"] = 1000
+	env.a.mu.Unlock()
+	env.b.mu.Lock()
+	env.b.nextStreamID["nodeA"] = 1000
+	env.b.mu.Unlock()
+
+	da := env.startSocks(t)
+	lnb, err := env.b.ListenSocks5("127.0.0.1:0", "nodeA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnb.Close()
+	db := socksDialer(t, lnb.Addr().String())
+
+	var wg sync.WaitGroup
+	for i, d := range []proxy.Dialer{da, db} {
+		payload := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+		wg.Add(1)
+		go func(d proxy.Dialer) {
+			defer wg.Done()
+			got, err := echoThrough(d, echo, payload, 10*time.Second)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("echo %c: err=%v, got %d bytes", payload[0], err, len(got))
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+func TestStreamResetOnRefusal(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 5, simPeer{}, simPeer{}, Timeouts{Open: 5 * time.Second})
+	policy, err := NewExitPolicy(nil, nil, []string{"*:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.b.SetExitPolicy(policy)
+	d := env.startSocks(t)
+
+	start := time.Now()
+	got, err := echoThrough(d, echo, []byte("denied"), 10*time.Second)
+	if err == nil && len(got) > 0 {
+		t.Fatalf("refused stream delivered %q", got)
+	}
+	// 收到 stream_reset 后立即结束，不必等待 stream_open 超时
+	if d := time.Since(start); d > 4*time.Second {
+		t.Fatalf("refusal took %v", d)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	env := newSimEnv(t, 6, simPeer{}, simPeer{}, Timeouts{Idle: 500 * time.Millisecond})
+	d := env.startSocks(t)
+
+	c, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	// 空闲超过 Idle 后本地连接被关闭
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(buf); err == nil {
+		t.Fatal("idle stream not closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("idle stream not closed within 5s")
+	}
+}
+
+// TestStreamLateDuplicateOpen 数据流结束后迟到的 stream_open 不会再次连接目标
+func TestStreamLateDuplicateOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	env := newSimEnv(t, 7, simPeer{}, simPeer{}, Timeouts{})
+	d := env.startSocks(t)
+	if _, err := echoThrough(d, ln.Addr().String(), []byte("once"), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	env.b.mu.Lock()
+	var sid string
+	for k := range env.b.streams {
+		sid = k.id
+	}
+	env.b.mu.Unlock()
+	if sid == "" {
+		t.Fatal("finished stream not kept in the table")
+	}
+	addr, _ := env.a.Lookup("nodeB")
+	env.a.sendProto(addr, ProtoMsg{Type: "stream_open", From: "nodeA", StreamID: sid, Target: ln.Addr().String()})
+	time.Sleep(300 * time.Millisecond)
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("target dialed %d times, want 1", n)
+	}
+}
+
+func TestStreamWriteAfterIdle(t *testing.T) {
+	// 空闲超过确认超时后再写入：确认在一个检查周期内回不来时数据流也不能被重置
+	echo := startEchoServer(t)
+	link := netsim.Link{Latency: 100 * time.Millisecond}
+	env := newSimEnv(t, 8, simPeer{link: link}, simPeer{link: link}, Timeouts{AckTimeout: 500 * time.Millisecond})
+	d := env.startSocks(t)
+
+	c, err := d.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	for i, msg := range []string{"first", "again"} {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatalf("write %q: %v", msg, err)
+		}
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+			t.Fatalf("read %q: %q, %v", msg, buf, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package p2proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// tracker 管理控制连接
+// 监听 unix 套接字（unix:/path，文件权限 0600）或 TCP 地址，每个连接处理一条命令，每行一个 JSON：
+//
+//	tracker -> {"nonce":"<随机数>"}
+//	client  -> {"cmd":"list|inspect|evict","node":"<id>","mac":"<HMAC-SHA256(key, nonce\ncmd\nnode)>"}
+//	tracker -> {"nodes":[...]} 或 {"error":"..."}
+//
+// 每个连接的随机数不同，截获的请求无法重放。
+
+const controlTimeout = 10 * time.Second
+
+type controlRequest struct {
+	Cmd  string `json:"cmd"`
+	Node string `json:"node,omitempty"`
+	Mac  string `json:"mac"`
+}
+
+type controlResponse struct {
+	Nonce string     `json:"nonce,omitempty"`
+	Nodes []NodeInfo `json:"nodes,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// controlMac 计算控制请求的签名
+func controlMac(key []byte, nonce string, r controlRequest) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(nonce + "\n" + r.Cmd + "\n" + r.Node))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitControlAddr 把控制地址拆分为网络类型与地址
+func splitControlAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// startControl 启动控制连接监听
+func (t *Tracker) startControl() error {
+	if t.ControlKey == "" {
+		return errors.New("tracker: control key is required for the control socket")
+	}
+	network, address := splitControlAddr(t.ControlAddr)
+	if network == "unix" {
+		// 清理上次异常退出留下的套接字文件
+		os.Remove(address)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0o600); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.ctlLn = ln
+	t.mu.Unlock()
+	t.log.Info("tracker control listening", logKeyAddr, t.ControlAddr)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					t.log.Warn("tracker control accept error", "err", err)
+				}
+				return
+			}
+			go t.handleControl(c)
+		}
+	}()
+	return nil
+}
+
+// handleControl 处理一个控制连接
+func (t *Tracker) handleControl(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(controlTimeout))
+	enc := json.NewEncoder(c)
+
+	nb := make([]byte, 16)
+	if _, err := rand.Read(nb); err != nil {
+		return
+	}
+	nonce := hex.EncodeToString(nb)
+	if err := enc.Encode(controlResponse{Nonce: nonce}); err != nil {
+		return
+	}
+	var req controlRequest
+	if err := json.NewDecoder(bufio.NewReader(c)).Decode(&req); err != nil {
+		return
+	}
+	want := controlMac([]byte(t.ControlKey), nonce, req)
+	if !hmac.Equal([]byte(req.Mac), []byte(want)) {
+		t.log.Warn("tracker control: authentication failed", logKeyAddr, c.RemoteAddr().String())
+		enc.Encode(controlResponse{Error: "authentication failed"})
+		return
+	}
+
+	var resp controlResponse
+	switch req.Cmd {
+	case "list":
+		resp.Nodes = t.Nodes()
+	case "inspect":
+		if info, ok := t.Node(req.Node); ok {
+			resp.Nodes = []NodeInfo{info}
+		} else {
+			resp.Error = fmt.Sprintf("node %q not found", req.Node)
+		}
+	case "evict":
+		if !t.Evict(req.Node) {
+			resp.Error = fmt.Sprintf("node %q not found", req.Node)
+		}
+	default:
+		resp.Error = fmt.Sprintf("unknown command %q", req.Cmd)
+	}
+	enc.Encode(resp)
+}
+
+// TrackerControl 通过控制连接管理运行中的 tracker
+// Addr: tracker 的控制地址，unix:/path 或 host:port
+// Key: 控制连接的认证密钥，与 Tracker.ControlKey 一致
+type TrackerControl struct {
+	Addr string
+	Key  string
+}
+
+// List 列出所有有效的注册
+func (tc *TrackerControl) List() ([]NodeInfo, error) {
+	return tc.call(controlRequest{Cmd: "list"})
+}
+
+// Inspect 返回一个节点的注册信息
+func (tc *TrackerControl) Inspect(id string) (NodeInfo, error) {
+	nodes, err := tc.call(controlRequest{Cmd: "inspect", Node: id})
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	if len(nodes) == 0 {
+		return NodeInfo{}, fmt.Errorf("node %q not found", id)
+	}
+	return nodes[0], nil
+}
+
+// Evict 移除一个节点的注册
+func (tc *TrackerControl) Evict(id string) error {
+	_, err := tc.call(controlRequest{Cmd: "evict", Node: id})
+	return err
+}
+
+func (tc *TrackerControl) call(req controlRequest) ([]NodeInfo, error) {
+	network, address := splitControlAddr(tc.Addr)
+	c, err := net.DialTimeout(network, address, controlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(controlTimeout))
+	dec := json.NewDecoder(bufio.NewReader(c))
+
+	var hello controlResponse
+	if err := dec.Decode(&hello); err != nil {
+		return nil, fmt.Errorf("read control hello: %w", err)
+	}
+	req.Mac = controlMac([]byte(tc.Key), hello.Nonce, req)
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("read control response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Nodes, nil
+}
@@ -0,0 +1,279 @@
+package p2proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// tracker 的滥用防护
+// - 每个来源 IP 一个令牌桶，超出速率的包在解析之前丢弃；
+// - 每个 IP 注册的节点数有上限；
+// - 对未注册的地址回复的字节数不超过请求的 Amplification 倍（先去掉候选地址，仍超过时不回复），
+//   tracker 不能被伪造源地址的请求用来放大流量；
+// - 只有 lookup 的来源地址是请求方注册时的地址之一时才向目标节点发送 notify，同一对节点每秒最多一次，
+//   第三方不能借 tracker 向注册的节点发送大量 notify；
+// - 开启 RequireCookie 时，节点从新地址注册需要回显 tracker 发往该地址的 cookie，证明该地址可达。
+
+const (
+	defaultPerIPRate     = 20
+	defaultMaxNodesPerIP = 64
+	defaultAmplification = 3
+	notifyInterval       = time.Second
+	cookieWindow         = time.Minute
+	// maxTrackedIPs 同时跟踪的来源 IP 数量上限，超过后新来源共用一个令牌桶
+	maxTrackedIPs = 65536
+)
+
+// TrackerLimits tracker 的滥用防护设置，零值表示使用默认值，负数表示不限制
+type TrackerLimits struct {
+	PerIPRate     float64 // 每个来源 IP 每秒处理的包数，默认20
+	PerIPBurst    int     // 每个来源 IP 的突发包数，默认为 PerIPRate 的2倍
+	MaxNodesPerIP int     // 每个 IP 最多注册的节点数，默认64
+	Amplification float64 // 对未注册的地址回复的字节数不超过请求的该倍数，默认3
+	RequireCookie bool    // 从新地址注册需要回显 cookie
+}
+
+func (l TrackerLimits) withDefaults() TrackerLimits {
+	if l.PerIPRate == 0 {
+		l.PerIPRate = defaultPerIPRate
+	}
+	if l.PerIPBurst <= 0 {
+		l.PerIPBurst = int(2 * l.PerIPRate)
+	}
+	if l.MaxNodesPerIP == 0 {
+		l.MaxNodesPerIP = defaultMaxNodesPerIP
+	}
+	if l.Amplification == 0 {
+		l.Amplification = defaultAmplification
+	}
+	return l
+}
+
+// trackerGuard 滥用防护的状态，只在 Run 的读取循环中使用，不需要加锁
+type trackerGuard struct {
+	limits   TrackerLimits
+	buckets  map[string]*tokenBucket // 来源 IP -> 令牌桶
+	overflow *tokenBucket            // 跟踪的 IP 过多时新来源共用的令牌桶
+	notified map[string]time.Time    // requester|target -> 上次发送 notify 的时间
+	secret   []byte                  // cookie 的密钥，每次启动随机生成
+}
+
+func newTrackerGuard(l TrackerLimits) *trackerGuard {
+	l = l.withDefaults()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	g := &trackerGuard{
+		limits:   l,
+		buckets:  make(map[string]*tokenBucket),
+		notified: make(map[string]time.Time),
+		secret:   secret,
+	}
+	g.overflow = g.newBucket()
+	return g
+}
+
+// newBucket 按 PerIPRate/PerIPBurst 创建以包为单位的令牌桶，不限制时返回nil
+func (g *trackerGuard) newBucket() *tokenBucket {
+	if g.limits.PerIPRate < 0 {
+		return nil
+	}
+	burst := float64(g.limits.PerIPBurst)
+	return &tokenBucket{rate: g.limits.PerIPRate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow 来源 ip 的令牌桶是否还有令牌
+func (g *trackerGuard) allow(ip net.IP) bool {
+	if g.limits.PerIPRate < 0 {
+		return true
+	}
+	key := ip.String()
+	b := g.buckets[key]
+	if b == nil {
+		if len(g.buckets) >= maxTrackedIPs {
+			b = g.overflow
+		} else {
+			b = g.newBucket()
+			g.buckets[key] = b
+		}
+	}
+	return b.take(1)
+}
+
+// shouldNotify 同一对节点每 notifyInterval 最多发送一次 notify
+func (g *trackerGuard) shouldNotify(requester, target string, now time.Time) bool {
+	key := requester + "|" + target
+	if last, ok := g.notified[key]; ok && now.Sub(last) < notifyInterval {
+		return false
+	}
+	g.notified[key] = now
+	return true
+}
+
+// sweep 清理已经回满的令牌桶与过期的 notify 记录
+func (g *trackerGuard) sweep(now time.Time) {
+	for ip, b := range g.buckets {
+		if b.idle(now) {
+			delete(g.buckets, ip)
+		}
+	}
+	for k, last := range g.notified {
+		if now.Sub(last) >= notifyInterval {
+			delete(g.notified, k)
+		}
+	}
+}
+
+// cookie 计算节点 id 从 addr 注册的 cookie，epoch 为 cookieWindow 的序号
+func (g *trackerGuard) cookie(id string, addr *net.UDPAddr, epoch int64) string {
+	mac := hmac.New(sha256.New, g.secret)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(epoch))
+	mac.Write(b[:])
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(addr.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validCookie cookie 是否为当前或上一个时间窗口内发给 (id, addr) 的
+func (g *trackerGuard) validCookie(id string, addr *net.UDPAddr, cookie string, now time.Time) bool {
+	if cookie == "" {
+		return false
+	}
+	epoch := now.UnixNano() / int64(cookieWindow)
+	for _, e := range []int64{epoch, epoch - 1} {
+		if hmac.Equal([]byte(cookie), []byte(g.cookie(id, addr, e))) {
+			return true
+		}
+	}
+	return false
+}
+
+// take 令牌足够时取走 n 个令牌并返回 true，不足时不取并返回 false
+func (b *tokenBucket) take(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// idle 令牌桶是否已经回满，回满的令牌桶可以删除，之后按新建处理
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// refill 按经过的时间补充令牌，需持有 b.mu
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// nodesFromIP 从 ip 注册的未过期节点数，不计 except；except 已经从 ip 注册时返回0，重新注册不需要检查
+func (t *Tracker) nodesFromIP(ip net.IP, except string) int {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := t.nodes[except]; n != nil && n.addr != nil && n.addr.IP.Equal(ip) && n.Expires.After(now) {
+		return 0
+	}
+	count := 0
+	for _, n := range t.nodes {
+		if n.addr != nil && n.addr.IP.Equal(ip) && n.Expires.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// registeredFrom addr 是否为节点 id 注册时 tracker 看到的地址；withCandidates 为 true 时也可以是节点上报的候选地址
+// 候选地址由节点自己上报，没有经过验证，不能用于放大防护
+func (t *Tracker) registeredFrom(id string, addr *net.UDPAddr, withCandidates bool) bool {
+	key := addr.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.nodes[id]
+	if n == nil || !n.Expires.After(time.Now()) {
+		return false
+	}
+	if n.Addr == key {
+		return true
+	}
+	if !withCandidates {
+		return false
+	}
+	for _, c := range n.Candidates {
+		if c.Addr == key {
+			return true
+		}
+	}
+	return false
+}
+
+// reply 回复节点 id 的请求：来源地址不是该节点注册时的地址时，回复不超过请求大小的 Amplification 倍，
+// 超过时先去掉候选地址，仍然超过则不回复
+func (t *Tracker) reply(id string, addr *net.UDPAddr, reqSize int, m ProtoMsg) {
+	amp := t.guard.limits.Amplification
+	if amp < 0 || t.registeredFrom(id, addr, false) {
+		t.send(addr, m)
+		return
+	}
+	limit := int(amp * float64(reqSize))
+	for {
+		signMsg([]byte(t.Key), &m)
+		b, err := json.Marshal(&m)
+		if err != nil {
+			return
+		}
+		if len(b) <= limit {
+			t.conn.WriteTo(b, addr)
+			return
+		}
+		if len(m.Candidates) == 0 {
+			t.pktLog.Warn("tracker: reply dropped by amplification guard", logKeyAddr, addr.String(), "type", m.Type, "size", len(b), "request", reqSize)
+			return
+		}
+		m.Candidates = nil
+	}
+}
+
+// admit 检查注册请求：来源 IP 的节点数上限，以及开启 RequireCookie 时新地址的 cookie；
+// 缺少 cookie 时向来源地址发送 cookie 并返回 false
+func (t *Tracker) admit(m ProtoMsg, addr *net.UDPAddr, reqSize int) bool {
+	if m.From == "" {
+		return false
+	}
+	if max := t.guard.limits.MaxNodesPerIP; max > 0 && t.nodesFromIP(addr.IP, m.From) >= max {
+		t.pktLog.Warn("tracker: too many nodes from one address", logKeyNode, m.From, logKeyAddr, addr.String())
+		return false
+	}
+	if !t.guard.limits.RequireCookie {
+		return true
+	}
+	t.mu.Lock()
+	cur := t.nodes[m.From]
+	sameAddr := cur != nil && cur.Addr == addr.String() && cur.Expires.After(time.Now())
+	t.mu.Unlock()
+	now := time.Now()
+	if sameAddr || t.guard.validCookie(m.From, addr, m.Cookie, now) {
+		return true
+	}
+	cookie := t.guard.cookie(m.From, addr, now.UnixNano()/int64(cookieWindow))
+	t.reply(m.From, addr, reqSize, ProtoMsg{Type: "cookie", Cookie: cookie})
+	return false
+}
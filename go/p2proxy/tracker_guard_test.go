@@ -0,0 +1,176 @@
+package p2proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotames/easygo/p2proxy/netsim"
+)
+
+// rawPeer 直接收发协议消息的 UDP 端点，用于构造异常的请求
+type rawPeer struct {
+	conn net.PacketConn
+	dst  *net.UDPAddr
+}
+
+func newRawPeer(t *testing.T, h *netsim.Host, dst string) *rawPeer {
+	t.Helper()
+	conn, err := h.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ua, _ := net.ResolveUDPAddr("udp", dst)
+	return &rawPeer{conn: conn, dst: ua}
+}
+
+// send 发送消息，返回编码后的字节数
+func (p *rawPeer) send(m ProtoMsg) int {
+	b, _ := json.Marshal(&m)
+	p.conn.WriteTo(b, p.dst)
+	return len(b)
+}
+
+// recv 收集 wait 时间内收到的消息及其大小
+func (p *rawPeer) recv(wait time.Duration) (msgs []ProtoMsg, sizes []int) {
+	buf := make([]byte, 65535)
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, _, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var m ProtoMsg
+		if json.Unmarshal(buf[:n], &m) == nil {
+			msgs = append(msgs, m)
+			sizes = append(sizes, n)
+		}
+	}
+}
+
+func startGuardTracker(t *testing.T, nw *netsim.Network, limits TrackerLimits) *Tracker {
+	t.Helper()
+	tr := NewTracker(simTrackerAddr)
+	tr.Network = nw.AddHost("203.0.113.1", nil)
+	tr.Logger = quietLogger()
+	tr.Limits = limits
+	go tr.Run()
+	t.Cleanup(func() { tr.Close() })
+	time.Sleep(20 * time.Millisecond)
+	return tr
+}
+
+func TestTrackerRateLimit(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 16})
+	startGuardTracker(t, nw, TrackerLimits{PerIPRate: 5, PerIPBurst: 5})
+	p := newRawPeer(t, nw.AddHost("198.51.100.1", nil), simTrackerAddr)
+	for i := 0; i < 50; i++ {
+		p.send(ProtoMsg{Type: "lookup", From: "flooder", To: "nobody", ReqID: fmt.Sprint(i)})
+	}
+	msgs, _ := p.recv(200 * time.Millisecond)
+	if len(msgs) < 5 || len(msgs) > 7 {
+		t.Fatalf("got %d replies to 50 lookups, want about the burst of 5", len(msgs))
+	}
+	// 其他来源不受影响
+	q := newRawPeer(t, nw.AddHost("198.51.100.2", nil), simTrackerAddr)
+	q.send(ProtoMsg{Type: "lookup", From: "other", To: "nobody"})
+	if msgs, _ := q.recv(200 * time.Millisecond); len(msgs) != 1 {
+		t.Fatalf("other source got %d replies", len(msgs))
+	}
+}
+
+func TestTrackerMaxNodesPerIP(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 17})
+	tr := startGuardTracker(t, nw, TrackerLimits{MaxNodesPerIP: 2})
+	h := nw.AddHost("198.51.100.1", nil)
+	for _, id := range []string{"n1", "n2", "n3"} {
+		newRawPeer(t, h, simTrackerAddr).send(ProtoMsg{Type: "register", From: id})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := len(tr.Nodes()); got != 2 {
+		t.Fatalf("%d nodes registered from one IP, want 2", got)
+	}
+	// 已注册的节点可以继续重新注册
+	p := newRawPeer(t, h, simTrackerAddr)
+	p.send(ProtoMsg{Type: "register", From: "n1"})
+	if msgs, _ := p.recv(100 * time.Millisecond); len(msgs) != 1 || msgs[0].Type != "registered" {
+		t.Fatalf("re-register n1: %+v", msgs)
+	}
+}
+
+func TestTrackerAmplificationAndNotify(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 18})
+	startGuardTracker(t, nw, TrackerLimits{})
+	victim := newRawPeer(t, nw.AddHost("198.51.100.1", nil), simTrackerAddr)
+	var cands []Candidate
+	for i := 0; i < maxCandidates; i++ {
+		cands = append(cands, Candidate{Addr: fmt.Sprintf("10.0.0.%d:40000", i+1), Type: candidateHost})
+	}
+	victim.send(ProtoMsg{Type: "register", From: "victim", Candidates: cands})
+	requester := newRawPeer(t, nw.AddHost("198.51.100.2", nil), simTrackerAddr)
+	requester.send(ProtoMsg{Type: "register", From: "requester"})
+	victim.recv(100 * time.Millisecond)
+	requester.recv(100 * time.Millisecond)
+
+	// 未注册的来源：回复不超过请求的 3 倍，去掉了候选地址；也不会通知 victim
+	spoof := newRawPeer(t, nw.AddHost("198.51.100.3", nil), simTrackerAddr)
+	size := spoof.send(ProtoMsg{Type: "lookup", From: "requester", To: "victim"})
+	msgs, sizes := spoof.recv(100 * time.Millisecond)
+	if len(msgs) != 1 || msgs[0].Type != "peer" || len(msgs[0].Candidates) != 0 || sizes[0] > 3*size {
+		t.Fatalf("unregistered source got %+v (sizes %v, request %d)", msgs, sizes, size)
+	}
+	if msgs, _ := victim.recv(100 * time.Millisecond); len(msgs) != 0 {
+		t.Fatalf("victim notified for a lookup from an unregistered source: %+v", msgs)
+	}
+
+	// 注册的来源得到完整的候选地址，victim 收到一次 notify，重发的 lookup 不重复通知
+	for i := 0; i < 3; i++ {
+		requester.send(ProtoMsg{Type: "lookup", From: "requester", To: "victim", ReqID: "r1"})
+	}
+	msgs, _ = requester.recv(100 * time.Millisecond)
+	if len(msgs) != 3 || len(msgs[0].Candidates) != maxCandidates {
+		t.Fatalf("registered requester got %d replies, first with %d candidates", len(msgs), len(msgs[0].Candidates))
+	}
+	if msgs, _ := victim.recv(100 * time.Millisecond); len(msgs) != 1 || msgs[0].Type != "notify" {
+		t.Fatalf("victim got %+v, want one notify", msgs)
+	}
+}
+
+func TestTrackerCookie(t *testing.T) {
+	nw := netsim.New(netsim.Config{Seed: 19})
+	tr := startGuardTracker(t, nw, TrackerLimits{RequireCookie: true})
+
+	// 不回显 cookie 的注册不会被接受
+	p := newRawPeer(t, nw.AddHost("198.51.100.1", nil), simTrackerAddr)
+	p.send(ProtoMsg{Type: "register", From: "raw"})
+	msgs, _ := p.recv(100 * time.Millisecond)
+	if len(msgs) != 1 || msgs[0].Type != "cookie" || msgs[0].Cookie == "" {
+		t.Fatalf("register without cookie got %+v", msgs)
+	}
+	if _, ok := tr.Node("raw"); ok {
+		t.Fatal("registered without echoing the cookie")
+	}
+	// 别的节点ID或别的地址不能使用这个 cookie
+	p.send(ProtoMsg{Type: "register", From: "other", Cookie: msgs[0].Cookie})
+	q := newRawPeer(t, nw.AddHost("198.51.100.2", nil), simTrackerAddr)
+	q.send(ProtoMsg{Type: "register", From: "raw", Cookie: msgs[0].Cookie})
+	time.Sleep(100 * time.Millisecond)
+	if len(tr.Nodes()) != 0 {
+		t.Fatalf("cookie reused: %+v", tr.Nodes())
+	}
+
+	// 节点自动回显 cookie 完成注册
+	n, err := NewNodeWithConfig(NodeConfig{ID: "nodeA", Trackers: []string{simTrackerAddr}, Logger: quietLogger(), Network: nw.AddHost("198.51.100.4", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	n.Register()
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := tr.Node("nodeA"); !ok {
+		t.Fatal("node did not register with the cookie")
+	}
+}
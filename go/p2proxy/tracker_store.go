@@ -0,0 +1,372 @@
+package p2proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tracker 注册信息的持久化
+// nodeStore 是一个追加写的日志文件，每行一条 JSON 记录：
+//
+//	{"op":"put","node":{...}}  注册或重新注册
+//	{"op":"del","id":"..."}    被管理员移除
+//
+// 启动时按顺序重放得到每个节点最后的状态，跳过已过期的注册；
+// 记录数远多于有效节点数时重写为只包含有效节点的快照（先写临时文件再改名）。
+
+const (
+	defaultNodeTTL     = 360 * time.Second
+	trackerSweepPeriod = 30 * time.Second
+	// storeCompactSlack 日志中的冗余记录超过该数量且超过有效节点数时压缩
+	storeCompactSlack = 1024
+)
+
+type storeRecord struct {
+	Op   string    `json:"op"`
+	Node *NodeInfo `json:"node,omitempty"`
+	ID   string    `json:"id,omitempty"`
+}
+
+// nodeStore 注册信息日志文件
+type nodeStore struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	w       *bufio.Writer
+	records int // 日志中的记录数
+}
+
+// openNodeStore 打开（或创建）日志文件并重放，返回 now 时刻仍有效的注册
+func openNodeStore(path string, now time.Time) (*nodeStore, map[string]NodeInfo, error) {
+	live := make(map[string]NodeInfo)
+	records := 0
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, nil, err
+	default:
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var r storeRecord
+			// 进程异常退出时最后一行可能不完整，忽略无法解析的记录
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				continue
+			}
+			records++
+			switch {
+			case r.Op == "put" && r.Node != nil:
+				live[r.Node.ID] = *r.Node
+			case r.Op == "del":
+				delete(live, r.ID)
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read node store %s: %w", path, err)
+		}
+	}
+	for id, info := range live {
+		if !info.Expires.After(now) {
+			delete(live, id)
+		}
+	}
+
+	s := &nodeStore{path: path, records: records}
+	// 启动时总是重写一次，去掉过期与冗余的记录
+	if err := s.rewrite(live); err != nil {
+		return nil, nil, err
+	}
+	return s, live, nil
+}
+
+// append 追加一条记录，需持有 s.mu
+func (s *nodeStore) append(r storeRecord) error {
+	if s.w == nil {
+		return os.ErrClosed
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.records++
+	return s.w.Flush()
+}
+
+func (s *nodeStore) put(info NodeInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(storeRecord{Op: "put", Node: &info})
+}
+
+func (s *nodeStore) del(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(storeRecord{Op: "del", ID: id})
+}
+
+// needCompact 日志中的冗余记录是否过多
+func (s *nodeStore) needCompact(liveCount int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	extra := s.records - liveCount
+	return extra > storeCompactSlack && extra > liveCount
+}
+
+// rewrite 把 live 写成新的日志文件并替换旧文件
+func (s *nodeStore) rewrite(live map[string]NodeInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(live))
+	for id := range live {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		info := live[id]
+		if err = enc.Encode(storeRecord{Op: "put", Node: &info}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.w, s.records = f, bufio.NewWriter(f), len(ids)
+	return nil
+}
+
+func (s *nodeStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w = nil, nil
+	return err
+}
+
+// openStore 配置了 StorePath 时打开持久化文件并恢复注册信息
+func (t *Tracker) openStore() error {
+	if t.StorePath == "" {
+		return nil
+	}
+	store, live, err := openNodeStore(t.StorePath, time.Now())
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.store = store
+	for id, info := range live {
+		addr, err := net.ResolveUDPAddr("udp", info.Addr)
+		if err != nil {
+			continue
+		}
+		t.nodes[id] = &trackerNode{NodeInfo: info, addr: addr}
+	}
+	t.mu.Unlock()
+	t.log.Info("tracker restored registrations", "nodes", len(live), "store", t.StorePath)
+	return nil
+}
+
+// closeStore 压缩并关闭持久化文件
+func (t *Tracker) closeStore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.store == nil {
+		return
+	}
+	if err := t.store.rewrite(t.snapshot(time.Now())); err != nil {
+		t.log.Warn("tracker: compact node store error", "err", err)
+	}
+	if err := t.store.close(); err != nil {
+		t.log.Warn("tracker: close node store error", "err", err)
+	}
+	t.store = nil
+}
+
+// snapshot 返回未过期的注册信息，需持有 t.mu
+func (t *Tracker) snapshot(now time.Time) map[string]NodeInfo {
+	live := make(map[string]NodeInfo, len(t.nodes))
+	for id, n := range t.nodes {
+		if n.Expires.After(now) {
+			live[id] = n.NodeInfo
+		}
+	}
+	return live
+}
+
+func (t *Tracker) nodeTTL() time.Duration {
+	if t.NodeTTL <= 0 {
+		return defaultNodeTTL
+	}
+	return t.NodeTTL
+}
+
+// register 记录节点的注册并写入持久化文件
+// 持久化文件的写入都在持有 t.mu 时进行，保证与压缩时的快照顺序一致
+func (t *Tracker) register(id string, addr *net.UDPAddr, cands []Candidate) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.nodes[id]
+	if n == nil || !n.Expires.After(now) {
+		n = &trackerNode{NodeInfo: NodeInfo{ID: id, Registered: now}}
+		t.nodes[id] = n
+	}
+	n.addr = addr
+	n.Addr = addr.String()
+	n.Candidates = mergeCandidates(addr, cands)
+	n.LastSeen = now
+	n.Expires = now.Add(t.nodeTTL())
+	if t.store != nil {
+		if err := t.store.put(n.NodeInfo); err != nil {
+			t.pktLog.Warn("tracker: persist registration error", logKeyNode, id, "err", err)
+		}
+	}
+}
+
+// lookup 返回节点的地址与候选地址，未注册或注册已过期时返回 nil
+func (t *Tracker) lookup(id string) (*net.UDPAddr, []Candidate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.nodes[id]
+	if n == nil || !n.Expires.After(time.Now()) {
+		return nil, nil
+	}
+	return n.addr, n.Candidates
+}
+
+// mergeCandidates 节点上报的候选地址加上 tracker 看到的地址，去重并限制数量
+// 旧版本节点不上报候选地址时返回nil，查询方按原来的方式只使用 Addr
+func mergeCandidates(addr *net.UDPAddr, cands []Candidate) []Candidate {
+	if len(cands) == 0 {
+		return nil
+	}
+	observed := Candidate{Addr: addr.String(), Type: candidateSrflx}
+	merged := []Candidate{observed}
+	seen := map[string]bool{observed.Addr: true}
+	for _, c := range cands {
+		if len(merged) == maxCandidates {
+			break
+		}
+		if c.Type != candidateHost && c.Type != candidateSrflx {
+			continue
+		}
+		ua, err := net.ResolveUDPAddr("udp", c.Addr)
+		if err != nil || ua.IP == nil || ua.IP.IsUnspecified() || seen[c.Addr] {
+			continue
+		}
+		seen[c.Addr] = true
+		merged = append(merged, c)
+	}
+	return merged
+}
+
+// Nodes 返回未过期的注册信息，按节点ID排序
+func (t *Tracker) Nodes() []NodeInfo {
+	t.mu.Lock()
+	live := t.snapshot(time.Now())
+	t.mu.Unlock()
+	nodes := make([]NodeInfo, 0, len(live))
+	for _, info := range live {
+		nodes = append(nodes, info)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Node 返回一个节点的注册信息
+func (t *Tracker) Node(id string) (NodeInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.nodes[id]
+	if n == nil || !n.Expires.After(time.Now()) {
+		return NodeInfo{}, false
+	}
+	return n.NodeInfo, true
+}
+
+// Evict 移除一个节点的注册，节点下次注册前其他节点无法查找到它
+func (t *Tracker) Evict(id string) bool {
+	t.mu.Lock()
+	_, ok := t.nodes[id]
+	delete(t.nodes, id)
+	if ok && t.store != nil {
+		if err := t.store.del(id); err != nil {
+			t.log.Warn("tracker: persist eviction error", logKeyNode, id, "err", err)
+		}
+	}
+	t.mu.Unlock()
+	if ok {
+		t.log.Info("tracker: node evicted", logKeyNode, id)
+	}
+	return ok
+}
+
+// sweepLoop 定期清理过期的注册，并在日志冗余过多时压缩持久化文件
+func (t *Tracker) sweepLoop() {
+	ticker := time.NewTicker(trackerSweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.quit:
+			return
+		}
+		now := time.Now()
+		t.mu.Lock()
+		for id, n := range t.nodes {
+			if !n.Expires.After(now) {
+				delete(t.nodes, id)
+			}
+		}
+		if t.store != nil && t.store.needCompact(len(t.nodes)) {
+			if err := t.store.rewrite(t.snapshot(now)); err != nil {
+				t.log.Warn("tracker: compact node store error", "err", err)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
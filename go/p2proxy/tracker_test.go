@@ -0,0 +1,128 @@
+package p2proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestTracker 在本机回环地址启动 tracker，等待控制连接就绪
+func startTestTracker(t *testing.T, tr *Tracker) {
+	t.Helper()
+	tr.Logger = quietLogger()
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Run() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.mu.Lock()
+		ready := tr.ctlLn != nil
+		tr.mu.Unlock()
+		if ready {
+			return
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("tracker run: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tracker not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrackerStoreRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.log")
+	tr := NewTracker("127.0.0.1:0")
+	tr.StorePath = path
+	tr.log, tr.pktLog = quietLogger(), quietLogger()
+	if err := tr.openStore(); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 4321}
+	for i := 0; i < 3; i++ {
+		tr.register("nodeA", addr, nil)
+	}
+	tr.register("nodeB", addr, nil)
+	tr.register("gone", addr, nil)
+	tr.Evict("gone")
+	// 模拟已过期的注册
+	tr.mu.Lock()
+	tr.nodes["nodeB"].Expires = time.Now().Add(-time.Second)
+	tr.store.put(tr.nodes["nodeB"].NodeInfo)
+	tr.mu.Unlock()
+	// 模拟异常退出时写了一半的记录
+	tr.store.close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","node":{"id":"tor`)
+	f.Close()
+
+	tr2 := NewTracker("127.0.0.1:0")
+	tr2.StorePath = path
+	tr2.log, tr2.pktLog = quietLogger(), quietLogger()
+	if err := tr2.openStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr2.closeStore()
+	nodes := tr2.Nodes()
+	if len(nodes) != 1 || nodes[0].ID != "nodeA" || nodes[0].Addr != addr.String() {
+		t.Fatalf("restored nodes = %+v, want only nodeA", nodes)
+	}
+	if got, _ := tr2.lookup("nodeA"); got == nil || got.String() != addr.String() {
+		t.Fatalf("lookup restored node = %v", got)
+	}
+	// 启动时已压缩为一条记录
+	b, _ := os.ReadFile(path)
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Fatalf("store has %d records after compaction, want 1:\n%s", n, b)
+	}
+}
+
+func TestTrackerControl(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ctl.sock")
+	tr := NewTracker("127.0.0.1:0")
+	tr.ControlAddr = "unix:" + sock
+	tr.ControlKey = "secret"
+	startTestTracker(t, tr)
+	defer tr.Close()
+
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("control socket mode: %v %v", fi, err)
+	}
+	tr.register("nodeA", &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1000}, nil)
+	tr.register("nodeB", &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 2000}, nil)
+
+	bad := &TrackerControl{Addr: tr.ControlAddr, Key: "wrong"}
+	if _, err := bad.List(); err == nil {
+		t.Fatal("list with wrong key succeeded")
+	}
+
+	tc := &TrackerControl{Addr: tr.ControlAddr, Key: "secret"}
+	nodes, err := tc.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].ID != "nodeA" || nodes[1].ID != "nodeB" {
+		t.Fatalf("list = %+v", nodes)
+	}
+	info, err := tc.Inspect("nodeB")
+	if err != nil || info.Addr != "198.51.100.2:2000" {
+		t.Fatalf("inspect nodeB = %+v, %v", info, err)
+	}
+	if err := tc.Evict("nodeA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Inspect("nodeA"); err == nil {
+		t.Fatal("nodeA still registered after evict")
+	}
+	if err := tc.Evict("nodeA"); err == nil {
+		t.Fatal("evicting unknown node succeeded")
+	}
+}
@@ -0,0 +1,391 @@
+package p2proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 文件传输
+// 接收方调用 ReceiveFiles 注册 file 服务，发送方通过 SendFiles 打开到该服务的数据流。
+// 双方在数据流上交换以换行结尾的 JSON 消息，文件内容直接以原始字节传输：
+//
+//	发送方 -> {"files":[{"path":"dir/a.txt","size":123,"mode":420,"hash":"<qetag>"}, ...]}
+//	接收方 -> {"offsets":[0, 64, ...]}        每个文件已有的字节数，断点续传
+//	发送方 -> 依次发送每个文件 offset 之后的内容
+//	接收方 -> {"errors":["..."]}               校验失败的文件，全部成功时为空
+//
+// 接收中的文件写入 <文件名>.part，内容的 qetag 与发送方一致后才改为正式文件名；
+// 传输中断时 .part 文件保留，下次发送同一文件时从其末尾继续。
+
+// fileServiceName 文件接收服务的名称
+const fileServiceName = "file"
+
+// partSuffix 接收中的文件的后缀
+const partSuffix = ".part"
+
+// progressInterval 两次进度回调的最小间隔
+const progressInterval = 200 * time.Millisecond
+
+// TransferProgress 文件传输进度
+// Peer: 对端节点ID
+// Path: 当前文件的相对路径
+// FileDone/FileSize: 当前文件已传输的字节数（含续传时已有的部分）及文件大小
+// Done/Total: 所有文件已传输的字节数及总字节数
+type TransferProgress struct {
+	Peer     string
+	Path     string
+	FileDone int64
+	FileSize int64
+	Done     int64
+	Total    int64
+}
+
+// transferFile 传输清单中的一项
+type transferFile struct {
+	Path string      `json:"path"` // 相对路径，使用 / 分隔
+	Size int64       `json:"size"`
+	Mode fs.FileMode `json:"mode"`
+	Hash string      `json:"hash,omitempty"` // 文件内容的 qetag，目录为空
+	Dir  bool        `json:"dir,omitempty"`
+}
+
+// transferMsg 文件传输的控制消息
+type transferMsg struct {
+	Files   []transferFile `json:"files,omitempty"`
+	Offsets []int64        `json:"offsets,omitempty"`
+	Errors  []string       `json:"errors,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// progressCounter 统计传输的字节数，按 progressInterval 回调进度
+type progressCounter struct {
+	fn   func(TransferProgress)
+	p    TransferProgress
+	last time.Time
+}
+
+// startFile 开始传输一个文件，offset 为续传时已有的字节数
+func (pc *progressCounter) startFile(f transferFile, offset int64) {
+	pc.p.Path, pc.p.FileSize, pc.p.FileDone = f.Path, f.Size, offset
+	pc.p.Done += offset
+}
+
+func (pc *progressCounter) Write(p []byte) (int, error) {
+	pc.p.FileDone += int64(len(p))
+	pc.p.Done += int64(len(p))
+	if pc.fn != nil && time.Since(pc.last) >= progressInterval {
+		pc.flush()
+	}
+	return len(p), nil
+}
+
+// flush 立即回调当前进度
+func (pc *progressCounter) flush() {
+	if pc.fn != nil {
+		pc.last = time.Now()
+		pc.fn(pc.p)
+	}
+}
+
+// readTransferMsg 读取一条控制消息
+func readTransferMsg(r *bufio.Reader) (transferMsg, error) {
+	var m transferMsg
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(line, &m); err != nil {
+		return m, fmt.Errorf("invalid transfer message: %w", err)
+	}
+	return m, nil
+}
+
+// writeTransferMsg 写入一条控制消息
+func writeTransferMsg(w io.Writer, m transferMsg) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// scanTransferFiles 生成 path 的传输清单：文件只包含自身，目录包含目录名及其下所有普通文件与子目录
+func scanTransferFiles(path string) ([]transferFile, error) {
+	path = filepath.Clean(path)
+	base := filepath.Dir(path)
+	var files []transferFile
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := transferFile{Path: filepath.ToSlash(rel), Mode: info.Mode().Perm()}
+		switch {
+		case d.IsDir():
+			f.Dir = true
+		case info.Mode().IsRegular():
+			f.Size = info.Size()
+			if f.Hash, err = fileQetag(p); err != nil {
+				return err
+			}
+		default:
+			// 跳过符号链接、设备文件等
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// SendFiles 把文件或目录 path 发送给 peerID 节点，对端需已调用 ReceiveFiles
+// 对端已有的部分（中断的传输留下的 .part 文件）不再重复发送；progress 为nil时不回调进度
+// 所有文件都已保存且校验通过时返回nil
+func (n *Node) SendFiles(ctx context.Context, peerID, path string, progress func(TransferProgress)) error {
+	files, err := scanTransferFiles(path)
+	if err != nil {
+		return err
+	}
+	c, err := n.DialPeer(ctx, peerID, servicePrefix+fileServiceName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	err = sendFiles(c, path, files, &progressCounter{fn: progress, p: TransferProgress{Peer: peerID}})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sendFiles 在已打开的连接上完成一次发送
+func sendFiles(c net.Conn, path string, files []transferFile, pc *progressCounter) error {
+	r := bufio.NewReader(c)
+	if err := writeTransferMsg(c, transferMsg{Files: files}); err != nil {
+		return err
+	}
+	reply, err := readTransferMsg(r)
+	if err != nil {
+		return fmt.Errorf("read transfer offsets: %w", err)
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	if len(reply.Offsets) != len(files) {
+		return fmt.Errorf("peer returned %d offsets for %d files", len(reply.Offsets), len(files))
+	}
+	for _, f := range files {
+		pc.p.Total += f.Size
+	}
+
+	base := filepath.Dir(filepath.Clean(path))
+	w := bufio.NewWriterSize(c, streamChunkSize)
+	for i, f := range files {
+		if f.Dir {
+			continue
+		}
+		off := reply.Offsets[i]
+		if off < 0 || off > f.Size {
+			return fmt.Errorf("peer returned invalid offset %d for %s", off, f.Path)
+		}
+		pc.startFile(f, off)
+		if err := sendFile(w, filepath.Join(base, filepath.FromSlash(f.Path)), off, f.Size, pc); err != nil {
+			return fmt.Errorf("send %s: %w", f.Path, err)
+		}
+		pc.flush()
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	result, err := readTransferMsg(r)
+	if err != nil {
+		return fmt.Errorf("read transfer result: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("peer rejected %d file(s): %s", len(result.Errors), strings.Join(result.Errors, "; "))
+	}
+	return nil
+}
+
+// sendFile 发送文件 [off, size) 的内容
+func sendFile(w io.Writer, name string, off, size int64, pc *progressCounter) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	// 文件在计算 qetag 后变短时，接收方会因为校验失败而拒绝该文件
+	_, err = io.CopyN(io.MultiWriter(w, pc), f, size-off)
+	return err
+}
+
+// ReceiveFiles 注册文件接收服务，把其他节点通过 SendFiles 发送的文件保存到目录 dir
+// 只接受 allowPeers 中的节点发送的文件（同时受出口策略的 AllowPeers 限制），为空时返回错误；
+// progress 为nil时不回调进度
+func (n *Node) ReceiveFiles(dir string, allowPeers []string, progress func(TransferProgress)) error {
+	if len(allowPeers) == 0 {
+		return errors.New("no peers allowed to send files")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return n.registerService(fileServiceName, func(peer string, c net.Conn) {
+		defer c.Close()
+		lg := n.log.With(logKeyPeer, peer)
+		if !slices.Contains(allowPeers, peer) {
+			lg.Warn("refuse files from peer not in the allowed senders")
+			// 按协议先读完发送方的清单再回复错误
+			readTransferMsg(bufio.NewReader(c))
+			writeTransferMsg(c, transferMsg{Error: fmt.Sprintf("peer %s is not allowed to send files", peer)})
+			return
+		}
+		pc := &progressCounter{fn: progress, p: TransferProgress{Peer: peer}}
+		if err := receiveFiles(c, dir, pc, lg); err != nil {
+			lg.Warn("receive files failed", "err", err)
+		}
+	})
+}
+
+// receivingFile 接收方对清单中一项的处理状态
+type receivingFile struct {
+	dst      string // 正式文件名
+	offset   int64  // 已有的字节数
+	complete bool   // 正式文件已存在且内容一致
+	hash     *qetag // 已有部分的 qetag，继续写入后得到整个文件的 qetag
+}
+
+// receiveFiles 在一条连接上完成一次接收
+func receiveFiles(c net.Conn, dir string, pc *progressCounter, lg *slog.Logger) error {
+	r := bufio.NewReader(c)
+	m, err := readTransferMsg(r)
+	if err != nil {
+		return err
+	}
+	states := make([]receivingFile, len(m.Files))
+	offsets := make([]int64, len(m.Files))
+	for i, f := range m.Files {
+		rel := filepath.FromSlash(f.Path)
+		if !filepath.IsLocal(rel) || f.Size < 0 {
+			msg := fmt.Sprintf("invalid path %q", f.Path)
+			writeTransferMsg(c, transferMsg{Error: msg})
+			return errors.New(msg)
+		}
+		st, err := prepareReceive(filepath.Join(dir, rel), f)
+		if err != nil {
+			writeTransferMsg(c, transferMsg{Error: fmt.Sprintf("prepare %s: %v", f.Path, err)})
+			return err
+		}
+		states[i], offsets[i] = st, st.offset
+		pc.p.Total += f.Size
+	}
+	if err := writeTransferMsg(c, transferMsg{Offsets: offsets}); err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, f := range m.Files {
+		st := states[i]
+		if f.Dir {
+			continue
+		}
+		pc.startFile(f, st.offset)
+		if st.complete {
+			pc.flush()
+			continue
+		}
+		if err := receiveFile(r, st, f, pc); err != nil {
+			// 连接中断时保留 .part 文件，下次续传
+			return fmt.Errorf("receive %s: %w", f.Path, err)
+		}
+		pc.flush()
+		if sum := st.hash.Sum(); sum != f.Hash {
+			os.Remove(st.dst + partSuffix)
+			failed = append(failed, fmt.Sprintf("%s: hash mismatch (got %s, want %s)", f.Path, sum, f.Hash))
+			continue
+		}
+		if err := os.Rename(st.dst+partSuffix, st.dst); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", f.Path, err))
+			continue
+		}
+		lg.Info("file received", "path", f.Path, "size", f.Size)
+	}
+	return writeTransferMsg(c, transferMsg{Errors: failed})
+}
+
+// prepareReceive 创建目录，检查已有的正式文件与 .part 文件，决定从哪里继续接收
+func prepareReceive(dst string, f transferFile) (receivingFile, error) {
+	st := receivingFile{dst: dst}
+	if f.Dir {
+		return st, os.MkdirAll(dst, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return st, err
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.Mode().IsRegular() && fi.Size() == f.Size {
+		if sum, err := fileQetag(dst); err == nil && sum == f.Hash {
+			st.offset, st.complete = f.Size, true
+			return st, nil
+		}
+	}
+	part := dst + partSuffix
+	st.hash = newQetag()
+	pf, err := os.Open(part)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	defer pf.Close()
+	fi, err := pf.Stat()
+	if err != nil {
+		return st, err
+	}
+	if fi.Size() > f.Size {
+		// 不是同一个文件留下的，重新接收
+		return st, os.Remove(part)
+	}
+	if st.offset, err = io.Copy(st.hash, pf); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// receiveFile 把文件剩余的内容追加到 .part 文件
+func receiveFile(r io.Reader, st receivingFile, f transferFile, pc *progressCounter) error {
+	pf, err := os.OpenFile(st.dst+partSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, f.Mode|0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.MultiWriter(pf, st.hash, pc), r, f.Size-st.offset)
+	if cerr := pf.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package p2proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQetag(t *testing.T) {
+	// 七牛文档中空文件的 etag
+	if got := newQetag().Sum(); got != "Fto5o-5ea0sNMlW_75VgGJCv2AcJ" {
+		t.Fatalf("empty qetag = %s", got)
+	}
+	data := make([]byte, 2*qetagBlockSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, size := range []int{100, qetagBlockSize, len(data)} {
+		var want []byte
+		if size <= qetagBlockSize {
+			h := sha1.Sum(data[:size])
+			want = append([]byte{0x16}, h[:]...)
+		} else {
+			var sums []byte
+			for off := 0; off < size; off += qetagBlockSize {
+				h := sha1.Sum(data[off:min(off+qetagBlockSize, size)])
+				sums = append(sums, h[:]...)
+			}
+			h := sha1.Sum(sums)
+			want = append([]byte{0x96}, h[:]...)
+		}
+		// 以不对齐块边界的大小分批写入
+		q := newQetag()
+		for off := 0; off < size; off += 1000003 {
+			q.Write(data[off:min(off+1000003, size)])
+		}
+		if got := q.Sum(); got != base64.URLEncoding.EncodeToString(want) {
+			t.Fatalf("size %d: qetag = %s, want %s", size, got, base64.URLEncoding.EncodeToString(want))
+		}
+	}
+}
+
+// writeTestTree 创建用于传输的目录
+func writeTestTree(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(2))
+	files := map[string][]byte{
+		"data/a.bin":       make([]byte, 96*1024),
+		"data/sub/b.txt":   []byte("hello p2proxy\n"),
+		"data/sub/empty":   {},
+		"data/sub/c/d.bin": make([]byte, 20*1024),
+	}
+	root := t.TempDir()
+	for name, b := range files {
+		rng.Read(b)
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(root, "data", "emptydir"), 0o755)
+	return filepath.Join(root, "data"), files
+}
+
+func checkReceived(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: err=%v, got %d bytes, want %d", name, err, len(got), len(want))
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)) + partSuffix); err == nil {
+			t.Fatalf("%s: part file left behind", name)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "data", "emptydir")); err != nil || !fi.IsDir() {
+		t.Fatalf("empty directory not created: %v", err)
+	}
+}
+
+func TestTransferFiles(t *testing.T) {
+	env := newSimEnv(t, 8, simPeer{}, simPeer{}, Timeouts{})
+	src, files := writeTestTree(t)
+	dst := t.TempDir()
+	if err := env.b.ReceiveFiles(dst, []string{"nodeA"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var last TransferProgress
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := env.a.SendFiles(ctx, "nodeB", src, func(p TransferProgress) { last = p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, dst, files)
+	var total int64
+	for _, b := range files {
+		total += int64(len(b))
+	}
+	if last.Done != total || last.Total != total || last.Peer != "nodeB" {
+		t.Fatalf("last progress = %+v, want %d bytes", last, total)
+	}
+
+	// 文件已存在且内容一致时不再重复发送
+	before := env.b.QuotaUsage("nodeA").DayBytes
+	if err := env.a.SendFiles(ctx, "nodeB", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if sent := env.b.QuotaUsage("nodeA").DayBytes - before; sent >= 10*1024 {
+		t.Fatalf("resend of identical files transferred %d bytes", sent)
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	env := newSimEnv(t, 9, simPeer{}, simPeer{}, Timeouts{})
+	src, files := writeTestTree(t)
+	dst := t.TempDir()
+	if err := env.b.ReceiveFiles(dst, []string{"nodeA"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// 中断的传输留下了 a.bin 的前半部分
+	a := files["data/a.bin"]
+	part := filepath.Join(dst, "data", "a.bin") + partSuffix
+	os.MkdirAll(filepath.Dir(part), 0o755)
+	if err := os.WriteFile(part, a[:len(a)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.a.SendFiles(ctx, "nodeB", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, dst, files)
+	var rest int64
+	for name, b := range files {
+		rest += int64(len(b))
+		if name == "data/a.bin" {
+			rest -= int64(len(a) / 2)
+		}
+	}
+	if got := env.b.QuotaUsage("nodeA").DayBytes; got >= rest+int64(len(a)/4) {
+		t.Fatalf("resumed transfer received %d bytes, want about %d", got, rest)
+	}
+
+	// 已有部分与源文件不一致时校验失败，删除 .part 后下次重新传输
+	os.Remove(filepath.Join(dst, "data", "a.bin"))
+	bad := bytes.Repeat([]byte{0xff}, 1024)
+	if err := os.WriteFile(part, bad, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := env.a.SendFiles(ctx, "nodeB", src, nil)
+	if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Fatalf("corrupt part: err = %v, want hash mismatch", err)
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Fatal("corrupt part file kept")
+	}
+	if err := env.a.SendFiles(ctx, "nodeB", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, dst, files)
+}
+
+func TestTransferAllowedSenders(t *testing.T) {
+	env := newSimEnv(t, 11, simPeer{}, simPeer{}, Timeouts{})
+	dst := t.TempDir()
+	if err := env.b.ReceiveFiles(dst, nil, nil); err == nil {
+		t.Fatal("ReceiveFiles without allowed senders should fail")
+	}
+	if err := env.b.ReceiveFiles(dst, []string{"nodeC"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	src, _ := writeTestTree(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := env.a.SendFiles(ctx, "nodeB", src, nil)
+	if err == nil || !strings.Contains(err.Error(), "not allowed to send files") {
+		t.Fatalf("send from peer not allowed: err = %v", err)
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) != 0 {
+		t.Fatalf("files received from peer not allowed: %v", entries)
+	}
+}
+
+func TestTransferRejectsUnknownService(t *testing.T) {
+	env := newSimEnv(t, 10, simPeer{}, simPeer{}, Timeouts{})
+	src, _ := writeTestTree(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := env.a.SendFiles(ctx, "nodeB", src, nil)
+	if err == nil || !strings.Contains(err.Error(), "no such service") {
+		t.Fatalf("send without receiver: err = %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultPunchInterval     = 500 * time.Millisecond
+	messageBacklog           = 64
+)
+
+// ErrNoPeer 还没有得到对端地址
+var ErrNoPeer = errors.New("rendezvous: no peer")
+
+// ClientConfig 客户端配置
+type ClientConfig struct {
+	ServerAddr        string        // 信令服务器地址，如 1.2.3.4:929
+	ID                string        // 本客户端ID
+	ListenAddr        string        // 本地 UDP 地址，默认 :0
+	HeartbeatInterval time.Duration // 向服务器发送心跳（及向对端发送保活包）的间隔，默认30秒
+	PunchInterval     time.Duration // 打洞时重发 PUNCH 的间隔，默认500毫秒
+	Logger            *slog.Logger  // 日志输出，为nil时使用 slog.Default()
+}
+
+// Client 信令客户端：向服务器注册并定期心跳，通过服务器得到对端地址后打洞，之后直接与对端收发消息
+type Client struct {
+	cfg    ClientConfig
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	log    *slog.Logger
+
+	replies  chan Message      // 服务器对 REGISTER/CONNECT 的回复
+	peerInfo chan *net.UDPAddr // 服务器发来的 PEER_INFO
+	messages chan string       // 对端发来的聊天消息
+
+	mu       sync.Mutex
+	peer     *net.UDPAddr
+	punched  chan struct{} // 收到对端的 PUNCH/PUNCH_ACK 时关闭
+	hbOnce   sync.Once
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewClient 创建客户端并开始接收消息
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("rendezvous: client id is required")
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":0"
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.PunchInterval <= 0 {
+		cfg.PunchInterval = defaultPunchInterval
+	}
+	server, err := net.ResolveUDPAddr("udp", cfg.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	lg := cfg.Logger
+	if lg == nil {
+		lg = slog.Default()
+	}
+	c := &Client{
+		cfg:      cfg,
+		conn:     conn,
+		server:   server,
+		log:      lg.With("id", cfg.ID),
+		replies:  make(chan Message, 4),
+		peerInfo: make(chan *net.UDPAddr, 4),
+		messages: make(chan string, messageBacklog),
+		punched:  make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// LocalAddr 本地 UDP 地址
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Close 关闭客户端
+func (c *Client) Close() error {
+	var err error
+	c.quitOnce.Do(func() {
+		close(c.quit)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Messages 对端发来的聊天消息，处理不及时的消息会被丢弃
+func (c *Client) Messages() <-chan string {
+	return c.messages
+}
+
+// Peer 返回当前的对端地址，没有时返回nil
+func (c *Client) Peer() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
+}
+
+// Punched 收到对端的打洞包后关闭
+func (c *Client) Punched() <-chan struct{} {
+	return c.punched
+}
+
+// Register 向服务器注册，未收到回复时每隔 PunchInterval 重发；成功后开始定期发送心跳
+func (c *Client) Register(ctx context.Context) error {
+	if _, err := c.request(ctx, Message{Kind: KindRegister, ID: c.cfg.ID}, KindRegisterOK); err != nil {
+		return err
+	}
+	c.hbOnce.Do(func() { go c.heartbeatLoop() })
+	return nil
+}
+
+// Connect 请求服务器交换与 target 的地址，返回对端地址；服务器同时把本客户端的地址发给 target
+func (c *Client) Connect(ctx context.Context, target string) (*net.UDPAddr, error) {
+	// 丢弃之前的 PEER_INFO，只接受这次请求的结果
+	for len(c.peerInfo) > 0 {
+		<-c.peerInfo
+	}
+	if _, err := c.send(Message{Kind: KindConnect, ID: target}, c.server); err != nil {
+		return nil, err
+	}
+	resend := time.NewTicker(c.cfg.PunchInterval)
+	defer resend.Stop()
+	for {
+		select {
+		case addr := <-c.peerInfo:
+			c.setPeer(addr)
+			return addr, nil
+		case m := <-c.replies:
+			if m.Kind == KindError {
+				return nil, fmt.Errorf("rendezvous: connect %s: %s", target, m.Text)
+			}
+		case <-resend.C:
+			c.send(Message{Kind: KindConnect, ID: target}, c.server)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.quit:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// WaitPeer 等待服务器转来其他客户端的连接请求，返回对端地址
+func (c *Client) WaitPeer(ctx context.Context) (*net.UDPAddr, error) {
+	select {
+	case addr := <-c.peerInfo:
+		c.setPeer(addr)
+		return addr, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Punch 每隔 PunchInterval 向对端发送 PUNCH，直到收到对端的 PUNCH 或 PUNCH_ACK
+func (c *Client) Punch(ctx context.Context) error {
+	peer := c.Peer()
+	if peer == nil {
+		return ErrNoPeer
+	}
+	ticker := time.NewTicker(c.cfg.PunchInterval)
+	defer ticker.Stop()
+	for {
+		c.send(Message{Kind: KindPunch}, c.Peer())
+		select {
+		case <-c.punched:
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.quit:
+			return net.ErrClosed
+		}
+	}
+}
+
+// Send 向对端发送一条聊天消息
+func (c *Client) Send(text string) error {
+	peer := c.Peer()
+	if peer == nil {
+		return ErrNoPeer
+	}
+	_, err := c.conn.WriteToUDP([]byte(text), peer)
+	return err
+}
+
+func (c *Client) setPeer(addr *net.UDPAddr) {
+	c.mu.Lock()
+	c.peer = addr
+	c.mu.Unlock()
+	c.log.Info("peer address", "peer", addr.String())
+}
+
+func (c *Client) send(m Message, addr *net.UDPAddr) (int, error) {
+	return c.conn.WriteToUDP([]byte(m.String()), addr)
+}
+
+// request 发送请求并等待指定类型的回复或 ERROR，未收到回复时重发
+func (c *Client) request(ctx context.Context, m Message, want string) (Message, error) {
+	resend := time.NewTicker(c.cfg.PunchInterval)
+	defer resend.Stop()
+	for {
+		if _, err := c.send(m, c.server); err != nil {
+			return Message{}, err
+		}
+		select {
+		case r := <-c.replies:
+			switch r.Kind {
+			case want:
+				return r, nil
+			case KindError:
+				return r, fmt.Errorf("rendezvous: %s: %s", m.Kind, r.Text)
+			}
+		case <-resend.C:
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-c.quit:
+			return Message{}, net.ErrClosed
+		}
+	}
+}
+
+// heartbeatLoop 定期向服务器发送心跳，并向已打通的对端发送保活包以维持 NAT 映射
+func (c *Client) heartbeatLoop() {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+		c.send(Message{Kind: KindHeartbeat, ID: c.cfg.ID}, c.server)
+		if peer := c.Peer(); peer != nil {
+			c.send(Message{Kind: KindPunch}, peer)
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			c.log.Debug("read error", "err", err)
+			continue
+		}
+		text := string(buf[:n])
+		if addr.IP.Equal(c.server.IP) && addr.Port == c.server.Port {
+			c.onServer(text)
+			continue
+		}
+		c.onPeer(text, addr)
+	}
+}
+
+// onServer 处理服务器的消息
+func (c *Client) onServer(text string) {
+	m, err := ParseMessage(text)
+	if err != nil {
+		c.log.Debug("invalid server message", "msg", text, "err", err)
+		return
+	}
+	switch m.Kind {
+	case KindPeerInfo:
+		select {
+		case c.peerInfo <- m.Addr:
+		default:
+		}
+	case KindHeartbeatAck:
+	default:
+		select {
+		case c.replies <- m:
+		default:
+		}
+	}
+}
+
+// onPeer 处理其他地址发来的消息：打洞包或聊天消息
+func (c *Client) onPeer(text string, addr *net.UDPAddr) {
+	m, err := ParseMessage(text)
+	if err == nil && (m.Kind == KindPunch || m.Kind == KindPunchAck) {
+		c.mu.Lock()
+		// 对端位于对称型 NAT 之后时，打洞包的来源地址才是可用的地址
+		c.peer = addr
+		select {
+		case <-c.punched:
+		default:
+			close(c.punched)
+			c.log.Info("punched", "peer", addr.String())
+		}
+		c.mu.Unlock()
+		if m.Kind == KindPunch {
+			c.send(Message{Kind: KindPunchAck}, addr)
+		}
+		return
+	}
+	select {
+	case c.messages <- text:
+	default:
+		c.log.Warn("message dropped", "peer", addr.String())
+	}
+}
@@ -0,0 +1,89 @@
+package rendezvous
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 文本协议，每个 UDP 包一条消息，命令与参数以空格分隔：
+//
+//	客户端 -> 服务器：REGISTER <id>、CONNECT <id>、HEARTBEAT <id>
+//	服务器 -> 客户端：REGISTER_OK、HEARTBEAT_ACK、PEER_INFO <ip> <port>、ERROR: <原因>
+//	客户端 <-> 客户端：PUNCH、PUNCH_ACK，其他内容都是聊天消息
+//
+// 与原来的 single/p2psvr.go、single/p2pclient.go 兼容。
+
+// 消息类型
+const (
+	KindRegister     = "REGISTER"
+	KindRegisterOK   = "REGISTER_OK"
+	KindConnect      = "CONNECT"
+	KindHeartbeat    = "HEARTBEAT"
+	KindHeartbeatAck = "HEARTBEAT_ACK"
+	KindPeerInfo     = "PEER_INFO"
+	KindError        = "ERROR"
+	KindPunch        = "PUNCH"
+	KindPunchAck     = "PUNCH_ACK"
+)
+
+// ErrUnknownMessage 不是协议消息，客户端之间收到时作为聊天消息处理
+var ErrUnknownMessage = errors.New("unknown message")
+
+// Message 一条协议消息
+// ID: REGISTER、CONNECT、HEARTBEAT 的客户端ID
+// Addr: PEER_INFO 的对端地址
+// Text: ERROR 的原因
+type Message struct {
+	Kind string
+	ID   string
+	Addr *net.UDPAddr
+	Text string
+}
+
+// ParseMessage 解析一条消息，不是协议消息时返回 ErrUnknownMessage，参数不正确时返回其他错误
+func ParseMessage(s string) (Message, error) {
+	s = strings.TrimRight(s, "\r\n")
+	kind, rest, _ := strings.Cut(s, " ")
+	m := Message{Kind: kind}
+	switch kind {
+	case KindRegister, KindConnect, KindHeartbeat:
+		if rest == "" || strings.ContainsAny(rest, " \t") {
+			return Message{}, fmt.Errorf("%s: invalid client id %q", kind, rest)
+		}
+		m.ID = rest
+	case KindRegisterOK, KindHeartbeatAck, KindPunch, KindPunchAck:
+		if rest != "" {
+			return Message{}, fmt.Errorf("%s: unexpected argument %q", kind, rest)
+		}
+	case KindPeerInfo:
+		ipStr, portStr, ok := strings.Cut(rest, " ")
+		ip := net.ParseIP(ipStr)
+		port, err := strconv.Atoi(portStr)
+		if !ok || ip == nil || err != nil || port <= 0 || port > 65535 {
+			return Message{}, fmt.Errorf("%s: invalid address %q", kind, rest)
+		}
+		m.Addr = &net.UDPAddr{IP: ip, Port: port}
+	case KindError, KindError + ":":
+		m.Kind = KindError
+		m.Text = strings.TrimSpace(rest)
+	default:
+		return Message{}, ErrUnknownMessage
+	}
+	return m, nil
+}
+
+// String 把消息编码为协议文本
+func (m Message) String() string {
+	switch m.Kind {
+	case KindRegister, KindConnect, KindHeartbeat:
+		return m.Kind + " " + m.ID
+	case KindPeerInfo:
+		return fmt.Sprintf("%s %s %d", m.Kind, m.Addr.IP, m.Addr.Port)
+	case KindError:
+		return m.Kind + ": " + m.Text
+	}
+	return m.Kind
+}
@@ -0,0 +1,171 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Message
+	}{
+		{"REGISTER clientA", Message{Kind: KindRegister, ID: "clientA"}},
+		{"CONNECT clientB\n", Message{Kind: KindConnect, ID: "clientB"}},
+		{"HEARTBEAT clientA", Message{Kind: KindHeartbeat, ID: "clientA"}},
+		{"REGISTER_OK", Message{Kind: KindRegisterOK}},
+		{"PUNCH", Message{Kind: KindPunch}},
+		{"PEER_INFO 1.2.3.4 5678", Message{Kind: KindPeerInfo, Addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}}},
+		{"PEER_INFO 2001:db8::1 929", Message{Kind: KindPeerInfo, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 929}}},
+		{"ERROR: Target not found", Message{Kind: KindError, Text: "Target not found"}},
+	} {
+		got, err := ParseMessage(tc.in)
+		if err != nil {
+			t.Errorf("ParseMessage(%q): %v", tc.in, err)
+			continue
+		}
+		if got.String() != tc.want.String() || got.ID != tc.want.ID || got.Text != tc.want.Text {
+			t.Errorf("ParseMessage(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+		// 编码后再解析得到相同的消息
+		if again, err := ParseMessage(got.String()); err != nil || again.String() != got.String() {
+			t.Errorf("round trip %q: %q, %v", tc.in, again.String(), err)
+		}
+	}
+	for _, in := range []string{"REGISTER", "REGISTER a b", "PEER_INFO 1.2.3.4", "PEER_INFO 1.2.3.4 0", "PEER_INFO x 1", "PUNCH now"} {
+		if _, err := ParseMessage(in); err == nil || errors.Is(err, ErrUnknownMessage) {
+			t.Errorf("ParseMessage(%q): %v, want a parse error", in, err)
+		}
+	}
+	for _, in := range []string{"hello", "", "register a"} {
+		if _, err := ParseMessage(in); !errors.Is(err, ErrUnknownMessage) {
+			t.Errorf("ParseMessage(%q): %v, want ErrUnknownMessage", in, err)
+		}
+	}
+}
+
+func startServer(t *testing.T, ttl time.Duration) *Server {
+	t.Helper()
+	s := NewServer("127.0.0.1:0")
+	s.ClientTTL = ttl
+	s.Logger = quietLogger()
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newTestClient(t *testing.T, s *Server, id string, heartbeat time.Duration) *Client {
+	t.Helper()
+	c, err := NewClient(ClientConfig{
+		ServerAddr:        s.Addr().String(),
+		ID:                id,
+		ListenAddr:        "127.0.0.1:0",
+		HeartbeatInterval: heartbeat,
+		PunchInterval:     50 * time.Millisecond,
+		Logger:            quietLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnectPunchChat(t *testing.T) {
+	s := startServer(t, 0)
+	a := newTestClient(t, s, "clientA", time.Minute)
+	b := newTestClient(t, s, "clientB", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Connect(ctx, "clientB"); err == nil || !strings.Contains(err.Error(), "Target not found") {
+		t.Fatalf("connect to unregistered client: %v", err)
+	}
+	if err := b.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := a.Connect(ctx, "clientB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != b.LocalAddr().String() {
+		t.Fatalf("peer of clientA = %s, want %s", addr, b.LocalAddr())
+	}
+	baddr, err := b.WaitPeer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baddr.String() != a.LocalAddr().String() {
+		t.Fatalf("peer of clientB = %s, want %s", baddr, a.LocalAddr())
+	}
+
+	// 只有一方打洞时，对端的 PUNCH_ACK 也能结束打洞
+	if err := a.Punch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Punch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Send("hello from A"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-b.Messages():
+		if msg != "hello from A" {
+			t.Fatalf("clientB got %q", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("clientB did not receive the message")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s := startServer(t, 300*time.Millisecond)
+	c := newTestClient(t, s, "clientA", 50*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Clients()["clientA"].LastSeen
+
+	// 心跳刷新活动时间，客户端在超过 TTL 之后仍然保持注册
+	time.Sleep(500 * time.Millisecond)
+	info, ok := s.Clients()["clientA"]
+	if !ok || !info.LastSeen.After(first) {
+		t.Fatalf("heartbeat did not refresh clientA: %+v, %v", info, ok)
+	}
+
+	// 服务器丢失注册后，心跳会重新注册
+	s.mu.Lock()
+	delete(s.clients, "clientA")
+	s.mu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := s.Clients()["clientA"]; !ok {
+		t.Fatal("heartbeat did not re-register clientA")
+	}
+
+	// 停止心跳后超过 TTL 被移除
+	c.Close()
+	time.Sleep(600 * time.Millisecond)
+	if _, ok := s.Clients()["clientA"]; ok {
+		t.Fatal("silent clientA not expired")
+	}
+}
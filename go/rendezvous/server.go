@@ -0,0 +1,215 @@
+package rendezvous
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPort 信令服务器的默认端口
+const DefaultPort = 929
+
+const defaultClientTTL = 90 * time.Second
+
+// ClientInfo 已注册的客户端
+type ClientInfo struct {
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+}
+
+// Server 信令服务器：记录客户端的公网地址，收到 CONNECT 时把双方的地址发给对方，以便双方打洞
+// ListenAddr: UDP 监听地址，如 :929
+// ClientTTL: 客户端超过该时间没有注册或心跳时移除，默认90秒
+// Logger: 日志输出，为nil时使用 slog.Default()
+type Server struct {
+	ListenAddr string
+	ClientTTL  time.Duration
+	Logger     *slog.Logger
+
+	mu      sync.Mutex
+	conn    *net.UDPConn
+	clients map[string]*ClientInfo
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewServer 创建监听 listenAddr 的信令服务器
+func NewServer(listenAddr string) *Server {
+	return &Server{ListenAddr: listenAddr}
+}
+
+// Listen 绑定 UDP 地址，之后可以通过 Addr 获得实际地址
+func (s *Server) Listen() error {
+	addr, err := net.ResolveUDPAddr("udp", s.ListenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.clients = make(map[string]*ClientInfo)
+	s.quit = make(chan struct{})
+	if s.ClientTTL <= 0 {
+		s.ClientTTL = defaultClientTTL
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Addr 返回实际监听的地址，Listen 之前返回nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Run 绑定地址并处理消息，直到 Close
+func (s *Server) Run() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Serve 处理消息，直到 Close；需先调用 Listen
+func (s *Server) Serve() error {
+	if s.conn == nil {
+		return errors.New("rendezvous: Serve called before Listen")
+	}
+	lg := s.logger()
+	lg.Info("rendezvous server listening", "addr", s.conn.LocalAddr().String())
+	go s.cleanupLoop()
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+			}
+			lg.Warn("read error", "err", err)
+			continue
+		}
+		m, err := ParseMessage(string(buf[:n]))
+		if err != nil {
+			lg.Debug("invalid message", "addr", addr.String(), "err", err)
+			continue
+		}
+		s.handle(m, addr)
+	}
+}
+
+// Close 停止服务器
+func (s *Server) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conn == nil {
+			return
+		}
+		close(s.quit)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// Clients 返回已注册客户端的快照
+func (s *Server) Clients() map[string]ClientInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]ClientInfo, len(s.clients))
+	for id, c := range s.clients {
+		out[id] = *c
+	}
+	return out
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Server) send(m Message, addr *net.UDPAddr) {
+	if _, err := s.conn.WriteToUDP([]byte(m.String()), addr); err != nil {
+		s.logger().Debug("send error", "addr", addr.String(), "err", err)
+	}
+}
+
+// touch 记录客户端的地址与活动时间，返回客户端是否为新注册或地址发生了变化
+func (s *Server) touch(id string, addr *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[id]
+	changed := c == nil || c.Addr.String() != addr.String()
+	s.clients[id] = &ClientInfo{Addr: addr, LastSeen: time.Now()}
+	return changed
+}
+
+func (s *Server) handle(m Message, addr *net.UDPAddr) {
+	lg := s.logger()
+	switch m.Kind {
+	case KindRegister:
+		s.touch(m.ID, addr)
+		lg.Info("client registered", "id", m.ID, "addr", addr.String())
+		s.send(Message{Kind: KindRegisterOK}, addr)
+
+	case KindHeartbeat:
+		// 心跳同时刷新地址：NAT 映射变化或服务器重启后客户端不必重新注册
+		if s.touch(m.ID, addr) {
+			lg.Info("client registered by heartbeat", "id", m.ID, "addr", addr.String())
+		}
+		s.send(Message{Kind: KindHeartbeatAck}, addr)
+
+	case KindConnect:
+		s.mu.Lock()
+		target := s.clients[m.ID]
+		var targetAddr *net.UDPAddr
+		if target != nil {
+			targetAddr = target.Addr
+		}
+		s.mu.Unlock()
+		if targetAddr == nil {
+			s.send(Message{Kind: KindError, Text: "Target not found"}, addr)
+			return
+		}
+		// 交换地址信息
+		s.send(Message{Kind: KindPeerInfo, Addr: addr}, targetAddr)
+		s.send(Message{Kind: KindPeerInfo, Addr: targetAddr}, addr)
+		lg.Info("exchanged peer addresses", "target", m.ID, "requester", addr.String(), "target_addr", targetAddr.String())
+	}
+}
+
+// cleanupLoop 定期移除超时没有活动的客户端
+func (s *Server) cleanupLoop() {
+	ticker := time.NewTicker(s.ClientTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for id, c := range s.clients {
+			if now.Sub(c.LastSeen) > s.ClientTTL {
+				s.logger().Info("client expired", "id", id)
+				delete(s.clients, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -2,148 +2,101 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
-	"net"
 	"os"
-	"strconv"
-	"strings"
 	"time"
+
+	"github.com/iotames/easygo/rendezvous"
 )
 
+// 信令客户端：注册后连接对端（或等待对端连接），打洞成功后与对端聊天
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("用法: p2p_client [服务器地址] [客户端ID] [要连接的客户端ID]")
+	server := flag.String("server", "", "rendezvous server address, e.g. 1.2.3.4:929")
+	id := flag.String("id", "", "client id")
+	peer := flag.String("peer", "", "client id to connect to, empty to wait for a connection")
+	heartbeat := flag.Duration("heartbeat", 30*time.Second, "heartbeat interval")
+	flag.Usage = func() {
+		fmt.Println("用法: p2p_client -server [服务器地址] -id [客户端ID] [-peer 要连接的客户端ID]")
+		fmt.Println("或:   p2p_client [服务器地址] [客户端ID] [要连接的客户端ID]")
 		fmt.Println("例如: p2p_client 1.2.3.4:929 clientA clientB")
-		return
+		flag.PrintDefaults()
 	}
-
-	serverAddrStr := os.Args[1]
-	myID := os.Args[2]
-	targetID := os.Args[3]
-
-	// 解析信令服务器地址
-	serverAddr, err := net.ResolveUDPAddr("udp", serverAddrStr)
-	if err != nil {
-		panic(err)
+	flag.Parse()
+	// 兼容原来的位置参数
+	if args := flag.Args(); len(args) >= 2 {
+		*server, *id = args[0], args[1]
+		if len(args) >= 3 {
+			*peer = args[2]
+		}
 	}
-
-	// 创建本地UDP Socket，端口随机 - 使用 ListenUDP 而不是 DialUDP
-	localAddr, _ := net.ResolveUDPAddr("udp", ":0")
-	conn, err := net.ListenUDP("udp", localAddr)
-	if err != nil {
-		panic(err)
+	if *server == "" || *id == "" {
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer conn.Close()
-	fmt.Printf("本地地址: %s\n", conn.LocalAddr().String())
 
-	// 注册到信令服务器
-	registerMsg := fmt.Sprintf("REGISTER %s", myID)
-	_, err = conn.WriteToUDP([]byte(registerMsg), serverAddr)
+	c, err := rendezvous.NewClient(rendezvous.ClientConfig{ServerAddr: *server, ID: *id, HeartbeatInterval: *heartbeat})
 	if err != nil {
-		panic(err)
+		fmt.Println("创建客户端失败:", err)
+		os.Exit(1)
 	}
+	defer c.Close()
+	fmt.Printf("本地地址: %s\n", c.LocalAddr())
 
-	buffer := make([]byte, 1024)
-	n, addr, err := conn.ReadFromUDP(buffer)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = c.Register(ctx)
+	cancel()
 	if err != nil {
-		panic(err)
+		fmt.Println("注册失败:", err)
+		os.Exit(1)
 	}
-
-	// 检查消息是否来自信令服务器
-	if !addr.IP.Equal(serverAddr.IP) || addr.Port != serverAddr.Port {
-		fmt.Printf("收到非信令服务器的消息，忽略: %s\n", addr.String())
+	fmt.Println("注册成功")
+
+	ctx = context.Background()
+	if *peer == "" {
+		fmt.Println("等待其他客户端连接...")
+		if _, err := c.WaitPeer(ctx); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else {
-		if string(buffer[:n]) != "REGISTER_OK" {
-			fmt.Println("注册失败")
-			return
+		// 对端可能还没有注册，重试直到成功
+		for {
+			if _, err = c.Connect(ctx, *peer); err == nil {
+				break
+			}
+			fmt.Printf("%v，2秒后重试\n", err)
+			time.Sleep(2 * time.Second)
 		}
-		fmt.Println("注册成功")
-	}
-
-	// 请求连接目标客户端
-	connectMsg := fmt.Sprintf("CONNECT %s", targetID)
-	_, err = conn.WriteToUDP([]byte(connectMsg), serverAddr)
-	if err != nil {
-		panic(err)
-	}
-
-	// 读取服务器返回的对等端地址信息
-	n, addr, err = conn.ReadFromUDP(buffer)
-	if err != nil {
-		panic(err)
-	}
-
-	// 确保消息来自信令服务器
-	if !addr.IP.Equal(serverAddr.IP) || addr.Port != serverAddr.Port {
-		fmt.Printf("收到非信令服务器的消息，忽略: %s\n", addr.String())
-		return
-	}
-
-	peerInfo := string(buffer[:n])
-	if strings.HasPrefix(peerInfo, "ERROR") {
-		fmt.Println(peerInfo)
-		return
-	}
-
-	// 解析对等端的IP和端口
-	infoParts := strings.Split(peerInfo, " ")
-	if len(infoParts) != 3 || infoParts[0] != "PEER_INFO" {
-		fmt.Printf("无效的对等端信息: %s\n", peerInfo)
-		return
-	}
-	peerIP := infoParts[1]
-	peerPort, _ := strconv.Atoi(infoParts[2])
-	peerAddr := &net.UDPAddr{
-		IP:   net.ParseIP(peerIP),
-		Port: peerPort,
 	}
-	fmt.Printf("对等端地址: %s\n", peerAddr.String())
+	fmt.Printf("对等端地址: %s\n", c.Peer())
 
-	// 开始打洞：向对等端的公网地址发送UDP包
 	fmt.Println("开始向对等端地址发送UDP包进行打洞...")
 	go func() {
-		for {
-			// 持续发送，维持NAT映射
-			_, err := conn.WriteToUDP([]byte("PUNCH"), peerAddr)
-			if err != nil {
-				fmt.Printf("发送打洞包错误: %v\n", err)
-			}
-			time.Sleep(5 * time.Second) // 每5秒发送一次维持包
+		if err := c.Punch(ctx); err == nil {
+			fmt.Printf("收到来自 %s 的打洞包，P2P连接已建立！\n", c.Peer())
 		}
 	}()
-
-	// 处理可能从对等端发来的消息
-	fmt.Println("开始监听来自对等端的消息...")
 	go func() {
-		for {
-			n, addr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				fmt.Printf("读取错误: %v\n", err)
-				continue
-			}
-			// 忽略来自信令服务器的消息
-			if addr.IP.Equal(serverAddr.IP) && addr.Port == serverAddr.Port {
-				continue
-			}
-			msg := string(buffer[:n])
-			if msg == "PUNCH" {
-				fmt.Printf("收到来自 %s 的打洞包，P2P连接可能已建立！\n", addr.String())
-			} else {
-				fmt.Printf("收到来自 %s 的消息: %s\n", addr.String(), msg)
-			}
+		for msg := range c.Messages() {
+			fmt.Printf("收到来自 %s 的消息: %s\n", c.Peer(), msg)
 		}
 	}()
 
-	// 简单的控制台输入，用于发送测试消息
-	fmt.Printf("输入消息直接发送给对等端%s (输入exit退出):\n", peerAddr.String())
+	fmt.Println("输入消息直接发送给对等端 (输入exit退出):")
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		text := scanner.Text()
 		if text == "exit" {
 			break
 		}
-		_, err := conn.WriteToUDP([]byte(text), peerAddr)
-		if err != nil {
+		select {
+		case <-c.Punched():
+		default:
+			fmt.Println("尚未收到对等端的打洞包，消息可能无法送达")
+		}
+		if err := c.Send(text); err != nil {
 			fmt.Printf("发送消息错误: %v\n", err)
 		}
 	}